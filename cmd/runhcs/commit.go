@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/urfave/cli"
+)
+
+var commitCommand = cli.Command{
+	Name:  "commit",
+	Usage: "commit saves the changes a stopped container made to its layers as a new layer",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container, which
+must be stopped. The changes recorded in the container's scratch are written as
+an OCI layer tar, with deleted files as whiteouts, or are imported as a new
+read-only layer whose parents are the container's read-only layers. The
+container's layers are unmounted, so it cannot be started again, and must
+still be deleted.
+
+EXAMPLE:
+For example, if the container id is "build01" the following imports its
+changes as the layer "C:\layers\build01":
+
+       # runhcs commit --layer C:\layers\build01 build01`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "output layer tar (defaults to stdout)",
+		},
+		cli.StringFlag{
+			Name:  "layer, l",
+			Usage: "path of a new layer to import the changes as, rather than writing a tar",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		output, layer := context.String("output"), context.String("layer")
+		if output != "" && layer != "" {
+			return errors.New("only one of --output and --layer may be specified")
+		}
+		c, err := getContainer(id, false)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		s, err := c.Status()
+		if err != nil {
+			return err
+		}
+		if s != containerStopped {
+			return fmt.Errorf("cannot commit container %s that is not stopped: %s", id, s)
+		}
+
+		if c.Spec.Linux != nil {
+			return commitInVM(c, output, layer)
+		}
+
+		if err := c.Unmount(false); err != nil {
+			return err
+		}
+		opts := &hcsoci.CommitOptions{Spec: c.Spec}
+		if layer != "" {
+			err = winio.EnableProcessPrivileges([]string{winio.SeBackupPrivilege, winio.SeRestorePrivilege})
+			if err != nil {
+				return err
+			}
+			_, err = hcsoci.Commit(opts, layer)
+			return err
+		}
+		err = winio.EnableProcessPrivileges([]string{winio.SeBackupPrivilege})
+		if err != nil {
+			return err
+		}
+		if output == "" {
+			return hcsoci.CommitToTar(opts, os.Stdout)
+		}
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		err = hcsoci.CommitToTar(opts, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+			return err
+		}
+		return nil
+	},
+}
+
+// commitInVM commits a Linux container from the VM shim hosting it, which
+// holds its utility VM. A tar written to stdout is written by the VM shim to a
+// temporary file first.
+func commitInVM(c *container, output, layer string) (err error) {
+	if !c.VMIsolated() {
+		return fmt.Errorf("container %s is not running in a utility VM", c.ID)
+	}
+	req := &vmRequest{ID: c.ID, Op: opCommit}
+	// The VM shim has a different working directory.
+	if layer != "" {
+		if req.Layer, err = filepath.Abs(layer); err != nil {
+			return err
+		}
+		return c.sendVMRequest(req)
+	}
+	if output != "" {
+		if req.Path, err = filepath.Abs(output); err != nil {
+			return err
+		}
+		return c.sendVMRequest(req)
+	}
+
+	f, err := ioutil.TempFile("", "runhcs-commit")
+	if err != nil {
+		return err
+	}
+	req.Path = f.Name()
+	f.Close()
+	os.Remove(req.Path)
+	defer os.Remove(req.Path)
+	if err := c.sendVMRequest(req); err != nil {
+		return err
+	}
+	f, err = os.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// commitContainer detaches the disks of the stopped Linux container c created
+// in pod, as when it stops, and commits its scratch using the pod's utility VM,
+// as a new layer if layer is set and otherwise as a tar written to the new file
+// path. The container's other resources are released when it is deleted.
+func commitContainer(pod *hcsoci.Pod, c *container, path, layer string) error {
+	if err := c.unmountInPod(pod, false); err != nil {
+		return err
+	}
+	opts := &hcsoci.CommitOptions{Spec: c.Spec, HostingSystem: pod.UtilityVM()}
+	if layer != "" {
+		_, err := hcsoci.Commit(opts, layer)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = hcsoci.CommitToTar(opts, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -28,15 +28,13 @@ import (
 var errContainerStopped = errors.New("container is stopped")
 
 type persistedState struct {
-	ID             string
-	SandboxID      string
-	HostID         string
+	ID string
+	hcsoci.PodMembership
 	Bundle         string
 	Created        time.Time
 	Rootfs         string
 	Spec           *specs.Spec
 	RequestedNetNS string
-	IsHost         bool
 	UniqueID       guid.GUID
 	HostUniqueID   guid.GUID
 }
@@ -55,13 +53,17 @@ const (
 	keyShimPid   = "shim"
 	keyInitPid   = "pid"
 	keyNetNS     = "netns"
+	keyPod       = "pod"
+
+	keyStopReason = "stopreason"
 )
 
 type container struct {
 	persistedState
-	ShimPid   int
-	hc        *hcs.System
-	resources *hcsoci.Resources
+	ShimPid    int
+	StopReason string // Why the container was stopped by runhcs rather than exiting, eg its VM was unhealthy
+	hc         *hcs.System
+	resources  *hcsoci.Resources
 }
 
 func getErrorFromPipe(pipe io.Reader, p *os.Process) error {
@@ -199,32 +201,19 @@ func launchShim(cmd, pidFile, logFile string, args []string, data interface{}) (
 	return p, nil
 }
 
-func parseSandboxAnnotations(spec *specs.Spec) (string, bool) {
-	a := spec.Annotations
-	var t, id string
-	if t = a["io.kubernetes.cri.container-type"]; t != "" {
-		id = a["io.kubernetes.cri.sandbox-id"]
-	} else if t = a["io.kubernetes.cri-o.ContainerType"]; t != "" {
-		id = a["io.kubernetes.cri-o.SandboxID"]
-	} else if t = a["io.kubernetes.docker.type"]; t != "" {
-		id = a["io.kubernetes.sandbox.id"]
-		if t == "podsandbox" {
-			t = "sandbox"
-		}
-	}
-	if t == "container" {
-		return id, false
-	}
-	if t == "sandbox" {
-		return id, true
-	}
-	return "", false
-}
-
-func (c *container) startVMShim(logFile string, consolePipe string) (*os.Process, error) {
+// startVMShim starts a vmshim for the container's utility VM. console is
+// either a named pipe to connect the VM's serial console to, or a file to log
+// the serial console to. overcommitRatio is the VM's overcommit ratio, or 0
+// for the default.
+func (c *container) startVMShim(logFile string, console string, overcommitRatio float64) (*os.Process, error) {
 	opts := &uvm.UVMOptions{
-		ID:          vmID(c.ID),
-		ConsolePipe: consolePipe,
+		ID:              vmID(c.ID),
+		OvercommitRatio: overcommitRatio,
+	}
+	if isPipePath(console) {
+		opts.ConsolePipe = console
+	} else {
+		opts.ConsoleLogFile = console
 	}
 	if c.Spec.Windows != nil {
 		opts.Resources = c.Spec.Windows.Resources
@@ -256,7 +245,8 @@ type containerConfig struct {
 	PidFile                string
 	ShimLogFile, VMLogFile string
 	Spec                   *specs.Spec
-	VMConsolePipe          string
+	VMConsole              string  // Named pipe or log file for the VM's serial console
+	VMOvercommitRatio      float64 // Overcommit ratio of the VM, or 0 for the default
 }
 
 func createContainer(cfg *containerConfig) (_ *container, err error) {
@@ -266,55 +256,29 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		return nil, err
 	}
 
-	vmisolated := cfg.Spec.Linux != nil || (cfg.Spec.Windows != nil && cfg.Spec.Windows.HyperV != nil)
-
-	sandboxID, isSandbox := parseSandboxAnnotations(cfg.Spec)
-	hostID := cfg.HostID
-	if isSandbox {
-		if sandboxID != cfg.ID {
-			return nil, errors.New("sandbox ID must match ID")
-		}
-	} else if sandboxID != "" {
-		// Validate that the sandbox container exists.
-		sandbox, err := getContainer(sandboxID, false)
+	membership, err := hcsoci.ResolvePodMembership(cfg.ID, cfg.Spec, cfg.HostID, func(id string) (*hcsoci.PodMembership, error) {
+		c, err := getContainer(id, false)
 		if err != nil {
 			return nil, err
 		}
-		defer sandbox.Close()
-		if sandbox.SandboxID != sandboxID {
-			return nil, fmt.Errorf("container %s is not a sandbox", sandboxID)
-		}
-		if hostID == "" {
-			// Use the sandbox's host.
-			hostID = sandbox.HostID
-		} else if sandbox.HostID == "" {
-			return nil, fmt.Errorf("sandbox container %s is not running in a VM host, but host %s was specified", sandboxID, hostID)
-		} else if hostID != sandbox.HostID {
-			return nil, fmt.Errorf("sandbox container %s has a different host %s from the requested host %s", sandboxID, sandbox.HostID, hostID)
-		}
-		if vmisolated && hostID == "" {
-			return nil, fmt.Errorf("container %s is not a VM isolated sandbox", sandboxID)
-		}
+		c.Close()
+		return &c.PodMembership, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	uniqueID := guid.New()
-
-	newvm := false
 	var hostUniqueID guid.GUID
-	if hostID != "" {
-		host, err := getContainer(hostID, false)
+	if membership.IsHost {
+		hostUniqueID = uniqueID
+	} else if membership.HostID != "" {
+		host, err := getContainer(membership.HostID, false)
 		if err != nil {
 			return nil, err
 		}
-		defer host.Close()
-		if !host.IsHost {
-			return nil, fmt.Errorf("host container %s is not a VM host", hostID)
-		}
+		host.Close()
 		hostUniqueID = host.UniqueID
-	} else if vmisolated && (isSandbox || cfg.Spec.Linux != nil) {
-		hostID = cfg.ID
-		newvm = true
-		hostUniqueID = uniqueID
 	}
 
 	// Make absolute the paths in Root.Path and Windows.LayerFolders.
@@ -355,9 +319,7 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 			Rootfs:         rootfs,
 			Created:        time.Now(),
 			Spec:           cfg.Spec,
-			SandboxID:      sandboxID,
-			HostID:         hostID,
-			IsHost:         newvm,
+			PodMembership:  *membership,
 			RequestedNetNS: netNS,
 			UniqueID:       uniqueID,
 			HostUniqueID:   hostUniqueID,
@@ -374,8 +336,8 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 	}()
 
 	// Start a VM if necessary.
-	if newvm {
-		shim, err := c.startVMShim(cfg.VMLogFile, cfg.VMConsolePipe)
+	if c.IsHost {
+		shim, err := c.startVMShim(cfg.VMLogFile, cfg.VMConsole, cfg.VMOvercommitRatio)
 		if err != nil {
 			return nil, err
 		}
@@ -448,6 +410,26 @@ func (c *container) unmountInHost(vm *uvm.UtilityVM, all bool) error {
 	return nil
 }
 
+// unmountInPod releases the resources of a container created in pod, falling
+// back to the persisted resources for containers the pod does not know about.
+func (c *container) unmountInPod(pod *hcsoci.Pod, all bool) error {
+	for _, id := range pod.Containers() {
+		if id != c.ID {
+			continue
+		}
+		err := pod.ReleaseContainer(c.ID, all)
+		if err != nil {
+			return err
+		}
+		err = stateKey.Clear(c.ID, keyResources)
+		if _, ok := err.(*regstate.NoStateError); ok || err == nil {
+			return nil
+		}
+		return err
+	}
+	return c.unmountInHost(pod.UtilityVM(), all)
+}
+
 func (c *container) Unmount(all bool) error {
 	if c.VMIsolated() {
 		op := opUnmountContainerDiskOnly
@@ -468,7 +450,9 @@ func (c *container) Unmount(all bool) error {
 	return nil
 }
 
-func createContainerInHost(c *container, vm *uvm.UtilityVM) (err error) {
+// createContainerInHost creates the container from this process, in pod if it
+// is not nil.
+func createContainerInHost(c *container, pod *hcsoci.Pod) (err error) {
 	if c.hc != nil {
 		return errors.New("container already created")
 	}
@@ -477,25 +461,44 @@ func createContainerInHost(c *container, vm *uvm.UtilityVM) (err error) {
 	opts := &hcsoci.CreateOptions{
 		ID:               c.ID,
 		Spec:             c.Spec,
-		HostingSystem:    vm,
 		NetworkNamespace: c.RequestedNetNS,
+
+		// The host container's resources sized its pod's VM.
+		SpecSizesHostingSystem: c.IsHost,
 	}
-	vmid := ""
-	if vm != nil {
-		vmid = vm.ID()
-	}
-	logrus.Infof("creating container %s (VM: '%s')", c.ID, vmid)
-	hc, resources, err := hcsoci.CreateContainer(opts)
-	if err != nil {
-		return err
-	}
-	defer func() {
+	var (
+		hc        *hcs.System
+		resources *hcsoci.Resources
+	)
+	if pod != nil {
+		vmid := ""
+		if vm := pod.UtilityVM(); vm != nil {
+			vmid = vm.ID()
+		}
+		logrus.Infof("creating container %s (VM: '%s')", c.ID, vmid)
+		hc, resources, err = pod.AddContainer(opts)
 		if err != nil {
-			hc.Terminate()
-			hc.Wait()
-			hcsoci.ReleaseResources(resources, vm, true)
+			return err
 		}
-	}()
+		defer func() {
+			if err != nil {
+				pod.RemoveContainer(c.ID)
+			}
+		}()
+	} else {
+		logrus.Infof("creating container %s (VM: '')", c.ID)
+		hc, resources, err = hcsoci.CreateContainer(opts)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				hc.Terminate()
+				hc.Wait()
+				hcsoci.ReleaseResources(resources, nil, true)
+			}
+		}()
+	}
 
 	// Record the network namespace to support namespace sharing by container ID.
 	if resources.NetNS() != "" {
@@ -592,6 +595,12 @@ func getContainer(id string, notStopped bool) (*container, error) {
 		}
 		c.ShimPid = -1
 	}
+	err = stateKey.Get(id, keyStopReason, &c.StopReason)
+	if err != nil {
+		if _, ok := err.(*regstate.NoStateError); !ok {
+			return nil, err
+		}
+	}
 	if notStopped && c.ShimPid == 0 {
 		return nil, errContainerStopped
 	}
@@ -618,7 +627,13 @@ func (c *container) Remove() error {
 	// Follow kata's example and delay tearing down the VM until the owning
 	// container is removed.
 	if c.IsHost {
-		vm, err := hcs.OpenComputeSystem(vmID(c.ID))
+		// The VM shim records the pod it created, including its utility VM.
+		vmid := vmID(c.ID)
+		var pod hcsoci.PodDescription
+		if err := stateKey.Get(c.ID, keyPod, &pod); err == nil && pod.UtilityVMID != "" {
+			vmid = pod.UtilityVMID
+		}
+		vm, err := hcs.OpenComputeSystem(vmid)
 		if err == nil {
 			if err := vm.Terminate(); hcs.IsPending(err) {
 				vm.Wait()
@@ -643,7 +658,7 @@ func (c *container) Kill() error {
 }
 
 func (c *container) Status() (containerStatus, error) {
-	if c.hc == nil || c.ShimPid == 0 {
+	if c.hc == nil || c.ShimPid == 0 || c.StopReason != "" {
 		return containerStopped, nil
 	}
 	props, err := c.hc.Properties()
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/urfave/cli"
+)
+
+var cpCommand = cli.Command{
+	Name:  "cp",
+	Usage: "cp copies files or directories between a container and the host",
+	ArgsUsage: `<container-id>:<src-path> <dest-path>
+       runhcs cp [command options] <src-path> <container-id>:<dest-path>
+
+Where "<container-id>" is the name for the instance of the container. If the
+destination is an existing directory the source is copied into it, otherwise
+the source is copied to the destination, whose parent directory must exist.
+Modes, owners and modification times are preserved.
+
+Only Linux containers are supported.
+
+EXAMPLE:
+For example, if the container id is "ubuntu01" the following copies the host
+directory "C:\config" to "/etc/config" in the container:
+
+       # runhcs cp C:\config ubuntu01:/etc/config`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "progress",
+			Usage: "print the number of bytes copied to stderr as the copy proceeds",
+		},
+	},
+	Before: appargs.Validate(appargs.NonEmptyString, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		srcID, src := parseCopyPath(context.Args().Get(0))
+		dstID, dst := parseCopyPath(context.Args().Get(1))
+		if (srcID == "") == (dstID == "") {
+			return errors.New("exactly one of the source and destination must be a path in a container")
+		}
+		id := srcID + dstID
+		c, err := getContainer(id, true)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if c.Spec.Linux == nil {
+			return fmt.Errorf("container %s is not a Linux container", id)
+		}
+
+		opts := &lcow.CopyOptions{}
+		if context.Bool("progress") {
+			opts.Progress = func(n int64) {
+				fmt.Fprintf(os.Stderr, "\r%d bytes", n)
+			}
+			defer fmt.Fprintln(os.Stderr)
+		}
+		if srcID != "" {
+			return lcow.CopyFromContainer(c.hc, src, dst, opts)
+		}
+		return lcow.CopyToContainer(c.hc, src, dst, opts)
+	},
+}
+
+// parseCopyPath splits a `runhcs cp` argument into a container ID and a path
+// in that container. The ID is empty for a path on the host, including one
+// which begins with a drive letter, so container IDs must be longer than one
+// character.
+func parseCopyPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i <= 1 || strings.ContainsAny(arg[:i], `\/`) {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
 	"github.com/urfave/cli"
 )
 
@@ -29,7 +32,11 @@ var createRunFlags = []cli.Flag{
 	cli.StringFlag{
 		Name:  "vm-console",
 		Value: "",
-		Usage: `path to the pipe for the VM's console (e.g. \\.\pipe\debugpipe)`,
+		Usage: `path to the pipe for the VM's console (e.g. \\.\pipe\debugpipe), or a file to log the console to`,
+	},
+	cli.Float64Flag{
+		Name:  "vm-overcommit-ratio",
+		Usage: "ratio of the memory and processors which may be committed to the containers in the VM to the VM's, overriding the " + hcsoci.AnnotationOvercommitRatio + " annotation",
 	},
 	cli.StringFlag{
 		Name:  "host",
@@ -83,17 +90,35 @@ func containerConfigFromContext(context *cli.Context) (*containerConfig, error)
 	if err != nil {
 		return nil, err
 	}
+	vmConsole := context.String("vm-console")
+	if !isPipePath(vmConsole) {
+		vmConsole, err = absPathOrEmpty(vmConsole)
+		if err != nil {
+			return nil, err
+		}
+	}
 	spec, err := setupSpec(context)
 	if err != nil {
 		return nil, err
 	}
+	overcommitRatio := context.Float64("vm-overcommit-ratio")
+	if overcommitRatio == 0 {
+		overcommitRatio, err = hcsoci.ParseOvercommitRatio(spec)
+		if err != nil {
+			return nil, err
+		}
+	} else if !(overcommitRatio > 0) {
+		return nil, fmt.Errorf("invalid --vm-overcommit-ratio %g: must be a positive number", overcommitRatio)
+	}
 	return &containerConfig{
-		ID:            id,
-		PidFile:       pidFile,
-		ShimLogFile:   shimLog,
-		VMLogFile:     vmLog,
-		VMConsolePipe: context.String("vm-console"),
-		Spec:          spec,
-		HostID:        context.String("host"),
+		ID:          id,
+		PidFile:     pidFile,
+		ShimLogFile: shimLog,
+		VMLogFile:   vmLog,
+		VMConsole:   vmConsole,
+		Spec:        spec,
+		HostID:      context.String("host"),
+
+		VMOvercommitRatio: overcommitRatio,
 	}, nil
 }
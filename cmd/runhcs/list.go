@@ -35,6 +35,9 @@ type containerState struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 	// The owner of the state directory (the owner of the container).
 	Owner string `json:"owner"`
+	// StopReason is why runhcs stopped the container, for example because its
+	// utility VM became unhealthy.
+	StopReason string `json:"stopReason,omitempty"`
 }
 
 var listCommand = cli.Command{
@@ -131,6 +134,7 @@ func getContainers(context *cli.Context) ([]containerState, error) {
 			Rootfs:         c.Rootfs,
 			Created:        c.Created,
 			Annotations:    c.Spec.Annotations,
+			StopReason:     c.StopReason,
 		})
 	}
 	return s, nil
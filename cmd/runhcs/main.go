@@ -100,12 +100,16 @@ func main() {
 		},
 	}
 	app.Commands = []cli.Command{
+		commitCommand,
+		cpCommand,
 		createCommand,
 		deleteCommand,
 		// eventsCommand,
 		execCommand,
 		killCommand,
 		listCommand,
+		mountCommand,
+		networkCommand,
 		pauseCommand,
 		psCommand,
 		resizeTtyCommand,
@@ -115,6 +119,7 @@ func main() {
 		startCommand,
 		stateCommand,
 		// updateCommand,
+		vmCommand,
 		vmshimCommand,
 	}
 	app.Before = func(context *cli.Context) error {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+var mountCommand = cli.Command{
+	Name:        "mount",
+	Usage:       "manage the bind mounts of a running container",
+	Subcommands: []cli.Command{mountAddCommand, mountRemoveCommand},
+}
+
+var mountAddCommand = cli.Command{
+	Name:  "add",
+	Usage: "adds a bind mount of a host directory to a running container",
+	ArgsUsage: `<container-id> <source> <destination>
+
+Where "<container-id>" is the name for the instance of the container,
+"<source>" is the host directory and "<destination>" is the path in the
+container.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "read-only, r",
+			Usage: "mount the directory read-only",
+		},
+	},
+	Before: appargs.Validate(argID, appargs.NonEmptyString, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		mount := specs.Mount{
+			Source:      context.Args().Get(1),
+			Destination: context.Args().Get(2),
+		}
+		if context.Bool("read-only") {
+			mount.Options = []string{"ro"}
+		}
+		return modifyMount(context.Args().First(), &vmRequest{Op: opAddMount, Mount: &mount})
+	},
+}
+
+var mountRemoveCommand = cli.Command{
+	Name:  "remove",
+	Usage: "removes a bind mount added to a running container",
+	ArgsUsage: `<container-id> <destination>
+
+Where "<container-id>" is the name for the instance of the container and
+"<destination>" is the path in the container of a mount added by
+"runhcs mount add".`,
+	Before: appargs.Validate(argID, appargs.NonEmptyString),
+	Action: func(context *cli.Context) error {
+		return modifyMount(context.Args().First(), &vmRequest{Op: opRemoveMount, Path: context.Args().Get(1)})
+	},
+}
+
+// modifyMount adds or removes a mount of a running container as requested by
+// req, in the VM shim for a container in a utility VM.
+func modifyMount(id string, req *vmRequest) error {
+	c, err := getContainer(id, true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if c.Spec.Linux != nil && req.Mount != nil {
+		req.Mount.Type = "bind"
+	}
+	if c.VMIsolated() {
+		req.ID = id
+		return c.sendVMRequest(req)
+	}
+	resources := &hcsoci.Resources{}
+	if err := stateKey.Get(id, keyResources, resources); err != nil {
+		return err
+	}
+	if req.Op == opAddMount {
+		err = hcsoci.AddMount(c.hc, resources, nil, *req.Mount)
+	} else {
+		err = hcsoci.RemoveMount(c.hc, resources, nil, req.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return stateKey.Set(id, keyResources, resources)
+}
+
+// modifyMountInPod adds or removes a mount of a container created in pod,
+// recording its updated resources.
+func modifyMountInPod(pod *hcsoci.Pod, c *container, req *vmRequest) error {
+	var (
+		resources *hcsoci.Resources
+		err       error
+	)
+	switch {
+	case req.Op == opAddMount && req.Mount != nil:
+		resources, err = pod.AddMount(c.ID, *req.Mount)
+	case req.Op == opRemoveMount:
+		resources, err = pod.RemoveMount(c.ID, req.Path)
+	default:
+		return fmt.Errorf("invalid mount operation %s", req.Op)
+	}
+	if err != nil {
+		return err
+	}
+	return stateKey.Set(c.ID, keyResources, resources)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/urfave/cli"
+)
+
+var networkCommand = cli.Command{
+	Name:  "network",
+	Usage: "manage the network endpoints of a running container",
+	Subcommands: []cli.Command{
+		networkEndpointCommand("add", "adds an HNS endpoint to a running container", opAddEndpoint),
+		networkEndpointCommand("remove", "removes an HNS endpoint added to a running container", opRemoveEndpoint),
+	},
+}
+
+func networkEndpointCommand(name, usage string, op vmRequestOp) cli.Command {
+	return cli.Command{
+		Name:  name,
+		Usage: usage,
+		ArgsUsage: `<container-id> <endpoint-id>
+
+Where "<container-id>" is the name for the instance of the container and
+"<endpoint-id>" is the ID of the HNS endpoint. Only endpoints added by
+"runhcs network add" can be removed.`,
+		Before: appargs.Validate(argID, appargs.NonEmptyString),
+		Action: func(context *cli.Context) error {
+			id, endpointID := context.Args().Get(0), context.Args().Get(1)
+			c, err := getContainer(id, true)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			if c.VMIsolated() {
+				return c.sendVMRequest(&vmRequest{ID: id, Op: op, Endpoint: endpointID})
+			}
+			resources := &hcsoci.Resources{}
+			if err := stateKey.Get(id, keyResources, resources); err != nil {
+				return err
+			}
+			if op == opAddEndpoint {
+				err = hcsoci.AddNetworkEndpoint(resources, nil, endpointID)
+			} else {
+				err = hcsoci.RemoveNetworkEndpoint(resources, nil, endpointID)
+			}
+			if err != nil {
+				return err
+			}
+			return stateKey.Set(id, keyResources, resources)
+		},
+	}
+}
+
+// modifyEndpointInPod adds or removes an HNS endpoint of a container created
+// in pod, recording its updated resources.
+func modifyEndpointInPod(pod *hcsoci.Pod, c *container, op vmRequestOp, endpointID string) error {
+	var (
+		resources *hcsoci.Resources
+		err       error
+	)
+	switch op {
+	case opAddEndpoint:
+		resources, err = pod.AddNetworkEndpoint(c.ID, endpointID)
+	case opRemoveEndpoint:
+		resources, err = pod.RemoveNetworkEndpoint(c.ID, endpointID)
+	default:
+		return fmt.Errorf("unknown network operation %s", op)
+	}
+	if err != nil {
+		return err
+	}
+	return stateKey.Set(c.ID, keyResources, resources)
+}
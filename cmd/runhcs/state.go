@@ -36,6 +36,7 @@ instance of a container.`,
 			Rootfs:         c.Rootfs,
 			Created:        c.Created,
 			Annotations:    c.Spec.Annotations,
+			StopReason:     c.StopReason,
 		}
 		data, err := json.MarshalIndent(cs, "", "  ")
 		if err != nil {
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/appargs"
 )
@@ -47,6 +48,11 @@ func safePipePath(name string) string {
 	return `\\.\pipe\ProtectedPrefix\Administrators\` + url.PathEscape(name)
 }
 
+// isPipePath returns true if path is a named pipe path such as \\.\pipe\foo.
+func isPipePath(path string) bool {
+	return strings.HasPrefix(strings.ToLower(path), `\\.\pipe\`)
+}
+
 func closeWritePipe(pipe net.Conn) error {
 	return pipe.(interface {
 		CloseWrite() error
@@ -6,11 +6,18 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	winio "github.com/Microsoft/go-winio"
 	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/lcow"
 	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -49,10 +56,11 @@ var vmshimCommand = cli.Command{
 			return err
 		}
 
-		vm, err := startVM(opts)
+		pod, err := createPod(opts)
 		if err != nil {
 			return err
 		}
+		vm := pod.UtilityVM()
 
 		// Asynchronously wait for the VM to exit.
 		exitCh := make(chan error)
@@ -60,7 +68,19 @@ var vmshimCommand = cli.Command{
 			exitCh <- vm.Wait()
 		}()
 
-		defer vm.Terminate()
+		defer pod.Destroy()
+
+		// Terminate the VM if the guest stops responding, recording why the
+		// containers running in it stopped.
+		containers := &vmContainers{ids: make(map[string]struct{})}
+		health := vm.StartHealthMonitor(uvm.HealthOptions{
+			OnUnhealthy: func(err error) {
+				err = vm.WithConsoleTail(err)
+				containers.setStopReason(err.Error())
+				vm.Terminate()
+			},
+		})
+		defer health.Stop()
 
 		// Alert the parent process that initialization has completed
 		// successfully.
@@ -82,64 +102,168 @@ var vmshimCommand = cli.Command{
 
 		for {
 			select {
-			case <-exitCh:
-				return nil
+			case err := <-exitCh:
+				if tail := vm.ConsoleTail(); len(tail) > 0 {
+					logrus.Warnf("VM exited, last %d lines of console output:\n%s", len(tail), strings.Join(tail, "\n"))
+				}
+				return vm.WithConsoleTail(err)
 			case pipe := <-pipeCh:
-				err = processRequest(vm, pipe)
-				if err == nil {
-					_, err = pipe.Write(shimSuccess)
-					// Wait until the pipe is closed before closing the
-					// container so that it is properly handed off to the other
-					// process.
-					if err == nil {
-						err = closeWritePipe(pipe)
-					}
-					if err == nil {
-						ioutil.ReadAll(pipe)
-					}
-				} else {
-					logrus.Error("failed creating container in VM: ", err)
-					fmt.Fprintf(pipe, "%v", err)
+				var req vmRequest
+				if err := json.NewDecoder(pipe).Decode(&req); err != nil {
+					respondToRequest(pipe, err)
+					continue
+				}
+				logrus.Debug("received operation ", req.Op, " for ", req.ID)
+				if req.Op == opCommit {
+					// A commit copies the container's whole scratch, so it is
+					// run in the background rather than holding up other
+					// requests. The pod's lock serializes its release of the
+					// container's disks with other requests.
+					go func() {
+						respondToRequest(pipe, processRequest(pod, containers, &req))
+					}()
+					continue
 				}
-				pipe.Close()
+				respondToRequest(pipe, processRequest(pod, containers, &req))
 			}
 		}
 	},
 }
 
+var vmCommand = cli.Command{
+	Name:        "vm",
+	Usage:       "manage the utility VMs hosting containers",
+	Subcommands: []cli.Command{vmDiagCommand},
+}
+
+var vmDiagCommand = cli.Command{
+	Name:      "diag",
+	Usage:     "diag saves a diagnostics bundle for the Linux utility VM hosting a container",
+	ArgsUsage: `<container-id>`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path of the .tar.gz bundle to write. Defaults to <host-id>-diag-<time>.tar.gz in the current directory",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		c, err := getContainer(id, true)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if !c.VMIsolated() {
+			return fmt.Errorf("container %s is not running in a utility VM", id)
+		}
+		path := context.String("output")
+		if path == "" {
+			path = fmt.Sprintf("%s-diag-%s.tar.gz", c.HostID, time.Now().UTC().Format("20060102T150405"))
+		}
+		// The VM shim has a different working directory.
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if err := c.sendVMRequest(&vmRequest{ID: id, Op: opDiagnostics, Path: path}); err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return nil
+	},
+}
+
 type vmRequestOp string
 
 const (
 	opCreateContainer          vmRequestOp = "create"
 	opUnmountContainer         vmRequestOp = "unmount"
 	opUnmountContainerDiskOnly vmRequestOp = "unmount-disk"
+	opDiagnostics              vmRequestOp = "diag"
+	opCommit                   vmRequestOp = "commit"
+	opAddEndpoint              vmRequestOp = "add-endpoint"
+	opRemoveEndpoint           vmRequestOp = "remove-endpoint"
+	opAddMount                 vmRequestOp = "add-mount"
+	opRemoveMount              vmRequestOp = "remove-mount"
 )
 
 type vmRequest struct {
-	ID string
-	Op vmRequestOp
+	ID    string
+	Op    vmRequestOp
+	Path  string `json:",omitempty"` // The file to write for opDiagnostics and opCommit, or the mount destination for opRemoveMount
+	Layer string `json:",omitempty"` // The layer to import for opCommit
+
+	Endpoint string       `json:",omitempty"` // The HNS endpoint for opAddEndpoint and opRemoveEndpoint
+	Mount    *specs.Mount `json:",omitempty"` // The mount for opAddMount
 }
 
-func startVM(opts *uvm.UVMOptions) (*uvm.UtilityVM, error) {
-	vm, err := uvm.Create(opts)
-	if err != nil {
-		return nil, err
+// createPod creates the pod for the containers sharing a VM, recording its
+// description in the state of the VM's host container.
+func createPod(opts *uvm.UVMOptions) (*hcsoci.Pod, error) {
+	hostID := strings.TrimSuffix(opts.ID, vmID(""))
+	return hcsoci.CreatePod(&hcsoci.PodOptions{
+		ID:         hostID,
+		UVMOptions: opts,
+		Persist: func(desc *hcsoci.PodDescription) error {
+			return stateKey.Set(hostID, keyPod, desc)
+		},
+	})
+}
+
+// vmContainers tracks the containers created in a VM by this vmshim.
+type vmContainers struct {
+	m   sync.Mutex
+	ids map[string]struct{}
+}
+
+func (vc *vmContainers) add(id string) {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+	vc.ids[id] = struct{}{}
+}
+
+func (vc *vmContainers) remove(id string) {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+	delete(vc.ids, id)
+}
+
+// setStopReason records reason as the reason each tracked container stopped.
+func (vc *vmContainers) setStopReason(reason string) {
+	vc.m.Lock()
+	defer vc.m.Unlock()
+	for id := range vc.ids {
+		if err := stateKey.Set(id, keyStopReason, reason); err != nil {
+			logrus.Errorf("failed to record stop reason for container %s: %s", id, err)
+		}
 	}
-	err = vm.Start()
-	if err != nil {
-		vm.Close()
-		return nil, err
+}
+
+// respondToRequest writes the result of a request to pipe and closes it.
+func respondToRequest(pipe net.Conn, err error) {
+	if err == nil {
+		_, err = pipe.Write(shimSuccess)
+		// Wait until the pipe is closed before closing the
+		// container so that it is properly handed off to the other
+		// process.
+		if err == nil {
+			err = closeWritePipe(pipe)
+		}
+		if err == nil {
+			ioutil.ReadAll(pipe)
+		}
+	} else {
+		logrus.Error("failed processing request in VM: ", err)
+		fmt.Fprintf(pipe, "%v", err)
 	}
-	return vm, nil
+	pipe.Close()
 }
 
-func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
-	var req vmRequest
-	err := json.NewDecoder(pipe).Decode(&req)
-	if err != nil {
-		return err
+func processRequest(pod *hcsoci.Pod, containers *vmContainers, req *vmRequest) error {
+	if req.Op == opDiagnostics {
+		return writeDiagnostics(pod, req.Path)
 	}
-	logrus.Debug("received operation ", req.Op, " for ", req.ID)
 	c, err := getContainer(req.ID, false)
 	if err != nil {
 		return err
@@ -151,20 +275,40 @@ func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
 	}()
 	switch req.Op {
 	case opCreateContainer:
-		err = createContainerInHost(c, vm)
+		err = createContainerInHost(c, pod)
 		if err != nil {
 			return err
 		}
 		c2 := c
 		c = nil
+		containers.add(c2.ID)
 		go func() {
 			c2.hc.Wait()
+			containers.remove(c2.ID)
 			c2.Close()
 		}()
 		c = nil
 
 	case opUnmountContainer, opUnmountContainerDiskOnly:
-		err = c.unmountInHost(vm, req.Op == opUnmountContainer)
+		err = c.unmountInPod(pod, req.Op == opUnmountContainer)
+		if err != nil {
+			return err
+		}
+
+	case opAddEndpoint, opRemoveEndpoint:
+		err = modifyEndpointInPod(pod, c, req.Op, req.Endpoint)
+		if err != nil {
+			return err
+		}
+
+	case opAddMount, opRemoveMount:
+		err = modifyMountInPod(pod, c, req)
+		if err != nil {
+			return err
+		}
+
+	case opCommit:
+		err = commitContainer(pod, c, req.Path, req.Layer)
 		if err != nil {
 			return err
 		}
@@ -183,7 +327,32 @@ func (err *noVMError) Error() string {
 	return "VM " + err.ID + " cannot be contacted"
 }
 
+// writeDiagnostics writes a diagnostics bundle for the pod's utility VM to a
+// new file.
+func writeDiagnostics(pod *hcsoci.Pod, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = lcow.WriteDiagnostics(pod.UtilityVM(), f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
 func (c *container) issueVMRequest(op vmRequestOp) error {
+	return c.sendVMRequest(&vmRequest{
+		ID: c.ID,
+		Op: op,
+	})
+}
+
+func (c *container) sendVMRequest(req *vmRequest) error {
 	pipe, err := winio.DialPipe(c.VMPipePath(), nil)
 	if err != nil {
 		if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ERROR_FILE_NOT_FOUND {
@@ -192,11 +361,7 @@ func (c *container) issueVMRequest(op vmRequestOp) error {
 		return err
 	}
 	defer pipe.Close()
-	req := vmRequest{
-		ID: c.ID,
-		Op: op,
-	}
-	err = json.NewEncoder(pipe).Encode(&req)
+	err = json.NewEncoder(pipe).Encode(req)
 	if err != nil {
 		return err
 	}
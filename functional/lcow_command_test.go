@@ -0,0 +1,71 @@
+// +build functional lcow
+
+package functional
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/functional/utilities"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/osversion"
+)
+
+// TestLCOWRunCommand runs commands in a utility VM, checking their output,
+// environment, working directory and exit codes.
+func TestLCOWRunCommand(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWRunCommand")
+	defer u.Terminate()
+
+	result, err := lcow.RunCommand(u, []string{"sh", "-c", "cat; echo $GREETING; pwd"}, &lcow.CommandOptions{
+		Stdin: strings.NewReader("from stdin\n"),
+		Env:   []string{"GREETING=hello world"},
+		Cwd:   "/tmp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "from stdin\nhello world\n/tmp\n" || result.ExitCode != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	result, err = lcow.RunCommand(u, []string{"sh", "-c", "echo out; echo 'it failed' >&2; exit 3"}, nil)
+	exitErr, ok := err.(*lcow.ExitError)
+	if !ok {
+		t.Fatalf("expected an ExitError, got %v", err)
+	}
+	if exitErr.ExitCode != 3 || exitErr.Stderr != "it failed" {
+		t.Fatalf("unexpected error %+v", exitErr)
+	}
+	if result == nil || result.ExitCode != 3 || string(result.Stdout) != "out\n" || string(result.Stderr) != "it failed\n" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// Large output on stderr must be truncated in the error.
+	_, err = lcow.RunCommand(u, []string{"sh", "-c", "head -c 100000 /dev/zero | tr '\\0' x >&2; exit 1"}, nil)
+	if exitErr, ok := err.(*lcow.ExitError); !ok || len(exitErr.Stderr) > 2048 || !strings.HasSuffix(exitErr.Stderr, "(truncated)") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Streaming stdout to a writer leaves it out of the result.
+	var stdout bytes.Buffer
+	result, err = lcow.RunCommand(u, []string{"echo", "streamed"}, &lcow.CommandOptions{Stdout: &stdout})
+	if err != nil || result.Stdout != nil || stdout.String() != "streamed\n" {
+		t.Fatalf("unexpected result %+v, %q, %v", result, stdout.String(), err)
+	}
+
+	// A cancelled command is killed.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := lcow.RunCommand(u, []string{"sleep", "60"}, &lcow.CommandOptions{Context: ctx}); err == nil || lcow.IsExitError(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(start) > 30*time.Second {
+		t.Fatal("the cancelled command was not killed")
+	}
+}
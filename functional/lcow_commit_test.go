@@ -0,0 +1,84 @@
+// +build functional lcow
+
+package functional
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/functional/utilities"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/osversion"
+)
+
+// TestLCOWCommit runs a container which adds and deletes a file, and commits
+// its scratch both as a tar and as a new layer.
+func TestLCOWCommit(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	alpineLayers := testutilities.LayerFolders(t, "alpine")
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWCommit")
+	defer u.Terminate()
+
+	scratchDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(scratchDir)
+	if err := lcow.CreateScratch(u, filepath.Join(scratchDir, "sandbox.vhdx"), lcow.DefaultScratchSizeGB, "", u.ID()); err != nil {
+		t.Fatal(err)
+	}
+	spec := testutilities.GetDefaultLinuxSpec(t)
+	spec.Windows.LayerFolders = append(alpineLayers, scratchDir)
+	spec.Process.Args = []string{"sh", "-c", "echo committed > /committed && rm /etc/motd && echo done"}
+	c, resources, err := CreateContainerTestWrapper(&hcsoci.CreateOptions{Spec: spec, HostingSystem: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Start(); err != nil {
+		hcsoci.ReleaseResources(resources, u, true)
+		t.Fatal(err)
+	}
+	runInitProcess(t, c, "done")
+	c.Terminate()
+	c.Wait()
+	if err := hcsoci.ReleaseResources(resources, u, true); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &hcsoci.CommitOptions{Spec: spec, HostingSystem: u}
+	var b bytes.Buffer
+	if err := hcsoci.CommitToTar(opts, &b); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	tr := tar.NewReader(&b)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[filepath.ToSlash(filepath.Clean(hdr.Name))] = true
+	}
+	for _, name := range []string{"committed", "etc/.wh.motd"} {
+		if !names[name] {
+			t.Errorf("%s is missing from the committed tar: %v", name, names)
+		}
+	}
+
+	layerDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(layerDir)
+	layer := filepath.Join(layerDir, "layer")
+	size, err := hcsoci.Commit(opts, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(layer, "layer.vhd")); err != nil || fi.Size() != size {
+		t.Fatalf("unexpected layer.vhd after commit: %v %v (expected %d bytes)", fi, err, size)
+	}
+}
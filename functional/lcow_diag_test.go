@@ -0,0 +1,67 @@
+// +build functional lcow
+
+package functional
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/functional/utilities"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/osversion"
+)
+
+// TestLCOWDiagnostics collects a diagnostics bundle from a utility VM and
+// checks the files it contains.
+func TestLCOWDiagnostics(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWDiagnostics")
+	defer u.Terminate()
+
+	dir, err := ioutil.TempDir("", "diag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := lcow.SaveDiagnostics(u, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	for _, name := range []string{"inventory.json", "hcs-errors.json", "guest/gcs.log", "guest/ps.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle is missing %s", name)
+		}
+	}
+	if !bytes.Contains(files["guest/ps.txt"], []byte("gcs")) {
+		t.Errorf("process list does not include gcs:\n%s", files["guest/ps.txt"])
+	}
+	if !bytes.Contains(files["inventory.json"], []byte(u.ID())) {
+		t.Errorf("inventory does not include the utility VM ID:\n%s", files["inventory.json"])
+	}
+}
@@ -0,0 +1,69 @@
+// +build functional lcow
+
+package functional
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/functional/utilities"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/osversion"
+	"github.com/Microsoft/hcsshim/internal/remotefs"
+)
+
+// TestLCOWRemoteFS executes file system operations in a utility VM. The
+// utility VM image must include the remotefs binary.
+func TestLCOWRemoteFS(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWRemoteFS")
+	defer u.Terminate()
+
+	if _, err := lcow.RunCommand(u, []string{"test", "-x", lcow.RemoteFSBinary}, nil); lcow.IsExitError(err) {
+		t.Skipf("%s is not in the utility VM image", lcow.RemoteFSBinary)
+	}
+	if _, err := lcow.RunCommand(u, []string{"mkdir", "-p", "/tmp/remotefs"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := lcow.OpenRemoteFS(u, "/tmp/remotefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	if err := fs.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := remotefs.Create(fs, "a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := fs.Rename("a/b/file", "a/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a/b/file"); !os.IsNotExist(err) {
+		t.Fatalf("stat of a renamed file: %v", err)
+	}
+	f, err = remotefs.Open(fs, "a/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	result, err := lcow.RunCommand(u, []string{"cat", "/tmp/remotefs/a/renamed"}, nil)
+	if err != nil || string(result.Stdout) != "hello" {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -50,6 +50,24 @@ func TestLCOWUVMNoSCSISingleVPMemVHD(t *testing.T) {
 	testLCOWUVMNoSCSISingleVPMem(t, opts, `Command line: root=/dev/pmem0 init=/init`)
 }
 
+// TestLCOWUVMKernelDirectInitrd starts an LCOW utility VM booting the kernel
+// directly rather than through UEFI. Uses initrd, so there is no initrd= on the
+// kernel command line.
+func TestLCOWUVMKernelDirectInitrd(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.V19H1)
+	scsiCount := 0
+	var vpmemCount int32 = 0
+	opts := &uvm.UVMOptions{
+		OperatingSystem:     "linux",
+		ID:                  "uvm",
+		KernelDirect:        true,
+		VPMemDeviceCount:    &vpmemCount,
+		SCSIControllerCount: &scsiCount,
+		KernelBootOptions:   "panic=-1",
+	}
+	testLCOWUVMNoSCSISingleVPMem(t, opts, `Command line: panic=-1`)
+}
+
 func testLCOWUVMNoSCSISingleVPMem(t *testing.T, opts *uvm.UVMOptions, expected string) {
 	testutilities.RequiresBuild(t, osversion.RS5)
 	lcowUVM, err := uvm.Create(opts)
@@ -0,0 +1,154 @@
+// +build functional lcow
+
+package functional
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/functional/utilities"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/osversion"
+)
+
+// TestLCOWVhdToTarRoundTrip converts a tar stream to a layer VHD and back.
+func TestLCOWVhdToTarRoundTrip(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWVhdToTarRoundTrip")
+	defer u.Terminate()
+
+	content := []byte("hello from a layer\n")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vhdFile := filepath.Join(tempDir, "layer.vhd")
+	size, err := lcow.TarToVhd(u, vhdFile, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := lcow.VhdToTar(u, vhdFile, "", false, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(hdr.Name) != "hello.txt" {
+			continue
+		}
+		got, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("got %q, expected %q", got, content)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatal("hello.txt was not in the exported tar stream")
+	}
+}
+
+// TestLCOWVhdToTarScratchNoMountPath checks a scratch cannot be exported
+// without the path it is mounted at.
+func TestLCOWVhdToTarScratchNoMountPath(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWVhdToTarScratchNoMountPath")
+	defer u.Terminate()
+
+	if _, err := lcow.VhdToTar(u, "sandbox.vhdx", "", true, 0); err == nil {
+		t.Fatal("exporting a scratch without a mount path succeeded")
+	}
+}
+
+// TestLCOWVhdToTarScratch exports a container scratch disk attached to a
+// utility VM which has its own scratch disk for staging.
+func TestLCOWVhdToTarScratch(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	u := testutilities.CreateLCOWUVM(t, "TestLCOWVhdToTarScratch")
+	defer u.Terminate()
+	if err := lcow.AttachUVMScratch(u, filepath.Join(tempDir, "uvmscratch.vhdx"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if u.ScratchPath() == "" {
+		t.Fatal("the utility VM has no scratch path after attaching a scratch disk")
+	}
+
+	scratch := filepath.Join(tempDir, "sandbox.vhdx")
+	if err := lcow.CreateScratch(u, scratch, lcow.DefaultScratchSizeGB, "", u.ID()); err != nil {
+		t.Fatal(err)
+	}
+	uvmPath := "/tmp/exportscratch"
+	if _, _, err := u.AddSCSI(scratch, uvmPath); err != nil {
+		t.Fatal(err)
+	}
+	defer u.RemoveSCSI(scratch)
+
+	// Populate the overlay upper directory as a container would.
+	content := "hello from a scratch\n"
+	script := "mkdir -p " + uvmPath + "/upper " + uvmPath + "/work && printf '" + content + "' > " + uvmPath + "/upper/hello.txt"
+	if _, err := lcow.RunCommand(u, []string{"sh", "-c", script}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := lcow.VhdToTar(u, scratch, uvmPath, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(hdr.Name) != "hello.txt" {
+			continue
+		}
+		got, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("got %q, expected %q", got, content)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatal("hello.txt was not in the exported tar stream")
+	}
+}
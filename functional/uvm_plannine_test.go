@@ -35,7 +35,7 @@ func TestPlan9(t *testing.T) {
 
 	// Remove them all
 	for i := 0; i < int(iterations); i++ {
-		if err := uvm.RemovePlan9(dir); err != nil {
+		if err := uvm.RemovePlan9(dir, fmt.Sprintf("/tmp/%s", filepath.Base(dir))); err != nil {
 			t.Fatalf("RemovePlan9 failed: %s", err)
 		}
 	}
@@ -3,13 +3,18 @@
 package functional
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/Microsoft/hcsshim/functional/utilities"
 	"github.com/Microsoft/hcsshim/internal/lcow"
 	"github.com/Microsoft/hcsshim/internal/osversion"
+	"github.com/Microsoft/hcsshim/internal/scratchcache"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 )
 
@@ -54,6 +59,66 @@ func TestScratchCreateLCOW(t *testing.T) {
 	// TODO Could consider giving it a host path and verifying it's contents somehow
 }
 
+func TestAttachUVMScratchLCOW(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	u := testutilities.CreateLCOWUVM(t, "TestAttachUVMScratchLCOW")
+	defer u.Terminate()
+
+	if u.ScratchPath() != "" {
+		t.Fatalf("new utility VM has scratch at %s", u.ScratchPath())
+	}
+	cacheFile := filepath.Join(tempDir, "cache.vhdx")
+	scratchFile := filepath.Join(tempDir, "uvmscratch.vhdx")
+	if err := lcow.AttachUVMScratch(u, scratchFile, cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if u.ScratchPath() != uvm.LCOWScratchPath {
+		t.Fatalf("expected scratch at %s, got %q", uvm.LCOWScratchPath, u.ScratchPath())
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Fatalf("cacheFile wasn't created!")
+	}
+	if err := u.AttachScratch(scratchFile); err == nil {
+		t.Fatal("attaching a second scratch disk succeeded")
+	}
+}
+
+// TestBootScratchLCOW creates a utility VM with a scratch disk, which must be
+// mounted once it has started.
+func TestBootScratchLCOW(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	formatUVM := testutilities.CreateLCOWUVM(t, "TestBootScratchLCOW_format")
+	defer formatUVM.Terminate()
+	scratchFile := filepath.Join(tempDir, "uvmscratch.vhdx")
+	if err := lcow.CreateScratch(formatUVM, scratchFile, uvm.DefaultLCOWScratchSizeGB, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := uvm.Create(&uvm.UVMOptions{ID: "TestBootScratchLCOW", OperatingSystem: "linux", ScratchFile: scratchFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Terminate()
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if u.ScratchPath() != uvm.LCOWScratchPath {
+		t.Fatalf("expected scratch at %s, got %q", uvm.LCOWScratchPath, u.ScratchPath())
+	}
+	if _, err := lcow.RunCommand(u, []string{"grep", "-q", " " + uvm.LCOWScratchPath + " ", "/proc/mounts"}, nil); err != nil {
+		t.Fatalf("%s is not mounted: %s", uvm.LCOWScratchPath, err)
+	}
+	if err := u.AttachScratch(scratchFile); err == nil {
+		t.Fatal("attaching a second scratch disk succeeded")
+	}
+}
+
 // TODO This is old test which should go here.
 //// createLCOWTempDirWithSandbox uses an LCOW utility VM to create a blank
 //// VHDX and format it ext4.
@@ -113,3 +178,95 @@ func TestScratchCreateLCOW(t *testing.T) {
 //	}
 
 //}
+
+// TestScratchCacheLCOW creates scratch disks in parallel through a scratch
+// cache, which must format only one template for the size.
+func TestScratchCacheLCOW(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	u := testutilities.CreateLCOWUVM(t, "TestScratchCacheLCOW")
+	defer u.Terminate()
+
+	cache, err := scratchcache.New(filepath.Join(tempDir, "cache"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dest := filepath.Join(tempDir, fmt.Sprintf("scratch%d.vhdx", i))
+			errs[i] = lcow.CreateScratchFromCache(u, dest, uvm.DefaultLCOWScratchSizeGB, cache, "")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(cache.Entry(lcow.ScratchCacheKey(uvm.DefaultLCOWScratchSizeGB)).Path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second size evicts the first, as the cache holds one entry.
+	if err := lcow.CreateScratchFromCache(u, filepath.Join(tempDir, "large.vhdx"), uvm.DefaultLCOWScratchSizeGB+10, cache, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.Entry(lcow.ScratchCacheKey(uvm.DefaultLCOWScratchSizeGB)).Path); !os.IsNotExist(err) {
+		t.Fatalf("the first entry was not evicted: %v", err)
+	}
+}
+
+// TestExpandScratchLCOW creates a scratch disk smaller than the default,
+// expands it offline, and checks that the file system has grown.
+func TestExpandScratchLCOW(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	tempDir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(tempDir)
+
+	u := testutilities.CreateLCOWUVM(t, "TestExpandScratchLCOW")
+	defer u.Terminate()
+
+	scratchFile := filepath.Join(tempDir, "sandbox.vhdx")
+	if err := lcow.CreateScratch(u, scratchFile, 5, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := lcow.GetScratchSize(scratchFile); err != nil || size.VirtualSize != 5*1024*1024*1024 {
+		t.Fatalf("unexpected size %+v, %v", size, err)
+	}
+	if err := lcow.ExpandScratch(u, scratchFile, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := lcow.ExpandScratch(u, scratchFile, 6); err == nil {
+		t.Fatal("shrinking a scratch disk succeeded")
+	}
+	size, err := lcow.GetScratchSize(scratchFile)
+	if err != nil || size.VirtualSize != 8*1024*1024*1024 {
+		t.Fatalf("unexpected size %+v, %v", size, err)
+	}
+
+	if _, _, err := u.AddSCSI(scratchFile, "/tmp/expanded"); err != nil {
+		t.Fatal(err)
+	}
+	defer u.RemoveSCSI(scratchFile)
+	if err := lcow.ResizeScratchFilesystem(u, "/tmp/expanded"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := lcow.RunCommand(u, []string{"df", "-k", "/tmp/expanded"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(result.Stdout)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 2 {
+		t.Fatalf("unexpected df output %q", result.Stdout)
+	}
+	if kb, err := strconv.ParseInt(fields[1], 10, 64); err != nil || kb < 7*1024*1024 {
+		t.Fatalf("file system was not expanded: %q", result.Stdout)
+	}
+}
@@ -3,12 +3,14 @@
 package functional
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Microsoft/hcsshim/functional/utilities"
 	"github.com/Microsoft/hcsshim/internal/osversion"
-	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
 )
 
 // TestVSMB tests adding/removing VSMB layers from a v2 Windows utility VM
@@ -16,25 +18,80 @@ func TestVSMB(t *testing.T) {
 	testutilities.RequiresBuild(t, osversion.RS5)
 	nanoLayers := testutilities.LayerFolders(t, "microsoft/nanoserver")
 
-	uvm, uvmScratchDir := testutilities.CreateWCOWUVM(t, nanoLayers, "", nil)
+	u, uvmScratchDir := testutilities.CreateWCOWUVM(t, nanoLayers, "", nil)
 	defer os.RemoveAll(uvmScratchDir)
-	defer uvm.Terminate()
+	defer u.Terminate()
 
 	dir := testutilities.CreateTempDir(t)
 	defer os.RemoveAll(dir)
+	options := uvm.LayerVSMBOptions()
 	var iterations uint32 = 64
 	for i := 0; i < int(iterations); i++ {
-		if err := uvm.AddVSMB(dir, "", schema2.VsmbFlagReadOnly|schema2.VsmbFlagPseudoOplocks|schema2.VsmbFlagTakeBackupPrivilege|schema2.VsmbFlagCacheIO|schema2.VsmbFlagShareRead); err != nil {
+		if err := u.AddVSMB(dir, "", options); err != nil {
 			t.Fatalf("AddVSMB failed: %s", err)
 		}
 	}
 
 	// Remove them all
 	for i := 0; i < int(iterations); i++ {
-		if err := uvm.RemoveVSMB(dir); err != nil {
+		if err := u.RemoveVSMB(dir, options); err != nil {
 			t.Fatalf("RemoveVSMB failed: %s", err)
 		}
 	}
 }
 
-// TODO: VSMB for mapped directories
+// TestVSMBOptions tests that the same host path shared with different options
+// results in separate shares, and that a single file can be shared.
+func TestVSMBOptions(t *testing.T) {
+	testutilities.RequiresBuild(t, osversion.RS5)
+	nanoLayers := testutilities.LayerFolders(t, "microsoft/nanoserver")
+
+	u, uvmScratchDir := testutilities.CreateWCOWUVM(t, nanoLayers, "", nil)
+	defer os.RemoveAll(uvmScratchDir)
+	defer u.Terminate()
+
+	dir := testutilities.CreateTempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.txt")
+	if err := ioutil.WriteFile(file, []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, rw := uvm.DefaultVSMBOptions(true), uvm.DefaultVSMBOptions(false)
+	for _, options := range []*uvm.VSMBOptions{ro, rw} {
+		if err := u.AddVSMB(dir, "", options); err != nil {
+			t.Fatalf("AddVSMB failed: %s", err)
+		}
+	}
+	roPath, err := u.GetVSMBUvmPath(dir, ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwPath, err := u.GetVSMBUvmPath(dir, rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roPath == rwPath {
+		t.Fatalf("expected separate shares for different options, both at %s", roPath)
+	}
+
+	if err := u.AddVSMB(file, "", ro); err != nil {
+		t.Fatalf("AddVSMB of a file failed: %s", err)
+	}
+	filePath, err := u.GetVSMBUvmPath(file, ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(filePath) != "config.txt" {
+		t.Fatalf("unexpected guest path for file share %s", filePath)
+	}
+
+	for _, share := range []struct {
+		hostPath string
+		options  *uvm.VSMBOptions
+	}{{dir, ro}, {dir, rw}, {file, ro}} {
+		if err := u.RemoveVSMB(share.hostPath, share.options); err != nil {
+			t.Fatalf("RemoveVSMB failed: %s", err)
+		}
+	}
+}
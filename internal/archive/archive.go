@@ -0,0 +1,287 @@
+// Package archive streams a single file or directory tree as a tar, as used
+// to copy files into and out of utility VMs and containers. Each stream holds
+// exactly one top-level entry, optionally with the entries below it, so that
+// the receiving end can rename it in the same way as `docker cp`.
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Progress is called with the cumulative number of bytes of file content
+// copied so far.
+type Progress func(int64)
+
+// counter calls a Progress as file content is copied.
+type counter struct {
+	total    int64
+	progress Progress
+}
+
+func (c *counter) add(n int) {
+	if n == 0 || c.progress == nil {
+		return
+	}
+	c.total += int64(n)
+	c.progress(c.total)
+}
+
+type countingWriter struct {
+	w io.Writer
+	c *counter
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.c.add(n)
+	return n, err
+}
+
+// Write writes srcPath, and everything below it if it is a directory, to w as
+// a tar. The top-level entry is named name, which defaults to the base name of
+// srcPath. Modes, owners and modification times are preserved.
+func Write(w io.Writer, srcPath, name string, progress Progress) error {
+	if name == "" {
+		name = filepath.Base(srcPath)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid archive entry name %q", name)
+	}
+	tw := tar.NewWriter(w)
+	c := &counter{progress: progress}
+	srcPath = filepath.Clean(srcPath)
+	err := filepath.Walk(srcPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		entry := name
+		if rel != "." {
+			entry = path.Join(name, filepath.ToSlash(rel))
+		}
+		return writeEntry(tw, c, p, entry, fi)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeEntry(tw *tar.Writer, c *counter, p, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %s", p, err)
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(&countingWriter{w: tw, c: c}, f)
+	return err
+}
+
+// Extract extracts a tar written by Write. If dstPath is an existing
+// directory, the top-level entry is extracted into it under its own name.
+// Otherwise the top-level entry is extracted as dstPath, whose parent must
+// exist. Modes and modification times are preserved, as are owners where the
+// caller has the privilege to set them. Hard links, as written by tar for
+// files with several names, are recreated if the file linked to is a regular
+// file earlier in the archive.
+func Extract(r io.Reader, dstPath string, progress Progress) error {
+	dstPath = filepath.Clean(dstPath)
+	dir, rename := filepath.Dir(dstPath), filepath.Base(dstPath)
+	if fi, err := os.Stat(dstPath); err == nil && fi.IsDir() {
+		dir, rename = dstPath, ""
+	}
+
+	tr := tar.NewReader(r)
+	c := &counter{progress: progress}
+	root := ""
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := entryPath(hdr.Name, &root, rename)
+		if err != nil {
+			return err
+		}
+		if err := checkParents(dir, name); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if hdr.Typeflag == tar.TypeLink {
+			if err := extractLink(hdr, dir, target, &root, rename); err != nil {
+				return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+			}
+			continue
+		}
+		if err := extractEntry(tr, c, hdr, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+	if root == "" {
+		return fmt.Errorf("archive is empty")
+	}
+
+	// Directory metadata is set last, as extracting their contents updates
+	// their modification times and may need write access.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+		name, _ := entryPath(hdr.Name, &root, rename)
+		if err := setMetadata(hdr, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkParents fails if any directory between dir and the entry name is a
+// symlink, so that an archive cannot write outside of the destination.
+func checkParents(dir, name string) error {
+	parts := strings.Split(name, "/")
+	p := dir
+	for _, part := range parts[:len(parts)-1] {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("archive entry %q is below %s which is not a directory", name, p)
+		}
+	}
+	return nil
+}
+
+// entryPath returns the slash separated path to extract an entry to,
+// relative to the destination directory. The first entry sets the top-level
+// name; every later entry must be below it. If rename is set, the top-level
+// name is replaced with it.
+func entryPath(name string, root *string, rename string) (string, error) {
+	clean := path.Clean("/" + strings.Replace(name, `\`, "/", -1))[1:]
+	if clean == "" {
+		return "", fmt.Errorf("invalid archive entry name %q", name)
+	}
+	parts := strings.SplitN(clean, "/", 2)
+	if *root == "" {
+		*root = parts[0]
+	} else if parts[0] != *root {
+		return "", fmt.Errorf("archive entry %q is not below %q", name, *root)
+	}
+	if rename != "" {
+		parts[0] = rename
+	}
+	return path.Join(parts...), nil
+}
+
+func extractEntry(tr *tar.Reader, c *counter, hdr *tar.Header, target string) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+		}
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		// Replace rather than overwrite an existing file, which may be a
+		// symlink or read-only.
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			os.Remove(target)
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(&countingWriter{w: f, c: c}, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		os.Remove(target)
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		// Owners of symlinks are preserved, but nothing else is.
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+		return nil
+	default:
+		// Devices and the like cannot be created portably.
+		return fmt.Errorf("unsupported archive entry type %q", hdr.Typeflag)
+	}
+	return setMetadata(hdr, target)
+}
+
+// extractLink creates the hard link at target to the file named by the entry's
+// link name, which must be a regular file already extracted below dir.
+func extractLink(hdr *tar.Header, dir, target string, root *string, rename string) error {
+	name, err := entryPath(hdr.Linkname, root, rename)
+	if err != nil {
+		return err
+	}
+	if err := checkParents(dir, name); err != nil {
+		return err
+	}
+	src := filepath.Join(dir, filepath.FromSlash(name))
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("hard link target %q is not a regular file", hdr.Linkname)
+	}
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		os.Remove(target)
+	}
+	// The link shares the metadata of the file linked to.
+	return os.Link(src, target)
+}
+
+func setMetadata(hdr *tar.Header, target string) error {
+	// Setting the owner fails without privilege, in which case the file is
+	// owned by the caller as it would be with tar.
+	os.Lchown(target, hdr.Uid, hdr.Gid)
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
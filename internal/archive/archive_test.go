@@ -0,0 +1,224 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeTree(t *testing.T, dir string) time.Time {
+	mtime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world!",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(p, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mtime
+}
+
+func roundTrip(t *testing.T, src, dst string) int64 {
+	var buf bytes.Buffer
+	var written, extracted int64
+	if err := Write(&buf, src, "", func(n int64) { written = n }); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(&buf, dst, func(n int64) { extracted = n }); err != nil {
+		t.Fatal(err)
+	}
+	if written != extracted {
+		t.Fatalf("wrote %d bytes but extracted %d", written, extracted)
+	}
+	return written
+}
+
+func TestCopyDirectoryToNewName(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	mtime := writeTree(t, src)
+
+	dst := filepath.Join(tmp, "dst")
+	if n := roundTrip(t, src, dst); n != int64(len("hello")+len("world!")) {
+		t.Fatalf("unexpected progress %d", n)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "world!" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("modification time not preserved: %s", fi.ModTime())
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Fatalf("mode not preserved: %s", fi.Mode())
+	}
+}
+
+func TestCopyIntoExistingDirectory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	writeTree(t, src)
+
+	dst := filepath.Join(tmp, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, src, dst)
+	if _, err := os.Stat(filepath.Join(dst, "src", "sub", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyFileOverExisting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTree(t, tmp)
+
+	dst := filepath.Join(tmp, "copy.txt")
+	if err := ioutil.WriteFile(dst, []byte("old content"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, filepath.Join(tmp, "a.txt"), dst)
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected content %q", b)
+	}
+}
+
+func TestExtractRejectsEscapingEntries(t *testing.T) {
+	for _, names := range [][]string{
+		{"a", "b/c"},
+		{"a", "a/../../c"},
+	} {
+		tmp, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range names {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755})
+		}
+		tw.Close()
+		if err := Extract(&buf, filepath.Join(tmp, "dst"), nil); err == nil {
+			t.Fatalf("extracting %v succeeded", names)
+		}
+	}
+}
+
+func TestExtractRejectsWritesThroughSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privilege on Windows")
+	}
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: tmp})
+	tw.WriteHeader(&tar.Header{Name: "a/link/escaped", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	if err := Extract(&buf, filepath.Join(tmp, "dst"), nil); err == nil {
+		t.Fatal("extracting through a symlink succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("file was written through a symlink: %v", err)
+	}
+}
+
+func TestExtractHardLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "a/sub/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "a/sub/link", Typeflag: tar.TypeLink, Linkname: "a/file"})
+	tw.Close()
+	if err := Extract(&buf, filepath.Join(tmp, "dst"), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, "dst", "sub", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	fi1, _ := os.Stat(filepath.Join(tmp, "dst", "file"))
+	fi2, _ := os.Stat(filepath.Join(tmp, "dst", "sub", "link"))
+	if !os.SameFile(fi1, fi2) {
+		t.Fatal("the link is not a hard link")
+	}
+}
+
+func TestExtractRejectsEscapingHardLinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "outside"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, linkname := range []string{"../outside", "a/../../outside", "b/outside"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: "a/link", Typeflag: tar.TypeLink, Linkname: linkname})
+		tw.Close()
+		dst := filepath.Join(tmp, "dst")
+		if err := Extract(&buf, dst, nil); err == nil {
+			t.Fatalf("extracting a hard link to %s succeeded", linkname)
+		}
+		os.RemoveAll(dst)
+	}
+}
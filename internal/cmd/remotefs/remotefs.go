@@ -0,0 +1,45 @@
+package main
+
+// remotefs is the guest side of the remote file system operations used by
+// lcow.OpenRemoteFS. It serves the internal/remotefs protocol on its stdin
+// and stdout, executing the operations beneath a root directory, until stdin
+// is closed.
+//
+// It must be built for Linux and installed in the utility VM image as
+// /bin/remotefs, eg:
+//
+//     GOOS=linux CGO_ENABLED=0 go build -o remotefs ./internal/cmd/remotefs
+//
+// Nothing but responses may be written to stdout; errors go to stderr.
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/hcsshim/internal/remotefs"
+	"github.com/urfave/cli"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "remotefs"
+	app.Usage = "Serves remote file system operations on stdin and stdout"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "Directory beneath which operations are executed",
+			Value: "/",
+		},
+	}
+	app.Action = func(c *cli.Context) error {
+		root := c.String("root")
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", root)
+		}
+		return remotefs.Serve(remotefs.NewLocalFS(root), os.Stdin, os.Stdout)
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "remotefs: %s\n", err)
+		os.Exit(1)
+	}
+}
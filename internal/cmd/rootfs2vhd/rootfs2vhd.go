@@ -4,33 +4,20 @@ package main
 // the Microsoft/opengcs repos build.ps1 script to rootfs.vhd which LCOW
 // can use for the root filesystem added on VPMem (as opposed to an initrd).
 //
-// It's not pretty, but enough to get the job done. It does require
-// the Hyper-V RSAT to be installed for shelling out to New-VHD.
+// The ext4 file system and the fixed VHD footer are written directly, so
+// neither a utility VM nor the Hyper-V RSAT is required.
 
 import (
-	"bufio"
-	"bytes"
+	"compress/gzip"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-	"time"
 
-	"github.com/Microsoft/hcsshim/internal/lcow"
-	"github.com/Microsoft/hcsshim/internal/schema2"
-	"github.com/Microsoft/hcsshim/internal/uvm"
-	"github.com/Microsoft/hcsshim/internal/wclayer"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/Microsoft/hcsshim/internal/tar2ext4"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
-var (
-	debug = false
-	pause = false
-)
-
 func main() {
 
 	app := cli.NewApp()
@@ -47,19 +34,10 @@ func main() {
 			Usage: "Full path to output filename",
 			Value: cwd + `\rootfs.vhd`,
 		},
-		cli.IntFlag{
-			Name:  "s",
-			Usage: "Size in MB of the new VHD",
-			Value: 19,
-		},
 		cli.BoolFlag{
 			Name:  "D",
 			Usage: "Debug mode",
 		},
-		cli.BoolFlag{
-			Name:  "P",
-			Usage: "Pause when complete but before tearing down the utility VM",
-		},
 	}
 	app.Action = func(c *cli.Context) {
 		rootfs2vhd(c)
@@ -73,138 +51,46 @@ func main() {
 func rootfs2vhd(c *cli.Context) {
 	sourceRootFS := c.String("i")
 	destFile := c.String("o")
-	debug = c.Bool("D")
-	pause = c.Bool("P")
 
-	if debug {
+	if c.Bool("D") {
 		logrus.SetLevel(logrus.DebugLevel)
 		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 	}
 
-	if _, err := os.Stat(sourceRootFS); err != nil {
+	in, err := os.Open(sourceRootFS)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s not found\n", sourceRootFS)
 		os.Exit(-1)
 	}
+	defer in.Close()
 
 	if _, err := os.Stat(destFile); err == nil {
 		fmt.Fprintf(os.Stderr, "%s exists. Not overwriting\n", destFile)
 		os.Exit(-1)
 	}
 
-	// TODO The right thing to do here is modify go-winio to be able to create this type of disk.
-	fmt.Printf("- Creating %s...\n", destFile)
-	if _, err := exec.Command(`powershell`, `-command`, fmt.Sprintf(`New-VHD %s -SizeBytes %dMB -fixed`, destFile, c.Int("s"))).Output(); err != nil {
-		fmt.Fprintf(os.Stderr, string(err.(*exec.ExitError).Stderr))
-		os.Exit(-1)
-	}
-
-	fmt.Println("- Creating an LCOW utility VM...")
-	lcowUVM, err := uvm.Create(&uvm.UVMOptions{OperatingSystem: "linux", ID: "rootfs2vhd"})
+	gz, err := gzip.NewReader(in)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create utility VM: %s", err)
-		os.Exit(-1)
-	}
-
-	fmt.Println("- Starting it....")
-	if err := lcowUVM.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start utility VM: %s", err)
-		os.Exit(-1)
-	}
-
-	fmt.Printf("- Adding %s as read-only...\n", filepath.Dir(sourceRootFS))
-	if err := lcowUVM.AddPlan9(filepath.Dir(sourceRootFS), `/fssource`, schema2.VPlan9FlagReadOnly); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to add %s: %s", filepath.Dir(sourceRootFS), err)
-		lcowUVM.Terminate()
-		lcowUVM.Wait()
-		os.Exit(-1)
-	}
-
-	fmt.Printf("- Granting access to %s...\n", destFile)
-	if err := wclayer.GrantVmAccess(lcowUVM.ID(), destFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to grant access: %s", err)
-		lcowUVM.Terminate()
-		lcowUVM.Wait()
+		fmt.Fprintf(os.Stderr, "Failed to decompress %s: %s\n", sourceRootFS, err)
 		os.Exit(-1)
 	}
 
-	fmt.Println("- Hot-adding SCSI disk...")
-	controller, lun, err := lcowUVM.AddSCSI(destFile, "") // No destination as not formatted
+	fmt.Printf("- Creating %s...\n", destFile)
+	out, err := os.Create(destFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to add SCSI: %s", err)
-		lcowUVM.Terminate()
-		lcowUVM.Wait()
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", destFile, err)
 		os.Exit(-1)
 	}
-	fmt.Printf("- Added at SCSI %d:%d\n", controller, lun)
-
-	uvmCommand(lcowUVM, []string{"test", "-d", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d", controller, lun)})
-	device := fmt.Sprintf(`/dev/%s`, strings.TrimSpace(uvmCommand(lcowUVM, []string{"ls", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d/block", controller, lun)})))
-	fmt.Printf("- Located at %s\n", device)
-
-	fmt.Printf("- Formatting ext4...\n")
-	uvmCommand(lcowUVM, []string{"mkfs.ext4", "-q", "-E", "lazy_itable_init=1", "-O", `^has_journal,sparse_super2,uninit_bg,^resize_inode`, device})
 
-	fmt.Printf("- Extracting %s...\n", filepath.Base(sourceRootFS))
-	uvmCommand(lcowUVM, []string{"mkdir", "/target"})
-	uvmCommand(lcowUVM, []string{"mount", device, "/target"})
-	uvmCommand(lcowUVM, []string{"rm", "-rf", "/target/lost+found"})
-	uvmCommand(lcowUVM, []string{"sh", "-c", fmt.Sprintf(`"cd /target; gzip -dc /fssource/%s | tar x"`, filepath.Base(sourceRootFS))})
-	fmt.Println("- Extract complete!")
-	fmt.Printf("\n%s\n", uvmCommand(lcowUVM, []string{"df", "/target"}))
-	possiblePause()
-
-	fmt.Println("- Removing SCSI disk...")
-	if err := lcowUVM.RemoveSCSI(destFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to remove SCSI: %s", err)
-		lcowUVM.Terminate()
-		lcowUVM.Wait()
+	fmt.Printf("- Converting %s...\n", filepath.Base(sourceRootFS))
+	err = tar2ext4.Convert(gz, out, tar2ext4.AppendVhdFooter)
+	out.Close()
+	if err != nil {
+		os.Remove(destFile)
+		fmt.Fprintf(os.Stderr, "Failed to convert %s: %s\n", sourceRootFS, err)
 		os.Exit(-1)
 	}
 
-	lcowUVM.Terminate()
-
 	fmt.Printf("\nSuccess\n")
 	os.Exit(0)
 }
-
-func uvmCommand(lcowUVM *uvm.UtilityVM, args []string) string {
-	timeout := 30 * time.Second
-	var outB, errB bytes.Buffer
-	p, _, err := lcow.CreateProcess(&lcow.ProcessOptions{
-		HCSSystem:         lcowUVM.ComputeSystem(),
-		CreateInUtilityVm: true,
-		CopyTimeout:       timeout,
-		Process:           &specs.Process{Args: args},
-		Stdout:            &outB,
-		Stderr:            &errB,
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%+v failed:\n%s\n%s)", args, err, errB.String())
-		possiblePause()
-		lcowUVM.Terminate()
-		os.Exit(-1)
-	}
-	defer p.Close()
-	p.WaitTimeout(timeout)
-	ec, err := p.ExitCode()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%+v failed to get exit code:\n%s\n%s)", args, err, errB.String())
-		possiblePause()
-		lcowUVM.Terminate()
-		os.Exit(-1)
-	}
-	if ec != 0 {
-		fmt.Fprintf(os.Stderr, "%+v had non-zero exit code:\n%s)", args, errB.String())
-		possiblePause()
-		lcowUVM.Terminate()
-		os.Exit(-1)
-	}
-	return outB.String()
-}
-
-func possiblePause() {
-	if pause {
-		fmt.Print("Press 'Enter' to continue...")
-		bufio.NewReader(os.Stdin).ReadBytes('\n')
-	}
-}
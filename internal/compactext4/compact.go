@@ -0,0 +1,1009 @@
+// Package compactext4 writes a compact ext4 file system image in a single
+// pass, for example from a container layer tar. File data is written as files
+// are created, each file occupying a contiguous run of blocks; directories,
+// inodes and the remaining metadata are written when the Writer is closed, and
+// the image is no larger than its contents require.
+//
+// The image has no journal, no reserved space for growth, and uses flexible
+// block groups so that metadata can be placed after the data. It is intended to
+// be mounted read-only, such as for the read-only layers of Linux containers.
+package compactext4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BlockSize is the block size of the file system.
+	BlockSize = 4096
+
+	blocksPerGroup    = BlockSize * 8
+	inodesPerBlock    = BlockSize / inodeSize
+	maxInodesPerGroup = BlockSize * 8
+	maxGroups         = 1<<32/blocksPerGroup - 1
+
+	// DefaultMaximumDiskSize is the largest file system a Writer can write by
+	// default. See MaximumDiskSize.
+	DefaultMaximumDiskSize = 16 * 1024 * 1024 * 1024
+)
+
+// maxBlocksPerExtent is the longest run of blocks described by an extent. It is
+// a variable so that tests can exercise the extent tree with small files.
+var maxBlocksPerExtent = 32768
+
+// File describes a file, directory or other file system object to create.
+type File struct {
+	Mode               uint16 // The type and permissions, using the S_IF* and S_I* constants
+	Uid, Gid           uint32
+	Size               int64 // The size of a regular file, whose data is written after Create
+	Atime, Ctime       time.Time
+	Mtime, Crtime      time.Time
+	Devmajor, Devminor uint32            // For character and block devices
+	Linkname           string            // The target of a symlink
+	Xattrs             map[string][]byte // Extended attributes
+}
+
+// extent is a run of contiguous blocks of a file.
+type extent struct {
+	logical uint32
+	start   uint32
+	length  uint32
+}
+
+// inode is a file system object being written.
+type inode struct {
+	number     uint32
+	file       File
+	linkCount  uint32
+	parent     *inode            // For directories
+	children   map[string]*inode // For directories
+	xattrs     []xattr
+	inlineData []byte // The target of a fast symlink, or the data of a device
+	extents    []extent
+	dataBlocks uint32 // Blocks of data, excluding metadata blocks
+	treeBlocks []uint32
+	xattrBlock uint32
+	size       uint64
+}
+
+func (n *inode) isDir() bool {
+	return n.file.Mode&TypeMask == S_IFDIR
+}
+
+// Writer writes a compact ext4 file system.
+type Writer struct {
+	f           io.WriteSeeker
+	bw          *bufio.Writer
+	pos         int64 // Offset in f of the next write
+	err         error
+	initialized bool
+	maxDiskSize int64
+	gdBlocks    uint32 // Blocks reserved for the group descriptors
+	dataStart   uint32 // The first block of file data
+
+	inodes []*inode // Indexed by inode number - 1. Removed inodes are nil
+
+	// The regular file whose data is being written.
+	current        *inode
+	currentName    string
+	currentStart   uint32
+	currentWritten int64
+}
+
+// Option is an option for NewWriter.
+type Option func(*Writer)
+
+// MaximumDiskSize sets the largest file system the Writer can write. Space for
+// the block group descriptors of a file system of this size is reserved at the
+// start of the image, at one block per 512GB.
+func MaximumDiskSize(size int64) Option {
+	return func(w *Writer) {
+		w.maxDiskSize = size
+	}
+}
+
+// NewWriter returns a Writer which writes a file system to f. Nothing is
+// written until the first file is created.
+func NewWriter(f io.WriteSeeker, opts ...Option) *Writer {
+	w := &Writer{
+		f:           f,
+		bw:          bufio.NewWriterSize(f, 1024*1024),
+		maxDiskSize: DefaultMaximumDiskSize,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// init creates the root and lost+found directories, and positions f after the
+// space reserved for the superblock and group descriptors.
+func (w *Writer) init() error {
+	if w.initialized {
+		return nil
+	}
+	w.initialized = true
+	groups := (w.maxDiskSize/BlockSize + blocksPerGroup - 1) / blocksPerGroup
+	if groups < 1 || groups > maxGroups {
+		return fmt.Errorf("invalid maximum disk size %d", w.maxDiskSize)
+	}
+	w.gdBlocks = uint32((groups*groupDescSize + BlockSize - 1) / BlockSize)
+	w.dataStart = 1 + w.gdBlocks
+	if _, err := w.f.Seek(int64(w.dataStart)*BlockSize, io.SeekStart); err != nil {
+		return err
+	}
+	w.pos = int64(w.dataStart) * BlockSize
+
+	w.inodes = make([]*inode, inodeFirst-1)
+	root := &inode{
+		number:    inodeRoot,
+		file:      File{Mode: S_IFDIR | 0755},
+		linkCount: 2,
+		children:  make(map[string]*inode),
+	}
+	root.parent = root
+	w.inodes[inodeRoot-1] = root
+	lostFound := w.newInode(&File{Mode: S_IFDIR | 0700})
+	if lostFound.number != inodeLostFound {
+		panic("lost+found must be the first non-reserved inode")
+	}
+	return w.link(root, "lost+found", lostFound)
+}
+
+func (w *Writer) newInode(f *File) *inode {
+	n := &inode{
+		number: uint32(len(w.inodes) + 1),
+		file:   *f,
+	}
+	if n.isDir() {
+		n.children = make(map[string]*inode)
+	}
+	w.inodes = append(w.inodes, n)
+	return n
+}
+
+func (w *Writer) write(b []byte) error {
+	if _, err := w.bw.Write(b); err != nil {
+		return err
+	}
+	w.pos += int64(len(b))
+	return nil
+}
+
+// block returns the block at which the next write starts. It must be aligned.
+func (w *Writer) block() uint32 {
+	return uint32(w.pos / BlockSize)
+}
+
+// padToBlock pads the data written so far to a block boundary.
+func (w *Writer) padToBlock() error {
+	if n := w.pos % BlockSize; n != 0 {
+		return w.write(make([]byte, BlockSize-n))
+	}
+	return nil
+}
+
+// writeData writes data of a file starting at a block boundary, recording the
+// blocks it occupies.
+func (w *Writer) writeData(n *inode, b []byte) error {
+	start := w.block()
+	if err := w.write(b); err != nil {
+		return err
+	}
+	if err := w.padToBlock(); err != nil {
+		return err
+	}
+	n.setData(start, uint64(len(b)))
+	return nil
+}
+
+// setData records the size of a file and the blocks holding its data, which
+// start at block start.
+func (n *inode) setData(start uint32, size uint64) {
+	blocks := uint32((size + BlockSize - 1) / BlockSize)
+	n.size = size
+	n.dataBlocks = blocks
+	n.extents = nil
+	for logical := uint32(0); logical < blocks; {
+		length := blocks - logical
+		if length > uint32(maxBlocksPerExtent) {
+			length = uint32(maxBlocksPerExtent)
+		}
+		n.extents = append(n.extents, extent{logical: logical, start: start + logical, length: length})
+		logical += length
+	}
+}
+
+// finishCurrent completes the regular file whose data is being written.
+func (w *Writer) finishCurrent() error {
+	n := w.current
+	if n == nil {
+		return nil
+	}
+	w.current = nil
+	if w.currentWritten != n.file.Size {
+		return fmt.Errorf("%s: %d bytes of data were written, expected %d", w.currentName, w.currentWritten, n.file.Size)
+	}
+	if err := w.padToBlock(); err != nil {
+		return err
+	}
+	n.setData(w.currentStart, uint64(n.file.Size))
+	return nil
+}
+
+// Write writes data of the regular file last created.
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.current == nil {
+		return 0, errors.New("no regular file is being written")
+	}
+	if int64(len(b)) > w.current.file.Size-w.currentWritten {
+		return 0, fmt.Errorf("%s: data exceeds the file size %d", w.currentName, w.current.file.Size)
+	}
+	if err := w.write(b); err != nil {
+		w.err = err
+		return 0, err
+	}
+	w.currentWritten += int64(len(b))
+	return len(b), nil
+}
+
+// splitPath returns the cleaned components of a path, which is relative to
+// the root of the file system.
+func splitPath(name string) []string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// lookup returns the inode at a path, or nil if it does not exist.
+func (w *Writer) lookup(name string) (*inode, error) {
+	n := w.inodes[inodeRoot-1]
+	for _, c := range splitPath(name) {
+		if !n.isDir() {
+			return nil, fmt.Errorf("%s: a parent is not a directory", name)
+		}
+		n = n.children[c]
+		if n == nil {
+			return nil, nil
+		}
+	}
+	return n, nil
+}
+
+// lookupParent returns the directory containing a path, and the path's
+// base name.
+func (w *Writer) lookupParent(name string) (*inode, string, error) {
+	components := splitPath(name)
+	if len(components) == 0 {
+		return nil, "", fmt.Errorf("%s: the root has no parent", name)
+	}
+	base := components[len(components)-1]
+	if len(base) > maxNameLength {
+		return nil, "", fmt.Errorf("%s: the name is too long", name)
+	}
+	dir, err := w.lookup(path.Join(components[:len(components)-1]...))
+	if err != nil {
+		return nil, "", err
+	}
+	if dir == nil || !dir.isDir() {
+		return nil, "", fmt.Errorf("%s: the parent directory does not exist", name)
+	}
+	return dir, base, nil
+}
+
+// link adds an entry for an inode to a directory.
+func (w *Writer) link(dir *inode, name string, n *inode) error {
+	if n.isDir() {
+		if dir.linkCount >= maxLinks {
+			dir.linkCount = 1 // Too many to count, as allowed by DIR_NLINK
+		} else if dir.linkCount > 1 {
+			dir.linkCount++
+		}
+		n.parent = dir
+		n.linkCount = 2
+	} else {
+		if n.linkCount >= maxLinks {
+			return fmt.Errorf("%s: too many links", name)
+		}
+		n.linkCount++
+	}
+	dir.children[name] = n
+	return nil
+}
+
+// unlink removes an entry from a directory, removing the inode and, for a
+// directory, its contents, if it is no longer linked.
+func (w *Writer) unlink(dir *inode, name string) {
+	n := dir.children[name]
+	if n == nil {
+		return
+	}
+	delete(dir.children, name)
+	if n.isDir() {
+		for c := range n.children {
+			w.unlink(n, c)
+		}
+		if dir.linkCount > 2 {
+			dir.linkCount--
+		}
+		n.linkCount = 0
+	} else {
+		n.linkCount--
+	}
+	if n.linkCount == 0 {
+		w.inodes[n.number-1] = nil
+	}
+}
+
+// Create creates a file, directory or other object. The parent directory must
+// exist. An existing object at the path is replaced, except that an existing
+// directory replaced by a directory keeps its contents. For a regular file,
+// f.Size bytes of data must then be written with Write.
+func (w *Writer) Create(name string, f *File) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.create(name, f); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w *Writer) create(name string, f *File) error {
+	if err := w.init(); err != nil {
+		w.err = err
+		return err
+	}
+	if err := w.finishCurrent(); err != nil {
+		w.err = err
+		return err
+	}
+
+	xattrs, err := newXattrs(f.Xattrs)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if _, err := splitXattrs(xattrs); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	switch f.Mode & TypeMask {
+	case S_IFREG:
+		if f.Size < 0 {
+			return fmt.Errorf("%s: invalid size %d", name, f.Size)
+		}
+	case S_IFLNK:
+		if len(f.Linkname) == 0 || len(f.Linkname) > BlockSize-1 {
+			return fmt.Errorf("%s: invalid symlink target %q", name, f.Linkname)
+		}
+	case S_IFDIR, S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+	default:
+		return fmt.Errorf("%s: invalid mode %#o", name, f.Mode)
+	}
+
+	if len(splitPath(name)) == 0 {
+		// The root directory's metadata is being set.
+		if f.Mode&TypeMask != S_IFDIR {
+			return fmt.Errorf("the root must be a directory")
+		}
+		root := w.inodes[inodeRoot-1]
+		root.file = *f
+		root.xattrs = xattrs
+		return nil
+	}
+
+	dir, base, err := w.lookupParent(name)
+	if err != nil {
+		return err
+	}
+	if existing := dir.children[base]; existing != nil {
+		if existing.isDir() && f.Mode&TypeMask == S_IFDIR {
+			existing.file = *f
+			existing.xattrs = xattrs
+			return nil
+		}
+		w.unlink(dir, base)
+	}
+
+	n := w.newInode(f)
+	n.xattrs = xattrs
+	if err := w.link(dir, base, n); err != nil {
+		return err
+	}
+	switch f.Mode & TypeMask {
+	case S_IFREG:
+		n.file.Size = f.Size
+		w.current = n
+		w.currentName = name
+		w.currentStart = w.block()
+		w.currentWritten = 0
+	case S_IFLNK:
+		if len(f.Linkname) < fastSymlinkSize {
+			n.inlineData = []byte(f.Linkname)
+			n.size = uint64(len(f.Linkname))
+		} else if err := w.writeData(n, []byte(f.Linkname)); err != nil {
+			w.err = err
+			return err
+		}
+	case S_IFCHR, S_IFBLK:
+		n.inlineData = encodeDevice(f.Devmajor, f.Devminor)
+	}
+	return nil
+}
+
+// encodeDevice returns the i_block of a device inode, using the old encoding
+// when the device numbers are small enough.
+func encodeDevice(major, minor uint32) []byte {
+	b := make([]byte, 12)
+	if major < 256 && minor < 256 {
+		binary.LittleEndian.PutUint32(b, major<<8|minor)
+	} else {
+		binary.LittleEndian.PutUint32(b[4:], minor&0xff|major<<8|(minor&^0xff)<<12)
+	}
+	return b
+}
+
+// Link creates a hard link newname to the existing non-directory oldname.
+func (w *Writer) Link(oldname, newname string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.init(); err != nil {
+		w.err = err
+		return err
+	}
+	if err := w.finishCurrent(); err != nil {
+		w.err = err
+		return err
+	}
+	n, err := w.lookup(oldname)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return fmt.Errorf("%s: link target %s does not exist", newname, oldname)
+	}
+	if n.isDir() {
+		return fmt.Errorf("%s: link target %s is a directory", newname, oldname)
+	}
+	dir, base, err := w.lookupParent(newname)
+	if err != nil {
+		return err
+	}
+	if dir.children[base] == n {
+		return nil
+	}
+	w.unlink(dir, base)
+	return w.link(dir, base, n)
+}
+
+// MakeParents creates the missing parent directories of a path, with mode 0755.
+func (w *Writer) MakeParents(name string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.init(); err != nil {
+		w.err = err
+		return err
+	}
+	components := splitPath(name)
+	dir := w.inodes[inodeRoot-1]
+	for i := 0; i+1 < len(components); i++ {
+		n := dir.children[components[i]]
+		if n == nil {
+			if err := w.finishCurrent(); err != nil {
+				w.err = err
+				return err
+			}
+			n = w.newInode(&File{Mode: S_IFDIR | 0755})
+			if err := w.link(dir, components[i], n); err != nil {
+				return err
+			}
+		} else if !n.isDir() {
+			return fmt.Errorf("%s: %s is not a directory", name, path.Join(components[:i+1]...))
+		}
+		dir = n
+	}
+	return nil
+}
+
+// Stat returns the description of an existing object.
+func (w *Writer) Stat(name string) (*File, error) {
+	if err := w.init(); err != nil {
+		w.err = err
+		return nil, err
+	}
+	n, err := w.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, fmt.Errorf("%s: does not exist", name)
+	}
+	f := n.file
+	f.Xattrs = make(map[string][]byte)
+	for k, v := range n.file.Xattrs {
+		f.Xattrs[k] = v
+	}
+	return &f, nil
+}
+
+// Close writes the directories and the metadata of the file system. It does
+// not close the underlying file.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.close(); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errors.New("the file system has been closed")
+	return nil
+}
+
+func (w *Writer) close() error {
+	if err := w.init(); err != nil {
+		return err
+	}
+	if err := w.finishCurrent(); err != nil {
+		return err
+	}
+
+	// Write the directory data, the extent tree blocks of large files and the
+	// extended attribute blocks.
+	for _, n := range w.inodes {
+		if n == nil {
+			continue
+		}
+		if n.isDir() {
+			if err := w.writeData(n, directoryData(n)); err != nil {
+				return err
+			}
+		}
+		if len(n.extents) > inodeExtentCount {
+			if err := w.writeExtentTree(n); err != nil {
+				return err
+			}
+		}
+		count, _ := splitXattrs(n.xattrs)
+		if count < len(n.xattrs) {
+			n.xattrBlock = w.block()
+			if err := w.write(xattrBlock(n.xattrs[count:])); err != nil {
+				return err
+			}
+		}
+	}
+
+	layout, err := w.layout()
+	if err != nil {
+		return err
+	}
+	if err := w.writeMetadata(layout); err != nil {
+		return err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.pos = 0
+	if err := w.writeSuperblock(layout); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// directoryData returns the entries of a directory, in blocks.
+func directoryData(n *inode) []byte {
+	type entry struct {
+		name string
+		n    *inode
+	}
+	entries := []entry{{".", n}, {"..", n.parent}}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, entry{name, n.children[name]})
+	}
+
+	var b []byte
+	last := -1 // Offset of the last entry in the current block
+	for _, e := range entries {
+		size := align4(8 + len(e.name))
+		if len(b)%BlockSize+size > BlockSize || len(b) == 0 {
+			if last >= 0 {
+				// Extend the last entry of the block to its end.
+				binary.LittleEndian.PutUint16(b[last+4:], uint16(len(b)+BlockSize-len(b)%BlockSize-last))
+				b = append(b, make([]byte, BlockSize-len(b)%BlockSize)...)
+			}
+		}
+		last = len(b)
+		entryBytes := make([]byte, size)
+		binary.LittleEndian.PutUint32(entryBytes, e.n.number)
+		binary.LittleEndian.PutUint16(entryBytes[4:], uint16(size))
+		entryBytes[6] = uint8(len(e.name))
+		entryBytes[7] = fileType(e.n.file.Mode)
+		copy(entryBytes[8:], e.name)
+		b = append(b, entryBytes...)
+	}
+	binary.LittleEndian.PutUint16(b[last+4:], uint16(len(b)+BlockSize-len(b)%BlockSize-last))
+	if len(b)%BlockSize != 0 {
+		b = append(b, make([]byte, BlockSize-len(b)%BlockSize)...)
+	}
+	return b
+}
+
+func fileType(mode uint16) uint8 {
+	switch mode & TypeMask {
+	case S_IFREG:
+		return fileTypeRegular
+	case S_IFDIR:
+		return fileTypeDirectory
+	case S_IFCHR:
+		return fileTypeCharacter
+	case S_IFBLK:
+		return fileTypeBlock
+	case S_IFIFO:
+		return fileTypeFIFO
+	case S_IFSOCK:
+		return fileTypeSocket
+	case S_IFLNK:
+		return fileTypeSymlink
+	}
+	return fileTypeUnknown
+}
+
+// writeExtentTree writes the leaf blocks of an extent tree of depth one for a
+// file with too many extents to fit in its inode.
+func (w *Writer) writeExtentTree(n *inode) error {
+	perBlock := (BlockSize - binary.Size(extentHeader{})) / binary.Size(extentLeaf{})
+	if len(n.extents) > perBlock*inodeExtentCount {
+		return fmt.Errorf("inode %d has too many extents", n.number)
+	}
+	for i := 0; i < len(n.extents); i += perBlock {
+		extents := n.extents[i:]
+		if len(extents) > perBlock {
+			extents = extents[:perBlock]
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &extentHeader{
+			Magic:   extentHeaderMagic,
+			Entries: uint16(len(extents)),
+			Max:     uint16(perBlock),
+		})
+		for _, e := range extents {
+			binary.Write(&buf, binary.LittleEndian, leaf(e))
+		}
+		buf.Write(make([]byte, BlockSize-buf.Len()))
+		n.treeBlocks = append(n.treeBlocks, w.block())
+		if err := w.write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func leaf(e extent) *extentLeaf {
+	return &extentLeaf{
+		Block:    e.logical,
+		Length:   uint16(e.length),
+		StartLow: e.start,
+	}
+}
+
+// layout is the placement of the block and inode bitmaps and inode tables,
+// which follow the data.
+type layout struct {
+	groups         uint32
+	inodesPerGroup uint32
+	blocks         uint32 // Total blocks in the file system
+	metadataStart  uint32 // The first block bitmap; inode bitmaps and tables follow
+}
+
+func (l *layout) blockBitmap(g uint32) uint32 {
+	return l.metadataStart + g
+}
+
+func (l *layout) inodeBitmap(g uint32) uint32 {
+	return l.metadataStart + l.groups + g
+}
+
+func (l *layout) inodeTable(g uint32) uint32 {
+	return l.metadataStart + 2*l.groups + g*l.inodesPerGroup/inodesPerBlock
+}
+
+// layout computes the number of block groups, which in turn depends on the
+// size of the metadata following the data.
+func (w *Writer) layout() (*layout, error) {
+	l := &layout{metadataStart: w.block()}
+	inodes := uint32(len(w.inodes))
+	groups := uint32(1)
+	for {
+		ipg := (inodes + groups - 1) / groups
+		ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		if ipg > maxInodesPerGroup {
+			groups++
+			continue
+		}
+		blocks := uint64(l.metadataStart) + 2*uint64(groups) + uint64(groups)*uint64(ipg)/inodesPerBlock
+		need := uint32((blocks + blocksPerGroup - 1) / blocksPerGroup)
+		if need <= groups {
+			l.groups = groups
+			l.inodesPerGroup = ipg
+			l.blocks = uint32(blocks)
+			break
+		}
+		groups = need
+		if uint64(groups)*groupDescSize > uint64(w.gdBlocks)*BlockSize {
+			return nil, fmt.Errorf("the file system exceeds the maximum disk size %d", w.maxDiskSize)
+		}
+	}
+	return l, nil
+}
+
+// writeMetadata writes the block and inode bitmaps and the inode tables.
+func (w *Writer) writeMetadata(l *layout) error {
+	blockBitmaps := make([]byte, l.groups*BlockSize)
+	setBits := func(start, count uint32) {
+		for b := start; b < start+count; b++ {
+			blockBitmaps[b/8] |= 1 << (b % 8)
+		}
+	}
+	setBits(0, 1+(l.groups*groupDescSize+BlockSize-1)/BlockSize) // Superblock and group descriptors
+	for _, n := range w.inodes {
+		if n == nil {
+			continue
+		}
+		for _, e := range n.extents {
+			setBits(e.start, e.length)
+		}
+		for _, b := range n.treeBlocks {
+			setBits(b, 1)
+		}
+		if n.xattrBlock != 0 {
+			setBits(n.xattrBlock, 1)
+		}
+	}
+	setBits(l.metadataStart, l.blocks-l.metadataStart)
+	setBits(l.blocks, l.groups*blocksPerGroup-l.blocks) // Padding past the end of the last group
+	if err := w.write(blockBitmaps); err != nil {
+		return err
+	}
+
+	for g := uint32(0); g < l.groups; g++ {
+		b := make([]byte, BlockSize)
+		for i := uint32(0); i < maxInodesPerGroup; i++ {
+			number := g*l.inodesPerGroup + i + 1
+			if i >= l.inodesPerGroup || number < inodeFirst || (number <= uint32(len(w.inodes)) && w.inodes[number-1] != nil) {
+				b[i/8] |= 1 << (i % 8)
+			}
+		}
+		if err := w.write(b); err != nil {
+			return err
+		}
+	}
+
+	for number := uint32(1); number <= l.groups*l.inodesPerGroup; number++ {
+		var b []byte
+		if number <= uint32(len(w.inodes)) && w.inodes[number-1] != nil {
+			var err error
+			if b, err = w.inodes[number-1].encode(); err != nil {
+				return err
+			}
+		} else {
+			b = make([]byte, inodeSize)
+		}
+		if err := w.write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTime returns the seconds and the extra field of a timestamp, which holds
+// the nanoseconds and the high bits of the seconds.
+func encodeTime(t time.Time) (uint32, uint32) {
+	if t.IsZero() {
+		return 0, 0
+	}
+	s := t.Unix()
+	epoch := uint32((s-int64(int32(s)))>>32) & 3
+	return uint32(s), epoch | uint32(t.Nanosecond())<<2
+}
+
+// encode returns the on-disk inode.
+func (n *inode) encode() ([]byte, error) {
+	blocks := uint64(n.dataBlocks) + uint64(len(n.treeBlocks))
+	if n.xattrBlock != 0 {
+		blocks++
+	}
+	sectors := blocks * (BlockSize / 512)
+	r := inodeRecord{
+		Mode:          n.file.Mode,
+		Uid:           uint16(n.file.Uid),
+		UidHigh:       uint16(n.file.Uid >> 16),
+		Gid:           uint16(n.file.Gid),
+		GidHigh:       uint16(n.file.Gid >> 16),
+		SizeLow:       uint32(n.size),
+		SizeHigh:      uint32(n.size >> 32),
+		LinksCount:    uint16(n.linkCount),
+		BlocksLow:     uint32(sectors),
+		BlocksHigh:    uint16(sectors >> 32),
+		XattrBlockLow: n.xattrBlock,
+		ExtraIsize:    inodeExtraSize,
+	}
+	r.Atime, r.AtimeExtra = encodeTime(n.file.Atime)
+	r.Ctime, r.CtimeExtra = encodeTime(n.file.Ctime)
+	r.Mtime, r.MtimeExtra = encodeTime(n.file.Mtime)
+	r.Crtime, r.CrtimeExtra = encodeTime(n.file.Crtime)
+
+	switch n.file.Mode & TypeMask {
+	case S_IFREG, S_IFDIR:
+		r.Flags = inodeFlagExtents
+	case S_IFLNK:
+		if n.inlineData == nil {
+			r.Flags = inodeFlagExtents
+		}
+	}
+	if r.Flags&inodeFlagExtents != 0 {
+		var buf bytes.Buffer
+		if len(n.extents) <= inodeExtentCount {
+			binary.Write(&buf, binary.LittleEndian, &extentHeader{
+				Magic:   extentHeaderMagic,
+				Entries: uint16(len(n.extents)),
+				Max:     inodeExtentCount,
+			})
+			for _, e := range n.extents {
+				binary.Write(&buf, binary.LittleEndian, leaf(e))
+			}
+		} else {
+			binary.Write(&buf, binary.LittleEndian, &extentHeader{
+				Magic:   extentHeaderMagic,
+				Entries: uint16(len(n.treeBlocks)),
+				Max:     inodeExtentCount,
+				Depth:   1,
+			})
+			perBlock := (BlockSize - binary.Size(extentHeader{})) / binary.Size(extentLeaf{})
+			for i, b := range n.treeBlocks {
+				binary.Write(&buf, binary.LittleEndian, &extentIndex{
+					Block:   n.extents[i*perBlock].logical,
+					LeafLow: b,
+				})
+			}
+		}
+		copy(r.Block[:], buf.Bytes())
+	} else {
+		copy(r.Block[:], n.inlineData)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &r)
+	count, err := splitXattrs(n.xattrs)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(inodeXattrs(n.xattrs[:count]))
+	return buf.Bytes(), nil
+}
+
+// writeSuperblock writes the superblock and the group descriptors.
+func (w *Writer) writeSuperblock(l *layout) error {
+	var usedBlocks, usedInodes uint32
+	descriptors := make([]groupDescriptor, l.groups)
+	for g := range descriptors {
+		descriptors[g] = groupDescriptor{
+			BlockBitmapLow: l.blockBitmap(uint32(g)),
+			InodeBitmapLow: l.inodeBitmap(uint32(g)),
+			InodeTableLow:  l.inodeTable(uint32(g)),
+		}
+	}
+	used := make([]uint32, l.groups)
+	count := func(start, length uint32) {
+		for b := start; b < start+length; b++ {
+			used[b/blocksPerGroup]++
+		}
+		usedBlocks += length
+	}
+	count(0, 1+(l.groups*groupDescSize+BlockSize-1)/BlockSize)
+	for _, n := range w.inodes {
+		if n == nil {
+			continue
+		}
+		for _, e := range n.extents {
+			count(e.start, e.length)
+		}
+		for _, b := range n.treeBlocks {
+			count(b, 1)
+		}
+		if n.xattrBlock != 0 {
+			count(n.xattrBlock, 1)
+		}
+	}
+	count(l.metadataStart, l.blocks-l.metadataStart)
+
+	for g := range descriptors {
+		groupBlocks := uint32(blocksPerGroup)
+		if g == len(descriptors)-1 {
+			groupBlocks = l.blocks - uint32(g)*blocksPerGroup
+		}
+		descriptors[g].FreeBlocksCountLow = uint16(groupBlocks - used[g])
+		freeInodes := l.inodesPerGroup
+		for i := uint32(0); i < l.inodesPerGroup; i++ {
+			number := uint32(g)*l.inodesPerGroup + i + 1
+			var n *inode
+			if number <= uint32(len(w.inodes)) {
+				n = w.inodes[number-1]
+			}
+			if number < inodeFirst || n != nil {
+				freeInodes--
+				usedInodes++
+			}
+			if n != nil && n.isDir() {
+				descriptors[g].UsedDirsCountLow++
+			}
+		}
+		descriptors[g].FreeInodesCountLow = uint16(freeInodes)
+	}
+
+	logGroupsPerFlex := uint8(1)
+	for 1<<logGroupsPerFlex < l.groups {
+		logGroupsPerFlex++
+	}
+	sb := superBlock{
+		InodesCount:        l.groups * l.inodesPerGroup,
+		BlocksCountLow:     l.blocks,
+		FreeBlocksCountLow: l.blocks - usedBlocks,
+		FreeInodesCount:    l.groups*l.inodesPerGroup - usedInodes,
+		LogBlockSize:       2, // 1024 << 2
+		LogClusterSize:     2,
+		BlocksPerGroup:     blocksPerGroup,
+		ClustersPerGroup:   blocksPerGroup,
+		InodesPerGroup:     l.inodesPerGroup,
+		MaxMountCount:      0xffff,
+		Magic:              superblockMagic,
+		State:              1, // Cleanly unmounted
+		Errors:             1, // Continue on errors
+		RevisionLevel:      1, // Dynamic inode sizes
+		FirstInode:         inodeFirst,
+		InodeSize:          inodeSize,
+		FeatureCompat:      compatSparseSuper2 | compatExtAttr,
+		FeatureIncompat:    incompatFiletype | incompatExtents | incompatFlexBg,
+		FeatureRoCompat:    roCompatLargeFile | roCompatHugeFile | roCompatDirNlink | roCompatExtraIsize,
+		MinExtraIsize:      inodeExtraSize,
+		WantExtraIsize:     inodeExtraSize,
+		LogGroupsPerFlex:   logGroupsPerFlex,
+		LpfInode:           inodeLostFound,
+	}
+	if _, err := rand.Read(sb.UUID[:]); err != nil {
+		return err
+	}
+	sb.UUID[6] = sb.UUID[6]&0x0f | 0x40 // Version 4
+	sb.UUID[8] = sb.UUID[8]&0x3f | 0x80 // Variant 10
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, superblockOffset))
+	binary.Write(&buf, binary.LittleEndian, &sb)
+	buf.Write(make([]byte, BlockSize-buf.Len()))
+	binary.Write(&buf, binary.LittleEndian, descriptors)
+	return w.write(buf.Bytes())
+}
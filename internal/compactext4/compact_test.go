@@ -0,0 +1,240 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStructSizes(t *testing.T) {
+	for _, s := range []struct {
+		name string
+		v    interface{}
+		size int
+	}{
+		{"superBlock", superBlock{}, 1024},
+		{"groupDescriptor", groupDescriptor{}, groupDescSize},
+		{"inodeRecord", inodeRecord{}, inodeXattrOffset},
+		{"extentHeader", extentHeader{}, 12},
+		{"extentIndex", extentIndex{}, 12},
+		{"extentLeaf", extentLeaf{}, 12},
+		{"xattrHeader", xattrHeader{}, xattrHeaderSize},
+		{"xattrEntry", xattrEntry{}, xattrEntrySize},
+	} {
+		if size := binary.Size(s.v); size != s.size {
+			t.Errorf("%s is %d bytes, expected %d", s.name, size, s.size)
+		}
+	}
+}
+
+type testFile struct {
+	name string
+	file *File
+	data []byte
+	link string // Creates a hard link to this file instead
+}
+
+// writeImage writes a file system containing files to a temporary file, and
+// returns its path.
+func writeImage(t *testing.T, files []testFile) string {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	for _, tf := range files {
+		if tf.link != "" {
+			if err := w.Link(tf.link, tf.name); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if tf.file.Mode&TypeMask == S_IFREG {
+			tf.file.Size = int64(len(tf.data))
+		}
+		if err := w.Create(tf.name, tf.file); err != nil {
+			t.Fatal(err)
+		}
+		if tf.data != nil {
+			if _, err := w.Write(tf.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func findTool(t *testing.T, name string) string {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		p = filepath.Join("/sbin", name)
+		if _, err := os.Stat(p); err != nil {
+			t.Skipf("%s is not available", name)
+		}
+	}
+	return p
+}
+
+// fsck checks the file system with e2fsck, failing the test if it finds any
+// problem.
+func fsck(t *testing.T, image string) {
+	out, err := exec.Command(findTool(t, "e2fsck"), "-fn", image).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck failed: %s\n%s", err, out)
+	}
+}
+
+// debugfs runs a debugfs request against the file system.
+func debugfs(t *testing.T, image, request string) string {
+	out, err := exec.Command(findTool(t, "debugfs"), "-R", request, image).CombinedOutput()
+	if err != nil {
+		t.Fatalf("debugfs %q failed: %s\n%s", request, err, out)
+	}
+	return string(out)
+}
+
+func catFile(t *testing.T, image, name string) []byte {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	debugfs(t, image, "dump "+name+" "+f.Name())
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriter(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 100000)
+	longTarget := strings.Repeat("x/", 100)
+	files := []testFile{
+		{name: "/", file: &File{Mode: S_IFDIR | 0755, Mtime: now}},
+		{name: "empty", file: &File{Mode: S_IFREG | 0644}},
+		{name: "small", file: &File{Mode: S_IFREG | 0600, Uid: 100000, Gid: 200000, Mtime: now}, data: []byte("hello\n")},
+		{name: "dir", file: &File{Mode: S_IFDIR | 0711}},
+		{name: "dir/large", file: &File{Mode: S_IFREG | 0644}, data: large},
+		{name: "dir/fastlink", file: &File{Mode: S_IFLNK | 0777, Linkname: "../small"}},
+		{name: "dir/slowlink", file: &File{Mode: S_IFLNK | 0777, Linkname: longTarget}},
+		{name: "dir/hardlink", link: "small"},
+		{name: "chr", file: &File{Mode: S_IFCHR | 0666, Devmajor: 1, Devminor: 3}},
+		{name: "blk", file: &File{Mode: S_IFBLK | 0660, Devmajor: 259, Devminor: 65536}},
+		{name: "fifo", file: &File{Mode: S_IFIFO | 0644}},
+		{name: "replaced", file: &File{Mode: S_IFREG | 0644}, data: []byte("old")},
+		{name: "replaced", file: &File{Mode: S_IFDIR | 0755}},
+		{name: "replaced/child", file: &File{Mode: S_IFREG | 0644}, data: []byte("new")},
+	}
+	image := writeImage(t, files)
+	defer os.Remove(image)
+	fsck(t, image)
+
+	if b := catFile(t, image, "small"); string(b) != "hello\n" {
+		t.Errorf("small has %q", b)
+	}
+	if b := catFile(t, image, "dir/large"); !bytes.Equal(b, large) {
+		t.Errorf("dir/large has the wrong data")
+	}
+	if b := catFile(t, image, "replaced/child"); string(b) != "new" {
+		t.Errorf("replaced/child has %q", b)
+	}
+	stat := debugfs(t, image, "stat small")
+	for _, s := range []string{"User: 100000", "Group: 200000", "Links: 2", "Mode:  0600"} {
+		if !strings.Contains(stat, s) {
+			t.Errorf("stat small does not contain %q:\n%s", s, stat)
+		}
+	}
+	if stat := debugfs(t, image, "stat dir/slowlink"); !strings.Contains(stat, "Size: 200") {
+		t.Errorf("dir/slowlink has the wrong size:\n%s", stat)
+	}
+	if out := debugfs(t, image, "stat dir/fastlink"); !strings.Contains(out, `Fast link dest: "../small"`) {
+		t.Errorf("dir/fastlink has the wrong target:\n%s", out)
+	}
+	if b := catFile(t, image, "dir/slowlink"); string(b) != longTarget {
+		t.Errorf("dir/slowlink has the wrong target %q", b)
+	}
+	if stat := debugfs(t, image, "stat blk"); !strings.Contains(stat, "Device major/minor number: 259:65536") {
+		t.Errorf("blk has the wrong device number:\n%s", stat)
+	}
+}
+
+func TestWriterExtentTree(t *testing.T) {
+	defer func(n int) { maxBlocksPerExtent = n }(maxBlocksPerExtent)
+	maxBlocksPerExtent = 1
+	data := bytes.Repeat([]byte{0xa5}, BlockSize*10+1)
+	image := writeImage(t, []testFile{
+		{name: "file", file: &File{Mode: S_IFREG | 0644}, data: data},
+	})
+	defer os.Remove(image)
+	fsck(t, image)
+	if b := catFile(t, image, "file"); !bytes.Equal(b, data) {
+		t.Errorf("file has the wrong data")
+	}
+}
+
+func TestWriterXattrs(t *testing.T) {
+	acl := []byte{2, 0, 0, 0, 1, 0, 6, 0, 0xff, 0xff, 0xff, 0xff, 2, 0, 4, 0, 0xe8, 3, 0, 0, 4, 0, 4, 0, 0xff, 0xff, 0xff, 0xff, 0x10, 0, 4, 0, 0xff, 0xff, 0xff, 0xff, 0x20, 0, 4, 0, 0xff, 0xff, 0xff, 0xff}
+	image := writeImage(t, []testFile{
+		{name: "inline", file: &File{Mode: S_IFREG | 0644, Xattrs: map[string][]byte{
+			"trusted.overlay.opaque":  []byte("y"),
+			"system.posix_acl_access": acl,
+		}}},
+		{name: "block", file: &File{Mode: S_IFDIR | 0755, Xattrs: map[string][]byte{
+			"user.large":     bytes.Repeat([]byte("v"), 1000),
+			"security.label": []byte("x"),
+		}}},
+	})
+	defer os.Remove(image)
+	fsck(t, image)
+	if out := debugfs(t, image, "ea_get inline trusted.overlay.opaque"); !strings.Contains(out, "y") {
+		t.Errorf("trusted.overlay.opaque is missing:\n%s", out)
+	}
+	if out := debugfs(t, image, "ea_get block user.large"); !strings.Contains(out, strings.Repeat("v", 100)) {
+		t.Errorf("user.large is missing:\n%s", out)
+	}
+	if stat := debugfs(t, image, "stat block"); !regexp.MustCompile(`File ACL: [1-9]`).MatchString(stat) {
+		t.Errorf("block has no extended attribute block:\n%s", stat)
+	}
+	if stat := debugfs(t, image, "stat inline"); !strings.Contains(stat, "File ACL: 0") {
+		t.Errorf("inline has an extended attribute block:\n%s", stat)
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := NewWriter(f)
+	if err := w.Create("missing/file", &File{Mode: S_IFREG | 0644}); err == nil {
+		t.Error("creating a file in a missing directory succeeded")
+	}
+	if err := w.Create("file", &File{Mode: S_IFREG | 0644, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err == nil {
+		t.Error("writing more than the file size succeeded")
+	}
+	if err := w.Link("file", "dir/link"); err == nil {
+		t.Error("linking into a missing directory succeeded")
+	}
+	if err := w.Create("other", &File{Mode: S_IFREG | 0644}); err == nil {
+		t.Error("creating a file after a short write succeeded")
+	}
+}
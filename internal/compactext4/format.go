@@ -0,0 +1,285 @@
+package compactext4
+
+// On-disk structures and constants of the ext4 format. See
+// https://ext4.wiki.kernel.org/index.php/Ext4_Disk_Layout. Only the subset used
+// by this package is described.
+
+const (
+	superblockOffset = 1024
+	superblockMagic  = 0xef53
+
+	inodeSize      = 256
+	inodeExtraSize = 24 // Extra inode fields in use, up to and including i_crtime_extra
+
+	inodeFirst      = 11 // The first non-reserved inode, used for lost+found
+	inodeRoot       = 2
+	inodeLostFound  = inodeFirst
+	groupDescSize   = 32
+	maxLinks        = 65000
+	maxNameLength   = 255
+	fastSymlinkSize = 60 // Symlink targets shorter than this are stored in the inode
+
+	extentHeaderMagic = 0xf30a
+	inodeExtentCount  = 4 // Extents or extent indexes in the i_block of an inode
+
+	xattrMagic       = 0xea020000
+	xattrHeaderSize  = 32
+	xattrEntrySize   = 16
+	inodeXattrOffset = 128 + inodeExtraSize
+)
+
+// Feature flags.
+const (
+	compatExtAttr      = 0x8
+	compatSparseSuper2 = 0x200
+
+	incompatFiletype = 0x2
+	incompatExtents  = 0x40
+	incompatFlexBg   = 0x200
+
+	roCompatLargeFile  = 0x2
+	roCompatHugeFile   = 0x8
+	roCompatDirNlink   = 0x20
+	roCompatExtraIsize = 0x40
+)
+
+// Inode flags.
+const (
+	inodeFlagHugeFile = 0x40000
+	inodeFlagExtents  = 0x80000
+)
+
+// Inode modes.
+const (
+	S_IXOTH  = 0x1
+	S_IWOTH  = 0x2
+	S_IROTH  = 0x4
+	S_IXGRP  = 0x8
+	S_IWGRP  = 0x10
+	S_IRGRP  = 0x20
+	S_IXUSR  = 0x40
+	S_IWUSR  = 0x80
+	S_IRUSR  = 0x100
+	S_ISVTX  = 0x200
+	S_ISGID  = 0x400
+	S_ISUID  = 0x800
+	S_IFIFO  = 0x1000
+	S_IFCHR  = 0x2000
+	S_IFDIR  = 0x4000
+	S_IFBLK  = 0x6000
+	S_IFREG  = 0x8000
+	S_IFLNK  = 0xa000
+	S_IFSOCK = 0xc000
+
+	TypeMask = 0xf000
+)
+
+// Directory entry file types.
+const (
+	fileTypeUnknown   = 0
+	fileTypeRegular   = 1
+	fileTypeDirectory = 2
+	fileTypeCharacter = 3
+	fileTypeBlock     = 4
+	fileTypeFIFO      = 5
+	fileTypeSocket    = 6
+	fileTypeSymlink   = 7
+)
+
+// superBlock is the ext4 superblock, as written at offset 1024.
+type superBlock struct {
+	InodesCount          uint32
+	BlocksCountLow       uint32
+	RootBlocksCountLow   uint32
+	FreeBlocksCountLow   uint32
+	FreeInodesCount      uint32
+	FirstDataBlock       uint32
+	LogBlockSize         uint32
+	LogClusterSize       uint32
+	BlocksPerGroup       uint32
+	ClustersPerGroup     uint32
+	InodesPerGroup       uint32
+	Mtime                uint32
+	Wtime                uint32
+	MountCount           uint16
+	MaxMountCount        uint16
+	Magic                uint16
+	State                uint16
+	Errors               uint16
+	MinorRevisionLevel   uint16
+	LastCheck            uint32
+	CheckInterval        uint32
+	CreatorOS            uint32
+	RevisionLevel        uint32
+	DefaultReservedUid   uint16
+	DefaultReservedGid   uint16
+	FirstInode           uint32
+	InodeSize            uint16
+	BlockGroupNr         uint16
+	FeatureCompat        uint32
+	FeatureIncompat      uint32
+	FeatureRoCompat      uint32
+	UUID                 [16]uint8
+	VolumeName           [16]byte
+	LastMounted          [64]byte
+	AlgorithmUsageBitmap uint32
+	PreallocBlocks       uint8
+	PreallocDirBlocks    uint8
+	ReservedGdtBlocks    uint16
+	JournalUUID          [16]uint8
+	JournalInum          uint32
+	JournalDev           uint32
+	LastOrphan           uint32
+	HashSeed             [4]uint32
+	DefHashVersion       uint8
+	JournalBackupType    uint8
+	DescSize             uint16
+	DefaultMountOpts     uint32
+	FirstMetaBg          uint32
+	MkfsTime             uint32
+	JournalBlocks        [17]uint32
+	BlocksCountHigh      uint32
+	RBlocksCountHigh     uint32
+	FreeBlocksCountHigh  uint32
+	MinExtraIsize        uint16
+	WantExtraIsize       uint16
+	Flags                uint32
+	RaidStride           uint16
+	MmpInterval          uint16
+	MmpBlock             uint64
+	RaidStripeWidth      uint32
+	LogGroupsPerFlex     uint8
+	ChecksumType         uint8
+	ReservedPad          uint16
+	KbytesWritten        uint64
+	SnapshotInum         uint32
+	SnapshotID           uint32
+	SnapshotRBlocksCount uint64
+	SnapshotList         uint32
+	ErrorCount           uint32
+	FirstErrorTime       uint32
+	FirstErrorInode      uint32
+	FirstErrorBlock      uint64
+	FirstErrorFunc       [32]uint8
+	FirstErrorLine       uint32
+	LastErrorTime        uint32
+	LastErrorInode       uint32
+	LastErrorLine        uint32
+	LastErrorBlock       uint64
+	LastErrorFunc        [32]uint8
+	MountOpts            [64]uint8
+	UserQuotaInum        uint32
+	GroupQuotaInum       uint32
+	OverheadBlocks       uint32
+	BackupBgs            [2]uint32
+	EncryptAlgorithms    [4]uint8
+	EncryptPwSalt        [16]uint8
+	LpfInode             uint32
+	ProjectQuotaInum     uint32
+	ChecksumSeed         uint32
+	WtimeHigh            uint8
+	MtimeHigh            uint8
+	MkfsTimeHigh         uint8
+	LastcheckHigh        uint8
+	FirstErrorTimeHigh   uint8
+	LastErrorTimeHigh    uint8
+	Pad                  [2]uint8
+	Reserved             [96]uint32
+	Checksum             uint32
+}
+
+// groupDescriptor is a 32-byte block group descriptor.
+type groupDescriptor struct {
+	BlockBitmapLow     uint32
+	InodeBitmapLow     uint32
+	InodeTableLow      uint32
+	FreeBlocksCountLow uint16
+	FreeInodesCountLow uint16
+	UsedDirsCountLow   uint16
+	Flags              uint16
+	ExcludeBitmapLow   uint32
+	BlockBitmapCsumLow uint16
+	InodeBitmapCsumLow uint16
+	ItableUnusedLow    uint16
+	Checksum           uint16
+}
+
+// inodeRecord is the on-disk inode, including the extra fields.
+type inodeRecord struct {
+	Mode                 uint16
+	Uid                  uint16
+	SizeLow              uint32
+	Atime                uint32
+	Ctime                uint32
+	Mtime                uint32
+	Dtime                uint32
+	Gid                  uint16
+	LinksCount           uint16
+	BlocksLow            uint32
+	Flags                uint32
+	Version              uint32
+	Block                [60]byte
+	Generation           uint32
+	XattrBlockLow        uint32
+	SizeHigh             uint32
+	ObsoleteFragmentAddr uint32
+	BlocksHigh           uint16
+	XattrBlockHigh       uint16
+	UidHigh              uint16
+	GidHigh              uint16
+	ChecksumLow          uint16
+	Reserved             uint16
+	ExtraIsize           uint16
+	ChecksumHigh         uint16
+	CtimeExtra           uint32
+	MtimeExtra           uint32
+	AtimeExtra           uint32
+	Crtime               uint32
+	CrtimeExtra          uint32
+}
+
+// extentHeader starts the i_block of an inode using extents, and each block of
+// the extent tree.
+type extentHeader struct {
+	Magic      uint16
+	Entries    uint16
+	Max        uint16
+	Depth      uint16
+	Generation uint32
+}
+
+// extentIndex points to a block of the next level of the extent tree.
+type extentIndex struct {
+	Block    uint32
+	LeafLow  uint32
+	LeafHigh uint16
+	Unused   uint16
+}
+
+// extentLeaf maps a run of logical blocks to physical blocks.
+type extentLeaf struct {
+	Block     uint32
+	Length    uint16
+	StartHigh uint16
+	StartLow  uint32
+}
+
+// xattrHeader starts an extended attribute block.
+type xattrHeader struct {
+	Magic          uint32
+	ReferenceCount uint32
+	Blocks         uint32
+	Hash           uint32
+	Checksum       uint32
+	Reserved       [3]uint32
+}
+
+// xattrEntry describes an extended attribute, in an inode or a block.
+type xattrEntry struct {
+	NameLength  uint8
+	NameIndex   uint8
+	ValueOffset uint16
+	ValueInum   uint32
+	ValueSize   uint32
+	Hash        uint32
+}
@@ -0,0 +1,204 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// xattrPrefixes maps the prefixes of extended attribute names to the name
+// indexes stored on disk. Names matching none are stored whole with index 0.
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{2, "system.posix_acl_access"},
+	{3, "system.posix_acl_default"},
+	{1, "user."},
+	{4, "trusted."},
+	{6, "security."},
+	{7, "system."},
+}
+
+// xattr is an extended attribute as stored on disk.
+type xattr struct {
+	index uint8
+	name  string // Without the prefix of the index
+	value []byte
+}
+
+func (x *xattr) entrySize() int {
+	return align4(xattrEntrySize + len(x.name))
+}
+
+func (x *xattr) valueSize() int {
+	return align4(len(x.value))
+}
+
+// hash is the hash of an extended attribute entry, computed from its name and
+// value.
+func (x *xattr) hash() uint32 {
+	var h uint32
+	for i := 0; i < len(x.name); i++ {
+		h = (h << 5) ^ (h >> 27) ^ uint32(int8(x.name[i]))
+	}
+	value := make([]byte, x.valueSize())
+	copy(value, x.value)
+	for i := 0; i < len(value); i += 4 {
+		h = (h << 16) ^ (h >> 16) ^ binary.LittleEndian.Uint32(value[i:])
+	}
+	return h
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// newXattrs converts extended attributes to their on-disk form, sorted in the
+// order the kernel expects within a block.
+func newXattrs(xattrs map[string][]byte) ([]xattr, error) {
+	var xs []xattr
+	for name, value := range xattrs {
+		x := xattr{name: name, value: value}
+		for _, p := range xattrPrefixes {
+			if strings.HasPrefix(name, p.prefix) {
+				x.index = p.index
+				x.name = name[len(p.prefix):]
+				break
+			}
+		}
+		if x.index == 2 || x.index == 3 {
+			if x.name != "" {
+				return nil, fmt.Errorf("unknown extended attribute %s", name)
+			}
+			var err error
+			if x.value, err = convertACL(value); err != nil {
+				return nil, fmt.Errorf("invalid extended attribute %s: %s", name, err)
+			}
+		}
+		if len(x.name) > maxNameLength {
+			return nil, fmt.Errorf("extended attribute name %s is too long", name)
+		}
+		xs = append(xs, x)
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		if xs[i].index != xs[j].index {
+			return xs[i].index < xs[j].index
+		}
+		if len(xs[i].name) != len(xs[j].name) {
+			return len(xs[i].name) < len(xs[j].name)
+		}
+		return xs[i].name < xs[j].name
+	})
+	return xs, nil
+}
+
+// splitXattrs returns how many of the extended attributes fit in the space in an
+// inode; the remainder are stored in a block.
+func splitXattrs(xs []xattr) (int, error) {
+	space := inodeSize - inodeXattrOffset - 4
+	used := 4 // The terminating entry
+	n := 0
+	for ; n < len(xs); n++ {
+		size := xs[n].entrySize() + xs[n].valueSize()
+		if used+size > space {
+			break
+		}
+		used += size
+	}
+	used = xattrHeaderSize + 4
+	for _, x := range xs[n:] {
+		used += x.entrySize() + x.valueSize()
+	}
+	if n < len(xs) && used > BlockSize {
+		return 0, fmt.Errorf("extended attributes are too large")
+	}
+	return n, nil
+}
+
+// encodeXattrs writes the entries and values of extended attributes into b.
+// Entries are written from the start of b and values from its end; value
+// offsets are relative to base.
+func encodeXattrs(b []byte, base int, xs []xattr) {
+	offset := len(b)
+	entry := 0
+	for _, x := range xs {
+		offset -= x.valueSize()
+		copy(b[offset:], x.value)
+		e := xattrEntry{
+			NameLength: uint8(len(x.name)),
+			NameIndex:  x.index,
+			ValueSize:  uint32(len(x.value)),
+			Hash:       x.hash(),
+		}
+		if len(x.value) != 0 {
+			e.ValueOffset = uint16(offset + base)
+		}
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &e)
+		buf.WriteString(x.name)
+		copy(b[entry:], buf.Bytes())
+		entry += x.entrySize()
+	}
+}
+
+// inodeXattrs returns the extended attribute region of an inode.
+func inodeXattrs(xs []xattr) []byte {
+	b := make([]byte, inodeSize-inodeXattrOffset)
+	if len(xs) == 0 {
+		return b
+	}
+	binary.LittleEndian.PutUint32(b, xattrMagic)
+	encodeXattrs(b[4:], 0, xs)
+	return b
+}
+
+// xattrBlock returns an extended attribute block.
+func xattrBlock(xs []xattr) []byte {
+	b := make([]byte, BlockSize)
+	encodeXattrs(b[xattrHeaderSize:], xattrHeaderSize, xs)
+	var h uint32
+	for _, x := range xs {
+		h = (h << 16) ^ (h >> 16) ^ x.hash()
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &xattrHeader{
+		Magic:          xattrMagic,
+		ReferenceCount: 1,
+		Blocks:         1,
+		Hash:           h,
+	})
+	copy(b, buf.Bytes())
+	return b
+}
+
+// POSIX ACL tags, and the versions of the format used by the xattr system
+// calls and on disk.
+const (
+	aclUser           = 0x2
+	aclGroup          = 0x8
+	aclXattrVersion   = 2
+	aclExt4Version    = 1
+	aclXattrEntrySize = 8
+)
+
+// convertACL converts a POSIX ACL from the format used by the xattr system
+// calls, as found in tar files, to the format ext4 stores on disk, in which
+// only named user and group entries hold an ID.
+func convertACL(value []byte) ([]byte, error) {
+	if len(value) < 4 || (len(value)-4)%aclXattrEntrySize != 0 || binary.LittleEndian.Uint32(value) != aclXattrVersion {
+		return nil, fmt.Errorf("invalid POSIX ACL")
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(aclExt4Version))
+	for b := value[4:]; len(b) != 0; b = b[aclXattrEntrySize:] {
+		tag := binary.LittleEndian.Uint16(b)
+		buf.Write(b[:4]) // The tag and permissions
+		if tag == aclUser || tag == aclGroup {
+			buf.Write(b[4:8])
+		}
+	}
+	return buf.Bytes(), nil
+}
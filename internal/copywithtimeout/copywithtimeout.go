@@ -1,12 +1,13 @@
 package copywithtimeout
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -29,69 +30,133 @@ func init() {
 	}
 }
 
-// Copy is a wrapper for io.Copy using a timeout duration
-func Copy(dst io.Writer, src io.Reader, size int64, context string, timeout time.Duration) (int64, error) {
-	log := "to EOF"
-	if size > 0 {
-		log = fmt.Sprintf("%d bytes", size)
-	}
-	logrus.Debugf(fmt.Sprintf("hcsshim::copywithtimeout (%s) %s", context, log))
+// Stream is one of the streams copied by CopyStreams, such as a stdio stream of
+// a process.
+type Stream struct {
+	Name string    // Used in logging and errors, such as "stdout"
+	Dst  io.Writer // The destination, which may be a buffer or a streaming consumer such as a pipe
+	Src  io.Reader
+	Size int64 // The maximum number of bytes to copy, or 0 to copy to EOF
 
-	type resultType struct {
-		err   error
-		bytes int64
-	}
+	// Done is optionally called once the stream has been copied successfully,
+	// such as to close the stdin of a process so that it sees EOF.
+	Done func() error
+
+	copied int64 // Accessed atomically
+}
+
+// Copied returns the number of bytes copied so far.
+func (s *Stream) Copied() int64 {
+	return atomic.LoadInt64(&s.copied)
+}
 
-	done := make(chan resultType, 1)
-	go func() {
-		result := resultType{}
-		if logrus.GetLevel() < logrus.DebugLevel || logDataByteCount == 0 {
-			result.bytes, result.err = io.Copy(dst, src)
-		} else {
-			// In advanced debug mode where we log (hexdump format) what is copied
-			// up to the number of bytes defined by environment variable
-			// HCSSHIM_LOG_DATA_BYTE_COUNT
-			var buf bytes.Buffer
-			tee := io.TeeReader(src, &buf)
-			result.bytes, result.err = io.Copy(dst, tee)
-			if result.err == nil {
-				size := result.bytes
-				if size > logDataByteCount {
-					size = logDataByteCount
-				}
-				if size > 0 {
-					bytes := make([]byte, size)
-					if _, err := buf.Read(bytes); err == nil {
-						logrus.Debugf(fmt.Sprintf("hcsshim: copyWithTimeout\n%s", hex.Dump(bytes)))
-					}
-				}
+// progressWriter counts the bytes written to a stream, and records the time of
+// the latest write so that an idle timeout can be detected.
+type progressWriter struct {
+	w        io.Writer
+	s        *Stream
+	activity *int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if logDataByteCount > 0 && logrus.GetLevel() >= logrus.DebugLevel {
+		// In advanced debug mode we log (hexdump format) what is copied up
+		// to the number of bytes defined by environment variable
+		// HCSSHIM_LOG_DATA_BYTE_COUNT
+		if copied := p.s.Copied(); copied < logDataByteCount {
+			dump := b
+			if int64(len(dump)) > logDataByteCount-copied {
+				dump = dump[:logDataByteCount-copied]
 			}
+			logrus.Debugf("hcsshim::CopyStreams (%s)\n%s", p.s.Name, hex.Dump(dump))
 		}
-		done <- result
-	}()
+	}
+	n, err := p.w.Write(b)
+	atomic.AddInt64(&p.s.copied, int64(n))
+	atomic.StoreInt64(p.activity, time.Now().UnixNano())
+	return n, err
+}
+
+// isPipeClosed returns whether err is the error returned by a read from a
+// Windows pipe whose writer has closed it, which is treated as EOF. See
+// https://github.com/golang/go/blob/f3f29d1dea525f48995c1693c609f5e67c046893/src/os/exec/exec_windows.go
+func isPipeClosed(err error) bool {
+	if se, ok := err.(syscall.Errno); ok {
+		const (
+			errNoData     = syscall.Errno(232)
+			errBrokenPipe = syscall.Errno(109)
+		)
+		return se == errNoData || se == errBrokenPipe
+	}
+	return false
+}
 
-	var result resultType
-	timedout := time.After(timeout)
+// CopyStreams copies the streams concurrently, so that a process which writes
+// to one stream while another is not being read cannot deadlock. It returns
+// once every stream has been copied, or as soon as a stream fails, ctx is done,
+// or no data has been copied on any stream for idleTimeout. A zero idleTimeout
+// means no timeout.
+//
+// On failure, copies which are still in progress are not stopped: the caller
+// must unblock them, typically by killing and closing the process whose
+// streams they are. The number of bytes each stream has copied is available
+// from Copied.
+func CopyStreams(ctx context.Context, idleTimeout time.Duration, streams ...*Stream) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	activity := time.Now().UnixNano()
+	done := make(chan error, len(streams))
+	for _, s := range streams {
+		go func(s *Stream) {
+			src := s.Src
+			log := "to EOF"
+			if s.Size > 0 {
+				src = io.LimitReader(src, s.Size)
+				log = fmt.Sprintf("%d bytes", s.Size)
+			}
+			logrus.Debugf("hcsshim::CopyStreams (%s) %s", s.Name, log)
+			_, err := io.Copy(&progressWriter{w: s.Dst, s: s, activity: &activity}, src)
+			if err != nil && isPipeClosed(err) {
+				logrus.Debugf("hcsshim::CopyStreams: hit NoData or BrokenPipe: %s: %s", err, s.Name)
+				err = nil
+			}
+			if err != nil {
+				err = fmt.Errorf("hcsshim::CopyStreams: error copying: '%s' after %d bytes (%s)", err, s.Copied(), s.Name)
+			} else if s.Done != nil {
+				err = s.Done()
+			}
+			if err == nil {
+				logrus.Debugf("hcsshim::CopyStreams: success - copied %d bytes (%s)", s.Copied(), s.Name)
+			}
+			done <- err
+		}(s)
+	}
 
-	select {
-	case <-timedout:
-		return 0, fmt.Errorf("hcsshim::copyWithTimeout: timed out (%s)", context)
-	case result = <-done:
-		if result.err != nil && result.err != io.EOF {
-			// See https://github.com/golang/go/blob/f3f29d1dea525f48995c1693c609f5e67c046893/src/os/exec/exec_windows.go for a clue as to why we are doing this :)
-			if se, ok := result.err.(syscall.Errno); ok {
-				const (
-					errNoData     = syscall.Errno(232)
-					errBrokenPipe = syscall.Errno(109)
-				)
-				if se == errNoData || se == errBrokenPipe {
-					logrus.Debugf("hcsshim::copyWithTimeout: hit NoData or BrokenPipe: %d: %s", se, context)
-					return result.bytes, nil
-				}
+	var idle <-chan time.Time
+	if idleTimeout > 0 {
+		period := idleTimeout / 4
+		if period <= 0 {
+			period = idleTimeout
+		}
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	for remaining := len(streams); remaining > 0; {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			remaining--
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&activity))) >= idleTimeout {
+				return fmt.Errorf("hcsshim::CopyStreams: timed out after %s without data", idleTimeout)
 			}
-			return 0, fmt.Errorf("hcsshim::copyWithTimeout: error reading: '%s' after %d bytes (%s)", result.err, result.bytes, context)
 		}
 	}
-	logrus.Debugf("hcsshim::copyWithTimeout: success - copied %d bytes (%s)", result.bytes, context)
-	return result.bytes, nil
+	return nil
 }
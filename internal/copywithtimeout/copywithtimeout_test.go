@@ -0,0 +1,105 @@
+package copywithtimeout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopyStreamsConcurrent checks a writer filling one stream before
+// another is read does not deadlock, as it would if the streams were copied
+// in turn.
+func TestCopyStreamsConcurrent(t *testing.T) {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+	go func() {
+		stderrW.Write(data)
+		stderrW.Close()
+		stdoutW.Write(data)
+		stdoutW.Close()
+	}()
+
+	var stdout, stderr bytes.Buffer
+	stdoutStream := &Stream{Name: "stdout", Dst: &stdout, Src: stdoutR}
+	stderrStream := &Stream{Name: "stderr", Dst: &stderr, Src: stderrR}
+	if err := CopyStreams(context.Background(), 10*time.Second, stdoutStream, stderrStream); err != nil {
+		t.Fatal(err)
+	}
+	if stdoutStream.Copied() != int64(len(data)) || stderrStream.Copied() != int64(len(data)) {
+		t.Errorf("copied %d and %d bytes", stdoutStream.Copied(), stderrStream.Copied())
+	}
+	if !bytes.Equal(stdout.Bytes(), data) || !bytes.Equal(stderr.Bytes(), data) {
+		t.Error("the data was not copied")
+	}
+}
+
+func TestCopyStreamsSizeAndDone(t *testing.T) {
+	var dst bytes.Buffer
+	done := false
+	s := &Stream{Name: "stdin", Dst: &dst, Src: strings.NewReader("0123456789"), Size: 4, Done: func() error {
+		done = true
+		return nil
+	}}
+	if err := CopyStreams(nil, 0, s); err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != "0123" || s.Copied() != 4 || !done {
+		t.Errorf("copied %q (%d), done %t", dst.String(), s.Copied(), done)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("consumer failed")
+}
+
+func TestCopyStreamsFirstError(t *testing.T) {
+	blocked, _ := io.Pipe()
+	defer blocked.Close()
+	err := CopyStreams(context.Background(), 0,
+		&Stream{Name: "stdout", Dst: &bytes.Buffer{}, Src: blocked},
+		&Stream{Name: "stderr", Dst: failingWriter{}, Src: strings.NewReader("data")},
+	)
+	if err == nil || !strings.Contains(err.Error(), "consumer failed") || !strings.Contains(err.Error(), "stderr") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCopyStreamsIdleTimeout(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	// Data arriving regularly keeps the copy alive beyond the timeout.
+	go func() {
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("x"))
+			time.Sleep(25 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	err := CopyStreams(context.Background(), 100*time.Millisecond, &Stream{Name: "stdout", Dst: &bytes.Buffer{}, Src: r})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("timed out after %s while data was being copied", elapsed)
+	}
+}
+
+func TestCopyStreamsCancel(t *testing.T) {
+	r, _ := io.Pipe()
+	defer r.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := CopyStreams(ctx, 0, &Stream{Name: "stdout", Dst: &bytes.Buffer{}, Src: r}); err != context.Canceled {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Package gcs is a client for the bridge protocol of the guest compute service
+// (GCS) which runs inside a Linux utility VM. It allows the host to create and
+// manage containers and processes in the guest directly, rather than through
+// HCS hosted settings.
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrBridgeClosed is returned for RPCs issued after the bridge has been closed.
+var ErrBridgeClosed = errors.New("bridge closed")
+
+// RPCError is returned when the guest fails an RPC.
+type RPCError struct {
+	Proc         string
+	Result       int32 // HRESULT returned by the guest
+	Message      string
+	ErrorRecords []ErrorRecord
+}
+
+func (e *RPCError) Error() string {
+	msg := e.Message
+	if msg == "" && len(e.ErrorRecords) > 0 {
+		msg = e.ErrorRecords[0].Message
+	}
+	return fmt.Sprintf("guest RPC %s failed with %#x: %s", e.Proc, uint32(e.Result), msg)
+}
+
+// rpcResult is a response, or the error which prevented one arriving.
+type rpcResult struct {
+	body []byte
+	err  error
+}
+
+// bridge multiplexes RPCs over a connection to the guest and dispatches
+// notifications.
+type bridge struct {
+	conn   io.ReadWriteCloser
+	notify func(*ContainerNotification)
+
+	writeLock sync.Mutex
+
+	m       sync.Mutex
+	nextID  int64
+	pending map[int64]chan rpcResult
+	err     error // Set once the read loop has exited
+	closed  bool
+
+	done chan struct{}
+}
+
+func newBridge(conn io.ReadWriteCloser, notify func(*ContainerNotification)) *bridge {
+	return &bridge{
+		conn:    conn,
+		notify:  notify,
+		pending: make(map[int64]chan rpcResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// start starts the read loop. It must be called once before any RPC.
+func (b *bridge) start() {
+	go b.recvLoop()
+}
+
+func (b *bridge) recvLoop() {
+	var err error
+	for {
+		var m *message
+		m, err = readMessage(b.conn)
+		if err != nil {
+			break
+		}
+		switch m.typ & msgTypeMask {
+		case msgTypeResponse:
+			b.m.Lock()
+			ch := b.pending[m.id]
+			delete(b.pending, m.id)
+			b.m.Unlock()
+			if ch == nil {
+				logrus.Warnf("gcs::bridge response %#x for unknown request %d", uint32(m.typ), m.id)
+				continue
+			}
+			ch <- rpcResult{body: m.body}
+
+		case msgTypeNotify:
+			if m.typ != notifyContainer {
+				logrus.Warnf("gcs::bridge ignoring unknown notification %#x", uint32(m.typ))
+				continue
+			}
+			var n ContainerNotification
+			if err := json.Unmarshal(m.body, &n); err != nil {
+				logrus.Warnf("gcs::bridge invalid notification: %s", err)
+				continue
+			}
+			logrus.Debugf("gcs::bridge notification %+v", n)
+			if b.notify != nil {
+				b.notify(&n)
+			}
+
+		default:
+			logrus.Warnf("gcs::bridge ignoring unexpected message %#x", uint32(m.typ))
+		}
+	}
+
+	b.m.Lock()
+	if b.closed || err == io.EOF {
+		err = ErrBridgeClosed
+	} else {
+		err = fmt.Errorf("bridge read failed: %s", err)
+	}
+	b.err = err
+	pending := b.pending
+	b.pending = nil
+	b.m.Unlock()
+	for _, ch := range pending {
+		ch <- rpcResult{err: err}
+	}
+	close(b.done)
+}
+
+// rpc issues a request and waits for the response, which is decoded into
+// resp. An error is returned if the guest fails the request.
+func (b *bridge) rpc(ctx context.Context, proc rpcProc, req interface{}, resp response) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request: %s", proc, err)
+	}
+
+	ch := make(chan rpcResult, 1)
+	b.m.Lock()
+	if b.pending == nil {
+		err := b.err
+		b.m.Unlock()
+		return err
+	}
+	if b.closed {
+		b.m.Unlock()
+		return ErrBridgeClosed
+	}
+	b.nextID++
+	id := b.nextID
+	b.pending[id] = ch
+	b.m.Unlock()
+
+	logrus.Debugf("gcs::bridge rpc %s id:%d %s", proc, id, body)
+	b.writeLock.Lock()
+	err = writeMessage(b.conn, msgTypeRequest|msgType(proc), id, body)
+	b.writeLock.Unlock()
+	if err != nil {
+		b.cancel(id)
+		return fmt.Errorf("failed to send %s request: %s", proc, err)
+	}
+
+	var result rpcResult
+	select {
+	case result = <-ch:
+	case <-ctx.Done():
+		b.cancel(id)
+		return ctx.Err()
+	}
+	if result.err != nil {
+		return result.err
+	}
+
+	if err := json.Unmarshal(result.body, resp); err != nil {
+		return fmt.Errorf("failed to decode %s response: %s", proc, err)
+	}
+	base := resp.base()
+	if base.Result != 0 {
+		return &RPCError{
+			Proc:         proc.String(),
+			Result:       base.Result,
+			Message:      base.ErrorMessage,
+			ErrorRecords: base.ErrorRecords,
+		}
+	}
+	return nil
+}
+
+// cancel forgets a pending request. A response which arrives later is ignored.
+func (b *bridge) cancel(id int64) {
+	b.m.Lock()
+	delete(b.pending, id)
+	b.m.Unlock()
+}
+
+// close closes the connection and waits for the read loop to exit. Pending
+// RPCs fail with ErrBridgeClosed.
+func (b *bridge) close() error {
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		<-b.done
+		return nil
+	}
+	b.closed = true
+	b.m.Unlock()
+	err := b.conn.Close()
+	<-b.done
+	return err
+}
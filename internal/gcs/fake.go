@@ -0,0 +1,334 @@
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HRESULTs returned by the fake guest.
+const (
+	hrInvalidArg int32 = -2147024809 // 0x80070057 E_INVALIDARG
+	hrNotFound   int32 = -2147023728 // 0x80070490 ERROR_NOT_FOUND
+	hrTimeout    int32 = -2147023436 // 0x800705B4 ERROR_TIMEOUT
+)
+
+// FakeGuest is an in-memory implementation of the guest side of the bridge
+// protocol. It serves a single connection, typically one end of a net.Pipe(),
+// so that code using a GuestConnection can be tested without a utility VM.
+//
+// Containers and processes exist only as state in the fake: processes run
+// until they are signalled, their container is shut down, or ExitProcess() is
+// called.
+type FakeGuest struct {
+	conn      io.ReadWriteCloser
+	writeLock sync.Mutex
+
+	m             sync.Mutex
+	containers    map[string]*fakeContainer
+	nextPid       uint32
+	failures      map[string]*RPCError
+	modifications map[string][]json.RawMessage
+
+	done chan struct{}
+}
+
+type fakeContainer struct {
+	config    json.RawMessage
+	started   bool
+	processes map[uint32]*fakeProcess
+}
+
+type fakeProcess struct {
+	params   json.RawMessage
+	exited   chan struct{}
+	exitCode int
+}
+
+// FakeProcessProperties is the properties document returned by the fake guest
+// for a container.
+type FakeProcessProperties struct {
+	ProcessList []FakeProcessListItem
+}
+
+// FakeProcessListItem describes a running process in a container.
+type FakeProcessListItem struct {
+	ProcessID uint32 `json:"ProcessId"`
+}
+
+// NewFakeGuest starts serving the bridge protocol on conn. Close() must be
+// called to stop it.
+func NewFakeGuest(conn io.ReadWriteCloser) *FakeGuest {
+	g := &FakeGuest{
+		conn:          conn,
+		containers:    make(map[string]*fakeContainer),
+		failures:      make(map[string]*RPCError),
+		modifications: make(map[string][]json.RawMessage),
+		done:          make(chan struct{}),
+	}
+	go g.serve()
+	return g
+}
+
+// AddContainer adds a container which already exists and is started, such as
+// the utility VM itself.
+func (g *FakeGuest) AddContainer(cid string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.containers[cid] = &fakeContainer{started: true, processes: make(map[uint32]*fakeProcess)}
+}
+
+// Fail causes the next RPC named proc, eg "ExecuteProcess", to fail with
+// result and message.
+func (g *FakeGuest) Fail(proc string, result int32, message string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.failures[proc] = &RPCError{Proc: proc, Result: result, Message: message}
+}
+
+// ExitProcess causes a process to exit with exitCode.
+func (g *FakeGuest) ExitProcess(cid string, pid uint32, exitCode int) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	p := g.process(cid, pid)
+	if p == nil {
+		return fmt.Errorf("process %d not found in container %s", pid, cid)
+	}
+	p.exit(exitCode)
+	return nil
+}
+
+// Modifications returns the modification requests received for a container.
+func (g *FakeGuest) Modifications(cid string) []json.RawMessage {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return append([]json.RawMessage(nil), g.modifications[cid]...)
+}
+
+// Notify sends a container notification to the host.
+func (g *FakeGuest) Notify(n *ContainerNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+	return writeMessage(g.conn, notifyContainer, 0, body)
+}
+
+// Close closes the connection and waits for the fake to stop serving.
+func (g *FakeGuest) Close() error {
+	err := g.conn.Close()
+	<-g.done
+	return err
+}
+
+func (g *FakeGuest) serve() {
+	defer close(g.done)
+	for {
+		m, err := readMessage(g.conn)
+		if err != nil {
+			return
+		}
+		if m.typ&msgTypeMask != msgTypeRequest {
+			continue
+		}
+		// Handle each request concurrently, as a real guest does, so that
+		// WaitForProcess does not block other requests.
+		go g.handle(m)
+	}
+}
+
+func (g *FakeGuest) handle(m *message) {
+	proc := rpcProc(m.typ &^ msgTypeMask)
+	var base requestBase
+	resp, err := func() (interface{}, *RPCError) {
+		if err := json.Unmarshal(m.body, &base); err != nil {
+			return nil, &RPCError{Result: hrInvalidArg, Message: err.Error()}
+		}
+		g.m.Lock()
+		failure := g.failures[proc.String()]
+		delete(g.failures, proc.String())
+		g.m.Unlock()
+		if failure != nil {
+			return nil, failure
+		}
+		return g.dispatch(proc, base.ContainerID, m.body)
+	}()
+
+	var body []byte
+	if err != nil {
+		body, _ = json.Marshal(&responseBase{Result: err.Result, ErrorMessage: err.Message, ActivityID: base.ActivityID})
+	} else {
+		body, _ = json.Marshal(resp)
+	}
+	g.writeLock.Lock()
+	writeMessage(g.conn, msgTypeResponse|msgType(proc), m.id, body)
+	g.writeLock.Unlock()
+
+	if err == nil && (proc == rpcShutdownGraceful || proc == rpcShutdownForced) {
+		typ := "GracefulExit"
+		if proc == rpcShutdownForced {
+			typ = "ForcedExit"
+		}
+		g.Notify(&ContainerNotification{ContainerID: base.ContainerID, Type: typ, Operation: "None"})
+	}
+}
+
+func (g *FakeGuest) dispatch(proc rpcProc, cid string, body []byte) (interface{}, *RPCError) {
+	switch proc {
+	case rpcNegotiateProtocol:
+		var req negotiateProtocolRequest
+		json.Unmarshal(body, &req)
+		if req.MinimumVersion > protocolVersion || req.MaximumVersion < protocolVersion {
+			return nil, &RPCError{Result: hrInvalidArg, Message: "unsupported protocol version"}
+		}
+		return &negotiateProtocolResponse{
+			Version:      protocolVersion,
+			Capabilities: GuestCapabilities{SendHostCreateMessage: true, SendHostStartMessage: true, RuntimeOsType: "linux"},
+		}, nil
+
+	case rpcCreate:
+		var req containerCreate
+		json.Unmarshal(body, &req)
+		g.m.Lock()
+		defer g.m.Unlock()
+		if _, ok := g.containers[cid]; ok {
+			return nil, &RPCError{Result: hrInvalidArg, Message: "container " + cid + " already exists"}
+		}
+		g.containers[cid] = &fakeContainer{config: json.RawMessage(req.ContainerConfig), processes: make(map[uint32]*fakeProcess)}
+		return &responseBase{}, nil
+
+	case rpcStart:
+		g.m.Lock()
+		defer g.m.Unlock()
+		c := g.containers[cid]
+		if c == nil {
+			return nil, notFound("container " + cid)
+		}
+		c.started = true
+		return &responseBase{}, nil
+
+	case rpcShutdownGraceful, rpcShutdownForced:
+		g.m.Lock()
+		defer g.m.Unlock()
+		c := g.containers[cid]
+		if c == nil {
+			return nil, notFound("container " + cid)
+		}
+		for _, p := range c.processes {
+			p.exit(137)
+		}
+		delete(g.containers, cid)
+		return &responseBase{}, nil
+
+	case rpcExecuteProcess:
+		var req containerExecuteProcess
+		json.Unmarshal(body, &req)
+		g.m.Lock()
+		defer g.m.Unlock()
+		c := g.containers[cid]
+		if c == nil {
+			return nil, notFound("container " + cid)
+		}
+		g.nextPid++
+		c.processes[g.nextPid] = &fakeProcess{
+			params: json.RawMessage(req.Settings.ProcessParameters),
+			exited: make(chan struct{}),
+		}
+		return &containerExecuteProcessResponse{ProcessID: g.nextPid}, nil
+
+	case rpcSignalProcess:
+		var req containerSignalProcess
+		json.Unmarshal(body, &req)
+		g.m.Lock()
+		defer g.m.Unlock()
+		p := g.process(cid, req.ProcessID)
+		if p == nil {
+			return nil, notFound(fmt.Sprintf("process %d", req.ProcessID))
+		}
+		p.exit(128 + req.Options.Signal)
+		return &responseBase{}, nil
+
+	case rpcWaitForProcess:
+		var req containerWaitForProcess
+		json.Unmarshal(body, &req)
+		g.m.Lock()
+		p := g.process(cid, req.ProcessID)
+		g.m.Unlock()
+		if p == nil {
+			return nil, notFound(fmt.Sprintf("process %d", req.ProcessID))
+		}
+		var timeout <-chan time.Time
+		if req.TimeoutInMs != 0xffffffff {
+			timeout = time.After(time.Duration(req.TimeoutInMs) * time.Millisecond)
+		}
+		select {
+		case <-p.exited:
+		case <-timeout:
+			return nil, &RPCError{Result: hrTimeout, Message: "timed out waiting for process"}
+		}
+		g.m.Lock()
+		defer g.m.Unlock()
+		return &containerWaitForProcessResponse{ExitCode: uint32(p.exitCode)}, nil
+
+	case rpcGetProperties:
+		g.m.Lock()
+		defer g.m.Unlock()
+		c := g.containers[cid]
+		if c == nil {
+			return nil, notFound("container " + cid)
+		}
+		var props FakeProcessProperties
+		for pid, p := range c.processes {
+			select {
+			case <-p.exited:
+			default:
+				props.ProcessList = append(props.ProcessList, FakeProcessListItem{ProcessID: pid})
+			}
+		}
+		sort.Slice(props.ProcessList, func(i, j int) bool { return props.ProcessList[i].ProcessID < props.ProcessList[j].ProcessID })
+		propsj, _ := json.Marshal(&props)
+		return &containerGetPropertiesResponse{Properties: string(propsj)}, nil
+
+	case rpcModifySettings:
+		var req struct {
+			Request json.RawMessage
+		}
+		json.Unmarshal(body, &req)
+		g.m.Lock()
+		defer g.m.Unlock()
+		if _, ok := g.containers[cid]; !ok {
+			return nil, notFound("container " + cid)
+		}
+		g.modifications[cid] = append(g.modifications[cid], req.Request)
+		return &responseBase{}, nil
+	}
+	return nil, &RPCError{Result: hrInvalidArg, Message: "unsupported RPC " + proc.String()}
+}
+
+// process finds a process. The lock must be held.
+func (g *FakeGuest) process(cid string, pid uint32) *fakeProcess {
+	c := g.containers[cid]
+	if c == nil {
+		return nil
+	}
+	return c.processes[pid]
+}
+
+// exit marks the process exited. The lock must be held.
+func (p *fakeProcess) exit(exitCode int) {
+	select {
+	case <-p.exited:
+	default:
+		p.exitCode = exitCode
+		close(p.exited)
+	}
+}
+
+func notFound(what string) *RPCError {
+	return &RPCError{Result: hrNotFound, Message: what + " not found"}
+}
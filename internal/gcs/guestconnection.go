@@ -0,0 +1,196 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GuestConnectionConfig is the configuration for Connect().
+type GuestConnectionConfig struct {
+	// Notify is called for each container notification from the guest. It is
+	// called on the connection's read goroutine, so it must not block or issue
+	// RPCs on the same connection.
+	Notify func(*ContainerNotification)
+}
+
+// GuestConnection is a connection to the GCS in a Linux utility VM.
+type GuestConnection struct {
+	b            *bridge
+	version      uint32
+	capabilities GuestCapabilities
+}
+
+// Connect negotiates the bridge protocol over conn, which is typically an
+// hvsocket connection to the utility VM, and returns a connection on which
+// RPCs can be issued. The connection takes ownership of conn.
+func Connect(ctx context.Context, conn io.ReadWriteCloser, config *GuestConnectionConfig) (*GuestConnection, error) {
+	if config == nil {
+		config = &GuestConnectionConfig{}
+	}
+	gc := &GuestConnection{b: newBridge(conn, config.Notify)}
+	gc.b.start()
+
+	req := negotiateProtocolRequest{
+		MinimumVersion: protocolVersion,
+		MaximumVersion: protocolVersion,
+	}
+	var resp negotiateProtocolResponse
+	if err := gc.b.rpc(ctx, rpcNegotiateProtocol, &req, &resp); err != nil {
+		gc.b.close()
+		return nil, fmt.Errorf("failed to negotiate bridge protocol: %s", err)
+	}
+	if resp.Version != protocolVersion {
+		gc.b.close()
+		return nil, fmt.Errorf("guest negotiated unsupported bridge protocol version %d", resp.Version)
+	}
+	gc.version = resp.Version
+	gc.capabilities = resp.Capabilities
+	logrus.Debugf("gcs::Connect protocol version %d capabilities %+v", gc.version, gc.capabilities)
+	return gc, nil
+}
+
+// Capabilities returns the capabilities reported by the guest.
+func (gc *GuestConnection) Capabilities() GuestCapabilities {
+	return gc.capabilities
+}
+
+// CreateContainer creates a container in the guest. config is the container
+// configuration, either already JSON encoded or a value to encode.
+func (gc *GuestConnection) CreateContainer(ctx context.Context, cid string, config interface{}) error {
+	configj, err := encodeJSONString(config)
+	if err != nil {
+		return err
+	}
+	req := containerCreate{
+		requestBase:     requestBase{ContainerID: cid},
+		ContainerConfig: configj,
+	}
+	var resp responseBase
+	return gc.b.rpc(ctx, rpcCreate, &req, &resp)
+}
+
+// StartContainer starts a container previously created in the guest.
+func (gc *GuestConnection) StartContainer(ctx context.Context, cid string) error {
+	req := requestBase{ContainerID: cid}
+	var resp responseBase
+	return gc.b.rpc(ctx, rpcStart, &req, &resp)
+}
+
+// ShutdownContainer shuts down a container in the guest. If force is set the
+// container is terminated rather than asked to shut down.
+func (gc *GuestConnection) ShutdownContainer(ctx context.Context, cid string, force bool) error {
+	proc := rpcShutdownGraceful
+	if force {
+		proc = rpcShutdownForced
+	}
+	req := containerShutdown{requestBase: requestBase{ContainerID: cid}}
+	var resp responseBase
+	return gc.b.rpc(ctx, proc, &req, &resp)
+}
+
+// ExecProcess starts a process in a container, or in the utility VM itself if
+// cid is the ID of the utility VM. params are the process parameters, either
+// already JSON encoded or a value to encode. stdio optionally describes the
+// vsock ports the guest connects the process's standard handles to. It returns
+// the process ID in the guest.
+func (gc *GuestConnection) ExecProcess(ctx context.Context, cid string, params interface{}, stdio *VsockStdioRelaySettings) (uint32, error) {
+	paramsj, err := encodeJSONString(params)
+	if err != nil {
+		return 0, err
+	}
+	req := containerExecuteProcess{
+		requestBase: requestBase{ContainerID: cid},
+		Settings: executeProcessSettings{
+			ProcessParameters:       paramsj,
+			VsockStdioRelaySettings: stdio,
+		},
+	}
+	var resp containerExecuteProcessResponse
+	if err := gc.b.rpc(ctx, rpcExecuteProcess, &req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ProcessID, nil
+}
+
+// SignalProcess sends a signal to a process in the guest.
+func (gc *GuestConnection) SignalProcess(ctx context.Context, cid string, pid uint32, signal int) error {
+	req := containerSignalProcess{
+		requestBase: requestBase{ContainerID: cid},
+		ProcessID:   pid,
+		Options:     signalProcessOptions{Signal: signal},
+	}
+	var resp responseBase
+	return gc.b.rpc(ctx, rpcSignalProcess, &req, &resp)
+}
+
+// WaitProcess waits for a process in the guest to exit and returns its exit
+// code. A zero timeout waits indefinitely.
+func (gc *GuestConnection) WaitProcess(ctx context.Context, cid string, pid uint32, timeout time.Duration) (int, error) {
+	req := containerWaitForProcess{
+		requestBase: requestBase{ContainerID: cid},
+		ProcessID:   pid,
+		TimeoutInMs: 0xffffffff,
+	}
+	if timeout > 0 {
+		req.TimeoutInMs = uint32(timeout / time.Millisecond)
+	}
+	var resp containerWaitForProcessResponse
+	if err := gc.b.rpc(ctx, rpcWaitForProcess, &req, &resp); err != nil {
+		return -1, err
+	}
+	return int(int32(resp.ExitCode)), nil
+}
+
+// Modify sends a modification request, such as adding a mapped disk, to a
+// container or to the utility VM itself.
+func (gc *GuestConnection) Modify(ctx context.Context, cid string, request interface{}) error {
+	req := containerModifySettings{
+		requestBase: requestBase{ContainerID: cid},
+		Request:     request,
+	}
+	var resp responseBase
+	return gc.b.rpc(ctx, rpcModifySettings, &req, &resp)
+}
+
+// Properties queries the properties of a container, such as its process list
+// or statistics. The JSON encoded result is decoded into v.
+func (gc *GuestConnection) Properties(ctx context.Context, cid string, query interface{}, v interface{}) error {
+	queryj, err := encodeJSONString(query)
+	if err != nil {
+		return err
+	}
+	req := containerGetProperties{
+		requestBase: requestBase{ContainerID: cid},
+		Query:       queryj,
+	}
+	var resp containerGetPropertiesResponse
+	if err := gc.b.rpc(ctx, rpcGetProperties, &req, &resp); err != nil {
+		return err
+	}
+	if resp.Properties == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(resp.Properties), v); err != nil {
+		return fmt.Errorf("failed to decode properties of %s: %s", cid, err)
+	}
+	return nil
+}
+
+// Close closes the connection. Outstanding RPCs fail with ErrBridgeClosed.
+func (gc *GuestConnection) Close() error {
+	return gc.b.close()
+}
+
+// Wait waits for the connection to be closed, either by Close() or because the
+// guest disconnected, and returns the reason.
+func (gc *GuestConnection) Wait() error {
+	<-gc.b.done
+	gc.b.m.Lock()
+	defer gc.b.m.Unlock()
+	return gc.b.err
+}
@@ -0,0 +1,208 @@
+package gcs
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func connectFake(t *testing.T, config *GuestConnectionConfig) (*GuestConnection, *FakeGuest) {
+	host, guest := net.Pipe()
+	g := NewFakeGuest(guest)
+	gc, err := Connect(context.Background(), host, config)
+	if err != nil {
+		g.Close()
+		t.Fatal(err)
+	}
+	return gc, g
+}
+
+func TestGuestConnectionLifecycle(t *testing.T) {
+	notifications := make(chan *ContainerNotification, 1)
+	gc, g := connectFake(t, &GuestConnectionConfig{
+		Notify: func(n *ContainerNotification) { notifications <- n },
+	})
+	defer g.Close()
+	defer gc.Close()
+	ctx := context.Background()
+
+	if gc.Capabilities().RuntimeOsType != "linux" {
+		t.Fatalf("unexpected capabilities %+v", gc.Capabilities())
+	}
+	if err := gc.CreateContainer(ctx, "c1", map[string]string{"Hostname": "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.StartContainer(ctx, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := gc.ExecProcess(ctx, "c1", map[string]interface{}{"CommandLine": "sleep 100"}, &VsockStdioRelaySettings{StdOut: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var props FakeProcessProperties
+	if err := gc.Properties(ctx, "c1", map[string][]string{"PropertyTypes": {"ProcessList"}}, &props); err != nil {
+		t.Fatal(err)
+	}
+	if len(props.ProcessList) != 1 || props.ProcessList[0].ProcessID != pid {
+		t.Fatalf("unexpected properties %+v", props)
+	}
+
+	// Wait times out while the process is running
+	if _, err := gc.WaitProcess(ctx, "c1", pid, 10*time.Millisecond); err == nil {
+		t.Fatal("expected wait to time out")
+	} else if rerr, ok := err.(*RPCError); !ok || rerr.Result != hrTimeout {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := gc.SignalProcess(ctx, "c1", pid, 15); err != nil {
+		t.Fatal(err)
+	}
+	exitCode, err := gc.WaitProcess(ctx, "c1", pid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 143 {
+		t.Fatalf("expected exit code 143 got %d", exitCode)
+	}
+
+	if err := gc.Modify(ctx, "c1", map[string]string{"ResourceType": "MappedVirtualDisk"}); err != nil {
+		t.Fatal(err)
+	}
+	if mods := g.Modifications("c1"); len(mods) != 1 || string(mods[0]) != `{"ResourceType":"MappedVirtualDisk"}` {
+		t.Fatalf("unexpected modifications %s", mods)
+	}
+
+	if err := gc.ShutdownContainer(ctx, "c1", true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if n.ContainerID != "c1" || n.Type != "ForcedExit" {
+			t.Fatalf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+}
+
+func TestGuestConnectionErrors(t *testing.T) {
+	gc, g := connectFake(t, nil)
+	defer g.Close()
+	defer gc.Close()
+	ctx := context.Background()
+
+	_, err := gc.ExecProcess(ctx, "missing", "{}", nil)
+	if rerr, ok := err.(*RPCError); !ok || rerr.Result != hrNotFound || rerr.Proc != "ExecuteProcess" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	g.AddContainer("uvm")
+	g.Fail("ExecuteProcess", hrInvalidArg, "injected")
+	if _, err := gc.ExecProcess(ctx, "uvm", "{}", nil); err == nil {
+		t.Fatal("expected injected failure")
+	}
+	if _, err := gc.ExecProcess(ctx, "uvm", "{}", nil); err != nil {
+		t.Fatalf("failure should only be injected once: %s", err)
+	}
+}
+
+func TestGuestConnectionConcurrentWaits(t *testing.T) {
+	gc, g := connectFake(t, nil)
+	defer g.Close()
+	defer gc.Close()
+	ctx := context.Background()
+	g.AddContainer("uvm")
+
+	const n = 10
+	pids := make([]uint32, n)
+	for i := range pids {
+		pid, err := gc.ExecProcess(ctx, "uvm", "{}", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids[i] = pid
+	}
+	results := make(chan error, n)
+	for i, pid := range pids {
+		go func(pid uint32, expected int) {
+			exitCode, err := gc.WaitProcess(ctx, "uvm", pid, 0)
+			if err == nil && exitCode != expected {
+				err = &RPCError{Message: "unexpected exit code"}
+			}
+			results <- err
+		}(pid, i)
+	}
+	// Exit in reverse order to check responses are matched to requests by ID
+	for i := n - 1; i >= 0; i-- {
+		if err := g.ExitProcess("uvm", pids[i], i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range pids {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGuestConnectionClose(t *testing.T) {
+	gc, g := connectFake(t, nil)
+	defer g.Close()
+	ctx := context.Background()
+	g.AddContainer("uvm")
+	pid, err := gc.ExecProcess(ctx, "uvm", "{}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		_, err := gc.WaitProcess(ctx, "uvm", pid, 0)
+		waitErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := gc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waitErr; err != ErrBridgeClosed {
+		t.Fatalf("expected pending RPC to fail with ErrBridgeClosed, got %v", err)
+	}
+	if err := gc.Wait(); err != ErrBridgeClosed {
+		t.Fatalf("unexpected wait result %v", err)
+	}
+	if err := gc.StartContainer(ctx, "uvm"); err != ErrBridgeClosed {
+		t.Fatalf("expected ErrBridgeClosed after close, got %v", err)
+	}
+}
+
+func TestGuestConnectionContextCancel(t *testing.T) {
+	gc, g := connectFake(t, nil)
+	defer g.Close()
+	defer gc.Close()
+	g.AddContainer("uvm")
+	pid, err := gc.ExecProcess(context.Background(), "uvm", "{}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := gc.WaitProcess(ctx, "uvm", pid, 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	// The connection is still usable, and the late response is discarded.
+	g.ExitProcess("uvm", pid, 0)
+	if err := gc.StartContainer(context.Background(), "uvm"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGuestConnectionGuestDisconnect(t *testing.T) {
+	gc, g := connectFake(t, nil)
+	defer gc.Close()
+	g.Close()
+	if err := gc.Wait(); err != ErrBridgeClosed {
+		t.Fatalf("unexpected wait result %v", err)
+	}
+}
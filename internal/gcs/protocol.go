@@ -0,0 +1,272 @@
+package gcs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The bridge protocol frames each message with a 16 byte little-endian header
+// followed by a JSON body. The header holds the message type, the total size
+// of the message including the header, and an ID which correlates a response
+// with its request.
+
+const (
+	hdrSize    = 16
+	hdrOffType = 0
+	hdrOffSize = 4
+	hdrOffID   = 8
+
+	// maxMsgSize is the largest message accepted from the other end.
+	maxMsgSize = 0x1000000
+)
+
+// protocolVersion is the bridge protocol version this client speaks.
+const protocolVersion = 4
+
+type msgType uint32
+
+const (
+	msgTypeRequest  msgType = 0x10000000
+	msgTypeResponse msgType = 0x20000000
+	msgTypeNotify   msgType = 0x30000000
+	msgTypeMask     msgType = 0xf0000000
+)
+
+// rpcProc identifies an RPC. It is combined with msgTypeRequest or
+// msgTypeResponse to form the message type.
+type rpcProc uint32
+
+const (
+	rpcCreate rpcProc = 0x00100101 + iota<<8
+	rpcStart
+	rpcShutdownGraceful
+	rpcShutdownForced
+	rpcExecuteProcess
+	rpcWaitForProcess
+	rpcSignalProcess
+	rpcResizeConsole
+	rpcGetProperties
+	rpcModifySettings
+	rpcNegotiateProtocol
+)
+
+// notifyContainer is the message type of a container notification.
+const notifyContainer = msgTypeNotify | 0x00100101
+
+func (proc rpcProc) String() string {
+	switch proc {
+	case rpcCreate:
+		return "Create"
+	case rpcStart:
+		return "Start"
+	case rpcShutdownGraceful:
+		return "ShutdownGraceful"
+	case rpcShutdownForced:
+		return "ShutdownForced"
+	case rpcExecuteProcess:
+		return "ExecuteProcess"
+	case rpcWaitForProcess:
+		return "WaitForProcess"
+	case rpcSignalProcess:
+		return "SignalProcess"
+	case rpcResizeConsole:
+		return "ResizeConsole"
+	case rpcGetProperties:
+		return "GetProperties"
+	case rpcModifySettings:
+		return "ModifySettings"
+	case rpcNegotiateProtocol:
+		return "NegotiateProtocol"
+	}
+	return fmt.Sprintf("%#x", uint32(proc))
+}
+
+// message is a single framed message read from or written to the bridge.
+type message struct {
+	typ  msgType
+	id   int64
+	body []byte
+}
+
+func writeMessage(w io.Writer, typ msgType, id int64, body []byte) error {
+	var buf [hdrSize]byte
+	binary.LittleEndian.PutUint32(buf[hdrOffType:], uint32(typ))
+	binary.LittleEndian.PutUint32(buf[hdrOffSize:], uint32(len(body)+hdrSize))
+	binary.LittleEndian.PutUint64(buf[hdrOffID:], uint64(id))
+	// Write the header and body together so that messages are not interleaved
+	// on transports which split writes.
+	_, err := w.Write(append(buf[:], body...))
+	return err
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	var buf [hdrSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	m := &message{
+		typ: msgType(binary.LittleEndian.Uint32(buf[hdrOffType:])),
+		id:  int64(binary.LittleEndian.Uint64(buf[hdrOffID:])),
+	}
+	size := binary.LittleEndian.Uint32(buf[hdrOffSize:])
+	if size < hdrSize || size > maxMsgSize {
+		return nil, fmt.Errorf("bridge message %#x has invalid size %d", uint32(m.typ), size)
+	}
+	m.body = make([]byte, size-hdrSize)
+	if _, err := io.ReadFull(r, m.body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// requestBase is embedded in every request.
+type requestBase struct {
+	ContainerID string `json:"ContainerId"`
+	ActivityID  string `json:"ActivityId"`
+}
+
+// ErrorRecord is additional detail about a failed RPC returned by the guest.
+type ErrorRecord struct {
+	Result       int32
+	Message      string
+	ModuleName   string `json:",omitempty"`
+	FileName     string `json:",omitempty"`
+	Line         uint32 `json:",omitempty"`
+	FunctionName string `json:",omitempty"`
+}
+
+// responseBase is embedded in every response.
+type responseBase struct {
+	Result       int32
+	ErrorMessage string        `json:",omitempty"`
+	ActivityID   string        `json:"ActivityId,omitempty"`
+	ErrorRecords []ErrorRecord `json:",omitempty"`
+}
+
+func (r *responseBase) base() *responseBase {
+	return r
+}
+
+// response is implemented by every response type.
+type response interface {
+	base() *responseBase
+}
+
+type negotiateProtocolRequest struct {
+	requestBase
+	MinimumVersion uint32
+	MaximumVersion uint32
+}
+
+// GuestCapabilities are the optional features supported by the guest.
+type GuestCapabilities struct {
+	SendHostCreateMessage      bool     `json:",omitempty"`
+	SendHostStartMessage       bool     `json:",omitempty"`
+	HVSocketConfigOnStartup    bool     `json:",omitempty"`
+	SendLifecycleNotifications bool     `json:",omitempty"`
+	SupportedSchemaVersions    []string `json:",omitempty"`
+	RuntimeOsType              string   `json:",omitempty"`
+}
+
+type negotiateProtocolResponse struct {
+	responseBase
+	Version      uint32
+	Capabilities GuestCapabilities
+}
+
+type containerCreate struct {
+	requestBase
+	ContainerConfig string // JSON encoded configuration
+}
+
+type containerShutdown struct {
+	requestBase
+}
+
+// VsockStdioRelaySettings are the vsock ports on which the guest connects the
+// standard handles of a process back to the host. Zero means no relay.
+type VsockStdioRelaySettings struct {
+	StdIn  uint32 `json:",omitempty"`
+	StdOut uint32 `json:",omitempty"`
+	StdErr uint32 `json:",omitempty"`
+}
+
+type executeProcessSettings struct {
+	ProcessParameters       string                   // JSON encoded parameters
+	VsockStdioRelaySettings *VsockStdioRelaySettings `json:",omitempty"`
+}
+
+type containerExecuteProcess struct {
+	requestBase
+	Settings executeProcessSettings
+}
+
+type containerExecuteProcessResponse struct {
+	responseBase
+	ProcessID uint32 `json:"ProcessId"`
+}
+
+type containerWaitForProcess struct {
+	requestBase
+	ProcessID   uint32 `json:"ProcessId"`
+	TimeoutInMs uint32
+}
+
+type containerWaitForProcessResponse struct {
+	responseBase
+	ExitCode uint32
+}
+
+type signalProcessOptions struct {
+	Signal int
+}
+
+type containerSignalProcess struct {
+	requestBase
+	ProcessID uint32 `json:"ProcessId"`
+	Options   signalProcessOptions
+}
+
+type containerGetProperties struct {
+	requestBase
+	Query string // JSON encoded query
+}
+
+type containerGetPropertiesResponse struct {
+	responseBase
+	Properties string // JSON encoded properties
+}
+
+type containerModifySettings struct {
+	requestBase
+	Request interface{}
+}
+
+// ContainerNotification is sent by the guest when a container changes state,
+// for example when it exits.
+type ContainerNotification struct {
+	ContainerID string `json:"ContainerId"`
+	ActivityID  string `json:"ActivityId"`
+	Type        string // eg "UnexpectedExit", "GracefulExit", "ForcedExit"
+	Operation   string
+	Result      int32
+	ResultInfo  string `json:",omitempty"`
+}
+
+// encodeJSONString encodes v as a JSON string, as required for the fields of
+// requests which the guest decodes separately.
+func encodeJSONString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,55 @@
+package gcs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, msgTypeRequest|msgType(rpcExecuteProcess), 42, []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != hdrSize+7 {
+		t.Fatalf("unexpected message size %d", buf.Len())
+	}
+	m, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.typ != 0x10100501 || m.id != 42 || string(m.body) != `{"a":1}` {
+		t.Fatalf("unexpected message %#x %d %s", uint32(m.typ), m.id, m.body)
+	}
+}
+
+func TestMessageBadSize(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessage(&buf, msgTypeRequest, 1, nil)
+	b := buf.Bytes()
+	b[hdrOffSize] = 1 // Smaller than the header
+	if _, err := readMessage(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected failure for invalid size")
+	}
+}
+
+func TestMessageTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessage(&buf, msgTypeRequest, 1, []byte("body"))
+	if _, err := readMessage(bytes.NewReader(buf.Bytes()[:hdrSize+2])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestRPCProcValues(t *testing.T) {
+	for proc, expected := range map[rpcProc]uint32{
+		rpcCreate:            0x00100101,
+		rpcExecuteProcess:    0x00100501,
+		rpcModifySettings:    0x00100a01,
+		rpcNegotiateProtocol: 0x00100b01,
+	} {
+		if uint32(proc) != expected {
+			t.Fatalf("%s: expected %#x got %#x", proc, expected, uint32(proc))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package guid
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 )
@@ -20,3 +21,19 @@ func New() GUID {
 func (g GUID) String() string {
 	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x-%02x", g[3], g[2], g[1], g[0], g[5], g[4], g[7], g[6], g[8:10], g[10:])
 }
+
+// FromString parses a GUID in the form xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx,
+// as produced by String.
+func FromString(s string) (GUID, error) {
+	var g GUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	g = GUID{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6]}
+	copy(g[8:], b[8:])
+	return g, nil
+}
@@ -0,0 +1,26 @@
+package guid
+
+import "testing"
+
+func TestFromString(t *testing.T) {
+	g := New()
+	parsed, err := FromString(g.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != g {
+		t.Errorf("%s parsed as %s", g, parsed)
+	}
+	parsed, err = FromString("2dc27766-f623-4200-9d64-115e9bfd4a08")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (GUID{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}); parsed != expected {
+		t.Errorf("unexpected layout %x", parsed[:])
+	}
+	for _, s := range []string{"", "2dc27766f6234200-9d64-115e9bfd4a08-", "2dc27766-f623-4200-9d64-115e9bfd4a0g"} {
+		if _, err := FromString(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
@@ -175,13 +175,15 @@ func makeSystemError(system *System, op string, extra string, err error, events
 	if _, ok := err.(*SystemError); ok {
 		return err
 	}
-	return &SystemError{
+	serr := &SystemError{
 		ID:     system.ID(),
 		Op:     op,
 		Extra:  extra,
 		Err:    err,
 		Events: events,
 	}
+	recordError(serr.ID, op, serr)
+	return serr
 }
 
 func (e *ProcessError) Error() string {
@@ -197,13 +199,15 @@ func makeProcessError(process *Process, op string, err error, events []ErrorEven
 	if _, ok := err.(*ProcessError); ok {
 		return err
 	}
-	return &ProcessError{
+	perr := &ProcessError{
 		Pid:      process.Pid(),
 		SystemID: process.SystemID(),
 		Op:       op,
 		Err:      err,
 		Events:   events,
 	}
+	recordError(perr.SystemID, op, perr)
+	return perr
 }
 
 // IsNotExist checks if an error is caused by the Container or Process not existing.
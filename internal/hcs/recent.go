@@ -0,0 +1,57 @@
+package hcs
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is the number of errors kept for diagnostics.
+const maxRecentErrors = 64
+
+// RecentError is an error returned by an operation on a compute system or one
+// of its processes, kept for diagnostics.
+type RecentError struct {
+	Time     time.Time
+	SystemID string
+	Op       string
+	Error    string
+}
+
+var recentErrors struct {
+	m      sync.Mutex
+	errors []RecentError
+	next   int
+}
+
+// recordError keeps an error for diagnostics, unless it is one which callers
+// routinely expect and handle, such as terminating a compute system which has
+// already stopped.
+func recordError(systemID, op string, err error) {
+	if IsNotExist(err) || IsAlreadyStopped(err) || IsAlreadyClosed(err) || IsPending(err) {
+		return
+	}
+	recentErrors.m.Lock()
+	defer recentErrors.m.Unlock()
+	e := RecentError{Time: time.Now(), SystemID: systemID, Op: op, Error: err.Error()}
+	if len(recentErrors.errors) < maxRecentErrors {
+		recentErrors.errors = append(recentErrors.errors, e)
+	} else {
+		recentErrors.errors[recentErrors.next] = e
+	}
+	recentErrors.next = (recentErrors.next + 1) % maxRecentErrors
+}
+
+// RecentErrors returns the most recent errors returned by operations on
+// compute systems and their processes in this process, oldest first.
+func RecentErrors() []RecentError {
+	recentErrors.m.Lock()
+	defer recentErrors.m.Unlock()
+	errs := make([]RecentError, 0, len(recentErrors.errors))
+	if len(recentErrors.errors) == maxRecentErrors {
+		errs = append(errs, recentErrors.errors[recentErrors.next:]...)
+		errs = append(errs, recentErrors.errors[:recentErrors.next]...)
+	} else {
+		errs = append(errs, recentErrors.errors...)
+	}
+	return errs
+}
@@ -0,0 +1,58 @@
+package hcs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func resetRecentErrors() {
+	recentErrors.m.Lock()
+	defer recentErrors.m.Unlock()
+	recentErrors.errors = nil
+	recentErrors.next = 0
+}
+
+func TestRecentErrors(t *testing.T) {
+	resetRecentErrors()
+	defer resetRecentErrors()
+
+	if errs := RecentErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	recordError("s", "op", errors.New("0"))
+	recordError("s", "op", errors.New("1"))
+	if errs := RecentErrors(); len(errs) != 2 || errs[0].Error != "0" || errs[1].Error != "1" {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// The ring keeps the most recent errors, oldest first.
+	for i := 2; i < maxRecentErrors+5; i++ {
+		recordError("s", "op", fmt.Errorf("%d", i))
+	}
+	errs := RecentErrors()
+	if len(errs) != maxRecentErrors {
+		t.Fatalf("got %d errors, expected %d", len(errs), maxRecentErrors)
+	}
+	for i, e := range errs {
+		if expected := fmt.Sprint(i + 5); e.Error != expected || e.SystemID != "s" || e.Op != "op" {
+			t.Errorf("error %d is %+v, expected %s", i, e, expected)
+		}
+	}
+}
+
+func TestRecentErrorsIgnoresExpected(t *testing.T) {
+	resetRecentErrors()
+	defer resetRecentErrors()
+
+	for _, err := range []error{ErrComputeSystemDoesNotExist, ErrElementNotFound, ErrVmcomputeAlreadyStopped, ErrAlreadyClosed, ErrVmcomputeOperationPending} {
+		recordError("s", "op", &SystemError{ID: "s", Op: "op", Err: err})
+	}
+	if errs := RecentErrors(); len(errs) != 0 {
+		t.Errorf("expected errors were recorded: %v", errs)
+	}
+	recordError("s", "op", &SystemError{ID: "s", Op: "op", Err: ErrTimeout})
+	if errs := RecentErrors(); len(errs) != 1 {
+		t.Errorf("got %d errors, expected 1: %v", len(errs), errs)
+	}
+}
@@ -0,0 +1,49 @@
+package hcsoci
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// AnnotationScratchSizeGB is the annotation requesting that the scratch disk
+// of an LCOW container be expanded to at least this many GB, and its file
+// system grown to match, when the container is created. Scratch disks are
+// never shrunk.
+const AnnotationScratchSizeGB = "io.microsoft.container.storage.scratch.size-gb"
+
+// parseScratchSizeGB returns the scratch size requested by the annotations of
+// a spec, or 0 if none is.
+func parseScratchSizeGB(spec *specs.Spec) (uint32, error) {
+	v, ok := spec.Annotations[AnnotationScratchSizeGB]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a positive number of GB", AnnotationScratchSizeGB, v)
+	}
+	return uint32(size), nil
+}
+
+// AnnotationOvercommitRatio is the annotation on the spec of a pod's host
+// container setting the overcommit ratio of the pod's utility VM. This is the
+// ratio of the memory and processors which may be committed to the pod's
+// containers to the utility VM's.
+const AnnotationOvercommitRatio = "io.microsoft.virtualmachine.overcommit-ratio"
+
+// ParseOvercommitRatio returns the overcommit ratio requested by the
+// annotations of a spec, or 0 if none is.
+func ParseOvercommitRatio(spec *specs.Spec) (float64, error) {
+	v, ok := spec.Annotations[AnnotationOvercommitRatio]
+	if !ok {
+		return 0, nil
+	}
+	ratio, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(ratio > 0) || math.IsInf(ratio, 0) {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a positive number", AnnotationOvercommitRatio, v)
+	}
+	return ratio, nil
+}
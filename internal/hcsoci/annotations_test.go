@@ -0,0 +1,49 @@
+package hcsoci
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseScratchSizeGB(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		size        uint32
+		valid       bool
+	}{
+		{nil, 0, true},
+		{map[string]string{AnnotationScratchSizeGB: "50"}, 50, true},
+		{map[string]string{AnnotationScratchSizeGB: "0"}, 0, false},
+		{map[string]string{AnnotationScratchSizeGB: "-1"}, 0, false},
+		{map[string]string{AnnotationScratchSizeGB: "20GB"}, 0, false},
+		{map[string]string{AnnotationScratchSizeGB: "5000000000"}, 0, false},
+	} {
+		size, err := parseScratchSizeGB(&specs.Spec{Annotations: tc.annotations})
+		if size != tc.size || (err == nil) != tc.valid {
+			t.Errorf("%v: got (%d, %v), expected (%d, valid %t)", tc.annotations, size, err, tc.size, tc.valid)
+		}
+	}
+}
+
+func TestParseOvercommitRatio(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		ratio       float64
+		valid       bool
+	}{
+		{nil, 0, true},
+		{map[string]string{AnnotationOvercommitRatio: "1.5"}, 1.5, true},
+		{map[string]string{AnnotationOvercommitRatio: "0.5"}, 0.5, true},
+		{map[string]string{AnnotationOvercommitRatio: "0"}, 0, false},
+		{map[string]string{AnnotationOvercommitRatio: "-1"}, 0, false},
+		{map[string]string{AnnotationOvercommitRatio: "NaN"}, 0, false},
+		{map[string]string{AnnotationOvercommitRatio: "+Inf"}, 0, false},
+		{map[string]string{AnnotationOvercommitRatio: "2x"}, 0, false},
+	} {
+		ratio, err := ParseOvercommitRatio(&specs.Spec{Annotations: tc.annotations})
+		if ratio != tc.ratio || (err == nil) != tc.valid {
+			t.Errorf("%v: got (%g, %v), expected (%g, valid %t)", tc.annotations, ratio, err, tc.ratio, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package hcsoci
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// specCommitment returns the memory and processors of a utility VM to commit
+// to a container from the limits in its spec. A container without limits
+// commits nothing.
+func specCommitment(spec *specs.Spec) uvm.Commitment {
+	var c uvm.Commitment
+	if spec.Linux != nil {
+		if r := spec.Linux.Resources; r != nil {
+			if r.Memory != nil && r.Memory.Limit != nil && *r.Memory.Limit > 0 {
+				c.MemoryMB = uint64(*r.Memory.Limit) / 1024 / 1024
+			}
+			if r.CPU != nil {
+				if r.CPU.Quota != nil && *r.CPU.Quota > 0 && r.CPU.Period != nil && *r.CPU.Period > 0 {
+					period := *r.CPU.Period
+					c.Processors = uint32((uint64(*r.CPU.Quota) + period - 1) / period)
+				} else if r.CPU.Cpus != "" {
+					c.Processors = cpuSetCount(r.CPU.Cpus)
+				}
+			}
+		}
+	} else if spec.Windows != nil {
+		if r := spec.Windows.Resources; r != nil {
+			if r.Memory != nil && r.Memory.Limit != nil {
+				c.MemoryMB = *r.Memory.Limit / 1024 / 1024
+			}
+			if r.CPU != nil && r.CPU.Count != nil {
+				c.Processors = uint32(*r.CPU.Count)
+			}
+		}
+	}
+	return c
+}
+
+// resourcesCommitment returns c with the devices of a utility VM used by a
+// container once its resources have been allocated. These are counted from the
+// SCSI attachments and VPMem devices in the utility VM's inventory backing the
+// container's layers: the scratch of the last layer folder, and the read-only
+// layers of a Linux container.
+func resourcesCommitment(c uvm.Commitment, r *Resources, inv *uvm.Inventory) uvm.Commitment {
+	paths := make(map[string]bool)
+	for i, layer := range r.layers {
+		if i == len(r.layers)-1 {
+			paths[strings.ToLower(filepath.Join(layer, "sandbox.vhdx"))] = true
+		} else {
+			paths[strings.ToLower(filepath.Join(layer, "layer.vhd"))] = true
+		}
+	}
+	for _, s := range inv.SCSI {
+		if paths[strings.ToLower(s.HostPath)] {
+			c.SCSI++
+		}
+	}
+	for _, v := range inv.VPMem {
+		if paths[strings.ToLower(v.HostPath)] {
+			c.VPMem++
+		}
+	}
+	return c
+}
+
+// cpuSetCount returns the number of processors in a Linux cpuset list such as
+// "0-3,6". Malformed entries are ignored.
+func cpuSetCount(cpus string) uint32 {
+	var n uint32
+	for _, r := range strings.Split(cpus, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil || last < first {
+				continue
+			}
+		}
+		n += uint32(last - first + 1)
+	}
+	return n
+}
@@ -0,0 +1,81 @@
+package hcsoci
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSpecCommitmentLinux(t *testing.T) {
+	limit := int64(256 * 1024 * 1024)
+	quota := int64(150000)
+	period := uint64(100000)
+	spec := &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+		CPU:    &specs.LinuxCPU{Quota: &quota, Period: &period, Cpus: "0-7"},
+	}}}
+	c := specCommitment(spec)
+	if c != (uvm.Commitment{MemoryMB: 256, Processors: 2}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+
+	spec.Linux.Resources.CPU.Quota = nil
+	if c := specCommitment(spec); c != (uvm.Commitment{MemoryMB: 256, Processors: 8}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+}
+
+func TestResourcesCommitment(t *testing.T) {
+	r := &Resources{layers: []string{"l3", "l2", "l1", "scratch"}}
+	inv := &uvm.Inventory{
+		SCSI: []uvm.SCSIInventory{
+			{HostPath: filepath.Join("scratch", "sandbox.vhdx")},
+			{HostPath: filepath.Join("other", "sandbox.vhdx")},
+		},
+		VPMem: []uvm.VPMemInventory{
+			{DeviceNumber: 0, HostPath: filepath.Join("L1", "layer.vhd")},
+			{DeviceNumber: 1, HostPath: filepath.Join("l2", "layer.vhd"), SizeBytes: 4096},
+			{DeviceNumber: 1, HostPath: filepath.Join("other", "layer.vhd"), Offset: 4096, SizeBytes: 4096},
+		},
+	}
+	c := resourcesCommitment(uvm.Commitment{MemoryMB: 256}, r, inv)
+	if c != (uvm.Commitment{MemoryMB: 256, SCSI: 1, VPMem: 2}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+	if c := resourcesCommitment(uvm.Commitment{}, &Resources{}, inv); c != (uvm.Commitment{}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+}
+
+func TestSpecCommitmentWindows(t *testing.T) {
+	limit := uint64(512 * 1024 * 1024)
+	count := uint64(2)
+	spec := &specs.Spec{Windows: &specs.Windows{Resources: &specs.WindowsResources{
+		Memory: &specs.WindowsMemoryResources{Limit: &limit},
+		CPU:    &specs.WindowsCPUResources{Count: &count},
+	}}}
+	c := specCommitment(spec)
+	if c != (uvm.Commitment{MemoryMB: 512, Processors: 2}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+	if c := specCommitment(&specs.Spec{Windows: &specs.Windows{}}); c != (uvm.Commitment{}) {
+		t.Fatalf("unexpected commitment %+v", c)
+	}
+}
+
+func TestCPUSetCount(t *testing.T) {
+	for cpus, n := range map[string]uint32{
+		"":          0,
+		"0":         1,
+		"0-3":       4,
+		"0-3,6":     5,
+		"1, 4-5, 7": 4,
+		"3-1,x,2":   1,
+	} {
+		if got := cpuSetCount(cpus); got != n {
+			t.Errorf("%q: got %d, expected %d", cpus, got, n)
+		}
+	}
+}
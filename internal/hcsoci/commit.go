@@ -0,0 +1,158 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+	"github.com/Microsoft/hcsshim/internal/lcow"
+	"github.com/Microsoft/hcsshim/internal/ociwclayer"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/Microsoft/hcsshim/internal/wclayer"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// CommitOptions are the set of fields used to call CommitToTar() and Commit().
+type CommitOptions struct {
+	// Spec is the definition of the container. Its LayerFolders are arranged
+	// as for CreateOptions, with the scratch to commit last.
+	Spec *specs.Spec
+
+	// HostingSystem is a Linux utility VM used to export the scratch of a
+	// Linux container, whatever utility VM the container ran in. It is
+	// required for Linux containers, and not used for Windows containers.
+	HostingSystem *uvm.UtilityVM
+}
+
+// CommitToTar writes the changes a stopped container made to its read-only
+// layers, as recorded in its scratch, to w as an OCI layer tar. Deleted files
+// are recorded as whiteouts.
+//
+// The container's layers must have been released, as by ReleaseResources. A
+// Windows container's scratch is exported on the host, which requires the
+// calling process to hold SeBackupPrivilege. A Linux container's scratch is
+// mounted in HostingSystem to export it.
+func CommitToTar(opts *CommitOptions, w io.Writer) error {
+	layerFolders, err := commitLayerFolders(opts)
+	if err != nil {
+		return err
+	}
+	scratch := layerFolders[len(layerFolders)-1]
+	logrus.Debugf("hcsshim::CommitToTar %s", scratch)
+
+	if opts.Spec.Linux == nil {
+		// The parents are those the scratch was prepared with by
+		// mountContainerLayers.
+		if err := ociwclayer.ExportLayer(w, scratch, layerFolders[:len(layerFolders)-1]); err != nil {
+			return fmt.Errorf("failed to export %s: %s", scratch, err)
+		}
+		return nil
+	}
+	return commitLinuxToTar(opts.HostingSystem, filepath.Join(scratch, "sandbox.vhdx"), w)
+}
+
+// commitLinuxToTar mounts the scratch at hostPath in lcowUVM and writes the
+// overlay upper directory on it to w.
+func commitLinuxToTar(lcowUVM *uvm.UtilityVM, hostPath string, w io.Writer) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("a Linux utility VM is required to commit %s", hostPath)
+	}
+	// A scratch still attached belongs to a container which has not been
+	// released, and would be mounted elsewhere than requested.
+	for _, scsi := range lcowUVM.Inventory().SCSI {
+		if strings.EqualFold(scsi.HostPath, hostPath) {
+			return fmt.Errorf("cannot commit %s as it is in use in utility VM %s", hostPath, lcowUVM.ID())
+		}
+	}
+
+	uvmPath := "/tmp/commit-" + guid.New().String()
+	if err := wclayer.GrantVmAccess(lcowUVM.ID(), hostPath); err != nil {
+		return err
+	}
+	if _, _, err := lcowUVM.AddSCSI(hostPath, uvmPath); err != nil {
+		return fmt.Errorf("failed to attach %s to utility VM %s: %s", hostPath, lcowUVM.ID(), err)
+	}
+	defer func() {
+		if err := lcowUVM.RemoveSCSI(hostPath); err != nil {
+			logrus.Warnf("hcsshim::CommitToTar failed to detach %s: %s", hostPath, err)
+		}
+	}()
+
+	r, err := lcow.VhdToTar(lcowUVM, hostPath, uvmPath, true, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to export %s: %s", hostPath, err)
+	}
+	return nil
+}
+
+// Commit imports the changes a stopped container made to its read-only
+// layers, as CommitToTar, as a new read-only layer at layerPath, which must
+// not exist. The new layer's parents are the container's read-only layers, so
+// a container using it has the LayerFolders layerPath, the container's
+// read-only layers, and a scratch. It returns the size of the new layer.
+//
+// Importing a Windows layer requires the calling process to also hold
+// SeRestorePrivilege. A Linux layer is converted to layerPath\layer.vhd on the
+// host.
+func Commit(opts *CommitOptions, layerPath string) (int64, error) {
+	layerFolders, err := commitLayerFolders(opts)
+	if err != nil {
+		return 0, err
+	}
+	logrus.Debugf("hcsshim::Commit %s to %s", layerFolders[len(layerFolders)-1], layerPath)
+	if _, err := os.Stat(layerPath); err == nil {
+		return 0, fmt.Errorf("cannot commit to %s as it already exists", layerPath)
+	}
+
+	// Export into a pipe in the background. After a successful import the
+	// rest of the export, such as the tar's end-of-archive blocks, is drained
+	// so that it completes; otherwise closing the read side stops it.
+	r, w := io.Pipe()
+	exportErr := make(chan error, 1)
+	go func() {
+		err := CommitToTar(opts, w)
+		w.CloseWithError(err)
+		exportErr <- err
+	}()
+
+	var size int64
+	if opts.Spec.Linux == nil {
+		size, err = ociwclayer.ImportLayer(r, layerPath, layerFolders[:len(layerFolders)-1])
+	} else if err = os.MkdirAll(layerPath, 0700); err == nil {
+		size, err = lcow.TarToVhd(opts.HostingSystem, filepath.Join(layerPath, "layer.vhd"), r)
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	r.CloseWithError(io.ErrClosedPipe)
+	if e := <-exportErr; err == nil {
+		err = e
+	}
+	if err != nil {
+		os.RemoveAll(layerPath)
+		return 0, fmt.Errorf("failed to commit to %s: %s", layerPath, err)
+	}
+	return size, nil
+}
+
+// commitLayerFolders validates opts, returning the container's layer folders.
+func commitLayerFolders(opts *CommitOptions) ([]string, error) {
+	if opts == nil || opts.Spec == nil {
+		return nil, fmt.Errorf("a container spec is required to commit")
+	}
+	if opts.Spec.Windows == nil || len(opts.Spec.Windows.LayerFolders) < 2 {
+		return nil, fmt.Errorf("at least two LayerFolders, a read-only layer and the scratch, are required to commit")
+	}
+	return opts.Spec.Windows.LayerFolders, nil
+}
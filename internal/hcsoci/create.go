@@ -11,6 +11,7 @@ import (
 
 	"github.com/Microsoft/hcsshim/internal/guid"
 	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/lcow"
 	"github.com/Microsoft/hcsshim/internal/schemaversion"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -32,6 +33,11 @@ type CreateOptions struct {
 	HostingSystem    *uvm.UtilityVM               // Utility or service VM in which the container is to be created.
 	NetworkNamespace string                       // Host network namespace to use (overrides anything in the spec)
 
+	// SpecSizesHostingSystem is set when the resources in Spec were used to
+	// size HostingSystem, so that the container is not admitted against the
+	// utility VM's budget for the memory and processors it already owns.
+	SpecSizesHostingSystem bool
+
 	// This is an advanced debugging parameter. It allows for diagnosibility by leaving a containers
 	// resources allocated in case of a failure. Thus you would be able to use tools such as hcsdiag
 	// to look at the state of a utility VM to see what resources were allocated. Obviously the caller
@@ -89,12 +95,16 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 	resources := &Resources{}
 	defer func() {
 		if err != nil {
+			// Collect diagnostics before the failed container's devices
+			// are removed from the utility VM.
+			lcow.SaveFailureDiagnostics(coi.HostingSystem, err)
 			if !coi.DoNotReleaseResourcesOnFailure {
 				ReleaseResources(resources, coi.HostingSystem, true)
 			}
 		}
 	}()
 
+	var commitment uvm.Commitment
 	if coi.HostingSystem != nil {
 		n := coi.HostingSystem.ContainerCounter()
 		if coi.Spec.Linux != nil {
@@ -102,6 +112,17 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 		} else {
 			resources.containerRootInUVM = `C:\c\` + strconv.FormatUint(n, 16)
 		}
+
+		// Admit the container to the utility VM's budget before allocating
+		// anything for it. A container whose limits sized the utility VM
+		// would fill its budget, so it commits no memory or processors.
+		if !coi.SpecSizesHostingSystem {
+			commitment = specCommitment(coi.Spec)
+		}
+		if err := coi.HostingSystem.Commit(coi.actualID, commitment); err != nil {
+			return nil, resources, err
+		}
+		resources.committedID = coi.actualID
 	}
 
 	// Create a network namespace if necessary.
@@ -162,6 +183,13 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 		}
 	}
 
+	if resources.committedID != "" {
+		err = coi.HostingSystem.Commit(coi.actualID, resourcesCommitment(commitment, resources, coi.HostingSystem.Inventory()))
+		if err != nil {
+			return nil, resources, err
+		}
+	}
+
 	logrus.Debugf("hcsshim::CreateContainer creating compute system")
 	system, err := hcs.CreateComputeSystem(coi.actualID, hcsDocument)
 	if err != nil {
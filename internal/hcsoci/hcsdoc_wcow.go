@@ -226,7 +226,7 @@ func createWindowsContainerDocument(coi *createOptionsInternal) (interface{}, er
 			if coi.HostingSystem == nil {
 				mdv2.HostPath = mount.Source
 			} else {
-				uvmPath, err := coi.HostingSystem.GetVSMBUvmPath(mount.Source)
+				uvmPath, err := coi.HostingSystem.GetVSMBUvmPath(mount.Source, vsmbOptionsForMount(mount))
 				if err != nil {
 					return nil, err
 				}
@@ -22,6 +22,10 @@ type vpMemEntry struct {
 
 const scratchPath = "scratch"
 
+// layerVSMBOptions are the options for sharing read-only layers into a Windows
+// utility VM.
+var layerVSMBOptions = uvm.LayerVSMBOptions()
+
 // mountContainerLayers is a helper for clients to hide all the complexity of layer mounting
 // Layer folder are in order: base, [rolayer1..rolayern,] scratch
 //
@@ -79,7 +83,7 @@ func mountContainerLayers(layerFolders []string, guestRoot string, uvm *uvm.Util
 	for _, layerPath := range layerFolders[:len(layerFolders)-1] {
 		var err error
 		if uvm.OS() == "windows" {
-			err = uvm.AddVSMB(layerPath, "", schema2.VsmbFlagReadOnly|schema2.VsmbFlagPseudoOplocks|schema2.VsmbFlagTakeBackupPrivilege|schema2.VsmbFlagCacheIO|schema2.VsmbFlagShareRead)
+			err = uvm.AddVSMB(layerPath, "", layerVSMBOptions)
 			if err == nil {
 				vsmbAdded = append(vsmbAdded, layerPath)
 			}
@@ -263,7 +267,7 @@ func unmountContainerLayers(layerFolders []string, guestRoot string, uvm *uvm.Ut
 	// to share layers.
 	if uvm.OS() == "windows" && len(layerFolders) > 1 && (op&unmountOperationVSMB) == unmountOperationVSMB {
 		for _, layerPath := range layerFolders[:len(layerFolders)-1] {
-			if e := uvm.RemoveVSMB(layerPath); e != nil {
+			if e := uvm.RemoveVSMB(layerPath, layerVSMBOptions); e != nil {
 				logrus.Debugln(e)
 				if retError == nil {
 					retError = e
@@ -297,7 +301,7 @@ func unmountContainerLayers(layerFolders []string, guestRoot string, uvm *uvm.Ut
 
 func cleanupOnMountFailure(uvm *uvm.UtilityVM, vsmbShares []string, vpmemDevices []vpMemEntry, scsiHostPath string) {
 	for _, vsmbShare := range vsmbShares {
-		if err := uvm.RemoveVSMB(vsmbShare); err != nil {
+		if err := uvm.RemoveVSMB(vsmbShare, layerVSMBOptions); err != nil {
 			logrus.Warnf("Possibly leaked vsmbshare on error removal path: %s", err)
 		}
 	}
@@ -315,7 +319,7 @@ func cleanupOnMountFailure(uvm *uvm.UtilityVM, vsmbShares []string, vpmemDevices
 
 func computeV2Layers(vm *uvm.UtilityVM, paths []string) (layers []schema2.ContainersResourcesLayerV2, err error) {
 	for _, path := range paths {
-		uvmPath, err := vm.GetVSMBUvmPath(path)
+		uvmPath, err := vm.GetVSMBUvmPath(path, layerVSMBOptions)
 		if err != nil {
 			return nil, err
 		}
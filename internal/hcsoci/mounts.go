@@ -0,0 +1,192 @@
+// +build windows
+
+package hcsoci
+
+// Contains functions for adding and removing mounts on a running container
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// addedMountPathPrefix prefixes the path in an LCOW utility VM at which a mount
+// added to a running container is shared.
+const addedMountPathPrefix = "a"
+
+// addedMount is a mount added to a running container by AddMount.
+type addedMount struct {
+	hostPath      string
+	containerPath string
+	readOnly      bool
+	uvmPath       string           // The source of the mapped directory in the utility VM, if any
+	vsmbOptions   *uvm.VSMBOptions // Set for a WCOW Xenon
+}
+
+func (m *addedMount) mappedDirectory() schema2.ContainersResourcesMappedDirectoryV2 {
+	md := schema2.ContainersResourcesMappedDirectoryV2{
+		HostPath:      m.hostPath,
+		ContainerPath: m.containerPath,
+		ReadOnly:      m.readOnly,
+	}
+	if m.uvmPath != "" {
+		md.HostPath = m.uvmPath
+	}
+	return md
+}
+
+// AddMount adds a bind mount to a running container. For a WCOW Xenon the source
+// is shared into the utility VM with VSMB, and for LCOW with Plan9; these shares
+// are ref-counted with those added when containers are created. The mount is
+// recorded in resources so that RemoveMount and ReleaseResources remove it.
+func AddMount(hc *hcs.System, r *Resources, vm *uvm.UtilityVM, mount specs.Mount) (err error) {
+	if mount.Destination == "" || mount.Source == "" {
+		return fmt.Errorf("a mount must have both source and a destination: %+v", mount)
+	}
+	if strings.HasPrefix(strings.ToLower(mount.Destination), `\\.\pipe\`) {
+		return fmt.Errorf("named pipe mounts cannot be added to a running container: %+v", mount)
+	}
+	for _, m := range r.addedMounts {
+		if m.containerPath == mount.Destination {
+			return fmt.Errorf("a mount has already been added at %s", mount.Destination)
+		}
+	}
+	logrus.Debugf("hcsoci::AddMount %+v", mount)
+
+	m := addedMount{
+		hostPath:      mount.Source,
+		containerPath: mount.Destination,
+	}
+	for _, o := range mount.Options {
+		if strings.ToLower(o) == "ro" {
+			m.readOnly = true
+		}
+	}
+
+	switch {
+	case vm == nil:
+		// Argon. The mapped directory is added directly.
+
+	case vm.OS() == "windows":
+		if mount.Type != "" {
+			return fmt.Errorf("invalid mount - Type '%s' must not be set", mount.Type)
+		}
+		m.vsmbOptions = vsmbOptionsForMount(mount)
+		if err := vm.AddVSMB(m.hostPath, "", m.vsmbOptions); err != nil {
+			return fmt.Errorf("failed to add VSMB share to utility VM for mount %+v: %s", mount, err)
+		}
+		defer func() {
+			if err != nil {
+				vm.RemoveVSMB(m.hostPath, m.vsmbOptions)
+			}
+		}()
+		if m.uvmPath, err = vm.GetVSMBUvmPath(m.hostPath, m.vsmbOptions); err != nil {
+			return err
+		}
+
+	default:
+		if mount.Type != "bind" {
+			return fmt.Errorf("invalid mount - Type '%s' must be bind", mount.Type)
+		}
+		// A host path already shared into the utility VM with the same
+		// read-only flag is shared again at the same path, which is where the
+		// ref-counting in the utility VM expects it. Otherwise it is shared
+		// at a new path.
+		if m.uvmPath, err = vm.GetPlan9UvmPath(m.hostPath, m.readOnly); err != nil {
+			r.addedMountCounter++
+			m.uvmPath = path.Join(r.containerRootInUVM, addedMountPathPrefix+strconv.FormatUint(r.addedMountCounter, 10))
+		}
+		var flags int32 = schema2.VPlan9FlagNone
+		if m.readOnly {
+			flags = schema2.VPlan9FlagReadOnly
+		}
+		if err := vm.AddPlan9(m.hostPath, m.uvmPath, flags); err != nil {
+			return fmt.Errorf("failed to add plan9 share to utility VM for mount %+v: %s", mount, err)
+		}
+		defer func() {
+			if err != nil {
+				vm.RemovePlan9(m.hostPath, m.uvmPath)
+			}
+		}()
+	}
+
+	if err := modifyMappedDirectory(hc, schema2.RequestTypeAdd, &m); err != nil {
+		return fmt.Errorf("failed to add mount %+v to container %s: %s", mount, hc.ID(), err)
+	}
+	if m.vsmbOptions != nil {
+		r.vsmbMounts = append(r.vsmbMounts, vsmbMount{hostPath: m.hostPath, options: m.vsmbOptions})
+	} else if vm != nil {
+		r.plan9Mounts = append(r.plan9Mounts, plan9Mount{hostPath: m.hostPath, uvmPath: m.uvmPath})
+	}
+	r.addedMounts = append(r.addedMounts, m)
+	logrus.Debugf("hcsoci::AddMount Success %+v", m)
+	return nil
+}
+
+// RemoveMount removes a mount previously added to a running container by
+// AddMount. containerPath is the destination of the mount.
+func RemoveMount(hc *hcs.System, r *Resources, vm *uvm.UtilityVM, containerPath string) error {
+	for i := range r.addedMounts {
+		m := r.addedMounts[i]
+		if m.containerPath != containerPath {
+			continue
+		}
+		logrus.Debugf("hcsoci::RemoveMount %+v", m)
+		if err := modifyMappedDirectory(hc, schema2.RequestTypeRemove, &m); err != nil {
+			return fmt.Errorf("failed to remove mount at %s from container %s: %s", containerPath, hc.ID(), err)
+		}
+		r.addedMounts = append(r.addedMounts[:i], r.addedMounts[i+1:]...)
+		if vm == nil {
+			return nil
+		}
+		if m.vsmbOptions != nil {
+			if err := vm.RemoveVSMB(m.hostPath, m.vsmbOptions); err != nil {
+				return err
+			}
+			for j := len(r.vsmbMounts) - 1; j >= 0; j-- {
+				// The options are compared by value as the resources may have
+				// been persisted.
+				if r.vsmbMounts[j].hostPath == m.hostPath && reflect.DeepEqual(r.vsmbMounts[j].options, m.vsmbOptions) {
+					r.vsmbMounts = append(r.vsmbMounts[:j], r.vsmbMounts[j+1:]...)
+					break
+				}
+			}
+			return nil
+		}
+		if err := vm.RemovePlan9(m.hostPath, m.uvmPath); err != nil {
+			return err
+		}
+		for j := len(r.plan9Mounts) - 1; j >= 0; j-- {
+			if r.plan9Mounts[j] == (plan9Mount{hostPath: m.hostPath, uvmPath: m.uvmPath}) {
+				r.plan9Mounts = append(r.plan9Mounts[:j], r.plan9Mounts[j+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no mount has been added at %s", containerPath)
+}
+
+// modifyMappedDirectory adds or removes a mapped directory in a running
+// container. For LCOW the GCS bind mounts the share from the utility VM.
+func modifyMappedDirectory(hc *hcs.System, requestType schema2.RequestType, m *addedMount) error {
+	md := m.mappedDirectory()
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedDirectory,
+		RequestType:  requestType,
+		Settings:     md,
+		ResourceUri:  "Container/MappedDirectories",
+	}
+	if m.uvmPath != "" {
+		modification.HostedSettings = md
+	}
+	return hc.Modify(modification)
+}
@@ -0,0 +1,61 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestAddMountValidation(t *testing.T) {
+	r := &Resources{addedMounts: []addedMount{{hostPath: `c:\src`, containerPath: `c:\dst`}}}
+	for _, mount := range []specs.Mount{
+		{Destination: `c:\new`},
+		{Source: `c:\src`},
+		{Source: `\\.\pipe\src`, Destination: `\\.\pipe\dst`},
+		{Source: `c:\other`, Destination: `c:\dst`},
+	} {
+		if err := AddMount(nil, r, nil, mount); err == nil {
+			t.Errorf("adding mount %+v succeeded", mount)
+		}
+	}
+	if len(r.addedMounts) != 1 {
+		t.Fatalf("mounts changed by failed operations: %+v", r.addedMounts)
+	}
+}
+
+func TestRemoveMountNotAdded(t *testing.T) {
+	r := &Resources{addedMounts: []addedMount{{hostPath: `c:\src`, containerPath: `c:\dst`}}}
+	if err := RemoveMount(nil, r, nil, `c:\other`); err == nil {
+		t.Fatal("removing a mount which was not added succeeded")
+	}
+	if len(r.addedMounts) != 1 {
+		t.Fatalf("mounts changed by failed operations: %+v", r.addedMounts)
+	}
+}
+
+func TestResourcesJSONMounts(t *testing.T) {
+	r := &Resources{
+		vsmbMounts: []vsmbMount{{hostPath: `c:\src`, options: uvm.DefaultVSMBOptions(true)}},
+		addedMounts: []addedMount{
+			{hostPath: `c:\src`, containerPath: `c:\dst`, readOnly: true, vsmbOptions: uvm.DefaultVSMBOptions(true)},
+			{hostPath: `c:\src2`, containerPath: "/dst", uvmPath: "/run/gcs/c/1/a1"},
+		},
+		addedMountCounter: 1,
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := &Resources{}
+	if err := json.Unmarshal(b, r2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, r2) {
+		t.Fatalf("resources changed by persisting them: %+v != %+v", r, r2)
+	}
+}
@@ -1,7 +1,12 @@
 package hcsoci
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/sirupsen/logrus"
 )
 
@@ -39,3 +44,72 @@ func getNamespaceEndpoints(netNS string) ([]*hns.HNSEndpoint, error) {
 	}
 	return endpoints, nil
 }
+
+// AddNetworkEndpoint adds an HNS endpoint to the network namespace of a running
+// container. For a container in a utility VM, a NIC for the endpoint is also
+// hot-added to the utility VM and configured in the guest. The endpoint is
+// recorded in resources so that ReleaseResources removes it.
+func AddNetworkEndpoint(r *Resources, vm *uvm.UtilityVM, endpointID string) (err error) {
+	if r.netNS == "" {
+		return fmt.Errorf("container has no network namespace")
+	}
+	for _, ids := range [][]string{r.networkEndpoints, r.addedEndpoints} {
+		for _, id := range ids {
+			if strings.EqualFold(id, endpointID) {
+				return fmt.Errorf("endpoint %s is already present in network namespace %s", endpointID, r.netNS)
+			}
+		}
+	}
+	endpoint, err := hns.GetHNSEndpointByID(endpointID)
+	if err != nil {
+		return err
+	}
+
+	if err := hns.AddNamespaceEndpoint(r.netNS, endpointID); err != nil {
+		return fmt.Errorf("failed to add endpoint %s to network namespace %s: %s", endpointID, r.netNS, err)
+	}
+	defer func() {
+		if err != nil {
+			hns.RemoveNamespaceEndpoint(r.netNS, endpointID)
+		}
+	}()
+	if vm != nil && r.addedNetNSToVM {
+		if err := vm.AddEndpointToNetNS(r.netNS, endpoint); err != nil {
+			return fmt.Errorf("failed to add endpoint %s to utility VM %s: %s", endpointID, vm.ID(), err)
+		}
+	}
+	logrus.Infof("added network endpoint %s to namespace %s", endpointID, r.netNS)
+	r.addedEndpoints = append(r.addedEndpoints, endpointID)
+	return nil
+}
+
+// RemoveNetworkEndpoint removes an HNS endpoint previously added to a running
+// container by AddNetworkEndpoint.
+func RemoveNetworkEndpoint(r *Resources, vm *uvm.UtilityVM, endpointID string) error {
+	for i, id := range r.addedEndpoints {
+		if strings.EqualFold(id, endpointID) {
+			if err := removeNetworkEndpoint(r, vm, id); err != nil {
+				return err
+			}
+			r.addedEndpoints = append(r.addedEndpoints[:i], r.addedEndpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("endpoint %s was not added to network namespace %s", endpointID, r.netNS)
+}
+
+func removeNetworkEndpoint(r *Resources, vm *uvm.UtilityVM, endpointID string) error {
+	if vm != nil && r.addedNetNSToVM {
+		if err := vm.RemoveEndpointFromNetNS(r.netNS, endpointID); err != nil {
+			return fmt.Errorf("failed to remove endpoint %s from utility VM %s: %s", endpointID, vm.ID(), err)
+		}
+	}
+	if err := hns.RemoveNamespaceEndpoint(r.netNS, endpointID); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		logrus.Warnf("removing endpoint %s from namespace %s: does not exist", endpointID, r.netNS)
+	}
+	logrus.Infof("removed network endpoint %s from namespace %s", endpointID, r.netNS)
+	return nil
+}
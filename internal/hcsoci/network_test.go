@@ -0,0 +1,58 @@
+package hcsoci
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAddNetworkEndpointValidation(t *testing.T) {
+	if err := AddNetworkEndpoint(&Resources{}, nil, "e1"); err == nil || !strings.Contains(err.Error(), "no network namespace") {
+		t.Fatalf("adding an endpoint without a namespace: %v", err)
+	}
+	r := &Resources{netNS: "ns", networkEndpoints: []string{"E1"}, addedEndpoints: []string{"e2"}}
+	for _, id := range []string{"e1", "E2"} {
+		if err := AddNetworkEndpoint(r, nil, id); err == nil || !strings.Contains(err.Error(), "already present") {
+			t.Fatalf("adding duplicate endpoint %s: %v", id, err)
+		}
+	}
+	// Only endpoints added to the running container can be removed.
+	if err := RemoveNetworkEndpoint(r, nil, "e1"); err == nil {
+		t.Fatal("removing an endpoint added at create succeeded")
+	}
+	if len(r.networkEndpoints) != 1 || len(r.addedEndpoints) != 1 {
+		t.Fatalf("endpoints changed by failed operations: %v %v", r.networkEndpoints, r.addedEndpoints)
+	}
+}
+
+func TestResourcesJSON(t *testing.T) {
+	r := &Resources{
+		containerRootInUVM: "/run/gcs/c/1",
+		layers:             []string{`c:\layers\1`, `c:\layers\scratch`},
+		plan9Mounts:        []plan9Mount{{hostPath: `c:\share`, uvmPath: "/run/gcs/c/1/m0"}},
+		netNS:              "ns",
+		networkEndpoints:   []string{"e1"},
+		createdNetNS:       true,
+		addedNetNSToVM:     true,
+		addedEndpoints:     []string{"e2", "e3"},
+		committedID:        "c1",
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := &Resources{}
+	if err := json.Unmarshal(b, r2); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := json.Marshal(r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(b2) {
+		t.Fatalf("resources changed by persisting them: %s != %s", b, b2)
+	}
+	if len(r2.addedEndpoints) != 2 || r2.addedEndpoints[1] != "e3" || r2.netNS != "ns" || !r2.addedNetNSToVM {
+		t.Fatalf("unexpected resources after persisting them: %s", b2)
+	}
+}
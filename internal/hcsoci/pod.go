@@ -0,0 +1,447 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+// PodOptions are the set of fields used to call CreatePod().
+type PodOptions struct {
+	ID string // Identifier for the pod
+
+	// UVMOptions are the options for the pod's utility VM. If nil, the pod has
+	// no utility VM and its containers are process isolated.
+	UVMOptions *uvm.UVMOptions
+
+	// NetworkNamespace is an existing host network namespace shared by the
+	// containers in the pod. If empty and NetworkEndpoints are supplied, a
+	// namespace holding them is created and removed when the pod is destroyed.
+	NetworkNamespace string
+	NetworkEndpoints []string
+
+	// Persist is optionally called with the description of the pod each time it
+	// changes, so that the caller can record it.
+	Persist func(*PodDescription) error
+}
+
+// PodDescription is a description of a pod which is safe to marshal as JSON.
+type PodDescription struct {
+	ID                      string
+	UtilityVMID             string `json:",omitempty"`
+	OperatingSystem         string `json:",omitempty"`
+	NetworkNamespace        string `json:",omitempty"`
+	CreatedNetworkNamespace bool   `json:",omitempty"`
+	Containers              []string
+}
+
+// Pod is a set of containers sharing a utility VM, or the host for process
+// isolated containers, and a network namespace. Resources in the utility VM,
+// such as read-only layers, are ref-counted across the containers in the pod.
+type Pod struct {
+	id           string
+	vm           *uvm.UtilityVM
+	netNS        string
+	createdNetNS bool
+	persist      func(*PodDescription) error
+
+	m          sync.Mutex
+	containers map[string]*podContainer
+	destroyed  bool
+}
+
+// podContainer is a container in a pod and the resources allocated to it.
+type podContainer struct {
+	hc        *hcs.System
+	resources *Resources
+	creating  bool // The ID is reserved while AddContainer creates the container
+}
+
+// CreatePod creates a pod. If utility VM options are supplied, the utility VM
+// is created and started.
+func CreatePod(opts *PodOptions) (_ *Pod, err error) {
+	logrus.Debugf("hcsoci::CreatePod %+v", opts)
+	if opts == nil || opts.ID == "" {
+		return nil, fmt.Errorf("an ID must be supplied to create a pod")
+	}
+	p := &Pod{
+		id:         opts.ID,
+		netNS:      opts.NetworkNamespace,
+		persist:    opts.Persist,
+		containers: make(map[string]*podContainer),
+	}
+	defer func() {
+		if err != nil {
+			p.Destroy()
+		}
+	}()
+
+	if p.netNS == "" && len(opts.NetworkEndpoints) != 0 {
+		p.netNS, err = hns.CreateNamespace()
+		if err != nil {
+			return nil, err
+		}
+		p.createdNetNS = true
+		logrus.Infof("created network namespace %s for pod %s", p.netNS, p.id)
+		for _, endpointID := range opts.NetworkEndpoints {
+			if err := hns.AddNamespaceEndpoint(p.netNS, endpointID); err != nil {
+				return nil, err
+			}
+			logrus.Infof("added network endpoint %s to namespace %s", endpointID, p.netNS)
+		}
+	}
+
+	if opts.UVMOptions != nil {
+		vmOpts := *opts.UVMOptions
+		if vmOpts.ID == "" {
+			vmOpts.ID = p.id + "@vm"
+		}
+		p.vm, err = uvm.Create(&vmOpts)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.vm.Start(); err != nil {
+			return nil, p.vm.WithConsoleTail(err)
+		}
+	}
+
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ID returns the identifier of the pod.
+func (p *Pod) ID() string {
+	return p.id
+}
+
+// UtilityVM returns the pod's utility VM, or nil if its containers are
+// process isolated.
+func (p *Pod) UtilityVM() *uvm.UtilityVM {
+	return p.vm
+}
+
+// NetworkNamespace returns the network namespace shared by the containers in
+// the pod, if any.
+func (p *Pod) NetworkNamespace() string {
+	return p.netNS
+}
+
+// Containers returns the IDs of the containers in the pod.
+func (p *Pod) Containers() []string {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.containerIDs()
+}
+
+// containerIDs returns the sorted IDs of the containers which have been
+// created. The lock must be held.
+func (p *Pod) containerIDs() []string {
+	ids := make([]string, 0, len(p.containers))
+	for id, c := range p.containers {
+		if !c.creating {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// container returns a container which has been created in the pod. The lock
+// must be held.
+func (p *Pod) container(id string) (*podContainer, error) {
+	c, err := p.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.creating {
+		return nil, fmt.Errorf("container %s is still being created in pod %s", id, p.id)
+	}
+	return c, nil
+}
+
+// Description returns a description of the pod.
+func (p *Pod) Description() *PodDescription {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.description()
+}
+
+// description returns a description of the pod. The lock must be held.
+func (p *Pod) description() *PodDescription {
+	d := &PodDescription{
+		ID:                      p.id,
+		NetworkNamespace:        p.netNS,
+		CreatedNetworkNamespace: p.createdNetNS,
+		Containers:              p.containerIDs(),
+	}
+	if p.vm != nil {
+		d.UtilityVMID = p.vm.ID()
+		d.OperatingSystem = p.vm.OS()
+	}
+	return d
+}
+
+// save calls the persist callback, if any. The lock must be held.
+func (p *Pod) save() error {
+	if p.persist == nil {
+		return nil
+	}
+	return p.persist(p.description())
+}
+
+// AddContainer creates a container in the pod. The container is created in the
+// pod's utility VM, if any, and joins the pod's network namespace, which must
+// not conflict with a namespace in opts. The caller is responsible for starting
+// the container. The returned resources remain owned by the pod and are
+// released by ReleaseContainer or RemoveContainer, including those returned
+// with an error when opts.DoNotReleaseResourcesOnFailure is set.
+//
+// The pod's lock is not held while the container is created, so that the
+// pod's other containers can be used meanwhile.
+func (p *Pod) AddContainer(opts *CreateOptions) (_ *hcs.System, _ *Resources, err error) {
+	if opts == nil || opts.ID == "" || opts.Spec == nil {
+		return nil, nil, fmt.Errorf("an ID and spec must be supplied to add a container to pod %s", p.id)
+	}
+	if opts.NetworkNamespace != "" && p.netNS != "" && !strings.EqualFold(opts.NetworkNamespace, p.netNS) {
+		return nil, nil, fmt.Errorf("container %s requests network namespace %s, but pod %s uses %s", opts.ID, opts.NetworkNamespace, p.id, p.netNS)
+	}
+	if err := p.reserve(opts.ID); err != nil {
+		return nil, nil, err
+	}
+
+	containerOpts := *opts
+	containerOpts.HostingSystem = p.vm
+	if p.netNS != "" && opts.Spec.Windows != nil {
+		// Joining the namespace requires a network section, which is added to
+		// a copy so that the caller's spec is unchanged.
+		spec := *opts.Spec
+		windows := *spec.Windows
+		if windows.Network == nil {
+			windows.Network = &specs.WindowsNetwork{}
+		}
+		spec.Windows = &windows
+		containerOpts.Spec = &spec
+		containerOpts.NetworkNamespace = p.netNS
+	}
+	hc, resources, err := CreateContainer(&containerOpts)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if err != nil {
+		if resources != nil && opts.DoNotReleaseResourcesOnFailure {
+			// The container is remembered so that removing it releases its resources.
+			p.containers[opts.ID] = &podContainer{resources: resources}
+			if saveErr := p.save(); saveErr != nil {
+				logrus.Warnf("failed to persist pod %s: %s", p.id, saveErr)
+			}
+			return nil, resources, err
+		}
+		delete(p.containers, opts.ID)
+		return nil, nil, err
+	}
+	p.containers[opts.ID] = &podContainer{hc: hc, resources: resources}
+	defer func() {
+		if err != nil {
+			p.removeContainer(opts.ID)
+		}
+	}()
+	if p.destroyed {
+		return nil, nil, fmt.Errorf("pod %s was destroyed while container %s was created", p.id, opts.ID)
+	}
+	if err := p.save(); err != nil {
+		return nil, nil, err
+	}
+	logrus.Debugf("hcsoci::Pod::AddContainer %s added to pod %s", opts.ID, p.id)
+	return hc, resources, nil
+}
+
+// reserve reserves the ID of a container to be created in the pod.
+func (p *Pod) reserve(id string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.destroyed {
+		return fmt.Errorf("pod %s has been destroyed", p.id)
+	}
+	if _, ok := p.containers[id]; ok {
+		return fmt.Errorf("container %s is already in pod %s", id, p.id)
+	}
+	p.containers[id] = &podContainer{creating: true}
+	return nil
+}
+
+// ReleaseContainer releases the resources allocated to a container in the pod
+// in the same way as ReleaseResources. If all is set the container is also
+// removed from the pod; otherwise only its storage is released.
+func (p *Pod) ReleaseContainer(id string, all bool) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, err := p.container(id)
+	if err != nil {
+		return err
+	}
+	if err := ReleaseResources(c.resources, p.vm, all); err != nil {
+		return err
+	}
+	if !all {
+		return nil
+	}
+	if c.hc != nil {
+		c.hc.Close()
+	}
+	delete(p.containers, id)
+	return p.save()
+}
+
+// AddNetworkEndpoint adds an HNS endpoint to a running container in the pod, as
+// AddNetworkEndpoint, returning the container's updated resources.
+func (p *Pod) AddNetworkEndpoint(id, endpointID string) (*Resources, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, err := p.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := AddNetworkEndpoint(c.resources, p.vm, endpointID); err != nil {
+		return nil, err
+	}
+	return c.resources, nil
+}
+
+// RemoveNetworkEndpoint removes an HNS endpoint added to a container in the pod
+// by AddNetworkEndpoint, returning the container's updated resources.
+func (p *Pod) RemoveNetworkEndpoint(id, endpointID string) (*Resources, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, err := p.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := RemoveNetworkEndpoint(c.resources, p.vm, endpointID); err != nil {
+		return nil, err
+	}
+	return c.resources, nil
+}
+
+// AddMount adds a bind mount to a running container in the pod, as AddMount,
+// returning the container's updated resources.
+func (p *Pod) AddMount(id string, mount specs.Mount) (*Resources, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, err := p.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.hc == nil {
+		return nil, fmt.Errorf("container %s is not running in pod %s", id, p.id)
+	}
+	if err := AddMount(c.hc, c.resources, p.vm, mount); err != nil {
+		return nil, err
+	}
+	return c.resources, nil
+}
+
+// RemoveMount removes a mount added to a container in the pod by AddMount,
+// returning the container's updated resources.
+func (p *Pod) RemoveMount(id string, containerPath string) (*Resources, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, err := p.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.hc == nil {
+		return nil, fmt.Errorf("container %s is not running in pod %s", id, p.id)
+	}
+	if err := RemoveMount(c.hc, c.resources, p.vm, containerPath); err != nil {
+		return nil, err
+	}
+	return c.resources, nil
+}
+
+// RemoveContainer terminates a container in the pod if it is still running,
+// releases its resources and removes it from the pod.
+func (p *Pod) RemoveContainer(id string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, err := p.container(id); err != nil {
+		return err
+	}
+	if err := p.removeContainer(id); err != nil {
+		return err
+	}
+	return p.save()
+}
+
+// removeContainer terminates a container and releases its resources. The lock
+// must be held.
+func (p *Pod) removeContainer(id string) error {
+	c := p.containers[id]
+	if c.hc != nil {
+		err := c.hc.Terminate()
+		if hcs.IsPending(err) {
+			err = c.hc.Wait()
+		}
+		if err != nil && !hcs.IsAlreadyStopped(err) && !hcs.IsAlreadyClosed(err) && !hcs.IsNotExist(err) {
+			return err
+		}
+		c.hc.Close()
+		c.hc = nil
+	}
+	if err := ReleaseResources(c.resources, p.vm, true); err != nil {
+		return err
+	}
+	delete(p.containers, id)
+	logrus.Debugf("hcsoci::Pod::RemoveContainer %s removed from pod %s", id, p.id)
+	return nil
+}
+
+// Destroy removes every container in the pod, terminates its utility VM and
+// removes the network namespace if the pod created it.
+func (p *Pod) Destroy() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	logrus.Debugf("hcsoci::Pod::Destroy %s", p.id)
+	p.destroyed = true
+	var firstErr error
+	for _, id := range p.containerIDs() {
+		if err := p.removeContainer(id); err != nil {
+			logrus.Warnf("failed to remove container %s from pod %s: %s", id, p.id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if p.vm != nil {
+		if err := p.vm.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		p.vm = nil
+	}
+	if p.createdNetNS {
+		endpoints, err := hns.GetNamespaceEndpoints(p.netNS)
+		if err == nil {
+			for _, endpointID := range endpoints {
+				if err := hns.RemoveNamespaceEndpoint(p.netNS, endpointID); err != nil && !os.IsNotExist(err) {
+					logrus.Warnf("failed to remove endpoint %s from namespace %s: %s", endpointID, p.netNS, err)
+				}
+			}
+		}
+		if err := hns.RemoveNamespace(p.netNS); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		p.createdNetNS = false
+	}
+	return firstErr
+}
@@ -0,0 +1,151 @@
+// +build windows
+
+package hcsoci
+
+import (
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Unit tests for the pod operations which do not need HCS
+
+func newTestPod(descs *[]*PodDescription) *Pod {
+	return &Pod{
+		id:         "pod",
+		netNS:      "netns",
+		containers: make(map[string]*podContainer),
+		persist: func(d *PodDescription) error {
+			*descs = append(*descs, d)
+			return nil
+		},
+	}
+}
+
+func TestPodAddContainerValidation(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	p.containers["c1"] = &podContainer{resources: &Resources{}}
+	for _, opts := range []*CreateOptions{
+		nil,
+		{Spec: &specs.Spec{}},
+		{ID: "c2"},
+		{ID: "c1", Spec: &specs.Spec{}},
+	} {
+		if _, _, err := p.AddContainer(opts); err == nil {
+			t.Errorf("expected an error adding %+v", opts)
+		}
+	}
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.AddContainer(&CreateOptions{ID: "c2", Spec: &specs.Spec{}}); err == nil {
+		t.Error("expected an error adding a container to a destroyed pod")
+	}
+	if len(descs) != 0 {
+		t.Errorf("unexpected descriptions persisted: %v", descs)
+	}
+}
+
+func TestPodAddContainerNetworkNamespace(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	_, _, err := p.AddContainer(&CreateOptions{ID: "c1", Spec: &specs.Spec{}, NetworkNamespace: "other"})
+	if err == nil {
+		t.Fatal("expected an error adding a container in another network namespace")
+	}
+	if _, ok := p.containers["c1"]; ok {
+		t.Error("the container was reserved despite the error")
+	}
+}
+
+func TestPodReservedContainer(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	// A container being created by AddContainer has its ID reserved.
+	if err := p.reserve("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.AddContainer(&CreateOptions{ID: "c1", Spec: &specs.Spec{}}); err == nil {
+		t.Error("expected an error adding a container being created")
+	}
+	if err := p.RemoveContainer("c1"); err == nil {
+		t.Error("expected an error removing a container being created")
+	}
+	if _, err := p.AddNetworkEndpoint("c1", "endpoint"); err == nil {
+		t.Error("expected an error adding an endpoint to a container being created")
+	}
+	if ids := p.Containers(); len(ids) != 0 {
+		t.Errorf("a container being created is listed: %v", ids)
+	}
+	// Destroying the pod leaves the container to AddContainer.
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.containers["c1"]; !ok {
+		t.Error("destroy removed a container being created")
+	}
+}
+
+func TestPodAddContainerDoesNotModifySpec(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	spec := &specs.Spec{Windows: &specs.Windows{}}
+	// There are no layers, so creating the container fails.
+	if _, _, err := p.AddContainer(&CreateOptions{ID: "c1", Spec: spec}); err == nil {
+		t.Fatal("expected an error creating a container without layers")
+	}
+	if spec.Windows.Network != nil {
+		t.Errorf("the caller's spec was modified: %+v", spec.Windows)
+	}
+	if _, ok := p.containers["c1"]; ok {
+		t.Error("a container which failed to be created is still reserved")
+	}
+	linux := &specs.Spec{Linux: &specs.Linux{}}
+	p.AddContainer(&CreateOptions{ID: "c2", Spec: linux})
+	if linux.Windows != nil {
+		t.Errorf("a Windows section was added to a Linux spec: %+v", linux.Windows)
+	}
+}
+
+func TestPodRemoveContainer(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	if err := p.RemoveContainer("c1"); err == nil {
+		t.Error("expected an error removing a container not in the pod")
+	}
+	// A container whose creation failed has resources but no compute system.
+	p.containers["c1"] = &podContainer{resources: &Resources{}}
+	p.containers["c2"] = &podContainer{resources: &Resources{}}
+	if err := p.RemoveContainer("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := p.Containers(); !reflect.DeepEqual(ids, []string{"c2"}) {
+		t.Errorf("unexpected containers after removal: %v", ids)
+	}
+	expected := &PodDescription{ID: "pod", NetworkNamespace: "netns", Containers: []string{"c2"}}
+	if len(descs) != 1 || !reflect.DeepEqual(descs[0], expected) {
+		t.Errorf("unexpected descriptions persisted: %+v", descs)
+	}
+}
+
+func TestPodDestroy(t *testing.T) {
+	var descs []*PodDescription
+	p := newTestPod(&descs)
+	p.containers["c1"] = &podContainer{resources: &Resources{}}
+	p.containers["c2"] = &podContainer{resources: &Resources{}}
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := p.Containers(); len(ids) != 0 {
+		t.Errorf("unexpected containers after destroy: %v", ids)
+	}
+	if !p.destroyed {
+		t.Error("pod was not marked destroyed")
+	}
+	// Destroying a pod again succeeds, as CreatePod does on failure.
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
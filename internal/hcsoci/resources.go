@@ -1,6 +1,7 @@
 package hcsoci
 
 import (
+	"encoding/json"
 	"os"
 
 	"github.com/Microsoft/hcsshim/internal/hns"
@@ -13,10 +14,23 @@ func (r *Resources) NetNS() string {
 	return r.netNS
 }
 
+// vsmbMount is a directory or file shared into a utility VM for a mount.
+type vsmbMount struct {
+	hostPath string
+	options  *uvm.VSMBOptions
+}
+
+// plan9Mount is a directory shared into an LCOW utility VM for a mount.
+type plan9Mount struct {
+	hostPath string
+	uvmPath  string
+}
+
 // Resources is the structure returned as part of creating a container. It holds
 // nothing useful to clients, hence everything is lowercased. A client would use
 // it in a call to ReleaseResource to ensure everything is cleaned up when a
-// container exits.
+// container exits. It can be marshaled as JSON for a client to persist it,
+// including the changes made by AddNetworkEndpoint and the like.
 type Resources struct {
 	// containerRootInUVM is the base path in a utility VM where elements relating
 	// to a container are exposed. For example, the mounted filesystem; the runtime
@@ -31,13 +45,13 @@ type Resources struct {
 	// the host in the case or a WCOW Argon, or in a utility VM for WCOW Xenon and LCOW.
 	layers []string
 
-	// vsmbMounts is an array of the host-paths mounted into a utility VM to support
-	// (bind-)mounts into a WCOW v2 Xenon.
-	vsmbMounts []string
+	// vsmbMounts is an array of the host-paths and options mounted into a utility VM
+	// to support (bind-)mounts into a WCOW v2 Xenon.
+	vsmbMounts []vsmbMount
 
-	// plan9Mounts is an array of all the host paths which have been added to
-	// an LCOW utility VM
-	plan9Mounts []string
+	// plan9Mounts is an array of all the host paths, and the paths they are
+	// shared at, which have been added to an LCOW utility VM
+	plan9Mounts []plan9Mount
 
 	// netNS is the network namespace
 	netNS string
@@ -50,9 +64,132 @@ type Resources struct {
 
 	// addedNetNSToVM indicates if the network namespace has been added to the containers utility VM
 	addedNetNSToVM bool
+
+	// addedEndpoints is the list of network endpoints added to the running container
+	// by AddNetworkEndpoint
+	addedEndpoints []string
+
+	// addedMounts is the list of mounts added to the running container by AddMount.
+	// Shares backing them in a utility VM are also in vsmbMounts or plan9Mounts.
+	addedMounts       []addedMount
+	addedMountCounter uint64
+
+	// committedID is the ID of the container when its memory, processors and
+	// devices have been committed to the utility VM's budget.
+	committedID string
+}
+
+// resourcesJSON is the persisted form of Resources, so that a client which
+// records them can release them from another process.
+type resourcesJSON struct {
+	ContainerRootInUVM string           `json:",omitempty"`
+	Layers             []string         `json:",omitempty"`
+	VSMBMounts         []vsmbMountJSON  `json:",omitempty"`
+	Plan9Mounts        []plan9MountJSON `json:",omitempty"`
+	NetNS              string           `json:",omitempty"`
+	NetworkEndpoints   []string         `json:",omitempty"`
+	CreatedNetNS       bool             `json:",omitempty"`
+	AddedNetNSToVM     bool             `json:",omitempty"`
+	AddedEndpoints     []string         `json:",omitempty"`
+	AddedMounts        []addedMountJSON `json:",omitempty"`
+	AddedMountCounter  uint64           `json:",omitempty"`
+	CommittedID        string           `json:",omitempty"`
+}
+
+type vsmbMountJSON struct {
+	HostPath string
+	Options  *uvm.VSMBOptions
+}
+
+type addedMountJSON struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool             `json:",omitempty"`
+	UVMPath       string           `json:",omitempty"`
+	VSMBOptions   *uvm.VSMBOptions `json:",omitempty"`
+}
+
+type plan9MountJSON struct {
+	HostPath string
+	UVMPath  string
+}
+
+// MarshalJSON marshals the resources so that they can be persisted and later
+// released by ReleaseResources.
+func (r *Resources) MarshalJSON() ([]byte, error) {
+	j := &resourcesJSON{
+		ContainerRootInUVM: r.containerRootInUVM,
+		Layers:             r.layers,
+		NetNS:              r.netNS,
+		NetworkEndpoints:   r.networkEndpoints,
+		CreatedNetNS:       r.createdNetNS,
+		AddedNetNSToVM:     r.addedNetNSToVM,
+		AddedEndpoints:     r.addedEndpoints,
+		AddedMountCounter:  r.addedMountCounter,
+		CommittedID:        r.committedID,
+	}
+	for _, m := range r.vsmbMounts {
+		j.VSMBMounts = append(j.VSMBMounts, vsmbMountJSON{HostPath: m.hostPath, Options: m.options})
+	}
+	for _, m := range r.plan9Mounts {
+		j.Plan9Mounts = append(j.Plan9Mounts, plan9MountJSON{HostPath: m.hostPath, UVMPath: m.uvmPath})
+	}
+	for _, m := range r.addedMounts {
+		j.AddedMounts = append(j.AddedMounts, addedMountJSON{
+			HostPath:      m.hostPath,
+			ContainerPath: m.containerPath,
+			ReadOnly:      m.readOnly,
+			UVMPath:       m.uvmPath,
+			VSMBOptions:   m.vsmbOptions,
+		})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON unmarshals resources marshaled by MarshalJSON.
+func (r *Resources) UnmarshalJSON(b []byte) error {
+	var j resourcesJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*r = Resources{
+		containerRootInUVM: j.ContainerRootInUVM,
+		layers:             j.Layers,
+		netNS:              j.NetNS,
+		networkEndpoints:   j.NetworkEndpoints,
+		createdNetNS:       j.CreatedNetNS,
+		addedNetNSToVM:     j.AddedNetNSToVM,
+		addedEndpoints:     j.AddedEndpoints,
+		addedMountCounter:  j.AddedMountCounter,
+		committedID:        j.CommittedID,
+	}
+	for _, m := range j.VSMBMounts {
+		r.vsmbMounts = append(r.vsmbMounts, vsmbMount{hostPath: m.HostPath, options: m.Options})
+	}
+	for _, m := range j.Plan9Mounts {
+		r.plan9Mounts = append(r.plan9Mounts, plan9Mount{hostPath: m.HostPath, uvmPath: m.UVMPath})
+	}
+	for _, m := range j.AddedMounts {
+		r.addedMounts = append(r.addedMounts, addedMount{
+			hostPath:      m.HostPath,
+			containerPath: m.ContainerPath,
+			readOnly:      m.ReadOnly,
+			uvmPath:       m.UVMPath,
+			vsmbOptions:   m.VSMBOptions,
+		})
+	}
+	return nil
 }
 
 func ReleaseResources(r *Resources, vm *uvm.UtilityVM, all bool) error {
+	for len(r.addedEndpoints) != 0 {
+		endpoint := r.addedEndpoints[len(r.addedEndpoints)-1]
+		if err := removeNetworkEndpoint(r, vm, endpoint); err != nil {
+			return err
+		}
+		r.addedEndpoints = r.addedEndpoints[:len(r.addedEndpoints)-1]
+	}
+
 	if vm != nil && r.addedNetNSToVM {
 		err := vm.RemoveNetNS(r.netNS)
 		if err != nil {
@@ -94,9 +231,14 @@ func ReleaseResources(r *Resources, vm *uvm.UtilityVM, all bool) error {
 	}
 
 	if all {
+		if vm != nil && r.committedID != "" {
+			vm.Uncommit(r.committedID)
+			r.committedID = ""
+		}
+
 		for len(r.vsmbMounts) != 0 {
 			mount := r.vsmbMounts[len(r.vsmbMounts)-1]
-			if err := vm.RemoveVSMB(mount); err != nil {
+			if err := vm.RemoveVSMB(mount.hostPath, mount.options); err != nil {
 				return err
 			}
 			r.vsmbMounts = r.vsmbMounts[:len(r.vsmbMounts)-1]
@@ -104,7 +246,7 @@ func ReleaseResources(r *Resources, vm *uvm.UtilityVM, all bool) error {
 
 		for len(r.plan9Mounts) != 0 {
 			mount := r.plan9Mounts[len(r.plan9Mounts)-1]
-			if err := vm.RemovePlan9(mount); err != nil {
+			if err := vm.RemovePlan9(mount.hostPath, mount.uvmPath); err != nil {
 				return err
 			}
 			r.plan9Mounts = r.plan9Mounts[:len(r.plan9Mounts)-1]
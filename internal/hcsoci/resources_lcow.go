@@ -7,9 +7,11 @@ package hcsoci
 import (
 	"fmt"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/Microsoft/hcsshim/internal/lcow"
 	"github.com/Microsoft/hcsshim/internal/schema2"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
@@ -23,6 +25,15 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 		coi.Spec.Root = &specs.Root{}
 	}
 	if coi.Spec.Root.Path == "" {
+		scratchSizeGB, err := parseScratchSizeGB(coi.Spec)
+		if err != nil {
+			return err
+		}
+		if scratchSizeGB != 0 && coi.HostingSystem != nil {
+			if err := expandScratch(coi.Spec.Windows.LayerFolders, scratchSizeGB); err != nil {
+				return err
+			}
+		}
 		logrus.Debugln("hcsshim::allocateLinuxResources mounting storage")
 		mcl, err := mountContainerLayers(coi.Spec.Windows.LayerFolders, resources.containerRootInUVM, coi.HostingSystem)
 		if err != nil {
@@ -34,6 +45,13 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 			coi.Spec.Root.Path = mcl.(schema2.CombinedLayersV2).ContainerRootPath // v2 Xenon LCOW
 		}
 		resources.layers = coi.Spec.Windows.LayerFolders
+		if scratchSizeGB != 0 && coi.HostingSystem != nil {
+			// Grow the file system to the disk, which may have been expanded
+			// now or when the container was previously created.
+			if err := lcow.ResizeScratchFilesystem(coi.HostingSystem, path.Join(resources.containerRootInUVM, scratchPath)); err != nil {
+				return err
+			}
+		}
 	} else {
 		// This is the "Plan 9" root filesystem.
 		// TODO: We need a test for this. Ask @jstarks how you can even lay this out on Windows.
@@ -48,7 +66,7 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 			return fmt.Errorf("adding plan9 root: %s", err)
 		}
 		coi.Spec.Root.Path = uvmPathForContainersFileSystem
-		resources.plan9Mounts = append(resources.plan9Mounts, hostPath)
+		resources.plan9Mounts = append(resources.plan9Mounts, plan9Mount{hostPath: hostPath, uvmPath: uvmPathForContainersFileSystem})
 	}
 
 	for i, mount := range coi.Spec.Mounts {
@@ -77,9 +95,20 @@ func allocateLinuxResources(coi *createOptionsInternal, resources *Resources) er
 				return fmt.Errorf("adding plan9 mount %+v: %s", mount, err)
 			}
 			coi.Spec.Mounts[i].Source = uvmPathForShare
-			resources.plan9Mounts = append(resources.plan9Mounts, hostPath)
+			resources.plan9Mounts = append(resources.plan9Mounts, plan9Mount{hostPath: hostPath, uvmPath: uvmPathForShare})
 		}
 	}
 
 	return nil
 }
+
+// expandScratch expands the VHDX of the scratch layer of an LCOW container to
+// at least sizeGB before it is attached.
+func expandScratch(layerFolders []string, sizeGB uint32) error {
+	if len(layerFolders) == 0 {
+		return fmt.Errorf("no scratch layer to expand")
+	}
+	hostPath := filepath.Join(layerFolders[len(layerFolders)-1], "sandbox.vhdx")
+	logrus.Debugf("hcsshim::expandScratch %s to at least %dGB", hostPath, sizeGB)
+	return lcow.ExpandScratchVhdx(hostPath, sizeGB)
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/Microsoft/hcsshim/internal/wclayer"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
@@ -69,21 +70,27 @@ func allocateWindowsResources(coi *createOptionsInternal, resources *Resources)
 
 		if coi.HostingSystem != nil && coi.actualSchemaVersion.IsV20() {
 			logrus.Debugf("hcsshim::allocateWindowsResources Hot-adding VSMB share for OCI mount %+v", mount)
-			var flags int32 = schema2.VsmbFlagNone
-			for _, o := range mount.Options {
-				if strings.ToLower(o) == "ro" {
-					flags = schema2.VsmbFlagReadOnly | schema2.VsmbFlagCacheIO | schema2.VsmbFlagShareRead | schema2.VsmbFlagForceLevelIIOplocks
-					break
-				}
-			}
-
-			err := coi.HostingSystem.AddVSMB(mount.Source, "", flags)
+			options := vsmbOptionsForMount(mount)
+			err := coi.HostingSystem.AddVSMB(mount.Source, "", options)
 			if err != nil {
 				return fmt.Errorf("failed to add VSMB share to utility VM for mount %+v: %s", mount, err)
 			}
-			resources.vsmbMounts = append(resources.vsmbMounts, mount.Source)
+			resources.vsmbMounts = append(resources.vsmbMounts, vsmbMount{hostPath: mount.Source, options: options})
 		}
 	}
 
 	return nil
 }
+
+// vsmbOptionsForMount returns the VSMB options for sharing the source of an OCI
+// mount into a utility VM. The source may be a directory or a single file.
+func vsmbOptionsForMount(mount specs.Mount) *uvm.VSMBOptions {
+	readOnly := false
+	for _, o := range mount.Options {
+		if strings.ToLower(o) == "ro" {
+			readOnly = true
+			break
+		}
+	}
+	return uvm.DefaultVSMBOptions(readOnly)
+}
@@ -0,0 +1,94 @@
+package hcsoci
+
+import (
+	"errors"
+	"fmt"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ParseSandboxAnnotations returns the ID of the sandbox (pod) a container
+// belongs to from the annotations set by Kubernetes container runtimes, and
+// whether the container is the sandbox container itself. The ID is empty if
+// the container is not part of a sandbox.
+func ParseSandboxAnnotations(spec *specs.Spec) (string, bool) {
+	a := spec.Annotations
+	var t, id string
+	if t = a["io.kubernetes.cri.container-type"]; t != "" {
+		id = a["io.kubernetes.cri.sandbox-id"]
+	} else if t = a["io.kubernetes.cri-o.ContainerType"]; t != "" {
+		id = a["io.kubernetes.cri-o.SandboxID"]
+	} else if t = a["io.kubernetes.docker.type"]; t != "" {
+		id = a["io.kubernetes.sandbox.id"]
+		if t == "podsandbox" {
+			t = "sandbox"
+		}
+	}
+	if t == "container" {
+		return id, false
+	}
+	if t == "sandbox" {
+		return id, true
+	}
+	return "", false
+}
+
+// PodMembership describes where a container is created: the sandbox it
+// belongs to, and the container whose utility VM hosts it.
+type PodMembership struct {
+	SandboxID string // The sandbox the container belongs to, if any
+	HostID    string // The container whose utility VM hosts the container, if any
+	IsHost    bool   // Whether the container's utility VM is created with it
+}
+
+// ResolvePodMembership determines the membership of the container id from the
+// sandbox annotations of its spec and hostID, the container whose utility VM is
+// requested to host it, if any. lookup returns the membership of an existing
+// container. A VM isolated sandbox container, or a Linux container outside a
+// sandbox, hosts its own utility VM unless a host is requested. Other
+// containers in a sandbox join the sandbox's host.
+func ResolvePodMembership(id string, spec *specs.Spec, hostID string, lookup func(id string) (*PodMembership, error)) (*PodMembership, error) {
+	vmisolated := spec.Linux != nil || (spec.Windows != nil && spec.Windows.HyperV != nil)
+
+	sandboxID, isSandbox := ParseSandboxAnnotations(spec)
+	if isSandbox {
+		if sandboxID != id {
+			return nil, errors.New("sandbox ID must match ID")
+		}
+	} else if sandboxID != "" {
+		// Validate that the sandbox container exists.
+		sandbox, err := lookup(sandboxID)
+		if err != nil {
+			return nil, err
+		}
+		if sandbox.SandboxID != sandboxID {
+			return nil, fmt.Errorf("container %s is not a sandbox", sandboxID)
+		}
+		if hostID == "" {
+			// Use the sandbox's host.
+			hostID = sandbox.HostID
+		} else if sandbox.HostID == "" {
+			return nil, fmt.Errorf("sandbox container %s is not running in a VM host, but host %s was specified", sandboxID, hostID)
+		} else if hostID != sandbox.HostID {
+			return nil, fmt.Errorf("sandbox container %s has a different host %s from the requested host %s", sandboxID, sandbox.HostID, hostID)
+		}
+		if vmisolated && hostID == "" {
+			return nil, fmt.Errorf("container %s is not a VM isolated sandbox", sandboxID)
+		}
+	}
+
+	m := &PodMembership{SandboxID: sandboxID, HostID: hostID}
+	if hostID != "" {
+		host, err := lookup(hostID)
+		if err != nil {
+			return nil, err
+		}
+		if !host.IsHost {
+			return nil, fmt.Errorf("host container %s is not a VM host", hostID)
+		}
+	} else if vmisolated && (isSandbox || spec.Linux != nil) {
+		m.HostID = id
+		m.IsHost = true
+	}
+	return m, nil
+}
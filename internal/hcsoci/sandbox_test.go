@@ -0,0 +1,86 @@
+package hcsoci
+
+import (
+	"fmt"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseSandboxAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		id          string
+		isSandbox   bool
+	}{
+		{nil, "", false},
+		{map[string]string{"io.kubernetes.cri.container-type": "sandbox", "io.kubernetes.cri.sandbox-id": "p1"}, "p1", true},
+		{map[string]string{"io.kubernetes.cri.container-type": "container", "io.kubernetes.cri.sandbox-id": "p1"}, "p1", false},
+		{map[string]string{"io.kubernetes.cri-o.ContainerType": "sandbox", "io.kubernetes.cri-o.SandboxID": "p2"}, "p2", true},
+		{map[string]string{"io.kubernetes.docker.type": "podsandbox", "io.kubernetes.sandbox.id": "p3"}, "p3", true},
+		{map[string]string{"io.kubernetes.docker.type": "container", "io.kubernetes.sandbox.id": "p3"}, "p3", false},
+		{map[string]string{"io.kubernetes.docker.type": "unknown", "io.kubernetes.sandbox.id": "p3"}, "", false},
+	} {
+		id, isSandbox := ParseSandboxAnnotations(&specs.Spec{Annotations: tc.annotations})
+		if id != tc.id || isSandbox != tc.isSandbox {
+			t.Errorf("%v: got (%q, %t), expected (%q, %t)", tc.annotations, id, isSandbox, tc.id, tc.isSandbox)
+		}
+	}
+}
+
+func TestResolvePodMembership(t *testing.T) {
+	existing := map[string]*PodMembership{
+		"vmsandbox": {SandboxID: "vmsandbox", HostID: "vmsandbox", IsHost: true},
+		"sandbox":   {SandboxID: "sandbox"},
+		"other":     {},
+		"vm":        {HostID: "vm", IsHost: true},
+	}
+	lookup := func(id string) (*PodMembership, error) {
+		if m, ok := existing[id]; ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("container %s does not exist", id)
+	}
+	cri := func(t, id string) map[string]string {
+		return map[string]string{"io.kubernetes.cri.container-type": t, "io.kubernetes.cri.sandbox-id": id}
+	}
+	linux := &specs.Linux{}
+	hyperv := &specs.Windows{HyperV: &specs.WindowsHyperV{}}
+	for _, tc := range []struct {
+		name     string
+		id       string
+		spec     specs.Spec
+		hostID   string
+		expected *PodMembership
+	}{
+		{"argon", "c", specs.Spec{}, "", &PodMembership{}},
+		{"xenon", "c", specs.Spec{Windows: hyperv}, "", &PodMembership{}},
+		{"lcow", "c", specs.Spec{Linux: linux}, "", &PodMembership{HostID: "c", IsHost: true}},
+		{"lcow in host", "c", specs.Spec{Linux: linux}, "vm", &PodMembership{HostID: "vm"}},
+		{"host not a host", "c", specs.Spec{Linux: linux}, "other", nil},
+		{"missing host", "c", specs.Spec{Linux: linux}, "missing", nil},
+		{"xenon sandbox", "p", specs.Spec{Windows: hyperv, Annotations: cri("sandbox", "p")}, "", &PodMembership{SandboxID: "p", HostID: "p", IsHost: true}},
+		{"argon sandbox", "p", specs.Spec{Annotations: cri("sandbox", "p")}, "", &PodMembership{SandboxID: "p"}},
+		{"sandbox ID mismatch", "p", specs.Spec{Annotations: cri("sandbox", "q")}, "", nil},
+		{"in vm sandbox", "c", specs.Spec{Linux: linux, Annotations: cri("container", "vmsandbox")}, "", &PodMembership{SandboxID: "vmsandbox", HostID: "vmsandbox"}},
+		{"in argon sandbox", "c", specs.Spec{Annotations: cri("container", "sandbox")}, "", &PodMembership{SandboxID: "sandbox"}},
+		{"vm in argon sandbox", "c", specs.Spec{Linux: linux, Annotations: cri("container", "sandbox")}, "", nil},
+		{"other host than sandbox", "c", specs.Spec{Linux: linux, Annotations: cri("container", "vmsandbox")}, "vm", nil},
+		{"host for argon sandbox", "c", specs.Spec{Annotations: cri("container", "sandbox")}, "vm", nil},
+		{"not a sandbox", "c", specs.Spec{Annotations: cri("container", "other")}, "", nil},
+		{"missing sandbox", "c", specs.Spec{Annotations: cri("container", "missing")}, "", nil},
+	} {
+		m, err := ResolvePodMembership(tc.id, &tc.spec, tc.hostID, lookup)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.name, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if *m != *tc.expected {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, m, tc.expected)
+		}
+	}
+}
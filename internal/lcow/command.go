@@ -0,0 +1,200 @@
+package lcow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCapturedStderr is the most stderr of a command kept in its result.
+	maxCapturedStderr = 64 * 1024
+	// maxExitErrorStderr is the most stderr of a command included in an
+	// ExitError.
+	maxExitErrorStderr = 1024
+)
+
+// CommandOptions are the options for running a command in a Linux utility VM.
+type CommandOptions struct {
+	Stdin  io.Reader // Optional data for the command's stdin
+	Stdout io.Writer // Optional writer for the command's stdout. If nil, stdout is returned in the result
+	Env    []string  // Optional environment, as KEY=value
+	Cwd    string    // Optional working directory. Defaults to /
+
+	// Timeout is how long stdio may be idle, and how long to wait for the
+	// command to exit once its stdio is complete. Defaults to four minutes;
+	// negative means no timeout, for long-running commands such as servers.
+	Timeout time.Duration
+	// Context optionally cancels the command, which is then killed.
+	Context context.Context
+}
+
+// CommandResult is the result of a command which ran to completion.
+type CommandResult struct {
+	ExitCode int
+	Stdout   []byte // Unless CommandOptions.Stdout was supplied
+	Stderr   []byte // Up to the first 64KB
+	Duration time.Duration
+}
+
+// ExitError is returned when a command exits with a non-zero exit code.
+type ExitError struct {
+	Args     []string
+	ExitCode int
+	Stderr   string // Up to the first 1KB of stderr, with surrounding whitespace removed
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("`%s` returned non-zero exit code (%d)", strings.Join(e.Args, " "), e.ExitCode)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// IsExitError returns whether err is an *ExitError, ie the command ran but
+// failed.
+func IsExitError(err error) bool {
+	_, ok := err.(*ExitError)
+	return ok
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// RunCommand runs a command in a Linux utility VM and waits for it to exit.
+// The result is returned whatever the exit code; an *ExitError is also
+// returned if it is non-zero. Other errors mean the command could not be run
+// to completion, and no result is returned.
+func RunCommand(lcowUVM *uvm.UtilityVM, args []string, opts *CommandOptions) (*CommandResult, error) {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return nil, fmt.Errorf("RunCommand requires a linux utility VM")
+	}
+	return runCommand(lcowUVM.ComputeSystem(), true, args, opts)
+}
+
+// runCommand runs a command in a utility VM or in a container, as RunCommand.
+func runCommand(system *hcs.System, inUVM bool, args []string, opts *CommandOptions) (*CommandResult, error) {
+	if opts == nil {
+		opts = &CommandOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeoutSeconds
+	}
+	copyTimeout := timeout
+	if timeout < 0 {
+		copyTimeout = 0
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	command := strings.Join(args, " ")
+	logrus.Debugf("hcsshim::lcow::runCommand `%s` in %s", command, system.ID())
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	var stdout bytes.Buffer
+	stderr := &limitedBuffer{max: maxCapturedStderr}
+	processOpts := &ProcessOptions{
+		HCSSystem:         system,
+		Process:           &specs.Process{Args: quoted, Env: opts.Env, Cwd: opts.Cwd},
+		CreateInUtilityVm: inUVM,
+		Stdin:             opts.Stdin,
+		Stdout:            opts.Stdout,
+		Stderr:            stderr,
+		CopyTimeout:       copyTimeout,
+		Context:           ctx,
+	}
+	if opts.Stdout == nil {
+		processOpts.Stdout = &stdout
+	}
+
+	start := time.Now()
+	proc, _, err := CreateProcess(processOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run `%s` in %s: %s", command, system.ID(), err)
+	}
+	defer proc.Close()
+
+	waited := make(chan error, 1)
+	go func() {
+		if timeout < 0 {
+			waited <- proc.Wait()
+		} else {
+			waited <- proc.WaitTimeout(timeout)
+		}
+	}()
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		proc.Kill()
+		err = ctx.Err()
+	}
+	if err != nil {
+		proc.Kill()
+		return nil, fmt.Errorf("failed waiting for `%s` in %s: %s", command, system.ID(), err)
+	}
+	exitCode, err := proc.ExitCode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exit code from `%s` in %s: %s", command, system.ID(), err)
+	}
+
+	result := &CommandResult{
+		ExitCode: exitCode,
+		Stderr:   stderr.Bytes(),
+		Duration: time.Since(start),
+	}
+	if opts.Stdout == nil {
+		result.Stdout = stdout.Bytes()
+	}
+	logrus.Debugf("hcsshim::lcow::runCommand `%s` in %s exited with %d after %s", command, system.ID(), exitCode, result.Duration)
+	if exitCode != 0 {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxExitErrorStderr || stderr.truncated {
+			if len(msg) > maxExitErrorStderr {
+				msg = msg[:maxExitErrorStderr]
+			}
+			msg += "... (truncated)"
+		}
+		return result, &ExitError{Args: args, ExitCode: exitCode, Stderr: msg}
+	}
+	return result, nil
+}
+
+// shellQuote quotes an argument for the command line of a process in the
+// guest, which is split into arguments using shell quoting rules.
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:@+,", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,128 @@
+package lcow
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/archive"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/sirupsen/logrus"
+)
+
+// CopyOptions are the options for copying files into and out of a Linux
+// utility VM or container.
+type CopyOptions struct {
+	Progress func(int64)   // Optional. Called with the cumulative number of bytes of file content copied
+	Timeout  time.Duration // Timeout for copying data and for each guest process to exit. Defaults to four minutes
+}
+
+// CopyToUVM copies a file or directory on the host into a Linux utility VM,
+// in the same way as `docker cp`. If uvmPath is an existing directory, hostPath
+// is copied into it; otherwise hostPath is copied to uvmPath, whose parent
+// directory must exist. Modes, owners and modification times are preserved.
+func CopyToUVM(lcowUVM *uvm.UtilityVM, hostPath, uvmPath string, opts *CopyOptions) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("CopyToUVM requires a linux utility VM")
+	}
+	return copyIn(lcowUVM.ComputeSystem(), true, hostPath, uvmPath, opts)
+}
+
+// CopyFromUVM copies a file or directory in a Linux utility VM to the host,
+// in the same way as `docker cp`. If hostPath is an existing directory,
+// uvmPath is copied into it; otherwise uvmPath is copied to hostPath.
+func CopyFromUVM(lcowUVM *uvm.UtilityVM, uvmPath, hostPath string, opts *CopyOptions) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("CopyFromUVM requires a linux utility VM")
+	}
+	return copyOut(lcowUVM.ComputeSystem(), true, uvmPath, hostPath, opts)
+}
+
+// CopyToContainer copies a file or directory on the host into a running
+// Linux container. It behaves as CopyToUVM.
+func CopyToContainer(container *hcs.System, hostPath, containerPath string, opts *CopyOptions) error {
+	return copyIn(container, false, hostPath, containerPath, opts)
+}
+
+// CopyFromContainer copies a file or directory in a running Linux container to
+// the host. It behaves as CopyFromUVM.
+func CopyFromContainer(container *hcs.System, containerPath, hostPath string, opts *CopyOptions) error {
+	return copyOut(container, false, containerPath, hostPath, opts)
+}
+
+func copyIn(system *hcs.System, inUVM bool, hostPath, guestPath string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	guestPath = path.Clean(guestPath)
+	logrus.Debugf("hcsshim::lcow::copyIn %s to %s in %s", hostPath, guestPath, system.ID())
+	if _, err := os.Lstat(hostPath); err != nil {
+		return err
+	}
+
+	// The top-level entry of the tar is named as the destination unless that
+	// is an existing directory, in which case it keeps its own name.
+	isDir, err := guestIsDir(system, inUVM, guestPath, opts)
+	if err != nil {
+		return err
+	}
+	dir, name := path.Dir(guestPath), path.Base(guestPath)
+	if isDir {
+		dir, name = guestPath, ""
+	}
+
+	r, w := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		err := archive.Write(w, hostPath, name, opts.Progress)
+		w.CloseWithError(err)
+		archived <- err
+	}()
+
+	// Owners, modes and modification times are preserved by tar when run as
+	// root, as processes in the utility VM are.
+	_, err = runCommand(system, inUVM, []string{"tar", "-xf", "-", "-C", dir}, &CommandOptions{Stdin: r, Timeout: opts.Timeout})
+	r.CloseWithError(err)
+	if aerr := <-archived; aerr != nil && aerr != err {
+		return fmt.Errorf("failed to archive %s: %s", hostPath, aerr)
+	}
+	return err
+}
+
+func copyOut(system *hcs.System, inUVM bool, guestPath, hostPath string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	guestPath = path.Clean(guestPath)
+	logrus.Debugf("hcsshim::lcow::copyOut %s in %s to %s", guestPath, system.ID(), hostPath)
+
+	r, w := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := archive.Extract(r, hostPath, opts.Progress)
+		r.CloseWithError(err)
+		extracted <- err
+	}()
+
+	_, err := runCommand(system, inUVM, []string{"tar", "-cf", "-", "-C", path.Dir(guestPath), path.Base(guestPath)}, &CommandOptions{Stdout: w, Timeout: opts.Timeout})
+	w.CloseWithError(err)
+	if xerr := <-extracted; xerr != nil && xerr != err {
+		err = fmt.Errorf("failed to extract %s to %s: %s", guestPath, hostPath, xerr)
+	}
+	return err
+}
+
+// guestIsDir returns whether guestPath is an existing directory in the guest.
+func guestIsDir(system *hcs.System, inUVM bool, guestPath string, opts *CopyOptions) (bool, error) {
+	_, err := runCommand(system, inUVM, []string{"test", "-d", guestPath}, &CommandOptions{Timeout: opts.Timeout})
+	if err == nil {
+		return true, nil
+	}
+	if IsExitError(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -1,55 +1,176 @@
 package lcow
 
-//func debugCommand(s string) string {
-//	return fmt.Sprintf(`echo -e 'DEBUG COMMAND: %s\\n--------------\\n';%s;echo -e '\\n\\n';`, s, s)
-//}
-
-// DebugLCOWGCS extracts logs from the GCS in LCOW. It's a useful hack for debugging,
-// but not necessarily optimal, but all that is available to us in RS3.
-//func (container *container) DebugLCOWGCS() {
-//	if logrus.GetLevel() < logrus.DebugLevel || len(os.Getenv("HCSSHIM_LCOW_DEBUG_ENABLE")) == 0 {
-//		return
-//	}
-
-//	var out bytes.Buffer
-//	cmd := os.Getenv("HCSSHIM_LCOW_DEBUG_COMMAND")
-//	if cmd == "" {
-//		cmd = `sh -c "`
-//		cmd += debugCommand("kill -10 `pidof gcs`") // SIGUSR1 for stackdump
-//		cmd += debugCommand("ls -l /tmp")
-//		cmd += debugCommand("cat /tmp/gcs.log")
-//		cmd += debugCommand("cat /tmp/gcs/gcs-stacks*")
-//		cmd += debugCommand("cat /tmp/gcs/paniclog*")
-//		cmd += debugCommand("ls -l /tmp/gcs")
-//		cmd += debugCommand("ls -l /tmp/gcs/*")
-//		cmd += debugCommand("cat /tmp/gcs/*/config.json")
-//		cmd += debugCommand("ls -lR /var/run/gcsrunc")
-//		cmd += debugCommand("cat /tmp/gcs/global-runc.log")
-//		cmd += debugCommand("cat /tmp/gcs/*/runc.log")
-//		cmd += debugCommand("ps -ef")
-//		cmd += `"`
-//	}
-
-//	proc, _, err := container.CreateProcessEx(
-//		&CreateProcessEx{
-//			OCISpecification: &specs.Spec{
-//				Process: &specs.Process{Args: []string{cmd}},
-//				Linux:   &specs.Linux{},
-//			},
-//			CreateInUtilityVm: true,
-//			Stdout:            &out,
-//		})
-//	defer func() {
-//		if proc != nil {
-//			proc.Kill()
-//			proc.Close()
-//		}
-//	}()
-//	if err != nil {
-//		logrus.Debugln("benign failure getting gcs logs: ", err)
-//	}
-//	if proc != nil {
-//		proc.WaitTimeout(time.Duration(int(time.Second) * 30))
-//	}
-//	logrus.Debugf("GCS Debugging:\n%s\n\nEnd GCS Debugging", strings.TrimSpace(out.String()))
-//}
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/sirupsen/logrus"
+)
+
+// diagnosticsTimeout is how long each guest command collecting diagnostics
+// may take. The guest may well be unhealthy, so this is short.
+const diagnosticsTimeout = 30 * time.Second
+
+// guestCommand is a shell command run in the guest to collect diagnostics,
+// and the name of the file in the bundle holding its output.
+type guestCommand struct {
+	name    string
+	command string
+}
+
+var guestDiagnostics = []guestCommand{
+	{"gcs-stacks.txt", "kill -USR1 `pidof gcs` && sleep 1 && cat /tmp/gcs/gcs-stacks*"},
+	{"gcs.log", "cat /tmp/gcs.log"},
+	{"gcs-panic.log", "cat /tmp/gcs/paniclog*"},
+	{"runc-global.log", "cat /tmp/gcs/global-runc.log"},
+	{"runc.log", "for f in /tmp/gcs/*/runc.log; do echo \"==> $f <==\"; cat \"$f\"; done"},
+	{"config.json", "for f in /tmp/gcs/*/config.json; do echo \"==> $f <==\"; cat \"$f\"; done"},
+	{"ls-tmp.txt", "ls -l /tmp /tmp/gcs /tmp/gcs/*"},
+	{"ls-gcsrunc.txt", "ls -lR /var/run/gcsrunc"},
+	{"ps.txt", "ps -ef"},
+}
+
+// DiagnosticsEnabled returns whether HCSSHIM_LCOW_DEBUG_ENABLE is set, in
+// which case diagnostics are saved automatically when creating a container in
+// a Linux utility VM fails. They are saved to HCSSHIM_LCOW_DEBUG_DIR, or the
+// temporary directory if that is not set.
+func DiagnosticsEnabled() bool {
+	return os.Getenv("HCSSHIM_LCOW_DEBUG_ENABLE") != ""
+}
+
+// SaveFailureDiagnostics saves diagnostics for a failure if they are enabled,
+// logging where they were saved. It is intended to be called before anything
+// is cleaned up after the failure.
+func SaveFailureDiagnostics(lcowUVM *uvm.UtilityVM, failure error) {
+	if !DiagnosticsEnabled() || lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return
+	}
+	path, err := SaveDiagnostics(lcowUVM, os.Getenv("HCSSHIM_LCOW_DEBUG_DIR"))
+	if err != nil {
+		logrus.Warnf("hcsshim::lcow::SaveFailureDiagnostics failed to save diagnostics for %s: %s", lcowUVM.ID(), err)
+		return
+	}
+	logrus.Warnf("hcsshim::lcow::SaveFailureDiagnostics saved diagnostics for failure in %s to %s: %s", lcowUVM.ID(), path, failure)
+}
+
+// SaveDiagnostics saves a diagnostics bundle for a Linux utility VM to a new
+// file in dir, or the temporary directory if dir is empty, returning its path.
+func SaveDiagnostics(lcowUVM *uvm.UtilityVM, dir string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := fmt.Sprintf("%s-diag-%s.tar.gz", lcowUVM.ID(), time.Now().UTC().Format("20060102T150405.000"))
+	path := filepath.Join(dir, strings.Replace(name, "@", "-", -1))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = WriteDiagnostics(lcowUVM, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// WriteDiagnostics writes a diagnostics bundle for a Linux utility VM to w as
+// a gzipped tar. It contains the utility VM's device inventory, the recent
+// HCS errors and console output in this process, and logs, stack dumps and
+// the process list collected from the guest. Failures to collect from the
+// guest, which may be unhealthy, are recorded in guest/errors.txt rather than
+// failing the bundle. HCSSHIM_LCOW_DEBUG_COMMAND may set an additional shell
+// command whose output is collected as guest/custom.txt.
+func WriteDiagnostics(lcowUVM *uvm.UtilityVM, w io.Writer) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("WriteDiagnostics requires a linux utility VM")
+	}
+	logrus.Debugf("hcsshim::lcow::WriteDiagnostics %s", lcowUVM.ID())
+
+	gz := gzip.NewWriter(w)
+	b := &bundle{tw: tar.NewWriter(gz), time: time.Now()}
+
+	if err := b.addJSON("inventory.json", lcowUVM.Inventory()); err != nil {
+		return err
+	}
+	if err := b.addJSON("hcs-errors.json", hcs.RecentErrors()); err != nil {
+		return err
+	}
+	if tail := lcowUVM.ConsoleTail(); len(tail) > 0 {
+		if err := b.add("console.log", []byte(strings.Join(tail, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	commands := guestDiagnostics
+	if custom := os.Getenv("HCSSHIM_LCOW_DEBUG_COMMAND"); custom != "" {
+		commands = append(commands[:len(commands):len(commands)], guestCommand{"custom.txt", custom})
+	}
+	var guestErrors []string
+	for _, c := range commands {
+		result, err := RunCommand(lcowUVM, []string{"sh", "-c", c.command}, &CommandOptions{Timeout: diagnosticsTimeout})
+		if err != nil {
+			guestErrors = append(guestErrors, fmt.Sprintf("%s: %s", c.name, err))
+		}
+		if result == nil {
+			// The guest could not run the command, so is unlikely to run
+			// any more.
+			guestErrors = append(guestErrors, "skipped the remaining guest diagnostics")
+			break
+		}
+		if err := b.add("guest/"+c.name, result.Stdout); err != nil {
+			return err
+		}
+	}
+	if len(guestErrors) > 0 {
+		if err := b.add("guest/errors.txt", []byte(strings.Join(guestErrors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bundle writes the files of a diagnostics bundle.
+type bundle struct {
+	tw   *tar.Writer
+	time time.Time
+}
+
+func (b *bundle) add(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.time,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s to diagnostics: %s", name, err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s to diagnostics: %s", name, err)
+	}
+	return nil
+}
+
+func (b *bundle) addJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %s", name, err)
+	}
+	return b.add(name, append(data, '\n'))
+}
@@ -1,6 +1,7 @@
 package lcow
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
@@ -27,12 +28,13 @@ type ByteCounts struct {
 type ProcessOptions struct {
 	HCSSystem         *hcs.System
 	Process           *specs.Process
-	Stdin             io.Reader     // Optional reader for sending on to the processes stdin stream
-	Stdout            io.Writer     // Optional writer for returning the processes stdout stream
-	Stderr            io.Writer     // Optional writer for returning the processes stderr stream
-	CopyTimeout       time.Duration // Timeout for the copy
-	CreateInUtilityVm bool          // If the compute system is a utility VM
-	ByteCounts        ByteCounts    // How much data to copy on each stream if they are supplied. 0 means to io.EOF.
+	Stdin             io.Reader       // Optional reader for sending on to the processes stdin stream
+	Stdout            io.Writer       // Optional writer for returning the processes stdout stream
+	Stderr            io.Writer       // Optional writer for returning the processes stderr stream
+	CopyTimeout       time.Duration   // Timeout for the copy when no data is copied on any stream. 0 means no timeout
+	Context           context.Context // Optional. Cancelling it stops the copy and kills the process
+	CreateInUtilityVm bool            // If the compute system is a utility VM
+	ByteCounts        ByteCounts      // How much data to copy on each stream if they are supplied. 0 means to io.EOF.
 }
 
 // CreateProcess creates a process either in an LCOW utility VM, or for starting
@@ -44,8 +46,11 @@ type ProcessOptions struct {
 // This is used on LCOW to run processes for remote filesystem commands, utilities,
 // and debugging.
 //
-// It optional performs IO copies with timeout between the pipes provided as input,
-// and the pipes in the process.
+// It optionally performs IO copies between the pipes provided as input and the
+// pipes in the process. The streams are copied concurrently, so the writers may
+// be streaming consumers, and the copy times out only if no data is copied on
+// any stream for CopyTimeout. If the copy fails, times out or opts.Context is
+// cancelled, the process is killed and the first error is returned.
 //
 // In the ProcessOptions structure, if byte-counts are non-zero, a maximum of those
 // bytes are copied to the appropriate standard IO reader/writer. When zero,
@@ -115,47 +120,46 @@ func CreateProcess(opts *ProcessOptions) (*hcs.Process, *ByteCounts, error) {
 		return nil, nil, fmt.Errorf("failed to get stdio pipes for process %+v: %s", processConfig, err)
 	}
 
-	// Send the data into the process's stdin
+	// Copy the stdio streams concurrently, so that a process which fills
+	// one pipe while another is not being read cannot deadlock.
+	var streams []*copywithtimeout.Stream
+	var stdin, stdout, stderr *copywithtimeout.Stream
 	if opts.Stdin != nil {
-		if copiedByteCounts.In, err = copywithtimeout.Copy(processStdin,
-			opts.Stdin,
-			opts.ByteCounts.In,
-			"stdin",
-			opts.CopyTimeout); err != nil {
-			return nil, nil, err
-		}
-
-		// Don't need stdin now we've sent everything. This signals GCS that we are finished sending data.
-		if err := proc.CloseStdin(); err != nil && !hcs.IsNotExist(err) && !hcs.IsAlreadyClosed(err) {
-			// This error will occur if the compute system is currently shutting down
-			if perr, ok := err.(*hcs.ProcessError); ok && perr.Err != hcs.ErrVmcomputeOperationInvalidState {
-				return nil, nil, err
+		stdin = &copywithtimeout.Stream{Name: "stdin", Dst: processStdin, Src: opts.Stdin, Size: opts.ByteCounts.In}
+		// Don't need stdin once we've sent everything. This signals GCS that we are finished sending data.
+		stdin.Done = func() error {
+			if err := proc.CloseStdin(); err != nil && !hcs.IsNotExist(err) && !hcs.IsAlreadyClosed(err) {
+				// This error will occur if the compute system is currently shutting down
+				if perr, ok := err.(*hcs.ProcessError); ok && perr.Err != hcs.ErrVmcomputeOperationInvalidState {
+					return err
+				}
 			}
+			return nil
 		}
+		streams = append(streams, stdin)
 	}
-
-	// Copy the data back from stdout
 	if opts.Stdout != nil {
-		// Copy the data over to the writer.
-		if copiedByteCounts.Out, err = copywithtimeout.Copy(opts.Stdout,
-			processStdout,
-			opts.ByteCounts.Out,
-			"stdout",
-			opts.CopyTimeout); err != nil {
-			return nil, nil, err
-		}
+		stdout = &copywithtimeout.Stream{Name: "stdout", Dst: opts.Stdout, Src: processStdout, Size: opts.ByteCounts.Out}
+		streams = append(streams, stdout)
 	}
-
-	// Copy the data back from stderr
 	if opts.Stderr != nil {
-		// Copy the data over to the writer.
-		if copiedByteCounts.Err, err = copywithtimeout.Copy(opts.Stderr,
-			processStderr,
-			opts.ByteCounts.Err,
-			"stderr",
-			opts.CopyTimeout); err != nil {
-			return nil, nil, err
-		}
+		stderr = &copywithtimeout.Stream{Name: "stderr", Dst: opts.Stderr, Src: processStderr, Size: opts.ByteCounts.Err}
+		streams = append(streams, stderr)
+	}
+	if err := copywithtimeout.CopyStreams(opts.Context, opts.CopyTimeout, streams...); err != nil {
+		// Killing and closing the process unblocks any copy still in progress.
+		proc.Kill()
+		proc.Close()
+		return nil, nil, err
+	}
+	if stdin != nil {
+		copiedByteCounts.In = stdin.Copied()
+	}
+	if stdout != nil {
+		copiedByteCounts.Out = stdout.Copied()
+	}
+	if stderr != nil {
+		copiedByteCounts.Err = stderr.Copied()
 	}
 	return proc, copiedByteCounts, nil
 }
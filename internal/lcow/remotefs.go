@@ -0,0 +1,77 @@
+package lcow
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/remotefs"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+	"github.com/sirupsen/logrus"
+)
+
+// RemoteFSBinary is the path in the utility VM of the binary built from
+// internal/cmd/remotefs, which serves the remote file system operations.
+var RemoteFSBinary = "/bin/remotefs"
+
+// RemoteFS is a remotefs.FS whose operations are executed in a Linux utility
+// VM, beneath a directory such as the root file system of a container. It
+// must be closed to end the process serving it.
+type RemoteFS struct {
+	*remotefs.Client
+	done      chan error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenRemoteFS starts a process in a Linux utility VM which executes file
+// system operations beneath root, a path in the utility VM.
+func OpenRemoteFS(lcowUVM *uvm.UtilityVM, root string) (*RemoteFS, error) {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return nil, fmt.Errorf("OpenRemoteFS requires a linux utility VM")
+	}
+	logrus.Debugf("hcsshim::lcow::OpenRemoteFS %s in %s", root, lcowUVM.ID())
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	fs := &RemoteFS{
+		Client: remotefs.NewClient(responseReader, requestWriter),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		_, err := RunCommand(lcowUVM, []string{RemoteFSBinary, "--root", root}, &CommandOptions{
+			Stdin:   requestReader,
+			Stdout:  responseWriter,
+			Timeout: -1,
+		})
+		if err == nil {
+			err = io.EOF
+		}
+		// Fail any request in progress, and any sent later.
+		responseWriter.CloseWithError(err)
+		requestReader.CloseWithError(err)
+		if err == io.EOF {
+			err = nil
+		}
+		fs.done <- err
+	}()
+
+	// Check that the server is running and root exists.
+	if _, err := fs.Stat("/"); err != nil {
+		if closeErr := fs.Close(); closeErr != nil {
+			err = closeErr
+		}
+		return nil, fmt.Errorf("failed to open remote file system %s in %s: %s", root, lcowUVM.ID(), err)
+	}
+	return fs, nil
+}
+
+// Close ends the process serving the file system, closing any files left
+// open, and returns any error from running it.
+func (fs *RemoteFS) Close() error {
+	fs.closeOnce.Do(func() {
+		fs.Client.Close()
+		fs.closeErr = <-fs.done
+	})
+	return fs.closeErr
+}
@@ -1,7 +1,6 @@
 package lcow
 
 import (
-	"bytes"
 	"fmt"
 	"os"
 	"strings"
@@ -9,10 +8,9 @@ import (
 	"time"
 
 	"github.com/Microsoft/go-winio/vhd"
-	"github.com/Microsoft/hcsshim/internal/copyfile"
+	"github.com/Microsoft/hcsshim/internal/scratchcache"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/Microsoft/hcsshim/internal/wclayer"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -33,53 +31,91 @@ const (
 // TODO Tidy up comment above.
 var defaultTimeoutSeconds = time.Second * 60 * 4
 
-// CreateScratch uses a utility VM to create an empty scratch disk of a requested size.
-// It has a caching capability. If the cacheFile exists, and the request is for a default
-// size, a copy of that is made to the target. If the size is non-default, or the cache file
-// does not exist, it uses a utility VM to create target. It is the responsibility of the
-// caller to synchronise simultaneous attempts to create the cache file.
-func CreateScratch(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32, cacheFile string, vmID string) error {
+// scratchMkfsArgs are the arguments to mkfs.ext4 formatting a scratch disk.
+// They are part of the key of cached scratch disks, so that templates
+// formatted differently are not used.
+var scratchMkfsArgs = []string{"-q", "-E", "lazy_itable_init=1", "-O", `^has_journal,sparse_super2,uninit_bg,^resize_inode`}
 
-	if lcowUVM == nil {
-		return fmt.Errorf("no uvm")
+// ScratchCacheKey returns the key of scratch disks of a size in a
+// scratchcache.Cache.
+func ScratchCacheKey(sizeGB uint32) scratchcache.Key {
+	return scratchcache.Key{SizeGB: sizeGB, Filesystem: "ext4 " + strings.Join(scratchMkfsArgs, " ")}
+}
+
+// CreateScratch uses a utility VM to create an empty scratch disk of a requested size,
+// or of DefaultScratchSizeGB if sizeGB is 0. It has a caching capability. If cacheFile is supplied and the request is for a default
+// size, cacheFile is used as a scratchcache.Entry: destFile is copied from it, the utility
+// VM populating it first if necessary. Simultaneous attempts to populate the cache file
+// are synchronised. Otherwise it uses a utility VM to create target. lcowUVM may be nil
+// if the request is fulfilled from the cache.
+func CreateScratch(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32, cacheFile string, vmID string) error {
+	if sizeGB == 0 {
+		sizeGB = DefaultScratchSizeGB
 	}
 
-	if lcowUVM.OS() != "linux" {
-		return fmt.Errorf("CreateLCOWScratch requires a linux utility VM to operate!")
+	logrus.Debugf("hcsshim::CreateLCOWScratch: Dest:%s size:%dGB cache:%s", destFile, sizeGB, cacheFile)
+
+	if cacheFile != "" && sizeGB == DefaultScratchSizeGB {
+		entry := &scratchcache.Entry{Path: cacheFile}
+		if err := entry.Get(destFile, func(path string) error {
+			return formatScratch(lcowUVM, path, sizeGB)
+		}); err != nil {
+			return err
+		}
+	} else if err := formatScratch(lcowUVM, destFile, sizeGB); err != nil {
+		return err
 	}
+	return grantScratchAccess(destFile, vmID)
+}
 
-	// Smallest we can accept is the default scratch size as we can't size down, only expand.
-	if sizeGB < DefaultScratchSizeGB {
+// CreateScratchFromCache creates an empty scratch disk of a requested size, or
+// of DefaultScratchSizeGB if sizeGB is 0, copying it from cache, which is keyed by ScratchCacheKey. If the cache has
+// no valid scratch disk of the size, the utility VM creates one for it. lcowUVM
+// may be nil if the request is fulfilled from the cache.
+func CreateScratchFromCache(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32, cache *scratchcache.Cache, vmID string) error {
+	if sizeGB == 0 {
 		sizeGB = DefaultScratchSizeGB
 	}
 
-	logrus.Debugf("hcsshim::CreateLCOWScratch: Dest:%s size:%dGB cache:%s", destFile, sizeGB, cacheFile)
+	logrus.Debugf("hcsshim::CreateScratchFromCache: Dest:%s size:%dGB cache:%s", destFile, sizeGB, cache.Dir)
 
-	// Retrieve from cache if the default size and already on disk
-	if cacheFile != "" && sizeGB == DefaultScratchSizeGB {
-		if _, err := os.Stat(cacheFile); err == nil {
-			if err := copyfile.CopyFile(cacheFile, destFile, false); err != nil {
-				return fmt.Errorf("failed to copy cached file '%s' to '%s': %s", cacheFile, destFile, err)
-			}
-			logrus.Debugf("hcsshim::CreateLCOWScratch: %s fulfilled from cache (%s)", destFile, cacheFile)
-
-			if vmID != "" {
-				if err := wclayer.GrantVmAccess(vmID, destFile); err != nil {
-					os.Remove(destFile)
-					return err
-				}
-			}
-
-			return nil
+	if err := cache.Get(ScratchCacheKey(sizeGB), destFile, func(path string) error {
+		return formatScratch(lcowUVM, path, sizeGB)
+	}); err != nil {
+		return err
+	}
+	return grantScratchAccess(destFile, vmID)
+}
+
+// grantScratchAccess grants the VM vmID access to a scratch disk, if vmID is
+// supplied, removing the disk on failure.
+func grantScratchAccess(destFile string, vmID string) error {
+	if vmID != "" {
+		if err := wclayer.GrantVmAccess(vmID, destFile); err != nil {
+			os.Remove(destFile)
+			return err
 		}
 	}
+	return nil
+}
+
+// formatScratch creates destFile as an empty ext4 formatted scratch disk, using
+// lcowUVM to format it.
+func formatScratch(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32) error {
+	if lcowUVM == nil {
+		return fmt.Errorf("no uvm")
+	}
+
+	if lcowUVM.OS() != "linux" {
+		return fmt.Errorf("CreateLCOWScratch requires a linux utility VM to operate!")
+	}
 
-	// Create the VHDX
+	// Create the VHDX. This uses the Windows virtual disk APIs rather than
+	// the internal vhd package, which is not yet validated against them.
 	if err := vhd.CreateVhdx(destFile, sizeGB, defaultVhdxBlockSizeMB); err != nil {
 		return fmt.Errorf("failed to create VHDx %s: %s", destFile, err)
 	}
 
-	//	uvmc.DebugLCOWGCS()
 	// Grant access
 	if err := wclayer.GrantVmAccess(lcowUVM.ID(), destFile); err != nil {
 		return err
@@ -92,105 +128,143 @@ func CreateScratch(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32, cache
 
 	logrus.Debugf("hcsshim::CreateLCOWScratch: %s at C=%d L=%d", destFile, controller, lun)
 
-	// Validate /sys/bus/scsi/devices/C:0:0:L exists as a directory
-	testdCommand := []string{"test", "-d", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d", controller, lun)}
-	testdProc, _, err := CreateProcess(&ProcessOptions{
-		HCSSystem:         lcowUVM.ComputeSystem(),
-		CreateInUtilityVm: true,
-		CopyTimeout:       defaultTimeoutSeconds,
-		Process:           &specs.Process{Args: testdCommand},
-	})
+	device, err := scsiDevice(lcowUVM, controller, lun)
 	if err != nil {
 		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to run %+v following hot-add %s to utility VM: %s", testdCommand, destFile, err)
+		return fmt.Errorf("failed following hot-add %s to utility VM: %s", destFile, err)
 	}
-	defer testdProc.Close()
+	logrus.Debugf("hcsshim: CreateExt4Vhdx: %s: device at %s", destFile, device)
 
-	testdProc.WaitTimeout(defaultTimeoutSeconds)
-	testdExitCode, err := testdProc.ExitCode()
-	if err != nil {
+	// Format it ext4
+	if _, err := RunCommand(lcowUVM, append(append([]string{"mkfs.ext4"}, scratchMkfsArgs...), device), nil); err != nil {
 		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to get exit code from from %+v following hot-add %s to utility VM: %s", testdCommand, destFile, err)
+		return fmt.Errorf("failed to format %s in utility VM: %s", destFile, err)
 	}
-	if testdExitCode != 0 {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("`%+v` return non-zero exit code (%d) following hot-add %s to utility VM", testdCommand, testdExitCode, destFile)
+
+	// Hot-Remove before we copy it
+	if err := lcowUVM.RemoveSCSI(destFile); err != nil {
+		return fmt.Errorf("failed to hot-remove: %s", err)
+	}
+
+	logrus.Debugf("hcsshim::CreateLCOWScratch: %s created (non-cache)", destFile)
+	return nil
+}
+
+// scsiDevice returns the device in a Linux utility VM of the disk hot-added at
+// a SCSI controller and LUN.
+func scsiDevice(lcowUVM *uvm.UtilityVM, controller int, lun int) (string, error) {
+	// Validate /sys/bus/scsi/devices/C:0:0:L exists as a directory
+	if _, err := RunCommand(lcowUVM, []string{"test", "-d", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d", controller, lun)}, nil); err != nil {
+		return "", err
 	}
 
 	// Get the device from under the block subdirectory by doing a simple ls. This will come back as (eg) `sda`
-	var lsOutput bytes.Buffer
-	lsCommand := []string{"ls", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d/block", controller, lun)}
-	lsProc, _, err := CreateProcess(&ProcessOptions{
-		HCSSystem:         lcowUVM.ComputeSystem(),
-		CreateInUtilityVm: true,
-		CopyTimeout:       defaultTimeoutSeconds,
-		Process:           &specs.Process{Args: lsCommand},
-		Stdout:            &lsOutput,
-	})
+	ls, err := RunCommand(lcowUVM, []string{"ls", fmt.Sprintf("/sys/bus/scsi/devices/%d:0:0:%d/block", controller, lun)}, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`/dev/%s`, strings.TrimSpace(string(ls.Stdout))), nil
+}
 
+// ScratchSize describes the size of a scratch disk.
+type ScratchSize struct {
+	FileSize    int64 // The current size of the VHDX file on the host
+	VirtualSize int64 // The size of the disk, which is the most the VHDX file can grow to
+}
+
+// GetScratchSize returns the current and maximum size of a scratch disk.
+func GetScratchSize(path string) (*ScratchSize, error) {
+	virtualSize, err := vhdxVirtualSize(path)
 	if err != nil {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to `%+v` following hot-add %s to utility VM: %s", lsCommand, destFile, err)
+		return nil, err
 	}
-	defer lsProc.Close()
-	lsProc.WaitTimeout(defaultTimeoutSeconds)
-	lsExitCode, err := lsProc.ExitCode()
+	fi, err := os.Stat(path)
 	if err != nil {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to get exit code from `%+v` following hot-add %s to utility VM: %s", lsCommand, destFile, err)
+		return nil, err
 	}
-	if lsExitCode != 0 {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("`%+v` return non-zero exit code (%d) following hot-add %s to utility VM", lsCommand, lsExitCode, destFile)
+	return &ScratchSize{FileSize: fi.Size(), VirtualSize: virtualSize}, nil
+}
+
+// ExpandScratch expands a scratch disk which is not attached to any VM to
+// sizeGB, growing both its VHDX and its ext4 file system. lcowUVM is used to
+// check and resize the file system. Scratch disks cannot be shrunk, so sizeGB
+// must be larger than the current size.
+func ExpandScratch(lcowUVM *uvm.UtilityVM, path string, sizeGB uint32) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("ExpandScratch requires a linux utility VM")
 	}
-	device := fmt.Sprintf(`/dev/%s`, strings.TrimSpace(lsOutput.String()))
-	logrus.Debugf("hcsshim: CreateExt4Vhdx: %s: device at %s", destFile, device)
+	logrus.Debugf("hcsshim::lcow::ExpandScratch %s to %dGB", path, sizeGB)
 
-	// Format it ext4
-	mkfsCommand := []string{"mkfs.ext4", "-q", "-E", "lazy_itable_init=1", "-O", `^has_journal,sparse_super2,uninit_bg,^resize_inode`, device}
-	var mkfsStderr bytes.Buffer
-	mkfsProc, _, err := CreateProcess(&ProcessOptions{
-		HCSSystem:         lcowUVM.ComputeSystem(),
-		CreateInUtilityVm: true,
-		CopyTimeout:       defaultTimeoutSeconds,
-		Process:           &specs.Process{Args: mkfsCommand},
-		Stderr:            &mkfsStderr,
-	})
-	if err != nil {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to `%+v` following hot-add %s to utility VM: %s", mkfsCommand, destFile, err)
+	if err := ExpandScratchVhdx(path, sizeGB); err != nil {
+		return err
 	}
-	defer mkfsProc.Close()
-	mkfsProc.WaitTimeout(defaultTimeoutSeconds)
-	mkfsExitCode, err := mkfsProc.ExitCode()
+	if err := wclayer.GrantVmAccess(lcowUVM.ID(), path); err != nil {
+		return err
+	}
+	controller, lun, err := lcowUVM.AddSCSI(path, "") // Not mounted, so it can be resized offline
 	if err != nil {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("failed to get exit code from `%+v` following hot-add %s to utility VM: %s", mkfsCommand, destFile, err)
+		return err
 	}
-	if mkfsExitCode != 0 {
-		lcowUVM.RemoveSCSI(destFile)
-		return fmt.Errorf("`%+v` return non-zero exit code (%d) following hot-add %s to utility VM: %s", mkfsCommand, mkfsExitCode, destFile, strings.TrimSpace(mkfsStderr.String()))
+	defer lcowUVM.RemoveSCSI(path)
+	device, err := scsiDevice(lcowUVM, controller, lun)
+	if err != nil {
+		return fmt.Errorf("failed following hot-add %s to utility VM: %s", path, err)
 	}
 
-	// Hot-Remove before we copy it
-	if err := lcowUVM.RemoveSCSI(destFile); err != nil {
-		return fmt.Errorf("failed to hot-remove: %s", err)
+	// resize2fs requires an unmounted file system to have been checked. An
+	// exit code of 1 means errors were corrected.
+	if _, err := RunCommand(lcowUVM, []string{"e2fsck", "-f", "-p", device}, nil); err != nil {
+		if exitErr, ok := err.(*ExitError); !ok || exitErr.ExitCode != 1 {
+			return fmt.Errorf("failed to check the file system of %s: %s", path, err)
+		}
+	}
+	if _, err := RunCommand(lcowUVM, []string{"resize2fs", device}, nil); err != nil {
+		return fmt.Errorf("failed to resize the file system of %s: %s", path, err)
 	}
+	return nil
+}
 
-	// Populate the cache.
-	if cacheFile != "" && (sizeGB == DefaultScratchSizeGB) {
-		if err := copyfile.CopyFile(destFile, cacheFile, true); err != nil {
-			return fmt.Errorf("failed to seed cache '%s' from '%s': %s", destFile, cacheFile, err)
+// ResizeScratchFilesystem grows the ext4 file system mounted at uvmPath in a
+// Linux utility VM to the size of its disk, such as a scratch disk whose VHDX
+// was expanded before it was attached.
+func ResizeScratchFilesystem(lcowUVM *uvm.UtilityVM, uvmPath string) error {
+	if lcowUVM == nil || lcowUVM.OS() != "linux" {
+		return fmt.Errorf("ResizeScratchFilesystem requires a linux utility VM")
+	}
+	mounts, err := RunCommand(lcowUVM, []string{"cat", "/proc/mounts"}, nil)
+	if err != nil {
+		return err
+	}
+	device := ""
+	for _, line := range strings.Split(string(mounts.Stdout), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == uvmPath {
+			device = fields[0]
 		}
 	}
+	if device == "" {
+		return fmt.Errorf("nothing is mounted at %s in %s", uvmPath, lcowUVM.ID())
+	}
+	logrus.Debugf("hcsshim::lcow::ResizeScratchFilesystem %s (%s) in %s", uvmPath, device, lcowUVM.ID())
+	if _, err := RunCommand(lcowUVM, []string{"resize2fs", device}, nil); err != nil {
+		return fmt.Errorf("failed to resize the file system at %s in %s: %s", uvmPath, lcowUVM.ID(), err)
+	}
+	return nil
+}
 
-	if vmID != "" {
-		if err := wclayer.GrantVmAccess(vmID, destFile); err != nil {
-			os.Remove(destFile)
+// AttachUVMScratch gives a running Linux utility VM a scratch disk mounted at
+// uvm.LCOWScratchPath, so that file system utilities such as those run by
+// VhdToTar stage their temporary files on it rather than in the VM's memory. destFile is created at the default size through the scratch
+// cache if it doesn't already exist, formatting it in the utility VM itself if
+// the cache is empty.
+func AttachUVMScratch(lcowUVM *uvm.UtilityVM, destFile string, cacheFile string) error {
+	if lcowUVM == nil {
+		return fmt.Errorf("no uvm")
+	}
+	if _, err := os.Stat(destFile); os.IsNotExist(err) {
+		if err := CreateScratch(lcowUVM, destFile, DefaultScratchSizeGB, cacheFile, lcowUVM.ID()); err != nil {
 			return err
 		}
 	}
-
-	logrus.Debugf("hcsshim::CreateLCOWScratch: %s created (non-cache)", destFile)
-	return nil
+	return lcowUVM.AttachScratch(destFile)
 }
@@ -5,39 +5,38 @@ import (
 	"io"
 	"os"
 
+	"github.com/Microsoft/hcsshim/internal/tar2ext4"
 	"github.com/Microsoft/hcsshim/internal/uvm"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 )
 
 // TarToVhd streams a tarstream contained in an io.Reader to a fixed vhd file
+// containing an ext4 file system. The conversion is done on the host, so the
+// utility VM is not used; it is accepted for compatibility with callers which
+// already have one. Whiteouts in the tar stream become overlay whiteouts. The
+// file is removed on failure.
 func TarToVhd(lcowUVM *uvm.UtilityVM, targetVHDFile string, reader io.Reader) (int64, error) {
 	logrus.Debugf("hcsshim: TarToVhd: %s", targetVHDFile)
 
-	if lcowUVM == nil {
-		return 0, fmt.Errorf("no utility VM passed")
-	}
-
-	//defer uvm.DebugLCOWGCS()
-
 	outFile, err := os.Create(targetVHDFile)
 	if err != nil {
 		return 0, fmt.Errorf("tar2vhd failed to create %s: %s", targetVHDFile, err)
 	}
 	defer outFile.Close()
-	// BUGBUG Delete the file on failure
 
-	tar2vhd, byteCounts, err := CreateProcess(&ProcessOptions{
-		Process:           &specs.Process{Args: []string{"tar2vhd"}},
-		CreateInUtilityVm: true,
-		Stdin:             reader,
-		Stdout:            outFile,
-	})
+	if err := tar2ext4.Convert(reader, outFile, tar2ext4.ConvertWhiteout, tar2ext4.AppendVhdFooter); err != nil {
+		outFile.Close()
+		os.Remove(targetVHDFile)
+		return 0, fmt.Errorf("tar2vhd failed to convert %s: %s", targetVHDFile, err)
+	}
+
+	size, err := outFile.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return 0, fmt.Errorf("failed to start tar2vhd for %s: %s", targetVHDFile, err)
+		outFile.Close()
+		os.Remove(targetVHDFile)
+		return 0, fmt.Errorf("tar2vhd failed to get the size of %s: %s", targetVHDFile, err)
 	}
-	defer tar2vhd.Close()
 
-	logrus.Debugf("hcsshim: TarToVhd: %s created, %d bytes", targetVHDFile, byteCounts.Out)
-	return byteCounts.Out, err
+	logrus.Debugf("hcsshim: TarToVhd: %s created, %d bytes", targetVHDFile, size)
+	return size, nil
 }
@@ -3,73 +3,80 @@ package lcow
 import (
 	"fmt"
 	"io"
-	//	"os"
+	"os"
 
 	"github.com/Microsoft/hcsshim/internal/uvm"
-	//	specs "github.com/opencontainers/runtime-spec/specs-go"
-	//	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 // VhdToTar does what is says - it exports a VHD in a specified
 // folder (either a read-only layer.vhd, or a read-write scratch vhdx) to a
 // ReadCloser containing a tar-stream of the layers contents.
+//
+// A read-only layer is streamed into the utility VM and converted by the
+// vhd2tar utility; vhdSize limits how much of the file is sent, 0 meaning all
+// of it. A container scratch must already be attached to the utility VM and
+// mounted at uvmMountPath; the exportSandbox utility exports the overlay upper
+// directory on it, with deleted files as whiteouts.
+//
+// The utility stages its temporary files under the utility VM's scratch disk,
+// if it has one (see AttachUVMScratch), rather than in the VM's memory.
+//
+// The tar stream is produced while it is read. If the utility fails, reading
+// the stream returns the error, including the utility's stderr. Closing the
+// stream before the end stops the utility.
 func VhdToTar(lcowUVM *uvm.UtilityVM, vhdFile string, uvmMountPath string, isContainerScratch bool, vhdSize int64) (io.ReadCloser, error) {
-	return nil, fmt.Errorf("not implemented yet")
-	//	logrus.Debugf("hcsshim: VhdToTar: %s isScratch: %t", vhdFile, isContainerScratch)
+	logrus.Debugf("hcsshim: VhdToTar: %s isScratch: %t", vhdFile, isContainerScratch)
 
-	//	if lcowUVM == nil {
-	//		return nil, fmt.Errorf("cannot VhdToTar as no utility VM is in configuration")
-	//	}
+	if lcowUVM == nil {
+		return nil, fmt.Errorf("cannot VhdToTar as no utility VM is in configuration")
+	}
 
-	//	//defer uvm.DebugLCOWGCS()
+	// Different binary depending on whether a RO layer or a RW scratch
+	args := []string{"vhd2tar"}
+	var vhdHandle *os.File
+	var stdin io.Reader
+	if isContainerScratch {
+		if uvmMountPath == "" {
+			return nil, fmt.Errorf("hcsshim: VhdToTar: %s: the path the scratch is mounted at in the utility VM must be supplied", vhdFile)
+		}
+		args = []string{"exportSandbox", "-path", uvmMountPath}
+	} else {
+		var err error
+		vhdHandle, err = os.Open(vhdFile)
+		if err != nil {
+			return nil, fmt.Errorf("hcsshim: VhdToTar: failed to open %s: %s", vhdFile, err)
+		}
+		stdin = vhdHandle
+		if vhdSize > 0 {
+			stdin = io.LimitReader(vhdHandle, vhdSize)
+		}
+	}
 
-	//	vhdHandle, err := os.Open(vhdFile)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("hcsshim: VhdToTar: failed to open %s: %s", vhdFile, err)
-	//	}
-	//	defer vhdHandle.Close()
-	//	logrus.Debugf("hcsshim: VhdToTar: exporting %s, size %d, isScratch %t", vhdHandle.Name(), vhdSize, isContainerScratch)
+	opts := &CommandOptions{Stdin: stdin}
+	if dir := lcowUVM.ScratchPath(); dir != "" {
+		opts.Env = []string{"TMPDIR=" + dir}
+		opts.Cwd = dir
+	}
 
-	//	// Different binary depending on whether a RO layer or a RW scratch
-	//	command := "vhd2tar"
-	//	if isContainerScratch {
-	//		command = fmt.Sprintf("exportSandbox -path %s", uvmMountPath)
-	//	}
+	// Run the utility in a goroutine which copies its stdout (ie the tar
+	// stream) to the write side of a pipe. The pipe is closed with the error,
+	// if any, so that it is returned to the reader.
+	reader, writer := io.Pipe()
+	go func() {
+		if vhdHandle != nil {
+			defer vhdHandle.Close()
+		}
+		opts.Stdout = writer
+		_, err := RunCommand(lcowUVM, args, opts)
+		if err != nil {
+			logrus.Errorf("hcsshim: VhdToTar: %s: failed to export: %s", vhdFile, err)
+		} else {
+			logrus.Debugf("hcsshim: VhdToTar: exported %s", vhdFile)
+		}
+		writer.CloseWithError(err)
+	}()
 
-	//	//	tar2vhd, byteCounts, err := lcowUVM.CreateProcess(&uvm.ProcessOptions{
-	//	//		Process: &specs.Process{Args: []string{"tar2vhd"}},
-	//	//		Stdin:   reader,
-	//	//		Stdout:  outFile,
-	//	//	})
-
-	//	// Start the binary in the utility VM
-	//	proc, stdin, stdout, _, err := config.createLCOWUVMProcess(command)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("hcsshim: VhdToTar: %s: failed to create utils process %s: %s", vhdHandle.Name(), command, err)
-	//	}
-
-	//	if !isContainerScratch {
-	//		// Send the VHD contents to the utility VM processes stdin handle if not a container scratch
-	//		logrus.Debugf("hcsshim: VhdToTar: copying the layer VHD into the utility VM")
-	//		if _, err = copyWithTimeout(stdin, vhdHandle, vhdSize, processOperationTimeoutSeconds, fmt.Sprintf("vhdtotarstream: sending %s to %s", vhdHandle.Name(), command)); err != nil {
-	//			proc.Close()
-	//			return nil, fmt.Errorf("hcsshim: VhdToTar: %s: failed to copyWithTimeout on the stdin pipe (to utility VM): %s", vhdHandle.Name(), err)
-	//		}
-	//	}
-
-	//	// Start a goroutine which copies the stdout (ie the tar stream)
-	//	reader, writer := io.Pipe()
-	//	go func() {
-	//		defer writer.Close()
-	//		defer proc.Close()
-	//		logrus.Debugf("hcsshim: VhdToTar: copying tar stream back from the utility VM")
-	//		bytes, err := copyWithTimeout(writer, stdout, vhdSize, processOperationTimeoutSeconds, fmt.Sprintf("vhdtotarstream: copy tarstream from %s", command))
-	//		if err != nil {
-	//			logrus.Errorf("hcsshim: VhdToTar: %s:  copyWithTimeout on the stdout pipe (from utility VM) failed: %s", vhdHandle.Name(), err)
-	//		}
-	//		logrus.Debugf("hcsshim: VhdToTar: copied %d bytes of the tarstream of %s from the utility VM", bytes, vhdHandle.Name())
-	//	}()
-
-	//	// Return the read-side of the pipe connected to the goroutine which is reading from the stdout of the process in the utility VM
-	//	return reader, nil
+	// Return the read-side of the pipe connected to the goroutine which is reading from the stdout of the process in the utility VM
+	return reader, nil
 }
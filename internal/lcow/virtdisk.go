@@ -0,0 +1,113 @@
+package lcow
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+//go:generate go run ../../mksyscall_windows.go -output zsyscall_windows.go virtdisk.go
+
+//sys openVirtualDisk(virtualStorageType *virtualStorageType, path string, virtualDiskAccessMask uint32, flags uint32, parameters *openVirtualDiskParameters, handle *syscall.Handle) (win32err error) = virtdisk.OpenVirtualDisk
+//sys getVirtualDiskInformation(handle syscall.Handle, virtualDiskInfoSize *uint32, virtualDiskInfo *getVirtualDiskInfo, sizeUsed *uint32) (win32err error) = virtdisk.GetVirtualDiskInformation
+//sys resizeVirtualDisk(handle syscall.Handle, flags uint32, parameters *resizeVirtualDiskParameters, overlapped *syscall.Overlapped) (win32err error) = virtdisk.ResizeVirtualDisk
+
+// Constants and structures of the virtdisk APIs. See virtdisk.h.
+const (
+	virtualStorageTypeDeviceVhdx = 3
+	virtualDiskAccessNone        = 0
+	openVirtualDiskFlagNone      = 0
+	openVirtualDiskVersion2      = 2
+	getVirtualDiskInfoSize       = 1
+	resizeVirtualDiskFlagNone    = 0
+	resizeVirtualDiskVersion1    = 1
+)
+
+// virtualStorageTypeVendorMicrosoft is ec984aec-a0f9-47e9-901f-71415a66345b.
+var virtualStorageTypeVendorMicrosoft = guid.GUID{0xec, 0x4a, 0x98, 0xec, 0xf9, 0xa0, 0xe9, 0x47, 0x90, 0x1f, 0x71, 0x41, 0x5a, 0x66, 0x34, 0x5b}
+
+type virtualStorageType struct {
+	DeviceID uint32
+	VendorID guid.GUID
+}
+
+type openVirtualDiskParameters struct {
+	Version        uint32
+	GetInfoOnly    int32
+	ReadOnly       int32
+	ResiliencyGUID guid.GUID
+}
+
+// getVirtualDiskInfo is a GET_VIRTUAL_DISK_INFO requesting the
+// GET_VIRTUAL_DISK_INFO_SIZE version, which is the largest member of its union.
+type getVirtualDiskInfo struct {
+	Version      uint32
+	VirtualSize  uint64
+	PhysicalSize uint64
+	BlockSize    uint32
+	SectorSize   uint32
+}
+
+type resizeVirtualDiskParameters struct {
+	Version uint32
+	NewSize uint64
+}
+
+// openVhdx opens the VHDX at path with the virtdisk APIs, which replay its log
+// if necessary. A VHDX opened only to get information is not modified.
+func openVhdx(path string, getInfoOnly bool) (syscall.Handle, error) {
+	storageType := virtualStorageType{
+		DeviceID: virtualStorageTypeDeviceVhdx,
+		VendorID: virtualStorageTypeVendorMicrosoft,
+	}
+	params := openVirtualDiskParameters{Version: openVirtualDiskVersion2}
+	if getInfoOnly {
+		params.GetInfoOnly = 1
+	}
+	var handle syscall.Handle
+	if err := openVirtualDisk(&storageType, path, virtualDiskAccessNone, openVirtualDiskFlagNone, &params, &handle); err != nil {
+		return 0, fmt.Errorf("failed to open %s: %s", path, err)
+	}
+	return handle, nil
+}
+
+// vhdxVirtualSize returns the virtual size of the VHDX at path.
+func vhdxVirtualSize(path string) (int64, error) {
+	handle, err := openVhdx(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(handle)
+	info := getVirtualDiskInfo{Version: getVirtualDiskInfoSize}
+	infoSize := uint32(unsafe.Sizeof(info))
+	if err := getVirtualDiskInformation(handle, &infoSize, &info, nil); err != nil {
+		return 0, fmt.Errorf("failed to get the size of %s: %s", path, err)
+	}
+	return int64(info.VirtualSize), nil
+}
+
+// ExpandScratchVhdx expands the VHDX of a scratch disk which is not attached to
+// any VM to at least sizeGB, without growing its file system. It is resized by
+// the virtdisk APIs, and is not shrunk if it is already at least sizeGB.
+func ExpandScratchVhdx(path string, sizeGB uint32) error {
+	size := int64(sizeGB) * 1024 * 1024 * 1024
+	current, err := vhdxVirtualSize(path)
+	if err != nil {
+		return err
+	}
+	if current >= size {
+		return nil
+	}
+	handle, err := openVhdx(path, false)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	params := resizeVirtualDiskParameters{Version: resizeVirtualDiskVersion1, NewSize: uint64(size)}
+	if err := resizeVirtualDisk(handle, resizeVirtualDiskFlagNone, &params, nil); err != nil {
+		return fmt.Errorf("failed to expand %s from %d to %d bytes: %s", path, current, size, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// MACHINE GENERATED BY 'go generate' COMMAND; DO NOT EDIT
+
+package lcow
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var _ unsafe.Pointer
+
+// Do the interface allocations only once for common
+// Errno values.
+const (
+	errnoERROR_IO_PENDING = 997
+)
+
+var (
+	errERROR_IO_PENDING error = syscall.Errno(errnoERROR_IO_PENDING)
+)
+
+// errnoErr returns common boxed Errno values, to prevent
+// allocations at runtime.
+func errnoErr(e syscall.Errno) error {
+	switch e {
+	case 0:
+		return nil
+	case errnoERROR_IO_PENDING:
+		return errERROR_IO_PENDING
+	}
+	// TODO: add more here, after collecting data on the common
+	// error values see on Windows. (perhaps when running
+	// all.bat?)
+	return e
+}
+
+var (
+	modvirtdisk = windows.NewLazySystemDLL("virtdisk.dll")
+
+	procOpenVirtualDisk           = modvirtdisk.NewProc("OpenVirtualDisk")
+	procGetVirtualDiskInformation = modvirtdisk.NewProc("GetVirtualDiskInformation")
+	procResizeVirtualDisk         = modvirtdisk.NewProc("ResizeVirtualDisk")
+)
+
+func openVirtualDisk(virtualStorageType *virtualStorageType, path string, virtualDiskAccessMask uint32, flags uint32, parameters *openVirtualDiskParameters, handle *syscall.Handle) (win32err error) {
+	var _p0 *uint16
+	_p0, win32err = syscall.UTF16PtrFromString(path)
+	if win32err != nil {
+		return
+	}
+	return _openVirtualDisk(virtualStorageType, _p0, virtualDiskAccessMask, flags, parameters, handle)
+}
+
+func _openVirtualDisk(virtualStorageType *virtualStorageType, path *uint16, virtualDiskAccessMask uint32, flags uint32, parameters *openVirtualDiskParameters, handle *syscall.Handle) (win32err error) {
+	r0, _, _ := syscall.Syscall6(procOpenVirtualDisk.Addr(), 6, uintptr(unsafe.Pointer(virtualStorageType)), uintptr(unsafe.Pointer(path)), uintptr(virtualDiskAccessMask), uintptr(flags), uintptr(unsafe.Pointer(parameters)), uintptr(unsafe.Pointer(handle)))
+	if r0 != 0 {
+		win32err = syscall.Errno(r0)
+	}
+	return
+}
+
+func getVirtualDiskInformation(handle syscall.Handle, virtualDiskInfoSize *uint32, virtualDiskInfo *getVirtualDiskInfo, sizeUsed *uint32) (win32err error) {
+	r0, _, _ := syscall.Syscall6(procGetVirtualDiskInformation.Addr(), 4, uintptr(handle), uintptr(unsafe.Pointer(virtualDiskInfoSize)), uintptr(unsafe.Pointer(virtualDiskInfo)), uintptr(unsafe.Pointer(sizeUsed)), 0, 0)
+	if r0 != 0 {
+		win32err = syscall.Errno(r0)
+	}
+	return
+}
+
+func resizeVirtualDisk(handle syscall.Handle, flags uint32, parameters *resizeVirtualDiskParameters, overlapped *syscall.Overlapped) (win32err error) {
+	r0, _, _ := syscall.Syscall6(procResizeVirtualDisk.Addr(), 4, uintptr(handle), uintptr(flags), uintptr(unsafe.Pointer(parameters)), uintptr(unsafe.Pointer(overlapped)), 0, 0)
+	if r0 != 0 {
+		win32err = syscall.Errno(r0)
+	}
+	return
+}
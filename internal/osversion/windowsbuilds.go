@@ -8,4 +8,6 @@ const (
 	RS4 = 17134
 	RS5 = 17659 // TODO Bump to final RS5 build
 
+	// V19H1 is the first build supporting direct boot of a Linux kernel (schema 2.1)
+	V19H1 = 18362
 )
@@ -0,0 +1,231 @@
+package remotefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Client is an FS whose operations are executed by a server, such as a
+// process serving the protocol with Serve on its stdio.
+type Client struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	dec    *json.Decoder
+	w      io.WriteCloser
+	err    error // The error which broke the connection, if any
+	closed bool
+}
+
+var _ FS = &Client{}
+
+// NewClient returns a client which sends requests to w and reads responses
+// from r. Closing the client closes w, which ends the server.
+func NewClient(r io.Reader, w io.WriteCloser) *Client {
+	return &Client{enc: json.NewEncoder(w), dec: json.NewDecoder(r), w: w}
+}
+
+// Close closes the connection to the server. Files still open are closed by
+// the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.w.Close()
+}
+
+// call sends a request and returns its response. A failure of the connection
+// fails all subsequent calls.
+func (c *Client) call(req *request) (*response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("remotefs: %s on closed client", req.Op)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	var resp response
+	if err := c.enc.Encode(req); err != nil {
+		c.err = fmt.Errorf("remotefs: failed to send %s request: %s", req.Op, err)
+		return nil, c.err
+	}
+	if err := c.dec.Decode(&resp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.err = fmt.Errorf("remotefs: failed to read %s response: %s", req.Op, err)
+		return nil, c.err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err.toError()
+	}
+	return &resp, nil
+}
+
+func (c *Client) Stat(name string) (os.FileInfo, error) {
+	resp, err := c.call(&request{Op: opStat, Path: name})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Info, nil
+}
+
+func (c *Client) Lstat(name string) (os.FileInfo, error) {
+	resp, err := c.call(&request{Op: opLstat, Path: name})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Info, nil
+}
+
+func (c *Client) ReadDir(name string) ([]os.FileInfo, error) {
+	resp, err := c.call(&request{Op: opReadDir, Path: name})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(resp.Infos))
+	for i, fi := range resp.Infos {
+		infos[i] = fi
+	}
+	return infos, nil
+}
+
+func (c *Client) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	resp, err := c.call(&request{Op: opOpenFile, Path: name, Flag: encodeFlag(flag), Perm: perm})
+	if err != nil {
+		return nil, err
+	}
+	return &clientFile{c: c, name: name, handle: resp.Handle}, nil
+}
+
+func (c *Client) Mkdir(name string, perm os.FileMode) error {
+	_, err := c.call(&request{Op: opMkdir, Path: name, Perm: perm})
+	return err
+}
+
+func (c *Client) MkdirAll(name string, perm os.FileMode) error {
+	_, err := c.call(&request{Op: opMkdirAll, Path: name, Perm: perm})
+	return err
+}
+
+func (c *Client) Remove(name string) error {
+	_, err := c.call(&request{Op: opRemove, Path: name})
+	return err
+}
+
+func (c *Client) RemoveAll(name string) error {
+	_, err := c.call(&request{Op: opRemoveAll, Path: name})
+	return err
+}
+
+func (c *Client) Rename(oldname, newname string) error {
+	_, err := c.call(&request{Op: opRename, Path: oldname, NewPath: newname})
+	return err
+}
+
+func (c *Client) Symlink(oldname, newname string) error {
+	_, err := c.call(&request{Op: opSymlink, Path: oldname, NewPath: newname})
+	return err
+}
+
+func (c *Client) Readlink(name string) (string, error) {
+	resp, err := c.call(&request{Op: opReadlink, Path: name})
+	if err != nil {
+		return "", err
+	}
+	return resp.Target, nil
+}
+
+func (c *Client) Chmod(name string, mode os.FileMode) error {
+	_, err := c.call(&request{Op: opChmod, Path: name, Perm: mode})
+	return err
+}
+
+// clientFile is a file opened by the server.
+type clientFile struct {
+	c      *Client
+	name   string
+	handle uint64
+	closed bool
+}
+
+func (f *clientFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	count := len(p)
+	if count > maxReadSize {
+		count = maxReadSize
+	}
+	resp, err := f.c.call(&request{Op: opRead, Handle: f.handle, Count: count})
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, resp.Data)
+	if n == 0 && resp.EOF {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *clientFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxReadSize {
+			chunk = chunk[:maxReadSize]
+		}
+		resp, err := f.c.call(&request{Op: opWrite, Handle: f.handle, Data: chunk})
+		if err != nil {
+			return written, err
+		}
+		written += resp.N
+		if resp.N < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (f *clientFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	resp, err := f.c.call(&request{Op: opSeek, Handle: f.handle, Offset: offset, Whence: whence})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Offset, nil
+}
+
+func (f *clientFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	resp, err := f.c.call(&request{Op: opFstat, Handle: f.handle})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Info, nil
+}
+
+func (f *clientFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	_, err := f.c.call(&request{Op: opClose, Handle: f.handle})
+	return err
+}
@@ -0,0 +1,194 @@
+package remotefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// LocalFS is an FS over a directory of the local file system.
+//
+// Paths are resolved beneath Root as if it were the root directory, so that
+// neither .. elements nor symbolic links, absolute or relative, can leave it.
+// A path is resolved before the operation on it, so this is not a security
+// boundary against concurrent changes to the directory.
+type LocalFS struct {
+	Root string
+}
+
+var _ FS = &LocalFS{}
+
+// maxSymlinks is the number of symbolic links followed resolving a path before
+// it is considered a loop.
+const maxSymlinks = 255
+
+// NewLocalFS returns an FS over the directory root.
+func NewLocalFS(root string) *LocalFS {
+	return &LocalFS{Root: root}
+}
+
+// path returns the local path of name, following symbolic links beneath Root.
+// A link in the final element is only followed if followLast is set. Elements
+// which don't exist are resolved as named, so that they can be created.
+func (fs *LocalFS) path(name string, followLast bool) (string, error) {
+	resolved := "" // Slash separated, relative to Root
+	remaining := path.Clean("/" + filepath.ToSlash(name))
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir("/" + resolved)[1:]
+			continue
+		}
+		next := path.Join(resolved, part)
+		if remaining == "" && !followLast {
+			resolved = next
+			break
+		}
+		local := filepath.Join(fs.Root, filepath.FromSlash(next))
+		fi, err := os.Lstat(local)
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		links++
+		if links > maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(local)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		if remaining != "" {
+			target += "/" + remaining
+		}
+		remaining = target
+	}
+	return filepath.Join(fs.Root, filepath.FromSlash(resolved)), nil
+}
+
+func (fs *LocalFS) Stat(name string) (os.FileInfo, error) {
+	p, err := fs.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (fs *LocalFS) Lstat(name string) (os.FileInfo, error) {
+	p, err := fs.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (fs *LocalFS) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := fs.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(p)
+}
+
+// OpenFile opens name, following a symbolic link in its final element unless
+// the file is created exclusively.
+func (fs *LocalFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p, err := fs.path(name, flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *LocalFS) Mkdir(name string, perm os.FileMode) error {
+	p, err := fs.path(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (fs *LocalFS) MkdirAll(name string, perm os.FileMode) error {
+	p, err := fs.path(name, true)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (fs *LocalFS) Remove(name string) error {
+	p, err := fs.path(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (fs *LocalFS) RemoveAll(name string) error {
+	p, err := fs.path(name, false)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (fs *LocalFS) Rename(oldname, newname string) error {
+	oldpath, err := fs.path(oldname, false)
+	if err != nil {
+		return err
+	}
+	newpath, err := fs.path(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// Symlink creates newname as a symbolic link to oldname, which is stored as
+// given and resolved beneath Root when the link is followed.
+func (fs *LocalFS) Symlink(oldname, newname string) error {
+	p, err := fs.path(newname, false)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(oldname, p)
+}
+
+func (fs *LocalFS) Readlink(name string) (string, error) {
+	p, err := fs.path(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+func (fs *LocalFS) Chmod(name string, mode os.FileMode) error {
+	p, err := fs.path(name, true)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
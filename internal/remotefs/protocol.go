@@ -0,0 +1,143 @@
+package remotefs
+
+import (
+	"errors"
+	"os"
+)
+
+// The protocol is a sequence of requests from the client, each answered by a
+// response from the server before the next request is sent. Both are JSON
+// objects, one per line.
+
+const (
+	opStat      = "Stat"
+	opLstat     = "Lstat"
+	opReadDir   = "ReadDir"
+	opOpenFile  = "OpenFile"
+	opMkdir     = "Mkdir"
+	opMkdirAll  = "MkdirAll"
+	opRemove    = "Remove"
+	opRemoveAll = "RemoveAll"
+	opRename    = "Rename"
+	opSymlink   = "Symlink"
+	opReadlink  = "Readlink"
+	opChmod     = "Chmod"
+	opRead      = "Read"
+	opWrite     = "Write"
+	opSeek      = "Seek"
+	opFstat     = "Fstat"
+	opClose     = "Close"
+)
+
+// maxReadSize is the most data returned by a single read request.
+const maxReadSize = 1024 * 1024
+
+type request struct {
+	Op      string
+	Path    string      `json:",omitempty"`
+	NewPath string      `json:",omitempty"`
+	Flag    int         `json:",omitempty"` // Open flags, as flag* values
+	Perm    os.FileMode `json:",omitempty"`
+	Handle  uint64      `json:",omitempty"`
+	Data    []byte      `json:",omitempty"`
+	Count   int         `json:",omitempty"`
+	Offset  int64       `json:",omitempty"`
+	Whence  int         `json:",omitempty"`
+}
+
+type response struct {
+	Err    *remoteError `json:",omitempty"`
+	Info   *FileInfo    `json:",omitempty"`
+	Infos  []*FileInfo  `json:",omitempty"`
+	Handle uint64       `json:",omitempty"`
+	Data   []byte       `json:",omitempty"`
+	N      int          `json:",omitempty"`
+	EOF    bool         `json:",omitempty"`
+	Offset int64        `json:",omitempty"`
+	Target string       `json:",omitempty"`
+}
+
+// Open flags are sent as these values rather than as os.O_* values, which
+// differ between the client's and the server's platforms.
+const (
+	flagWriteOnly = 1 << iota
+	flagReadWrite
+	flagAppend
+	flagCreate
+	flagExclusive
+	flagTruncate
+)
+
+var openFlags = []struct{ os, protocol int }{
+	{os.O_WRONLY, flagWriteOnly},
+	{os.O_RDWR, flagReadWrite},
+	{os.O_APPEND, flagAppend},
+	{os.O_CREATE, flagCreate},
+	{os.O_EXCL, flagExclusive},
+	{os.O_TRUNC, flagTruncate},
+}
+
+func encodeFlag(flag int) int {
+	var p int
+	for _, f := range openFlags {
+		if flag&f.os != 0 {
+			p |= f.protocol
+		}
+	}
+	return p
+}
+
+func decodeFlag(p int) int {
+	flag := os.O_RDONLY
+	for _, f := range openFlags {
+		if p&f.protocol != 0 {
+			flag |= f.os
+		}
+	}
+	return flag
+}
+
+// Errors are sent with the kind of the error, so that os.IsNotExist and
+// friends work with errors returned by the client.
+const (
+	errorKindNotExist   = "NotExist"
+	errorKindExist      = "Exist"
+	errorKindPermission = "Permission"
+)
+
+type remoteError struct {
+	Op      string
+	Path    string `json:",omitempty"`
+	Kind    string `json:",omitempty"`
+	Message string
+}
+
+func newRemoteError(op, path string, err error) *remoteError {
+	e := &remoteError{Op: op, Path: path, Message: err.Error()}
+	switch {
+	case os.IsNotExist(err):
+		e.Kind = errorKindNotExist
+	case os.IsExist(err):
+		e.Kind = errorKindExist
+	case os.IsPermission(err):
+		e.Kind = errorKindPermission
+	}
+	return e
+}
+
+// toError returns the error as an *os.PathError whose Err is one of the os
+// package's errors if it is of a known kind.
+func (e *remoteError) toError() error {
+	var err error
+	switch e.Kind {
+	case errorKindNotExist:
+		err = os.ErrNotExist
+	case errorKindExist:
+		err = os.ErrExist
+	case errorKindPermission:
+		err = os.ErrPermission
+	default:
+		return &os.PathError{Op: e.Op, Path: e.Path, Err: errors.New(e.Message)}
+	}
+	return &os.PathError{Op: e.Op, Path: e.Path, Err: err}
+}
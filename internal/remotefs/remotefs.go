@@ -0,0 +1,80 @@
+// Package remotefs provides file system operations which are executed by a
+// server elsewhere, such as in a Linux utility VM, over a simple
+// request/response protocol on a pair of streams such as the stdio of a
+// process.
+//
+// The operations are described by FS, in the style of the os package.
+// Client implements FS by sending requests; Serve executes requests against
+// another FS, typically a LocalFS over a directory on the server's machine.
+// Paths are slash-separated and relative to the root of the FS.
+package remotefs
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FS is a file system whose operations are those of the os package.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of a directory, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// OpenFile opens a file with the os.O_* flags O_RDONLY, O_WRONLY,
+	// O_RDWR, O_APPEND, O_CREATE, O_EXCL and O_TRUNC.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Chmod(name string, mode os.FileMode) error
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// Open opens a file of fs for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates a file of fs, opening it for reading and
+// writing.
+func Create(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// FileInfo describes a file. It implements os.FileInfo, and is how file
+// information is sent by the protocol.
+type FileInfo struct {
+	FileName    string
+	FileSize    int64
+	FileMode    os.FileMode
+	FileModTime time.Time
+}
+
+func newFileInfo(fi os.FileInfo) *FileInfo {
+	return &FileInfo{
+		FileName:    fi.Name(),
+		FileSize:    fi.Size(),
+		FileMode:    fi.Mode(),
+		FileModTime: fi.ModTime(),
+	}
+}
+
+func (fi *FileInfo) Name() string       { return fi.FileName }
+func (fi *FileInfo) Size() int64        { return fi.FileSize }
+func (fi *FileInfo) Mode() os.FileMode  { return fi.FileMode }
+func (fi *FileInfo) ModTime() time.Time { return fi.FileModTime }
+func (fi *FileInfo) IsDir() bool        { return fi.FileMode.IsDir() }
+func (fi *FileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,283 @@
+package remotefs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newLoopback returns a client connected to a server over a LocalFS of a new
+// temporary directory, and a function which cleans them up.
+func newLoopback(t *testing.T) (*Client, string, func()) {
+	dir, err := ioutil.TempDir("", "remotefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		err := Serve(NewLocalFS(dir), reqR, respW)
+		respW.Close()
+		served <- err
+	}()
+	c := NewClient(respR, reqW)
+	return c, dir, func() {
+		c.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	c, dir, cleanup := newLoopback(t)
+	defer cleanup()
+
+	f, err := Create(c, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), maxReadSize/5)
+	if n, err := f.Write(data); err != nil || n != len(data) {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if offset, err := f.Seek(0, io.SeekStart); err != nil || offset != 0 {
+		t.Fatalf("seek: %d, %v", offset, err)
+	}
+	read, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("read %d bytes, %v", len(read), err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(data)) || fi.Name() != "file" {
+		t.Errorf("stat: %+v, %v", fi, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("read of a closed file succeeded")
+	}
+	if local, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || !bytes.Equal(local, data) {
+		t.Errorf("local file has %d bytes, %v", len(local), err)
+	}
+
+	f, err = c.OpenFile("file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if fi, err := c.Stat("file"); err != nil || fi.Size() != int64(len(data)+3) || !fi.Mode().IsRegular() {
+		t.Errorf("stat: %+v, %v", fi, err)
+	}
+
+	if _, err := c.OpenFile("file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); !os.IsExist(err) {
+		t.Errorf("exclusive create of an existing file: %v", err)
+	}
+	if _, err := Open(c, "missing"); !os.IsNotExist(err) {
+		t.Errorf("open of a missing file: %v", err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	c, dir, cleanup := newLoopback(t)
+	defer cleanup()
+
+	if err := c.MkdirAll("a/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir("a/b", 0755); !os.IsExist(err) {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+	for _, name := range []string{"a/z", "a/m"} {
+		f, err := Create(c, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	fis, err := c.ReadDir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if len(fis) != 3 || names[0] != "b" || !fis[0].IsDir() || names[1] != "m" || names[2] != "z" {
+		t.Errorf("unexpected entries %v", names)
+	}
+
+	if err := c.Rename("a/m", "a/b/n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b", "n")); err != nil {
+		t.Error(err)
+	}
+	if err := c.Remove("a/b"); err == nil {
+		t.Error("remove of a non-empty directory succeeded")
+	}
+	if err := c.RemoveAll("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("a/b"); !os.IsNotExist(err) {
+		t.Errorf("stat of a removed directory: %v", err)
+	}
+
+	// Paths cannot leave the root.
+	if err := c.Mkdir("../../escaped", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLinksAndModes(t *testing.T) {
+	c, _, cleanup := newLoopback(t)
+	defer cleanup()
+
+	f, err := Create(c, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := c.Symlink("target", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := c.Readlink("link"); err != nil || target != "target" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := c.Lstat("link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat: %+v, %v", fi, err)
+	}
+	if fi, err := c.Stat("link"); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("stat: %+v, %v", fi, err)
+	}
+
+	if err := c.Chmod("target", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := c.Stat("target"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("stat after chmod: %+v, %v", fi, err)
+	}
+	if err := c.Chmod("missing", 0600); !os.IsNotExist(err) {
+		t.Errorf("chmod of a missing file: %v", err)
+	}
+}
+
+func TestLinksResolvedBeneathRoot(t *testing.T) {
+	c, dir, cleanup := newLoopback(t)
+	defer cleanup()
+	outside, err := ioutil.TempDir("", "remotefs-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "inside"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir("sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(filepath.Join(dir, "sub"), outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"abs":       "/",
+		"absout":    outside,
+		"sub/up":    "../../../..",
+		"sub/upout": rel,
+		"loop":      "loop",
+	}
+	for link, target := range links {
+		if err := c.Symlink(filepath.ToSlash(target), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Links to the root, absolute or with .. elements, stay beneath it.
+	for _, name := range []string{"abs/inside", "sub/up/inside", "sub/up/sub/up/inside"} {
+		if fi, err := c.Stat(name); err != nil || fi.Name() != "inside" {
+			t.Errorf("stat %s: %+v, %v", name, fi, err)
+		}
+	}
+	// Links to a directory outside the root are resolved beneath it, where
+	// it doesn't exist.
+	for _, name := range []string{"absout/secret", "sub/upout/secret"} {
+		if _, err := c.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("stat %s: %v", name, err)
+		}
+		if f, err := c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err == nil {
+			f.Close()
+			t.Errorf("opened %s outside the root", name)
+		}
+		if err := c.Chmod(name, 0600); err == nil {
+			t.Errorf("chmod %s outside the root succeeded", name)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(outside, "secret")); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the root changed: %q, %v", data, err)
+	}
+	if fi, err := os.Stat(filepath.Join(outside, "secret")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("mode of file outside the root changed: %+v, %v", fi, err)
+	}
+
+	// A link in the final element is not followed where it names the link.
+	if fi, err := c.Lstat("sub/up"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat: %+v, %v", fi, err)
+	}
+	if err := c.Remove("abs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "inside")); err != nil {
+		t.Errorf("removing a link removed its target: %v", err)
+	}
+	if _, err := c.Stat("loop"); err == nil {
+		t.Error("stat of a symbolic link loop succeeded")
+	}
+}
+
+func TestClosedConnection(t *testing.T) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	c := NewClient(respR, reqW)
+	go func() {
+		ioutil.ReadAll(reqR)
+	}()
+	respW.Close()
+	if _, err := c.Stat("file"); err == nil {
+		t.Fatal("stat succeeded without a server")
+	}
+	if _, err := c.Stat("file"); err == nil {
+		t.Error("stat succeeded after the connection failed")
+	}
+	c.Close()
+	if err := c.Mkdir("dir", 0755); err == nil {
+		t.Error("mkdir succeeded on a closed client")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, flag := range []int{
+		os.O_RDONLY,
+		os.O_WRONLY | os.O_APPEND,
+		os.O_RDWR | os.O_CREATE | os.O_EXCL,
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	} {
+		if decoded := decodeFlag(encodeFlag(flag)); decoded != flag {
+			t.Errorf("flag %#x decoded as %#x", flag, decoded)
+		}
+	}
+}
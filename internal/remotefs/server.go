@@ -0,0 +1,143 @@
+package remotefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Serve executes requests read from r against fs, writing the responses to w,
+// until r reaches EOF. Files left open by the client are then closed.
+func Serve(fs FS, r io.Reader, w io.Writer) error {
+	s := &server{fs: fs, files: make(map[uint64]File)}
+	defer func() {
+		for _, f := range s.files {
+			f.Close()
+		}
+	}()
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("remotefs: failed to read request: %s", err)
+		}
+		resp := s.handle(&req)
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("remotefs: failed to send %s response: %s", req.Op, err)
+		}
+	}
+}
+
+type server struct {
+	fs         FS
+	files      map[uint64]File
+	nextHandle uint64
+}
+
+func (s *server) handle(req *request) *response {
+	resp, err := s.dispatch(req)
+	if err != nil {
+		return &response{Err: newRemoteError(req.Op, req.Path, err)}
+	}
+	return resp
+}
+
+func (s *server) dispatch(req *request) (*response, error) {
+	switch req.Op {
+	case opStat, opLstat:
+		stat := s.fs.Stat
+		if req.Op == opLstat {
+			stat = s.fs.Lstat
+		}
+		fi, err := stat(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &response{Info: newFileInfo(fi)}, nil
+	case opReadDir:
+		fis, err := s.fs.ReadDir(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		resp := &response{Infos: make([]*FileInfo, len(fis))}
+		for i, fi := range fis {
+			resp.Infos[i] = newFileInfo(fi)
+		}
+		return resp, nil
+	case opOpenFile:
+		f, err := s.fs.OpenFile(req.Path, decodeFlag(req.Flag), req.Perm)
+		if err != nil {
+			return nil, err
+		}
+		s.nextHandle++
+		s.files[s.nextHandle] = f
+		return &response{Handle: s.nextHandle}, nil
+	case opMkdir:
+		return &response{}, s.fs.Mkdir(req.Path, req.Perm)
+	case opMkdirAll:
+		return &response{}, s.fs.MkdirAll(req.Path, req.Perm)
+	case opRemove:
+		return &response{}, s.fs.Remove(req.Path)
+	case opRemoveAll:
+		return &response{}, s.fs.RemoveAll(req.Path)
+	case opRename:
+		return &response{}, s.fs.Rename(req.Path, req.NewPath)
+	case opSymlink:
+		return &response{}, s.fs.Symlink(req.Path, req.NewPath)
+	case opReadlink:
+		target, err := s.fs.Readlink(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &response{Target: target}, nil
+	case opChmod:
+		return &response{}, s.fs.Chmod(req.Path, req.Perm)
+	}
+
+	f, ok := s.files[req.Handle]
+	if !ok {
+		return nil, fmt.Errorf("unknown file handle %d", req.Handle)
+	}
+	switch req.Op {
+	case opRead:
+		count := req.Count
+		if count > maxReadSize {
+			count = maxReadSize
+		}
+		buf := make([]byte, count)
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &response{Data: buf[:n], EOF: true}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &response{Data: buf[:n]}, nil
+	case opWrite:
+		n, err := f.Write(req.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &response{N: n}, nil
+	case opSeek:
+		offset, err := f.Seek(req.Offset, req.Whence)
+		if err != nil {
+			return nil, err
+		}
+		return &response{Offset: offset}, nil
+	case opFstat:
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return &response{Info: newFileInfo(fi)}, nil
+	case opClose:
+		delete(s.files, req.Handle)
+		return &response{}, f.Close()
+	}
+	return nil, fmt.Errorf("unknown operation %q", req.Op)
+}
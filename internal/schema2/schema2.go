@@ -160,12 +160,21 @@ type VirtualMachinesResourcesUefiV2 struct {
 	Console              string                                   `json:"Console,omitempty"`
 }
 
+// VirtualMachinesResourcesLinuxKernelDirectV2 boots a Linux kernel directly
+// from the host rather than through UEFI. Schema 2.1 (19H1) onwards.
+type VirtualMachinesResourcesLinuxKernelDirectV2 struct {
+	KernelFilePath string `json:"KernelFilePath,omitempty"`
+	InitRdPath     string `json:"InitRdPath,omitempty"`
+	KernelCmdLine  string `json:"KernelCmdLine,omitempty"`
+}
+
 type VirtualMachinesResourcesChipsetV2 struct {
-	UEFI                  *VirtualMachinesResourcesUefiV2 `json:"UEFI,omitempty"`
-	IsNumLockDisabled     bool                            `json:"IsNumLockDisabled,omitempty"`
-	BaseBoardSerialNumber string                          `json:"BaseBoardSerialNumber,omitempty"`
-	ChassisSerialNumber   string                          `json:"ChassisSerialNumber,omitempty"`
-	ChassisAssetTag       string                          `json:"ChassisAssetTag,omitempty"`
+	UEFI                  *VirtualMachinesResourcesUefiV2              `json:"UEFI,omitempty"`
+	LinuxKernelDirect     *VirtualMachinesResourcesLinuxKernelDirectV2 `json:"LinuxKernelDirect,omitempty"`
+	IsNumLockDisabled     bool                                         `json:"IsNumLockDisabled,omitempty"`
+	BaseBoardSerialNumber string                                       `json:"BaseBoardSerialNumber,omitempty"`
+	ChassisSerialNumber   string                                       `json:"ChassisSerialNumber,omitempty"`
+	ChassisAssetTag       string                                       `json:"ChassisAssetTag,omitempty"`
 }
 
 type VirtualMachinesResourcesComputeSharedMemoryRegionV2 struct {
@@ -191,14 +200,29 @@ type VirtualMachinesResourcesComputeMemoryV2 struct {
 
 type VirtualMachinesResourcesComputeProcessorV2 struct {
 	Count                          int32 `json:"Count,omitempty"`
+	Limit                          int32 `json:"Limit,omitempty"`  // 1..100000. Percentage of host CPU * 1000
+	Weight                         int32 `json:"Weight,omitempty"` // 0..10000. Relative to other VMs
 	ExposeVirtualizationExtensions bool  `json:"ExposeVirtualizationExtensions,omitempty"`
 	SynchronizeQPC                 bool  `json:"SynchronizeQPC,omitempty"`
 	EnableSchedulerAssist          bool  `json:"EnableSchedulerAssist,omitempty"`
 }
 
+// VirtualMachinesResourcesComputeProcessorLimitsV2 is used to update the
+// processor limits of a running virtual machine.
+type VirtualMachinesResourcesComputeProcessorLimitsV2 struct {
+	Limit  int32 `json:"Limit,omitempty"`
+	Weight int32 `json:"Weight,omitempty"`
+}
+
+type VirtualMachinesResourcesComputeNumaV2 struct {
+	VirtualNodeCount       int32   `json:"VirtualNodeCount,omitempty"`
+	PreferredPhysicalNodes []int32 `json:"PreferredPhysicalNodes,omitempty"`
+}
+
 type VirtualMachinesResourcesComputeTopologyV2 struct {
 	Memory    *VirtualMachinesResourcesComputeMemoryV2    `json:"Memory,omitempty"`
 	Processor *VirtualMachinesResourcesComputeProcessorV2 `json:"Processor,omitempty"`
+	Numa      *VirtualMachinesResourcesComputeNumaV2      `json:"Numa,omitempty"`
 }
 
 type VirtualMachinesResourcesStorageAttachmentV2 struct {
@@ -228,6 +252,14 @@ type VirtualMachinesResourcesStorageVpmemDeviceV2 struct {
 	HostPath    string `json:"HostPath,omitempty"`
 	ReadOnly    bool   `json:"ReadOnly,omitempty"`
 	ImageFormat string `json:"ImageFormat,omitempty"`
+	SizeBytes   uint64 `json:"SizeBytes,omitempty"` // Size of a device with no HostPath onto which images are mapped
+}
+
+// VirtualMachinesResourcesStorageVpmemMappingV2 maps an image into a VPMem
+// device at an offset. The offset is part of the ResourceUri.
+type VirtualMachinesResourcesStorageVpmemMappingV2 struct {
+	HostPath    string `json:"HostPath,omitempty"`
+	ImageFormat string `json:"ImageFormat,omitempty"`
 }
 
 type VirtualMachinesResourcesStorageVpmemControllerV2 struct {
@@ -324,10 +356,11 @@ const (
 )
 
 type VirtualMachinesResourcesStoragePlan9ShareV2 struct {
-	Name  string `json:"Name,omitempty"`
-	Path  string `json:"Path,omitempty"`
-	Port  int32  `json:"Port,omitempty"`
-	Flags string `json:"Flags,omitempty"`
+	Name       string `json:"Name,omitempty"`
+	AccessName string `json:"AccessName,omitempty"` // The aname the guest uses to select this share when shares are multiplexed over a single port
+	Path       string `json:"Path,omitempty"`
+	Port       int32  `json:"Port,omitempty"`
+	Flags      string `json:"Flags,omitempty"`
 }
 
 type VirtualMachinesResourcesNetworkNic struct {
@@ -389,6 +422,7 @@ type ModifySettingsRequestV2 struct {
 // ResourceType const
 const (
 	ResourceTypeMemory             ResourceType = "Memory"
+	ResourceTypeProcessor          ResourceType = "Processor"
 	ResourceTypeCpuGroup           ResourceType = "CpuGroup"
 	ResourceTypeMappedDirectory    ResourceType = "MappedDirectory"
 	ResourceTypeMappedPipe         ResourceType = "MappedPipe"
@@ -410,7 +444,7 @@ const (
 	RequestTypeAdd     RequestType  = "Add"
 	RequestTypeRemove  RequestType  = "Remove"
 	RequestTypeNetwork ResourceType = "Network"
-	RequestTypeUpdate  ResourceType = "Update"
+	RequestTypeUpdate  RequestType  = "Update"
 )
 
 // This class is used by a modify request to add or remove a combined layers
@@ -25,6 +25,11 @@ func SchemaV20() *SchemaVersion {
 	return &SchemaVersion{Major: 2, Minor: 0}
 }
 
+// SchemaV21 makes it easy for callers to get a v2.1 schema version object
+func SchemaV21() *SchemaVersion {
+	return &SchemaVersion{Major: 2, Minor: 1}
+}
+
 // isSupported determines if a given schema version is supported
 func (sv *SchemaVersion) IsSupported() error {
 	if sv.IsV10() {
@@ -36,6 +41,12 @@ func (sv *SchemaVersion) IsSupported() error {
 		}
 		return nil
 	}
+	if sv.IsV21() {
+		if osversion.Get().Build < osversion.V19H1 {
+			return fmt.Errorf("unsupported on this Windows build")
+		}
+		return nil
+	}
 	return fmt.Errorf("unknown schema version %s", sv.String())
 }
 
@@ -58,6 +69,15 @@ func (sv *SchemaVersion) IsV20() bool {
 	return false
 }
 
+// IsV21 determines if a given schema version object is 2.1. This is required
+// for features such as direct boot of a Linux kernel.
+func (sv *SchemaVersion) IsV21() bool {
+	if sv.Major == 2 && sv.Minor == 1 {
+		return true
+	}
+	return false
+}
+
 // String returns a JSON encoding of a schema version object
 func (sv *SchemaVersion) String() string {
 	b, err := json.Marshal(sv)
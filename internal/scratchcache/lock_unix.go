@@ -0,0 +1,64 @@
+// +build !windows
+
+package scratchcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on path, creating it if necessary and
+// waiting for any other holder, and returns a function which releases it.
+func lockFile(path string) (func(), error) {
+	return lock(path, syscall.LOCK_EX)
+}
+
+// tryLockFile is lockFile, but returns errLocked rather than waiting.
+func tryLockFile(path string) (func(), error) {
+	return lock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// removeLockFile removes the lock file at path, which is held, and releases
+// the lock with unlock. The file is removed while the lock is held, so that
+// no other process can take the lock in between; a process waiting on the
+// removed file finds it has been replaced when it gets the lock.
+func removeLockFile(path string, unlock func()) {
+	os.Remove(path)
+	unlock()
+}
+
+func lock(path string, how int) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), how); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, errLocked
+			}
+			return nil, err
+		}
+		unlock := func() {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		}
+		// The lock is only valid if the file was not removed by
+		// removeLockFile before it was taken. Otherwise the lock of the
+		// file which replaced it is taken.
+		locked, err := f.Stat()
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return unlock, nil
+		}
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package scratchcache
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on path, creating it if necessary and
+// waiting for any other holder, and returns a function which releases it.
+func lockFile(path string) (func(), error) {
+	return lock(path, windows.LOCKFILE_EXCLUSIVE_LOCK)
+}
+
+// tryLockFile is lockFile, but returns errLocked rather than waiting.
+func tryLockFile(path string) (func(), error) {
+	return lock(path, windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY)
+}
+
+// removeLockFile releases the lock with unlock, then removes the lock file at
+// path. Files are opened without FILE_SHARE_DELETE, so the removal fails,
+// leaving the file, if another process has opened it since.
+func removeLockFile(path string, unlock func()) {
+	unlock()
+	os.Remove(path)
+}
+
+func lock(path string, flags uint32) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := windows.Handle(f.Fd())
+	if err := windows.LockFileEx(h, flags, 0, 1, 0, &windows.Overlapped{}); err != nil {
+		f.Close()
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return func() {
+		windows.UnlockFileEx(h, 0, 1, 0, &windows.Overlapped{})
+		f.Close()
+	}, nil
+}
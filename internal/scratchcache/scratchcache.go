@@ -0,0 +1,331 @@
+// Package scratchcache caches templates of scratch disks, such as formatted
+// LCOW scratch VHDXs, so that new scratch disks can be copied from a template
+// rather than created from scratch.
+//
+// The cache may be shared by processes. Each entry has a lock file which is
+// held while the entry is validated, populated, copied or evicted, is
+// populated by renaming a completely written temporary file into place, and
+// is validated against a checksum recorded when it was populated. An entry
+// without a recorded checksum is replaced. An entry whose size and
+// modification time are unchanged since its checksum was recorded is not
+// hashed again.
+package scratchcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errLocked is returned by tryLockFile when the lock is held elsewhere.
+var errLocked = errors.New("locked by another process")
+
+// Entry is a single cached file at Path. Its checksum is kept in Path.json
+// and its lock file is Path.lock, which is removed when the entry is evicted.
+type Entry struct {
+	Path string
+}
+
+// metadata is the content of an entry's .json file.
+type metadata struct {
+	Key     *Key `json:",omitempty"` // Set for entries of a Cache
+	Size    int64
+	ModTime time.Time // Of the entry when its checksum was last verified
+	SHA256  string
+}
+
+func (e *Entry) metadataPath() string { return e.Path + ".json" }
+func (e *Entry) lockPath() string     { return e.Path + ".lock" }
+
+// Get copies the entry to dest, which must not exist. If the entry does not
+// exist, or does not match its checksum, it is first populated by calling
+// create with the path of a new file to create. Concurrent calls for the same
+// entry, in this or other processes, are serialized.
+func (e *Entry) Get(dest string, create func(path string) error) error {
+	return e.get(nil, dest, create)
+}
+
+func (e *Entry) get(key *Key, dest string, create func(path string) error) error {
+	unlock, err := lockFile(e.lockPath())
+	if err != nil {
+		return fmt.Errorf("failed to lock cache entry %s: %s", e.Path, err)
+	}
+	defer unlock()
+
+	err = e.check(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("hcsshim::scratchcache discarding cache entry %s: %s", e.Path, err)
+		}
+		if err := e.populate(key, create); err != nil {
+			return err
+		}
+	} else {
+		logrus.Debugf("hcsshim::scratchcache %s fulfilled from cache entry %s", dest, e.Path)
+	}
+	if err := copyFile(e.Path, dest); err != nil {
+		return fmt.Errorf("failed to copy cache entry %s to %s: %s", e.Path, dest, err)
+	}
+	// Record the use of the entry for eviction.
+	now := time.Now()
+	os.Chtimes(e.metadataPath(), now, now)
+	return nil
+}
+
+// check returns whether the entry exists and matches its checksum. An error
+// satisfying os.IsNotExist means the entry does not exist. An entry without a
+// checksum, such as one written before checksums were recorded, is invalid as
+// it may be truncated.
+//
+// The entry is only hashed if its size or modification time has changed
+// since its checksum was recorded. The checksum guards against entries left
+// incomplete or corrupted by a failed write, which change the file's size or
+// modification time. Keeping both requires deliberately resetting the
+// modification time, which a writer of the cache directory could equally do
+// to the recorded checksum.
+func (e *Entry) check(key *Key) error {
+	fi, err := os.Stat(e.Path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(e.metadataPath())
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no checksum recorded")
+	}
+	if err != nil {
+		return err
+	}
+	var m metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("invalid checksum file: %s", err)
+	}
+	if fi.Size() != m.Size {
+		return fmt.Errorf("size mismatch")
+	}
+	if fi.ModTime().Equal(m.ModTime) {
+		return nil
+	}
+	size, sum, err := checksumFile(e.Path)
+	if err != nil {
+		return err
+	}
+	if size != m.Size || sum != m.SHA256 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	// Record the modification time so that the entry is not hashed again.
+	m.ModTime = fi.ModTime()
+	if b, err := json.Marshal(&m); err == nil {
+		writeFileAtomic(e.metadataPath(), b)
+	}
+	return nil
+}
+
+// writeMetadata records the checksum of path, which is the entry's file or a
+// file to be renamed to it.
+func (e *Entry) writeMetadata(key *Key, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size, sum, err := checksumFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %s", path, err)
+	}
+	b, err := json.Marshal(&metadata{Key: key, Size: size, ModTime: fi.ModTime(), SHA256: sum})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.metadataPath(), b); err != nil {
+		return fmt.Errorf("failed to write checksum of cache entry %s: %s", e.Path, err)
+	}
+	return nil
+}
+
+// populate creates the entry, replacing any existing one. The entry's lock
+// must be held.
+func (e *Entry) populate(key *Key, create func(path string) error) error {
+	// A temporary file left by a process which failed while holding the
+	// lock can be replaced.
+	tmp := e.Path + ".tmp"
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The checksum is written first. Should the rename of the entry fail,
+	// the old entry will not match it and will be replaced when next used.
+	if err := e.writeMetadata(key, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, e.Path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to populate cache entry %s: %s", e.Path, err)
+	}
+	logrus.Debugf("hcsshim::scratchcache populated cache entry %s", e.Path)
+	return nil
+}
+
+// remove removes the entry. The entry's lock must be held.
+func (e *Entry) remove() error {
+	if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(e.metadataPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Key identifies the entry of a Cache for scratch disks of a size whose file
+// systems are created with the same options.
+type Key struct {
+	SizeGB uint32
+	// Filesystem describes how the file system is created, such as the
+	// arguments to mkfs. Templates created differently are cached separately.
+	Filesystem string
+}
+
+func (k *Key) name() string {
+	sum := sha256.Sum256([]byte(k.Filesystem))
+	return fmt.Sprintf("scratch-%dgb-%s.vhdx", k.SizeGB, hex.EncodeToString(sum[:6]))
+}
+
+// Cache is a directory of entries keyed by Key.
+type Cache struct {
+	Dir string
+	// MaxEntries is the most entries kept in the cache, evicting the least
+	// recently used after an entry is populated. 0 means no limit.
+	MaxEntries int
+}
+
+// New returns a cache in dir, creating the directory if necessary.
+func New(dir string, maxEntries int) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create scratch cache %s: %s", dir, err)
+	}
+	return &Cache{Dir: dir, MaxEntries: maxEntries}, nil
+}
+
+// Entry returns the entry for key.
+func (c *Cache) Entry(key Key) *Entry {
+	return &Entry{Path: filepath.Join(c.Dir, key.name())}
+}
+
+// Get copies the template for key to dest, which must not exist, populating
+// the cache with create as Entry.Get. Entries are then evicted as required by
+// MaxEntries.
+func (c *Cache) Get(key Key, dest string, create func(path string) error) error {
+	if err := c.Entry(key).get(&key, dest, create); err != nil {
+		return err
+	}
+	return c.Evict()
+}
+
+// Evict removes the least recently used entries while there are more than
+// MaxEntries. Entries in use by other callers are skipped.
+func (c *Cache) Evict() error {
+	if c.MaxEntries <= 0 {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read scratch cache %s: %s", c.Dir, err)
+	}
+	var entries []os.FileInfo
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".vhdx.json") {
+			entries = append(entries, fi)
+		}
+	}
+	if len(entries) <= c.MaxEntries {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	excess := len(entries) - c.MaxEntries
+	for _, fi := range entries {
+		if excess == 0 {
+			break
+		}
+		e := &Entry{Path: filepath.Join(c.Dir, strings.TrimSuffix(fi.Name(), ".json"))}
+		unlock, err := tryLockFile(e.lockPath())
+		if err == errLocked {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock cache entry %s: %s", e.Path, err)
+		}
+		if err := e.remove(); err != nil {
+			unlock()
+			return fmt.Errorf("failed to evict cache entry %s: %s", e.Path, err)
+		}
+		removeLockFile(e.lockPath(), unlock)
+		logrus.Debugf("hcsshim::scratchcache evicted cache entry %s", e.Path)
+		excess--
+	}
+	return nil
+}
+
+func checksumFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile copies src to dest, which must not exist, removing dest on failure.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data, so that path always holds either
+// its old or its new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package scratchcache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scratchcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// creator returns a create function writing content, and a count of calls.
+func creator(content string) (func(string) error, *int32) {
+	var calls int32
+	return func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		return ioutil.WriteFile(path, []byte(content), 0644)
+	}, &calls
+}
+
+func checkFile(t *testing.T, path, content string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != content {
+		t.Fatalf("%s has %q, expected %q", path, b, content)
+	}
+}
+
+func TestConcurrentGet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key{SizeGB: 20, Filesystem: "-O ^has_journal"}
+	create, calls := creator("template")
+	slowCreate := func(path string) error {
+		time.Sleep(50 * time.Millisecond)
+		return create(path)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Get(key, filepath.Join(dir, fmt.Sprintf("dest%d", i)), slowCreate)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, filepath.Join(dir, fmt.Sprintf("dest%d", i)), "template")
+	}
+	if *calls != 1 {
+		t.Errorf("created the template %d times", *calls)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := &Cache{Dir: dir}
+	keys := []Key{{SizeGB: 20}, {SizeGB: 30}, {SizeGB: 20, Filesystem: "other"}}
+	for i, key := range keys {
+		create, _ := creator(fmt.Sprint(i))
+		if err := c.Get(key, filepath.Join(dir, fmt.Sprintf("dest%d", i)), create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range keys {
+		checkFile(t, filepath.Join(dir, fmt.Sprintf("dest%d", i)), fmt.Sprint(i))
+		checkFile(t, c.Entry(key).Path, fmt.Sprint(i))
+	}
+}
+
+func TestInvalidEntry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := &Entry{Path: filepath.Join(dir, "cache.vhdx")}
+	create, calls := creator("template")
+	if err := e.Get(filepath.Join(dir, "dest1"), create); err != nil {
+		t.Fatal(err)
+	}
+
+	// A destination which exists fails without discarding the entry.
+	if err := e.Get(filepath.Join(dir, "dest1"), create); err == nil {
+		t.Fatal("copying over an existing file succeeded")
+	}
+	if *calls != 1 {
+		t.Fatalf("created the template %d times", *calls)
+	}
+
+	// A corrupted entry is replaced.
+	if err := ioutil.WriteFile(e.Path, []byte("corrupt!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Get(filepath.Join(dir, "dest2"), create); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "dest2"), "template")
+	if *calls != 2 {
+		t.Fatalf("created the template %d times", *calls)
+	}
+
+	// As is an entry of a different size, whatever its modification time.
+	fi, err := os.Stat(e.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(e.Path, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(e.Path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Get(filepath.Join(dir, "dest3"), create); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "dest3"), "template")
+	if *calls != 3 {
+		t.Fatalf("created the template %d times", *calls)
+	}
+}
+
+func TestEntryWithoutChecksum(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := &Entry{Path: filepath.Join(dir, "cache.vhdx")}
+
+	// An entry without a checksum, such as one written before checksums
+	// were recorded, may be truncated, so it is replaced.
+	if err := ioutil.WriteFile(e.Path, []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	create, calls := creator("template")
+	if err := e.Get(filepath.Join(dir, "dest"), create); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "dest"), "template")
+	checkFile(t, e.Path, "template")
+	if *calls != 1 {
+		t.Fatalf("created the template %d times", *calls)
+	}
+	if _, err := os.Stat(e.metadataPath()); err != nil {
+		t.Fatalf("the checksum was not recorded: %s", err)
+	}
+}
+
+func TestUnchangedEntryNotHashed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := &Entry{Path: filepath.Join(dir, "cache.vhdx")}
+	create, calls := creator("template")
+	if err := e.Get(filepath.Join(dir, "dest1"), create); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change which keeps the size and modification time is not noticed,
+	// showing the entry is not hashed again.
+	fi, err := os.Stat(e.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(e.Path, []byte("TEMPLATE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(e.Path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Get(filepath.Join(dir, "dest2"), create); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "dest2"), "TEMPLATE")
+	if *calls != 1 {
+		t.Fatalf("created the template %d times", *calls)
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := &Entry{Path: filepath.Join(dir, "cache.vhdx")}
+	failure := errors.New("failed")
+	err := e.Get(filepath.Join(dir, "dest"), func(path string) error {
+		ioutil.WriteFile(path, []byte("partial"), 0644)
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, path := range []string{e.Path, e.Path + ".tmp", e.metadataPath(), filepath.Join(dir, "dest")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists after a failed create", path)
+		}
+	}
+}
+
+func TestEvict(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c := &Cache{Dir: dir, MaxEntries: 2}
+	keys := []Key{{SizeGB: 20}, {SizeGB: 30}, {SizeGB: 40}, {SizeGB: 50}}
+	get := func(i int) {
+		create, _ := creator(fmt.Sprint(i))
+		if err := c.Get(keys[i], filepath.Join(dir, fmt.Sprintf("dest%d-%d", i, time.Now().UnixNano())), create); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the use times differ.
+		time.Sleep(20 * time.Millisecond)
+	}
+	exists := func(i int) bool {
+		_, err := os.Stat(c.Entry(keys[i]).Path)
+		return err == nil
+	}
+
+	get(0)
+	get(1)
+	get(0) // 1 is now the least recently used
+	get(2)
+	if !exists(0) || exists(1) || !exists(2) {
+		t.Fatalf("unexpected entries after evicting: %v %v %v", exists(0), exists(1), exists(2))
+	}
+
+	// An entry in use is not evicted.
+	unlock, err := lockFile(c.Entry(keys[0]).lockPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(3)
+	unlock()
+	if !exists(0) || exists(2) || !exists(3) {
+		t.Fatalf("unexpected entries after evicting: %v %v %v", exists(0), exists(2), exists(3))
+	}
+
+	// The lock files of evicted entries are removed.
+	for i, key := range keys {
+		_, err := os.Stat(c.Entry(key).lockPath())
+		if evicted := i == 1 || i == 2; evicted != os.IsNotExist(err) {
+			t.Errorf("lock file of entry %d: %v", i, err)
+		}
+	}
+}
+
+func TestRemoveLockFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.vhdx.lock")
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiter for a lock file which is removed takes the lock of the file
+	// which replaces it, which excludes other holders.
+	locked := make(chan func())
+	go func() {
+		unlock, err := lockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	time.Sleep(50 * time.Millisecond)
+	removeLockFile(path, unlock)
+	unlock = <-locked
+	if unlock == nil {
+		t.FailNow()
+	}
+	defer unlock()
+	if _, err := tryLockFile(path); err != errLocked {
+		t.Fatalf("took a held lock: %v", err)
+	}
+}
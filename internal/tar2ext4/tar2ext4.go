@@ -0,0 +1,176 @@
+// Package tar2ext4 converts a tar stream, such as a layer of a Linux container
+// image, to an ext4 file system image, optionally with a VHD footer so that it
+// can be attached to a utility VM.
+package tar2ext4
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/compactext4"
+	"github.com/Microsoft/hcsshim/internal/vhd"
+)
+
+type params struct {
+	convertWhiteout bool
+	appendVhdFooter bool
+	ext4opts        []compactext4.Option
+}
+
+// Option is the type for optional parameters to Convert.
+type Option func(*params)
+
+// ConvertWhiteout instructs the converter to convert OCI-style whiteouts
+// (beginning with .wh.) to overlay-style whiteouts.
+func ConvertWhiteout(p *params) {
+	p.convertWhiteout = true
+}
+
+// AppendVhdFooter instructs the converter to add a fixed VHD footer to the
+// file.
+func AppendVhdFooter(p *params) {
+	p.appendVhdFooter = true
+}
+
+// MaximumDiskSize instructs the writer to limit the disk size to the specified
+// value. This also reserves enough metadata space for the specified disk size.
+// If not provided, then 16GB is the default.
+func MaximumDiskSize(size int64) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.MaximumDiskSize(size))
+	}
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// Convert writes a compact ext4 file system image that contains the files in the
+// input tar stream.
+func Convert(r io.Reader, w io.WriteSeeker, options ...Option) error {
+	var p params
+	for _, opt := range options {
+		opt(&p)
+	}
+	t := tar.NewReader(bufio.NewReader(r))
+	fs := compactext4.NewWriter(w, p.ext4opts...)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = fs.MakeParents(hdr.Name); err != nil {
+			return fmt.Errorf("failed to ensure parent directories for %s: %s", hdr.Name, err)
+		}
+
+		if p.convertWhiteout {
+			dir, name := path.Split(hdr.Name)
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				if name == opaqueWhiteout {
+					// Update the directory with the appropriate xattr.
+					f, err := fs.Stat(dir)
+					if err != nil {
+						return fmt.Errorf("failed to find parent directory of opaque whiteout %s: %s", hdr.Name, err)
+					}
+					f.Xattrs["trusted.overlay.opaque"] = []byte("y")
+					if err := fs.Create(dir, f); err != nil {
+						return fmt.Errorf("failed to mark %s opaque: %s", dir, err)
+					}
+				} else if !strings.HasPrefix(name, whiteoutPrefix+whiteoutPrefix) {
+					// Create an overlay-style whiteout.
+					f := &compactext4.File{
+						Mode:     compactext4.S_IFCHR,
+						Devmajor: 0,
+						Devminor: 0,
+					}
+					if err := fs.Create(path.Join(dir, name[len(whiteoutPrefix):]), f); err != nil {
+						return fmt.Errorf("failed to create whiteout for %s: %s", hdr.Name, err)
+					}
+				}
+				continue
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			if err := fs.Link(hdr.Linkname, hdr.Name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f := &compactext4.File{
+			Mode:     uint16(hdr.Mode & 07777),
+			Atime:    hdr.AccessTime,
+			Mtime:    hdr.ModTime,
+			Ctime:    hdr.ChangeTime,
+			Crtime:   hdr.ModTime,
+			Size:     hdr.Size,
+			Uid:      uint32(hdr.Uid),
+			Gid:      uint32(hdr.Gid),
+			Linkname: hdr.Linkname,
+			Devmajor: uint32(hdr.Devmajor),
+			Devminor: uint32(hdr.Devminor),
+			Xattrs:   make(map[string][]byte),
+		}
+		for key, value := range hdr.PAXRecords {
+			const xattrPrefix = "SCHILY.xattr."
+			if strings.HasPrefix(key, xattrPrefix) {
+				f.Xattrs[key[len(xattrPrefix):]] = []byte(value)
+			}
+		}
+
+		var typ uint16
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			typ = compactext4.S_IFREG
+		case tar.TypeSymlink:
+			typ = compactext4.S_IFLNK
+		case tar.TypeChar:
+			typ = compactext4.S_IFCHR
+		case tar.TypeBlock:
+			typ = compactext4.S_IFBLK
+		case tar.TypeDir:
+			typ = compactext4.S_IFDIR
+		case tar.TypeFifo:
+			typ = compactext4.S_IFIFO
+		default:
+			// Other entries, such as the global headers of PAX archives, have
+			// no file system object.
+			continue
+		}
+		if typ != compactext4.S_IFREG {
+			f.Size = 0
+		}
+		f.Mode |= typ
+		if err := fs.Create(hdr.Name, f); err != nil {
+			return err
+		}
+		if typ == compactext4.S_IFREG {
+			if _, err := io.Copy(fs, t); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.Close(); err != nil {
+		return err
+	}
+	if p.appendVhdFooter {
+		size, err := w.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if err := vhd.WriteFixedFooter(w, size); err != nil {
+			return fmt.Errorf("failed to append the VHD footer: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package tar2ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/vhd"
+)
+
+func findTool(t *testing.T, name string) string {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		p = filepath.Join("/sbin", name)
+		if _, err := os.Stat(p); err != nil {
+			t.Skipf("%s is not available", name)
+		}
+	}
+	return p
+}
+
+func debugfs(t *testing.T, image, request string) string {
+	out, err := exec.Command(findTool(t, "debugfs"), "-R", request, image).CombinedOutput()
+	if err != nil {
+		t.Fatalf("debugfs %q failed: %s\n%s", request, err, out)
+	}
+	return string(out)
+}
+
+func testTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Unix(1500000000, 0)
+	for _, e := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644}, data: "127.0.0.1 localhost\n"},
+		{hdr: tar.Header{Name: "etc/hosts.link", Typeflag: tar.TypeLink, Linkname: "etc/hosts"}},
+		{hdr: tar.Header{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap"}}, data: "#!/bin/sh\n"},
+		{hdr: tar.Header{Name: "usr/bin/alias", Typeflag: tar.TypeSymlink, Linkname: "tool"}},
+		{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "var/.wh.deleted", Typeflag: tar.TypeReg}},
+	} {
+		e.hdr.Size = int64(len(e.data))
+		e.hdr.ModTime = mtime
+		if e.hdr.PAXRecords != nil {
+			e.hdr.Format = tar.FormatPAX
+		}
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvert(t *testing.T) {
+	f, err := ioutil.TempFile("", "tar2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := Convert(bytes.NewReader(testTar(t)), f, ConvertWhiteout, AppendVhdFooter); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size%4096 != 512 {
+		t.Fatalf("unexpected size %d for an image with a VHD footer", size)
+	}
+	info, err := vhd.Inspect(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != vhd.DiskTypeFixed || info.VirtualSize != size-512 {
+		t.Errorf("unexpected VHD %+v", info)
+	}
+
+	// Check the file system without the footer.
+	if err := vhd.FixedVhdToRaw(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	image := f.Name()
+	if out, err := exec.Command(findTool(t, "e2fsck"), "-fn", image).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck failed: %s\n%s", err, out)
+	}
+	if out := debugfs(t, image, "cat etc/hosts"); !strings.Contains(out, "127.0.0.1 localhost") {
+		t.Errorf("etc/hosts has the wrong contents:\n%s", out)
+	}
+	for request, expected := range map[string]string{
+		"stat etc/hosts.link":                     "Links: 2",
+		"stat usr/bin/alias":                      `Fast link dest: "tool"`,
+		"stat dev/null":                           "Device major/minor number: 01:03",
+		"stat var/deleted":                        "Device major/minor number: 00:00",
+		"ea_get usr/bin/tool security.capability": "cap",
+		"ea_get opaque trusted.overlay.opaque":    "y",
+		"stat usr/bin/tool":                       "Mode:  0755",
+	} {
+		if out := debugfs(t, image, request); !strings.Contains(out, expected) {
+			t.Errorf("%s does not contain %q:\n%s", request, expected, out)
+		}
+	}
+	if out := debugfs(t, image, "ls opaque"); strings.Contains(out, ".wh.") {
+		t.Errorf("the opaque whiteout was copied:\n%s", out)
+	}
+}
@@ -0,0 +1,117 @@
+package uvm
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultOvercommitRatio is the ratio of the memory and processors committed to
+// containers to the memory and processors of a utility VM allowed by default.
+const DefaultOvercommitRatio = 1.0
+
+// Commitment is the capacity of a utility VM committed to a container. Memory
+// and processors are admitted against the utility VM's budget; SCSI and VPMem
+// are the devices used by the container and are recorded for reporting only,
+// as they are limited when they are allocated.
+type Commitment struct {
+	MemoryMB   uint64 `json:",omitempty"` // Memory limit of the container
+	Processors uint32 `json:",omitempty"` // Processors the container may use
+	SCSI       int    `json:",omitempty"` // SCSI attachments used by the container
+	VPMem      int    `json:",omitempty"` // VPMem devices, or layers packed onto them, used by the container
+}
+
+// add adds o to the commitment.
+func (c *Commitment) add(o Commitment) {
+	c.MemoryMB += o.MemoryMB
+	c.Processors += o.Processors
+	c.SCSI += o.SCSI
+	c.VPMem += o.VPMem
+}
+
+// BudgetInventory describes the capacity of a utility VM and how much of it is
+// committed to containers.
+type BudgetInventory struct {
+	MemoryMB        uint64
+	Processors      uint32
+	OvercommitRatio float64
+	Committed       Commitment
+	Containers      map[string]Commitment `json:",omitempty"`
+}
+
+// validateOvercommitRatio returns the overcommit ratio to use for the options
+// supplied to Create().
+func validateOvercommitRatio(ratio float64) (float64, error) {
+	if ratio == 0 {
+		return DefaultOvercommitRatio, nil
+	}
+	if ratio < 0 {
+		return 0, fmt.Errorf("overcommit ratio must not be negative")
+	}
+	return ratio, nil
+}
+
+// Commit admits a container to the utility VM's budget, recording the memory,
+// processors and devices committed to it. It fails if the memory or processors
+// committed to all containers would exceed the utility VM's by more than its
+// overcommit ratio. A container is committed again to update its commitment,
+// for example once its devices have been allocated.
+func (uvm *UtilityVM) Commit(containerID string, c Commitment) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	logrus.Debugf("uvm::Commit id:%s container:%s %+v", uvm.id, containerID, c)
+	var committed Commitment
+	for id, o := range uvm.commitments {
+		if id != containerID {
+			committed.add(o)
+		}
+	}
+
+	if c.Processors > uint32(uvm.processorCount) {
+		return fmt.Errorf("container %s requires %d processors but utility VM %s has %d", containerID, c.Processors, uvm.id, uvm.processorCount)
+	}
+	if c.MemoryMB > 0 {
+		budget := uint64(float64(uvm.memoryMB) * uvm.overcommitRatio)
+		if committed.MemoryMB+c.MemoryMB > budget {
+			return fmt.Errorf("committing %dMB of memory to container %s would exceed the %dMB budget of utility VM %s (%dMB committed)", c.MemoryMB, containerID, budget, uvm.id, committed.MemoryMB)
+		}
+	}
+	if c.Processors > 0 {
+		budget := uint32(float64(uvm.processorCount) * uvm.overcommitRatio)
+		if committed.Processors+c.Processors > budget {
+			return fmt.Errorf("committing %d processors to container %s would exceed the budget of %d processors of utility VM %s (%d committed)", c.Processors, containerID, budget, uvm.id, committed.Processors)
+		}
+	}
+
+	if uvm.commitments == nil {
+		uvm.commitments = make(map[string]Commitment)
+	}
+	uvm.commitments[containerID] = c
+	return nil
+}
+
+// Uncommit removes a container from the utility VM's budget.
+func (uvm *UtilityVM) Uncommit(containerID string) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	logrus.Debugf("uvm::Uncommit id:%s container:%s", uvm.id, containerID)
+	delete(uvm.commitments, containerID)
+}
+
+// budgetInventory describes the utility VM's budget. The lock must be held.
+func (uvm *UtilityVM) budgetInventory() *BudgetInventory {
+	b := &BudgetInventory{
+		MemoryMB:        uint64(uvm.memoryMB),
+		Processors:      uint32(uvm.processorCount),
+		OvercommitRatio: uvm.overcommitRatio,
+	}
+	for id, c := range uvm.commitments {
+		if b.Containers == nil {
+			b.Containers = make(map[string]Commitment)
+		}
+		b.Containers[id] = c
+		b.Committed.add(c)
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+package uvm
+
+import (
+	"testing"
+)
+
+func TestCommitAdmission(t *testing.T) {
+	uvm := &UtilityVM{id: "vm", memoryMB: 1024, processorCount: 2, overcommitRatio: DefaultOvercommitRatio}
+	if err := uvm.Commit("a", Commitment{MemoryMB: 512, Processors: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uvm.Commit("b", Commitment{MemoryMB: 768}); err == nil {
+		t.Fatal("expected memory overcommit to fail")
+	}
+	if err := uvm.Commit("b", Commitment{Processors: 2}); err == nil {
+		t.Fatal("expected processor overcommit to fail")
+	}
+	if err := uvm.Commit("b", Commitment{Processors: 3}); err == nil {
+		t.Fatal("expected more processors than the VM has to fail")
+	}
+	if err := uvm.Commit("b", Commitment{MemoryMB: 512, Processors: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Committing a container again replaces its commitment.
+	if err := uvm.Commit("a", Commitment{MemoryMB: 512, Processors: 1, SCSI: 1, VPMem: 2}); err != nil {
+		t.Fatal(err)
+	}
+	b := uvm.Inventory().Budget
+	expected := Commitment{MemoryMB: 1024, Processors: 2, SCSI: 1, VPMem: 2}
+	if b.Committed != expected || len(b.Containers) != 2 || b.MemoryMB != 1024 || b.Processors != 2 {
+		t.Fatalf("unexpected budget %+v", b)
+	}
+
+	uvm.Uncommit("a")
+	if err := uvm.Commit("c", Commitment{MemoryMB: 512, Processors: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitOvercommitRatio(t *testing.T) {
+	uvm := &UtilityVM{id: "vm", memoryMB: 1024, processorCount: 2, overcommitRatio: 1.5}
+	if err := uvm.Commit("a", Commitment{MemoryMB: 1024, Processors: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uvm.Commit("b", Commitment{MemoryMB: 512, Processors: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uvm.Commit("c", Commitment{MemoryMB: 1}); err == nil {
+		t.Fatal("expected memory overcommit to fail")
+	}
+	// Containers without limits are always admitted.
+	if err := uvm.Commit("d", Commitment{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateOvercommitRatio(t *testing.T) {
+	if r, err := validateOvercommitRatio(0); err != nil || r != DefaultOvercommitRatio {
+		t.Fatalf("got %v, %v", r, err)
+	}
+	if r, err := validateOvercommitRatio(2); err != nil || r != 2 {
+		t.Fatalf("got %v, %v", r, err)
+	}
+	if _, err := validateOvercommitRatio(-1); err == nil {
+		t.Fatal("expected a negative ratio to fail")
+	}
+}
@@ -0,0 +1,292 @@
+package uvm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultConsoleLogMaxSizeBytes is the size at which a console log file is rotated.
+	DefaultConsoleLogMaxSizeBytes = 10 * 1024 * 1024
+
+	// DefaultConsoleLogMaxBackups is the number of rotated console log files kept.
+	DefaultConsoleLogMaxBackups = 3
+
+	// DefaultConsoleTailLines is the number of recent console lines kept in memory
+	// for inclusion in error messages.
+	DefaultConsoleTailLines = 50
+
+	// maxConsoleLineLength is the length at which console lines are truncated.
+	maxConsoleLineLength = 16 * 1024
+)
+
+// ConsoleLogOptions are the options for capturing the serial console of a
+// utility VM to a log file.
+type ConsoleLogOptions struct {
+	PipePath     string // Named pipe path COM1 is connected to. eg \\.\pipe\vmpipe
+	LogFile      string // Path of the log file to write to. Rotated files are suffixed .1, .2, ...
+	MaxSizeBytes int64  // Size at which LogFile is rotated. Defaults to DefaultConsoleLogMaxSizeBytes.
+	MaxBackups   int    // Number of rotated files to keep. Defaults to DefaultConsoleLogMaxBackups.
+	TailLines    int    // Number of recent lines kept for error messages. Defaults to DefaultConsoleTailLines.
+}
+
+// ConsoleLogger owns a named pipe server for the serial console of a utility
+// VM. Each line of output is timestamped and written to a size-rotated log
+// file, and the most recent lines are kept in memory.
+type ConsoleLogger struct {
+	opts     ConsoleLogOptions
+	listener net.Listener
+
+	m    sync.Mutex
+	file *os.File
+	size int64
+	tail []string
+	next int // Index in tail of the next line to write once tail is full
+
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// NewConsoleLogger starts a named pipe server at opts.PipePath, logging
+// everything written to it to opts.LogFile. Close() must be called to release
+// the pipe and file.
+func NewConsoleLogger(opts ConsoleLogOptions) (*ConsoleLogger, error) {
+	c, err := newConsoleLogger(opts)
+	if err != nil {
+		return nil, err
+	}
+	c.listener, err = winio.ListenPipe(opts.PipePath, nil)
+	if err != nil {
+		c.file.Close()
+		return nil, fmt.Errorf("failed to listen on console pipe %s: %s", opts.PipePath, err)
+	}
+	c.wg.Add(1)
+	go c.serve()
+	return c, nil
+}
+
+// newConsoleLogger creates a console logger without a pipe server.
+func newConsoleLogger(opts ConsoleLogOptions) (*ConsoleLogger, error) {
+	if opts.LogFile == "" {
+		return nil, fmt.Errorf("no console log file supplied")
+	}
+	if opts.MaxSizeBytes <= 0 {
+		opts.MaxSizeBytes = DefaultConsoleLogMaxSizeBytes
+	}
+	if opts.MaxBackups < 0 {
+		opts.MaxBackups = 0
+	} else if opts.MaxBackups == 0 {
+		opts.MaxBackups = DefaultConsoleLogMaxBackups
+	}
+	if opts.TailLines <= 0 {
+		opts.TailLines = DefaultConsoleTailLines
+	}
+	c := &ConsoleLogger{opts: opts}
+	if err := c.openFile(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// serve accepts connections on the console pipe one at a time. The VM
+// reconnects if it is reset, so keep accepting until closed.
+func (c *ConsoleLogger) serve() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			c.m.Lock()
+			closed := c.closed
+			c.m.Unlock()
+			if !closed {
+				logrus.Warnf("uvm::ConsoleLogger accept on %s failed: %s", c.opts.PipePath, err)
+			}
+			return
+		}
+		if err := c.copy(conn); err != nil {
+			logrus.Debugf("uvm::ConsoleLogger read from %s failed: %s", c.opts.PipePath, err)
+		}
+		conn.Close()
+	}
+}
+
+// copy reads lines from r until EOF, logging each one. Lines longer than
+// maxConsoleLineLength, such as those of a kernel stack dump, are truncated
+// rather than ending the capture.
+func (c *ConsoleLogger) copy(r io.Reader) error {
+	br := bufio.NewReader(r)
+	var line []byte
+	for {
+		b, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if len(line) > 0 {
+				c.writeLine(strings.TrimRight(string(line), "\r"))
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if n := maxConsoleLineLength - len(line); n > 0 {
+			if len(b) > n {
+				b = b[:n]
+			}
+			line = append(line, b...)
+		}
+		if !isPrefix {
+			c.writeLine(strings.TrimRight(string(line), "\r"))
+			line = line[:0]
+		}
+	}
+}
+
+func (c *ConsoleLogger) writeLine(line string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if len(c.tail) < c.opts.TailLines {
+		c.tail = append(c.tail, line)
+	} else {
+		c.tail[c.next] = line
+		c.next = (c.next + 1) % c.opts.TailLines
+	}
+
+	if c.file == nil {
+		return
+	}
+	entry := time.Now().UTC().Format(time.RFC3339Nano) + " " + line + "\n"
+	if c.size > 0 && c.size+int64(len(entry)) > c.opts.MaxSizeBytes {
+		if err := c.rotate(); err != nil {
+			logrus.Warnf("uvm::ConsoleLogger failed to rotate %s: %s", c.opts.LogFile, err)
+			return
+		}
+	}
+	n, err := c.file.WriteString(entry)
+	c.size += int64(n)
+	if err != nil {
+		logrus.Warnf("uvm::ConsoleLogger failed to write to %s: %s", c.opts.LogFile, err)
+	}
+}
+
+// openFile opens the log file for appending. The lock must be held or the
+// logger not yet in use.
+func (c *ConsoleLogger) openFile() error {
+	f, err := os.OpenFile(c.opts.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open console log file %s: %s", c.opts.LogFile, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file = f
+	c.size = fi.Size()
+	return nil
+}
+
+// rotate shifts LogFile to LogFile.1, LogFile.1 to LogFile.2 and so on,
+// discarding the oldest. The lock must be held.
+func (c *ConsoleLogger) rotate() error {
+	c.file.Close()
+	c.file = nil
+	for i := c.opts.MaxBackups; i > 0; i-- {
+		src := c.opts.LogFile
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", c.opts.LogFile, i-1)
+		}
+		dst := fmt.Sprintf("%s.%d", c.opts.LogFile, i)
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if c.opts.MaxBackups == 0 {
+		if err := os.Remove(c.opts.LogFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return c.openFile()
+}
+
+// Tail returns the most recent lines of console output, oldest first.
+func (c *ConsoleLogger) Tail() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	tail := make([]string, 0, len(c.tail))
+	tail = append(tail, c.tail[c.next:]...)
+	tail = append(tail, c.tail[:c.next]...)
+	return tail
+}
+
+// Close stops the pipe server and closes the log file.
+func (c *ConsoleLogger) Close() error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.m.Unlock()
+
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+		c.wg.Wait()
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.file != nil {
+		if ferr := c.file.Close(); err == nil {
+			err = ferr
+		}
+		c.file = nil
+	}
+	return err
+}
+
+// ConsoleError is an error annotated with the most recent serial console
+// output of the utility VM.
+type ConsoleError struct {
+	Err  error
+	Tail []string
+}
+
+func (e *ConsoleError) Error() string {
+	if len(e.Tail) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s\nlast %d lines of console output:\n%s", e.Err, len(e.Tail), strings.Join(e.Tail, "\n"))
+}
+
+// ConsoleTail returns the most recent lines of serial console output if the
+// utility VM was created with a console log file, otherwise nil.
+func (uvm *UtilityVM) ConsoleTail() []string {
+	if uvm.console == nil {
+		return nil
+	}
+	return uvm.console.Tail()
+}
+
+// WithConsoleTail annotates err with the most recent serial console output if
+// it is being captured. It is intended for errors where the VM has failed or
+// exited unexpectedly.
+func (uvm *UtilityVM) WithConsoleTail(err error) error {
+	if err == nil {
+		return nil
+	}
+	tail := uvm.ConsoleTail()
+	if len(tail) == 0 {
+		return err
+	}
+	return &ConsoleError{Err: err, Tail: tail}
+}
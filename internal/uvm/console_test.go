@@ -0,0 +1,101 @@
+package uvm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Unit tests for capturing the serial console of a utility VM
+
+func TestConsoleLoggerTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uvmconsole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConsoleLogger(ConsoleLogOptions{LogFile: filepath.Join(dir, "console.log"), TailLines: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.copy(strings.NewReader("one\r\ntwo\nthree\nfour\nfive")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"three", "four", "five"}
+	if tail := c.Tail(); fmt.Sprint(tail) != fmt.Sprint(expected) {
+		t.Fatalf("expected tail %q got %q", expected, tail)
+	}
+
+	msg := (&ConsoleError{Err: fmt.Errorf("exited"), Tail: c.Tail()}).Error()
+	if !strings.HasPrefix(msg, "exited\n") || !strings.HasSuffix(msg, "three\nfour\nfive") {
+		t.Fatalf("unexpected error %q", msg)
+	}
+}
+
+func TestConsoleLoggerRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uvmconsole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "console.log")
+	c, err := newConsoleLogger(ConsoleLogOptions{LogFile: logFile, MaxSizeBytes: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each timestamped line is around 60 bytes, so every line rotates the file.
+	for i := 0; i < 5; i++ {
+		c.writeLine(fmt.Sprintf("line %d %s", i, strings.Repeat("x", 20)))
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, suffix := range []string{"", ".1", ".2"} {
+		b, err := ioutil.ReadFile(logFile + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), fmt.Sprintf(" line %d ", 4-i)) {
+			t.Fatalf("unexpected contents of %s: %q", logFile+suffix, b)
+		}
+		if int64(len(b)) > 100 {
+			t.Fatalf("%s exceeds maximum size: %d", logFile+suffix, len(b))
+		}
+	}
+	if _, err := os.Stat(logFile + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups: %v", err)
+	}
+}
+
+func TestConsoleLoggerLongLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uvmconsole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConsoleLogger(ConsoleLogOptions{LogFile: filepath.Join(dir, "console.log"), TailLines: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	long := strings.Repeat("x", 100*1024)
+	if err := c.copy(strings.NewReader("before\n" + long + "\r\nafter\n")); err != nil {
+		t.Fatal(err)
+	}
+	tail := c.Tail()
+	if len(tail) != 3 || tail[0] != "before" || tail[1] != long[:maxConsoleLineLength] || tail[2] != "after" {
+		t.Fatalf("unexpected tail of %d lines", len(tail))
+	}
+}
@@ -11,9 +11,19 @@ const (
 	// defaultLCOWVhdxBlockSizeMB is the block-size for the scratch VHDx's this package can create.
 	defaultLCOWVhdxBlockSizeMB = 1
 
+	// LCOWScratchPath is where the scratch disk of a Linux utility VM is mounted.
+	LCOWScratchPath = "/tmp/scratch"
+
 	MaxVPMEM     = 128
 	DefaultVPMEM = 64
 
+	// DefaultVPMemDeviceSizeBytes is the size of a VPMem device onto which
+	// several read-only layers are packed.
+	DefaultVPMemDeviceSizeBytes = 4 * 1024 * 1024 * 1024
+
+	// vpmemMappingAlignment is the alignment of layers packed onto a VPMem device.
+	vpmemMappingAlignment = 2 * 1024 * 1024
+
 	// TODO: These aren't actually used yet
 	// When removing devices from a utility VM.
 	removeTypeVirtualHardware = 1
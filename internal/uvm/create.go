@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/guid"
@@ -34,9 +33,20 @@ type UVMOptions struct {
 	ID                      string                  // Identifier for the uvm. Defaults to generated GUID.
 	Owner                   string                  // Specifies the owner. Defaults to executable name.
 	OperatingSystem         string                  // "windows" or "linux".
-	Resources               *specs.WindowsResources // Optional resources for the utility VM. Supports Memory.limit and CPU.Count only currently. // TODO consider extending?
+	Resources               *specs.WindowsResources // Optional resources for the utility VM. Supports Memory.limit, CPU.Count, CPU.Maximum and CPU.Shares.
 	AdditionHCSDocumentJSON string                  // Optional additional JSON to merge into the HCS document prior
 
+	// Processor topology. These take precedence over Resources.CPU if supplied.
+	ProcessorCount                 *int32 // Number of virtual processors. Defaults to 2 (1 on single-core hosts). Cannot exceed the host.
+	ProcessorLimit                 *int32 // Maximum host CPU the VM can use as a percentage multiplied by 1000 (1..100000).
+	ProcessorWeight                *int32 // Relative scheduling weight against other VMs (0..10000).
+	NumaNodeCount                  *int32 // Optional number of virtual NUMA nodes. Cannot exceed the processor count.
+	ExposeVirtualizationExtensions bool   // If true, expose virtualization extensions for nested virtualization.
+
+	// OvercommitRatio is the ratio of the memory and processors committed to containers to the
+	// utility VM's that is allowed. Defaults to DefaultOvercommitRatio. See Commit.
+	OvercommitRatio float64
+
 	// WCOW specific parameters
 	LayerFolders []string // Set of folders for base layers and scratch. Ordered from top most read-only through base read-only layer, followed by scratch
 
@@ -45,11 +55,17 @@ type UVMOptions struct {
 	KernelFile            string               // Filename under BootFilesPath for the kernel. Defaults to `kernel`
 	RootFSFile            string               // Filename under BootFilesPath for the UVMs root file system. Defaults are `initrd.img` or `rootfs.vhd`.
 	PreferredRootFSType   *PreferredRootFSType // Controls searching for the RootFSFile.
-	KernelBootOptions     string               // Additional boot options for the kernel
+	KernelBootOptions     string               // Additional boot options for the kernel. Merged with the defaults. See KernelCommandLine.
 	EnableGraphicsConsole bool                 // If true, enable a graphics console for the utility VM
 	ConsolePipe           string               // The named pipe path to use for the serial console.  eg \\.\pipe\vmpipe
+	ConsoleLogFile        string               // If set, the serial console is captured to this file. A ConsolePipe is generated if not supplied.
+	KernelDirect          bool                 // If true, boot the kernel directly rather than through UEFI. Falls back to UEFI if the host does not support it.
+	Plan9PerPortShares    bool                 // If true, each Plan9 share uses its own vsock port rather than an aname on a single port. For guests without aname support.
+	VPMemMultiMapping     bool                 // If true, pack several read-only layers onto each VPMem device rather than one layer per device.
+	VPMemDeviceSizeBytes  uint64               // Size of each VPMem device when VPMemMultiMapping is set. Defaults to DefaultVPMemDeviceSizeBytes.
 	VPMemDeviceCount      *int32               // Number of VPMem devices. Limit at 128. If booting UVM from VHD, device 0 is taken.
 	SCSIControllerCount   *int                 // The number of SCSI controllers. Defaults to 1 if omitted. Currently we only support 0 or 1.
+	ScratchFile           string               // Optional ext4 formatted scratch disk of a Linux utility VM, attached to SCSI 0:0 from boot and mounted at LCOWScratchPath as it starts. See AttachScratch.
 }
 
 // Create creates an HCS compute system representing a utility VM.
@@ -136,7 +152,16 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 		scsi["0"] = schema2.VirtualMachinesResourcesStorageScsiV2{Attachments: attachments}
 		uvm.scsiLocations[0][0].hostPath = attachments["0"].Path
 	} else {
+		uvm.plan9PerPort = opts.Plan9PerPortShares
 		uvm.vpmemMax = DefaultVPMEM
+		uvm.vpmemMultiMapping = opts.VPMemMultiMapping
+		uvm.vpmemDeviceSizeBytes = DefaultVPMemDeviceSizeBytes
+		if opts.VPMemDeviceSizeBytes != 0 {
+			if opts.VPMemDeviceSizeBytes%vpmemMappingAlignment != 0 {
+				return nil, fmt.Errorf("VPMem device size must be a multiple of %d bytes", vpmemMappingAlignment)
+			}
+			uvm.vpmemDeviceSizeBytes = opts.VPMemDeviceSizeBytes
+		}
 		if opts.VPMemDeviceCount != nil {
 			if *opts.VPMemDeviceCount > MaxVPMEM || *opts.VPMemDeviceCount < 0 {
 				return nil, fmt.Errorf("vpmem device count must between 0 and %d", MaxVPMEM)
@@ -158,9 +183,26 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 		if opts.BootFilesPath == "" {
 			opts.BootFilesPath = filepath.Join(os.Getenv("ProgramFiles"), "Linux Containers")
 		}
-		if opts.KernelFile == "" {
-			opts.KernelFile = "kernel"
+		if opts.ScratchFile != "" {
+			if uvm.scsiControllerCount == 0 {
+				return nil, fmt.Errorf("a scratch disk requires a SCSI controller")
+			}
+			if _, err := os.Stat(opts.ScratchFile); err != nil {
+				return nil, fmt.Errorf("scratch disk %s not found: %s", opts.ScratchFile, err)
+			}
+			if err := wclayer.GrantVmAccess(uvm.id, opts.ScratchFile); err != nil {
+				return nil, fmt.Errorf("failed to grant access to scratch disk %s: %s", opts.ScratchFile, err)
+			}
+			// The scratch is attached to SCSI 0:0 from boot, as for WCOW, and
+			// mounted when the VM is started.
+			attachments["0"] = schema2.VirtualMachinesResourcesStorageAttachmentV2{
+				Path: opts.ScratchFile,
+				Type: "VirtualDisk",
+			}
+			uvm.scsiLocations[0][0] = scsiInfo{hostPath: opts.ScratchFile, uvmPath: LCOWScratchPath}
+			uvm.scratchFile = opts.ScratchFile
 		}
+		opts.KernelFile, uvm.kernelDirect = chooseKernel(opts.BootFilesPath, opts.KernelFile, opts.KernelDirect, kernelDirectSupported())
 		if _, err := os.Stat(filepath.Join(opts.BootFilesPath, opts.KernelFile)); os.IsNotExist(err) {
 			return nil, fmt.Errorf("kernel '%s' not found", filepath.Join(opts.BootFilesPath, opts.KernelFile))
 		}
@@ -202,17 +244,19 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 	}
 
 	memory := int32(1024)
-	processors := int32(2)
-	if runtime.NumCPU() == 1 {
-		processors = 1
+	if opts.Resources != nil && opts.Resources.Memory != nil && opts.Resources.Memory.Limit != nil {
+		memory = int32(*opts.Resources.Memory.Limit / 1024 / 1024) // OCI spec is in bytes. HCS takes MB
 	}
-	if opts.Resources != nil {
-		if opts.Resources.Memory != nil && opts.Resources.Memory.Limit != nil {
-			memory = int32(*opts.Resources.Memory.Limit / 1024 / 1024) // OCI spec is in bytes. HCS takes MB
-		}
-		if opts.Resources.CPU != nil && opts.Resources.CPU.Count != nil {
-			processors = int32(*opts.Resources.CPU.Count)
-		}
+	processor, numa, err := processorSettings(opts)
+	if err != nil {
+		return nil, err
+	}
+	uvm.processorCount = processor.Count
+	uvm.processorLimit = processor.Limit
+	uvm.processorWeight = processor.Weight
+	uvm.memoryMB = memory
+	if uvm.overcommitRatio, err = validateOvercommitRatio(opts.OvercommitRatio); err != nil {
+		return nil, err
 	}
 
 	hcsDocument := &schema2.ComputeSystemV2{
@@ -228,9 +272,8 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 					Backing: "Virtual",
 					Startup: memory,
 				},
-				Processor: &schema2.VirtualMachinesResourcesComputeProcessorV2{
-					Count: processors,
-				},
+				Processor: processor,
+				Numa:      numa,
 			},
 
 			Devices: &schema2.VirtualMachinesDevicesV2{
@@ -253,17 +296,15 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 		if uvm.vpmemMax > 0 {
 			hcsDocument.VirtualMachine.Devices.VPMem = &schema2.VirtualMachinesResourcesStorageVpmemControllerV2{MaximumCount: uvm.vpmemMax}
 		}
-		hcsDocument.VirtualMachine.Chipset.UEFI.BootThis = &schema2.VirtualMachinesResourcesUefiBootEntryV2{
-			DevicePath:   `\` + opts.KernelFile,
-			OptionalData: `initrd=\` + opts.RootFSFile,
-		}
+		kernelArgs := &KernelCommandLine{}
 
 		// Support for VPMem VHD(X) booting rather than initrd..
 		if actualRootFSType == PreferredRootFSTypeVHD {
 			if uvm.vpmemMax == 0 {
 				return nil, fmt.Errorf("PreferredRootFSTypeVHD requess at least one VPMem device")
 			}
-			hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.OptionalData = `root=/dev/pmem0 init=/init`
+			kernelArgs.Set("root", "/dev/pmem0")
+			kernelArgs.Set("init", "/init")
 			hcsDocument.VirtualMachine.Devices.VPMem.Devices = make(map[string]schema2.VirtualMachinesResourcesStorageVpmemDeviceV2)
 			imageFormat := "VHD1"
 			if strings.ToLower(filepath.Ext(opts.RootFSFile)) == "vhdx" {
@@ -283,26 +324,67 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 				uvmPath:  "/",
 				refCount: 1,
 			}
+		} else if !uvm.kernelDirect {
+			kernelArgs.Set("initrd", `\`+opts.RootFSFile)
+		}
+
+		if opts.ConsoleLogFile != "" {
+			if opts.ConsolePipe == "" {
+				opts.ConsolePipe = `\\.\pipe\ProtectedPrefix\Administrators\uvm-console-` + uvm.id
+			}
+			uvm.console, err = NewConsoleLogger(ConsoleLogOptions{
+				PipePath: opts.ConsolePipe,
+				LogFile:  opts.ConsoleLogFile,
+			})
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				if uvm.hcsSystem == nil {
+					uvm.console.Close()
+					uvm.console = nil
+				}
+			}()
 		}
 
 		if opts.ConsolePipe != "" {
-			hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.OptionalData += " console=ttyS0,115200"
+			kernelArgs.Add("console", "ttyS0,115200")
 			hcsDocument.VirtualMachine.Devices.COMPorts = &schema2.VirtualMachinesResourcesComPortsV2{Port1: opts.ConsolePipe}
 		}
 
 		if opts.EnableGraphicsConsole {
-			hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.OptionalData += " console=tty"
+			kernelArgs.Add("console", "tty")
 			hcsDocument.VirtualMachine.Devices.Keyboard = &schema2.VirtualMachinesResourcesKeyboardV2{}
 			hcsDocument.VirtualMachine.Devices.Rdp = &schema2.VirtualMachinesResourcesRdpV2{}
 			hcsDocument.VirtualMachine.Devices.VideoMonitor = &schema2.VirtualMachinesResourcesVideoMonitorV2{}
 		}
 
 		if opts.KernelBootOptions != "" {
-			hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.OptionalData = hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.OptionalData + fmt.Sprintf(" %s", opts.KernelBootOptions)
+			userArgs, err := ParseKernelCommandLine(opts.KernelBootOptions)
+			if err != nil {
+				return nil, err
+			}
+			if err := kernelArgs.Merge(userArgs); err != nil {
+				return nil, err
+			}
+		}
+		uvm.kernelCommandLine = kernelArgs.String()
+
+		if uvm.kernelDirect {
+			hcsDocument.SchemaVersion = schemaversion.SchemaV21()
+			hcsDocument.VirtualMachine.Chipset.UEFI = nil
+			hcsDocument.VirtualMachine.Chipset.LinuxKernelDirect = kernelDirectSettings(opts, actualRootFSType, uvm.kernelCommandLine)
+		} else {
+			hcsDocument.VirtualMachine.Chipset.UEFI.BootThis = &schema2.VirtualMachinesResourcesUefiBootEntryV2{
+				DevicePath:   `\` + opts.KernelFile,
+				OptionalData: uvm.kernelCommandLine,
+			}
 		}
 	}
-	hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.DiskNumber = 0
-	hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.UefiDevice = "VMBFS"
+	if hcsDocument.VirtualMachine.Chipset.UEFI != nil {
+		hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.DiskNumber = 0
+		hcsDocument.VirtualMachine.Chipset.UEFI.BootThis.UefiDevice = "VMBFS"
+	}
 
 	fullDoc, err := mergemaps.MergeJSON(hcsDocument, ([]byte)(opts.AdditionHCSDocumentJSON))
 	if err != nil {
@@ -312,7 +394,7 @@ func Create(opts *UVMOptions) (*UtilityVM, error) {
 	hcsSystem, err := hcs.CreateComputeSystem(uvm.id, fullDoc)
 	if err != nil {
 		logrus.Debugln("failed to create UVM: ", err)
-		return nil, err
+		return nil, uvm.WithConsoleTail(err)
 	}
 
 	uvm.hcsSystem = hcsSystem
@@ -331,6 +413,15 @@ func (uvm *UtilityVM) OS() string {
 
 // Close terminates and releases resources associated with the utility VM.
 func (uvm *UtilityVM) Close() error {
+	uvm.m.Lock()
+	health := uvm.health
+	uvm.m.Unlock()
+	if health != nil {
+		health.Stop()
+	}
 	uvm.Terminate()
+	if uvm.console != nil {
+		uvm.console.Close()
+	}
 	return uvm.hcsSystem.Close()
 }
@@ -0,0 +1,236 @@
+package uvm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/schemaversion"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthState is the health of a utility VM as determined by a HealthMonitor.
+type HealthState string
+
+const (
+	HealthUnknown   HealthState = "unknown"   // No probe has completed yet, or no monitor is running
+	HealthHealthy   HealthState = "healthy"   // The last probe succeeded
+	HealthDegraded  HealthState = "degraded"  // Probes are failing, but fewer than the failure threshold
+	HealthUnhealthy HealthState = "unhealthy" // Consecutive probe failures reached the failure threshold
+)
+
+const (
+	// DefaultHealthInterval is the default time between health probes.
+	DefaultHealthInterval = 30 * time.Second
+
+	// DefaultHealthTimeout is the default time a health probe may take before it is treated as failed.
+	DefaultHealthTimeout = 10 * time.Second
+
+	// DefaultHealthFailureThreshold is the default number of consecutive failed
+	// probes after which a utility VM is unhealthy.
+	DefaultHealthFailureThreshold = 3
+)
+
+// HealthOptions are the options passed to StartHealthMonitor().
+type HealthOptions struct {
+	Interval         time.Duration // Time between probes. Defaults to DefaultHealthInterval.
+	Timeout          time.Duration // Time allowed for a probe. Defaults to DefaultHealthTimeout.
+	FailureThreshold int           // Consecutive failures before the VM is unhealthy. Defaults to DefaultHealthFailureThreshold.
+
+	// OnUnhealthy is called once, on the monitor's goroutine, when the utility
+	// VM becomes unhealthy. err describes the last failure. Probing stops
+	// afterwards; the callback typically terminates the VM.
+	OnUnhealthy func(err error)
+}
+
+// HealthMonitor periodically probes the guest of a utility VM to detect a
+// hung VM, for example where the GCS has stopped responding.
+type HealthMonitor struct {
+	opts  HealthOptions
+	probe func() error
+
+	m        sync.Mutex
+	state    HealthState
+	failures int
+	lastErr  error
+	pending  chan error // Result of a probe which has not yet completed
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// StartHealthMonitor starts probing the guest of the utility VM. Each probe
+// runs a trivial process in the utility VM. Stop() must be called on the
+// returned monitor before the utility VM is closed.
+func (uvm *UtilityVM) StartHealthMonitor(opts HealthOptions) *HealthMonitor {
+	logrus.Debugf("uvm::StartHealthMonitor id:%s %+v", uvm.id, opts)
+	h := newHealthMonitor(uvm.healthProbe, opts)
+	uvm.m.Lock()
+	uvm.health = h
+	uvm.m.Unlock()
+	go h.run()
+	return h
+}
+
+// HealthState returns the health of the utility VM, or HealthUnknown if no
+// monitor has been started.
+func (uvm *UtilityVM) HealthState() HealthState {
+	uvm.m.Lock()
+	h := uvm.health
+	uvm.m.Unlock()
+	if h == nil {
+		return HealthUnknown
+	}
+	return h.State()
+}
+
+// healthProbe runs a process which exits immediately in the utility VM, which
+// requires a round trip through the guest.
+func (uvm *UtilityVM) healthProbe() error {
+	processConfig := &schema2.ProcessConfig{
+		SchemaVersion:     schemaversion.SchemaV20(),
+		CreateInUtilityVm: true,
+	}
+	if uvm.operatingSystem == "windows" {
+		processConfig.CommandLine = "cmd /c exit 0"
+	} else {
+		processConfig.CommandLine = "true"
+		processConfig.WorkingDirectory = "/"
+		processConfig.Environment = map[string]string{"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	}
+	proc, err := uvm.hcsSystem.CreateProcess(processConfig)
+	if err != nil {
+		return fmt.Errorf("health probe failed to create process: %s", err)
+	}
+	defer proc.Close()
+	if err := proc.Wait(); err != nil {
+		return fmt.Errorf("health probe failed waiting for process: %s", err)
+	}
+	return nil
+}
+
+func newHealthMonitor(probe func() error, opts HealthOptions) *HealthMonitor {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultHealthInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHealthTimeout
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = DefaultHealthFailureThreshold
+	}
+	return &HealthMonitor{
+		opts:    opts,
+		probe:   probe,
+		state:   HealthUnknown,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (h *HealthMonitor) run() {
+	defer close(h.stopped)
+	t := time.NewTicker(h.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-t.C:
+		}
+		if !h.check() {
+			return
+		}
+	}
+}
+
+// check runs a single probe and records the result. It returns false once
+// the VM is unhealthy and no further probes should be run.
+func (h *HealthMonitor) check() bool {
+	// A probe which previously timed out may still be outstanding. Don't pile
+	// up more against a hung guest; treat it as a further failure until it
+	// completes.
+	if h.pending == nil {
+		h.pending = make(chan error, 1)
+		go func(result chan<- error) {
+			result <- h.probe()
+		}(h.pending)
+	}
+
+	timer := time.NewTimer(h.opts.Timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-h.pending:
+		h.pending = nil
+	case <-timer.C:
+		err = fmt.Errorf("health probe timed out after %s", h.opts.Timeout)
+	case <-h.stop:
+		return false
+	}
+
+	h.m.Lock()
+	if err == nil {
+		h.state = HealthHealthy
+		h.failures = 0
+		h.lastErr = nil
+		h.m.Unlock()
+		return true
+	}
+	h.failures++
+	h.lastErr = err
+	if h.failures < h.opts.FailureThreshold {
+		h.state = HealthDegraded
+		h.m.Unlock()
+		logrus.Warnf("uvm::HealthMonitor probe failed (%d/%d): %s", h.failures, h.opts.FailureThreshold, err)
+		return true
+	}
+	h.state = HealthUnhealthy
+	failures := h.failures
+	h.m.Unlock()
+
+	err = fmt.Errorf("utility VM is unhealthy after %d consecutive failed health probes: %s", failures, err)
+	logrus.Error(err)
+	if h.opts.OnUnhealthy != nil {
+		h.opts.OnUnhealthy(err)
+	}
+	return false
+}
+
+// State returns the current health state.
+func (h *HealthMonitor) State() HealthState {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.state
+}
+
+// ConsecutiveFailures returns the number of probes which have failed since
+// the last successful probe.
+func (h *HealthMonitor) ConsecutiveFailures() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.failures
+}
+
+// LastError returns the error from the most recent failed probe, or nil if
+// the last probe succeeded.
+func (h *HealthMonitor) LastError() error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.lastErr
+}
+
+// Stop stops probing and waits for the monitor to exit. It must not be called
+// from OnUnhealthy.
+func (h *HealthMonitor) Stop() {
+	h.m.Lock()
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	h.m.Unlock()
+	<-h.stopped
+}
@@ -0,0 +1,87 @@
+package uvm
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Unit tests for the utility VM health monitor
+
+func TestHealthMonitorThreshold(t *testing.T) {
+	var (
+		m       sync.Mutex
+		results = []error{nil, errors.New("fail"), nil, errors.New("fail"), errors.New("fail"), errors.New("fail")}
+	)
+	probe := func() error {
+		m.Lock()
+		defer m.Unlock()
+		err := results[0]
+		results = results[1:]
+		return err
+	}
+	h := newHealthMonitor(probe, HealthOptions{Timeout: time.Second, FailureThreshold: 3})
+
+	expected := []HealthState{HealthHealthy, HealthDegraded, HealthHealthy, HealthDegraded, HealthDegraded}
+	for i, state := range expected {
+		if !h.check() {
+			t.Fatalf("probe %d: monitor stopped early", i)
+		}
+		if h.State() != state {
+			t.Fatalf("probe %d: expected %s got %s", i, state, h.State())
+		}
+	}
+	if h.ConsecutiveFailures() != 2 || h.LastError() == nil {
+		t.Fatalf("unexpected failures %d %v", h.ConsecutiveFailures(), h.LastError())
+	}
+	if h.check() {
+		t.Fatal("expected monitor to stop once unhealthy")
+	}
+	if h.State() != HealthUnhealthy {
+		t.Fatalf("expected %s got %s", HealthUnhealthy, h.State())
+	}
+}
+
+func TestHealthMonitorTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	probe := func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}
+	var unhealthy error
+	h := newHealthMonitor(probe, HealthOptions{
+		Timeout:          10 * time.Millisecond,
+		FailureThreshold: 2,
+		OnUnhealthy:      func(err error) { unhealthy = err },
+	})
+	if !h.check() || h.State() != HealthDegraded {
+		t.Fatalf("expected %s got %s", HealthDegraded, h.State())
+	}
+	if h.check() || h.State() != HealthUnhealthy {
+		t.Fatalf("expected %s got %s", HealthUnhealthy, h.State())
+	}
+	if unhealthy == nil {
+		t.Fatal("expected OnUnhealthy to be called")
+	}
+	close(release)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected a single outstanding probe, got %d", n)
+	}
+}
+
+func TestHealthMonitorStop(t *testing.T) {
+	h := newHealthMonitor(func() error { return nil }, HealthOptions{Interval: time.Millisecond})
+	go h.run()
+	for i := 0; h.State() != HealthHealthy; i++ {
+		if i == 1000 {
+			t.Fatal("monitor did not probe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.Stop()
+	h.Stop()
+}
@@ -0,0 +1,158 @@
+package uvm
+
+import (
+	"sort"
+)
+
+// Inventory is a point-in-time description of the settings of a utility VM
+// and the devices currently mapped into it. It is intended for debugging and
+// diagnostics and is safe to marshal as JSON.
+type Inventory struct {
+	ID                string
+	OperatingSystem   string
+	Health            HealthState
+	KernelCommandLine string `json:",omitempty"` // LCOW only
+	KernelDirect      bool   `json:",omitempty"` // LCOW only
+	ProcessorCount    int32
+	ProcessorLimit    int32 `json:",omitempty"`
+	ProcessorWeight   int32 `json:",omitempty"`
+	SCSI              []SCSIInventory
+	VPMem             []VPMemInventory `json:",omitempty"`
+	Plan9             []Plan9Inventory `json:",omitempty"`
+	VSMB              []VSMBInventory  `json:",omitempty"`
+	NetworkNamespaces []string         `json:",omitempty"`
+	Budget            *BudgetInventory
+}
+
+// SCSIInventory describes a disk attached to a SCSI controller.
+type SCSIInventory struct {
+	Controller int
+	LUN        int
+	HostPath   string
+	UVMPath    string `json:",omitempty"`
+}
+
+// VPMemInventory describes a VPMem device.
+type VPMemInventory struct {
+	DeviceNumber uint32
+	HostPath     string
+	UVMPath      string `json:",omitempty"`
+	Offset       uint64 `json:",omitempty"` // For layers packed onto a shared device
+	SizeBytes    uint64 `json:",omitempty"` // For layers packed onto a shared device
+	RefCount     uint32
+}
+
+// Plan9Inventory describes a Plan9 share.
+type Plan9Inventory struct {
+	HostPath  string
+	UVMPath   string
+	ShareName string
+	Port      int32
+	ReadOnly  bool
+	RefCount  uint32
+}
+
+// VSMBInventory describes a VSMB share.
+type VSMBInventory struct {
+	HostPath string
+	Name     string
+	Flags    int32
+	File     string `json:",omitempty"` // Set for a single-file share
+	RefCount uint32
+}
+
+// Inventory returns a snapshot of the utility VM's settings and devices.
+func (uvm *UtilityVM) Inventory() *Inventory {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	inv := &Inventory{
+		ID:                uvm.id,
+		OperatingSystem:   uvm.operatingSystem,
+		Health:            HealthUnknown,
+		KernelCommandLine: uvm.kernelCommandLine,
+		KernelDirect:      uvm.kernelDirect,
+		ProcessorCount:    uvm.processorCount,
+		ProcessorLimit:    uvm.processorLimit,
+		ProcessorWeight:   uvm.processorWeight,
+		Budget:            uvm.budgetInventory(),
+	}
+
+	if uvm.health != nil {
+		inv.Health = uvm.health.State()
+	}
+
+	for controller, luns := range uvm.scsiLocations {
+		for lun, si := range luns {
+			if si.hostPath != "" {
+				inv.SCSI = append(inv.SCSI, SCSIInventory{
+					Controller: controller,
+					LUN:        lun,
+					HostPath:   si.hostPath,
+					UVMPath:    si.uvmPath,
+				})
+			}
+		}
+	}
+
+	for deviceNumber, vi := range uvm.vpmemDevices {
+		if vi.hostPath != "" {
+			inv.VPMem = append(inv.VPMem, VPMemInventory{
+				DeviceNumber: uint32(deviceNumber),
+				HostPath:     vi.hostPath,
+				UVMPath:      vi.uvmPath,
+				RefCount:     vi.refCount,
+			})
+		}
+		for _, m := range vi.mappings {
+			inv.VPMem = append(inv.VPMem, VPMemInventory{
+				DeviceNumber: uint32(deviceNumber),
+				HostPath:     m.hostPath,
+				UVMPath:      m.uvmPath,
+				Offset:       m.offset,
+				SizeBytes:    m.sizeBytes,
+				RefCount:     m.refCount,
+			})
+		}
+	}
+
+	for key, share := range uvm.plan9Shares {
+		inv.Plan9 = append(inv.Plan9, Plan9Inventory{
+			HostPath:  key.hostPath,
+			UVMPath:   share.uvmPath,
+			ShareName: share.name,
+			Port:      share.port,
+			ReadOnly:  share.readOnly,
+			RefCount:  share.refCount,
+		})
+	}
+	sort.Slice(inv.Plan9, func(i, j int) bool {
+		if inv.Plan9[i].HostPath != inv.Plan9[j].HostPath {
+			return inv.Plan9[i].HostPath < inv.Plan9[j].HostPath
+		}
+		return inv.Plan9[i].UVMPath < inv.Plan9[j].UVMPath
+	})
+
+	for _, share := range uvm.vsmbShares {
+		inv.VSMB = append(inv.VSMB, VSMBInventory{
+			HostPath: share.hostPath,
+			Name:     share.name,
+			Flags:    share.options.flags(),
+			File:     share.file,
+			RefCount: share.refCount,
+		})
+	}
+	sort.Slice(inv.VSMB, func(i, j int) bool {
+		if inv.VSMB[i].HostPath != inv.VSMB[j].HostPath {
+			return inv.VSMB[i].HostPath < inv.VSMB[j].HostPath
+		}
+		return inv.VSMB[i].Name < inv.VSMB[j].Name
+	})
+
+	for id := range uvm.namespaces {
+		inv.NetworkNamespaces = append(inv.NetworkNamespaces, id)
+	}
+	sort.Strings(inv.NetworkNamespaces)
+
+	return inv
+}
@@ -0,0 +1,205 @@
+package uvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// kernelParam is a single Linux kernel boot parameter. Flags such as `quiet`
+// have no value.
+type kernelParam struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func (p kernelParam) String() string {
+	if !p.hasValue {
+		return p.key
+	}
+	value := p.value
+	if strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	return p.key + "=" + value
+}
+
+// protectedKernelParams are parameters which the utility VM relies on to boot.
+// A user-supplied value for any of these which differs from the value computed
+// by Create() is rejected rather than silently overriding how the VM boots.
+var protectedKernelParams = map[string]bool{
+	"initrd": true,
+	"root":   true,
+	"init":   true,
+}
+
+// multiValueKernelParams are parameters which may legitimately appear more than
+// once on a kernel command line.
+var multiValueKernelParams = map[string]bool{
+	"console": true,
+}
+
+// KernelCommandLine is an ordered set of Linux kernel boot parameters used to
+// boot an LCOW utility VM. Parameters after a `--` separator are passed to
+// init and are kept separately.
+type KernelCommandLine struct {
+	params   []kernelParam
+	initArgs []string
+}
+
+// ParseKernelCommandLine parses a kernel command line such as one supplied in
+// UVMOptions.KernelBootOptions. Values may be double-quoted to contain spaces.
+func ParseKernelCommandLine(s string) (*KernelCommandLine, error) {
+	k := &KernelCommandLine{}
+	fields, err := splitKernelCommandLine(s)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range fields {
+		if f == "--" {
+			k.initArgs = append(k.initArgs, fields[i+1:]...)
+			break
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid kernel parameter %q", f)
+		}
+		if len(parts) == 1 {
+			k.SetFlag(parts[0])
+		} else if multiValueKernelParams[parts[0]] {
+			k.Add(parts[0], parts[1])
+		} else {
+			k.Set(parts[0], parts[1])
+		}
+	}
+	return k, nil
+}
+
+// splitKernelCommandLine splits on whitespace, honouring double quotes the way
+// the kernel does. Quotes are removed from the returned fields.
+func splitKernelCommandLine(s string) ([]string, error) {
+	var (
+		fields  []string
+		current strings.Builder
+		inQuote bool
+		inField bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inField = true
+		case (r == ' ' || r == '\t' || r == '\n') && !inQuote:
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteRune(r)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in kernel command line %q", s)
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	return fields, nil
+}
+
+// Get returns the value of the last occurrence of a parameter, and whether it
+// is present at all.
+func (k *KernelCommandLine) Get(key string) (string, bool) {
+	for i := len(k.params) - 1; i >= 0; i-- {
+		if k.params[i].key == key {
+			return k.params[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets a parameter to a value, replacing any existing occurrences in place.
+func (k *KernelCommandLine) Set(key, value string) {
+	k.set(kernelParam{key: key, value: value, hasValue: true})
+}
+
+// SetFlag sets a parameter which has no value, such as `quiet`.
+func (k *KernelCommandLine) SetFlag(key string) {
+	k.set(kernelParam{key: key})
+}
+
+func (k *KernelCommandLine) set(p kernelParam) {
+	found := false
+	params := k.params[:0]
+	for _, existing := range k.params {
+		if existing.key == p.key {
+			if found {
+				continue
+			}
+			existing = p
+			found = true
+		}
+		params = append(params, existing)
+	}
+	k.params = params
+	if !found {
+		k.params = append(k.params, p)
+	}
+}
+
+// Add appends a parameter which may occur multiple times, such as `console`.
+// An identical key and value which is already present is not duplicated.
+func (k *KernelCommandLine) Add(key, value string) {
+	for _, existing := range k.params {
+		if existing.key == key && existing.hasValue && existing.value == value {
+			return
+		}
+	}
+	k.params = append(k.params, kernelParam{key: key, value: value, hasValue: true})
+}
+
+// Merge merges user-supplied parameters on top of k, which holds the defaults.
+//
+//   - initrd=, root= and init= must match the defaults if the defaults set them.
+//   - Multi-valued parameters such as console= are appended after the defaults.
+//   - Any other parameter overrides the default value in its original position,
+//     or is appended in the order supplied if there is no default.
+//   - Arguments to init (after `--`) are appended after any default init arguments.
+func (k *KernelCommandLine) Merge(user *KernelCommandLine) error {
+	if user == nil {
+		return nil
+	}
+	for _, p := range user.params {
+		if protectedKernelParams[p.key] {
+			if existing, ok := k.Get(p.key); ok {
+				if existing != p.value {
+					return fmt.Errorf("kernel boot option %s conflicts with %s=%s required to boot the utility VM", p, p.key, existing)
+				}
+				continue
+			}
+		}
+		if multiValueKernelParams[p.key] && p.hasValue {
+			k.Add(p.key, p.value)
+			continue
+		}
+		k.set(p)
+	}
+	k.initArgs = append(k.initArgs, user.initArgs...)
+	return nil
+}
+
+// String renders the command line. The output is deterministic for a given
+// sequence of operations.
+func (k *KernelCommandLine) String() string {
+	var fields []string
+	for _, p := range k.params {
+		fields = append(fields, p.String())
+	}
+	if len(k.initArgs) > 0 {
+		fields = append(fields, "--")
+		fields = append(fields, k.initArgs...)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,93 @@
+package uvm
+
+import (
+	"testing"
+)
+
+// Unit tests for building the LCOW kernel command line
+
+func TestKernelCommandLineParse(t *testing.T) {
+	k, err := ParseKernelCommandLine(`  quiet  loglevel=7 foo="a b"  console=ttyS0 console=tty -- init1 init2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `quiet loglevel=7 foo="a b" console=ttyS0 console=tty -- init1 init2`
+	if k.String() != expected {
+		t.Fatalf("expected %q got %q", expected, k.String())
+	}
+	if v, ok := k.Get("foo"); !ok || v != "a b" {
+		t.Fatalf("unexpected value for foo %q %t", v, ok)
+	}
+}
+
+func TestKernelCommandLineParseBad(t *testing.T) {
+	if _, err := ParseKernelCommandLine(`foo="bar`); err == nil {
+		t.Fatal("expected failure for unterminated quote")
+	}
+	if _, err := ParseKernelCommandLine(`=bar`); err == nil {
+		t.Fatal("expected failure for missing key")
+	}
+}
+
+func TestKernelCommandLineParseDuplicates(t *testing.T) {
+	k, err := ParseKernelCommandLine(`loglevel=3 quiet loglevel=7 console=tty console=tty`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `loglevel=7 quiet console=tty`
+	if k.String() != expected {
+		t.Fatalf("expected %q got %q", expected, k.String())
+	}
+}
+
+func TestKernelCommandLineMerge(t *testing.T) {
+	defaults := &KernelCommandLine{}
+	defaults.Set("root", "/dev/pmem0")
+	defaults.Set("init", "/init")
+	defaults.Add("console", "ttyS0,115200")
+	defaults.Set("loglevel", "3")
+
+	user, err := ParseKernelCommandLine(`loglevel=7 console=tty root=/dev/pmem0 panic=-1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := defaults.Merge(user); err != nil {
+		t.Fatal(err)
+	}
+	expected := `root=/dev/pmem0 init=/init console=ttyS0,115200 loglevel=7 console=tty panic=-1`
+	if defaults.String() != expected {
+		t.Fatalf("expected %q got %q", expected, defaults.String())
+	}
+}
+
+func TestKernelCommandLineMergeConflicts(t *testing.T) {
+	for _, user := range []string{`root=/dev/sda`, `init=/bin/sh`, `initrd=\other.img`} {
+		defaults := &KernelCommandLine{}
+		defaults.Set("initrd", `\initrd.img`)
+		defaults.Set("root", "/dev/pmem0")
+		defaults.Set("init", "/init")
+		u, err := ParseKernelCommandLine(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := defaults.Merge(u); err == nil {
+			t.Fatalf("expected conflict merging %q", user)
+		}
+	}
+}
+
+func TestKernelCommandLineMergeProtectedNotDefaulted(t *testing.T) {
+	defaults := &KernelCommandLine{}
+	defaults.Set("initrd", `\initrd.img`)
+	u, err := ParseKernelCommandLine(`init=/sbin/init`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := defaults.Merge(u); err != nil {
+		t.Fatal(err)
+	}
+	expected := `initrd=\initrd.img init=/sbin/init`
+	if defaults.String() != expected {
+		t.Fatalf("expected %q got %q", expected, defaults.String())
+	}
+}
@@ -0,0 +1,74 @@
+package uvm
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim/internal/osversion"
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kernelFile = "kernel"
+
+	// vmlinuxFile is the uncompressed kernel. It is preferred for direct boot
+	// as it avoids the kernel decompressing itself.
+	vmlinuxFile = "vmlinux"
+)
+
+// kernelDirectSupported determines whether the host can boot a Linux kernel
+// directly, rather than through UEFI from the VMBFS-exposed boot files.
+func kernelDirectSupported() bool {
+	return osversion.Get().Build >= osversion.V19H1
+}
+
+// defaultKernelFile returns the kernel filename to use under bootFilesPath if
+// the caller didn't supply one.
+func defaultKernelFile(bootFilesPath string, kernelDirect bool) string {
+	if kernelDirect {
+		if _, err := os.Stat(filepath.Join(bootFilesPath, vmlinuxFile)); err == nil {
+			return vmlinuxFile
+		}
+	}
+	return kernelFile
+}
+
+// chooseKernel returns the kernel file to boot under bootFilesPath, requested
+// if the caller supplied one, and whether to boot it directly. Direct boot
+// falls back to UEFI if the host does not support it, or if the kernel to boot
+// directly does not exist.
+func chooseKernel(bootFilesPath, requested string, kernelDirect, supported bool) (string, bool) {
+	if kernelDirect && !supported {
+		logrus.Warnf("uvm::Create direct kernel boot is not supported on build %d. Falling back to UEFI", osversion.Get().Build)
+		kernelDirect = false
+	}
+	file := requested
+	if file == "" {
+		file = defaultKernelFile(bootFilesPath, kernelDirect)
+	}
+	if kernelDirect {
+		if _, err := os.Stat(filepath.Join(bootFilesPath, file)); err != nil {
+			logrus.Warnf("uvm::Create kernel '%s' for direct boot not found. Falling back to UEFI", filepath.Join(bootFilesPath, file))
+			kernelDirect = false
+			if requested == "" {
+				file = kernelFile
+			}
+		}
+	}
+	return file, kernelDirect
+}
+
+// kernelDirectSettings generates the chipset settings for direct boot. The
+// kernel and initrd are passed to the hypervisor using their host paths. When
+// booting from a VPMem VHD there is no initrd.
+func kernelDirectSettings(opts *UVMOptions, rootFSType PreferredRootFSType, commandLine string) *schema2.VirtualMachinesResourcesLinuxKernelDirectV2 {
+	settings := &schema2.VirtualMachinesResourcesLinuxKernelDirectV2{
+		KernelFilePath: filepath.Join(opts.BootFilesPath, opts.KernelFile),
+		KernelCmdLine:  commandLine,
+	}
+	if rootFSType == PreferredRootFSTypeInitRd {
+		settings.InitRdPath = filepath.Join(opts.BootFilesPath, opts.RootFSFile)
+	}
+	return settings
+}
@@ -0,0 +1,49 @@
+package uvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Unit tests for choosing the kernel to boot an LCOW utility VM
+
+func TestChooseKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, kernelFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name           string
+		withVmlinux    bool
+		requested      string
+		kernelDirect   bool
+		supported      bool
+		expectedFile   string
+		expectedDirect bool
+	}{
+		{"uefi", true, "", false, true, kernelFile, false},
+		{"direct", true, "", true, true, vmlinuxFile, true},
+		{"direct without vmlinux", false, "", true, true, kernelFile, true},
+		{"unsupported build", true, "", true, false, kernelFile, false},
+		{"missing requested kernel", false, "custom", true, true, "custom", false},
+		{"requested kernel", false, kernelFile, true, true, kernelFile, true},
+	} {
+		os.Remove(filepath.Join(dir, vmlinuxFile))
+		if c.withVmlinux {
+			if err := ioutil.WriteFile(filepath.Join(dir, vmlinuxFile), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file, direct := chooseKernel(dir, c.requested, c.kernelDirect, c.supported)
+		if file != c.expectedFile || direct != c.expectedDirect {
+			t.Errorf("%s: got %s %t, expected %s %t", c.name, file, direct, c.expectedFile, c.expectedDirect)
+		}
+	}
+}
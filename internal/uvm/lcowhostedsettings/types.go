@@ -15,12 +15,20 @@ type MappedVirtualDisk struct {
 type MappedDirectory struct {
 	MountPath string
 	Port      int32
-	ShareName string // If empty not using ANames (not currently supported)
+	ShareName string // The aname of the share when multiplexed over a single port. If empty, the share has its own port.
 	ReadOnly  bool
 }
 
 // Read-only layers over VPMem
 type MappedVPMemDevice struct {
 	DeviceNumber uint32
-	MountPath    string // /tmp/pN
+	MountPath    string            // /tmp/pN, or /tmp/pN-<offset> for a layer packed into a device
+	MappingInfo  *VPMemMappingInfo `json:",omitempty"`
+}
+
+// VPMemMappingInfo is the location of a layer within a VPMem device onto which
+// several read-only layers are packed.
+type VPMemMappingInfo struct {
+	DeviceOffsetInBytes uint64
+	DeviceSizeInBytes   uint64
 }
@@ -3,6 +3,7 @@ package uvm
 import (
 	"fmt"
 	"path"
+	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/guid"
 	"github.com/Microsoft/hcsshim/internal/hns"
@@ -56,6 +57,52 @@ func (uvm *UtilityVM) RemoveNetNS(id string) error {
 	return err
 }
 
+// AddEndpointToNetNS hot-adds a NIC for endpoint to a network namespace
+// previously added with AddNetNS, for example when an endpoint is added to a
+// running container. The guest configures the NIC from the endpoint's settings.
+func (uvm *UtilityVM) AddEndpointToNetNS(id string, endpoint *hns.HNSEndpoint) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	ns := uvm.namespaces[id]
+	if ns == nil {
+		return fmt.Errorf("network namespace %s is not present in %s", id, uvm.id)
+	}
+	for _, nic := range ns.nics {
+		if strings.EqualFold(nic.Endpoint.Id, endpoint.Id) {
+			return fmt.Errorf("endpoint %s is already present in network namespace %s", endpoint.Id, id)
+		}
+	}
+	nicID := guid.New()
+	if err := uvm.addNIC(nicID, endpoint); err != nil {
+		return err
+	}
+	ns.nics = append(ns.nics, nicInfo{nicID, endpoint})
+	logrus.Debugf("uvm::AddEndpointToNetNS endpoint:%s namespace:%s nic:%s id:%s", endpoint.Id, id, nicID, uvm.id)
+	return nil
+}
+
+// RemoveEndpointFromNetNS hot-removes the NIC for an endpoint previously added
+// to a network namespace with AddNetNS or AddEndpointToNetNS.
+func (uvm *UtilityVM) RemoveEndpointFromNetNS(id string, endpointID string) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	ns := uvm.namespaces[id]
+	if ns == nil {
+		return fmt.Errorf("network namespace %s is not present in %s", id, uvm.id)
+	}
+	for i, nic := range ns.nics {
+		if strings.EqualFold(nic.Endpoint.Id, endpointID) {
+			if err := uvm.removeNIC(nic.ID, nic.Endpoint); err != nil {
+				return err
+			}
+			ns.nics = append(ns.nics[:i], ns.nics[i+1:]...)
+			logrus.Debugf("uvm::RemoveEndpointFromNetNS endpoint:%s namespace:%s id:%s", endpointID, id, uvm.id)
+			return nil
+		}
+	}
+	return fmt.Errorf("endpoint %s is not present in network namespace %s", endpointID, id)
+}
+
 func (uvm *UtilityVM) removeNamespaceNICs(ns *namespaceInfo) error {
 	for len(ns.nics) != 0 {
 		nic := ns.nics[len(ns.nics)-1]
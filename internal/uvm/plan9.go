@@ -8,8 +8,47 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// plan9Port is the vsock port on which all Plan9 shares are multiplexed. The
+// guest selects a share by passing its name as the aname when mounting.
+const plan9Port = 564
+
+// plan9ShareSettings returns the HCS settings and the GCS hosted settings for
+// a Plan9 share. Shares are multiplexed over plan9Port using anames unless
+// perPort is set, in which case each share uses its own port for guests which
+// do not support anames.
+func plan9ShareSettings(id uint64, hostPath, uvmPath string, readOnly, perPort bool) (schema2.VirtualMachinesResourcesStoragePlan9ShareV2, lcowhostedsettings.MappedDirectory) {
+	name := fmt.Sprintf("%d", id)
+	share := schema2.VirtualMachinesResourcesStoragePlan9ShareV2{
+		Name: name,
+		Path: hostPath,
+		Port: plan9Port,
+	}
+	hosted := lcowhostedsettings.MappedDirectory{
+		MountPath: uvmPath,
+		Port:      plan9Port,
+		ReadOnly:  readOnly,
+	}
+	if perPort {
+		share.Port = int32(id)
+		hosted.Port = int32(id)
+	} else {
+		share.AccessName = name
+		hosted.ShareName = name
+	}
+	return share, hosted
+}
+
+// plan9Key identifies a Plan9 share. The same host path may be shared more
+// than once, such as by each container binding it, at different paths in the
+// utility VM.
+type plan9Key struct {
+	hostPath string
+	uvmPath  string
+}
+
 // AddPlan9 adds a Plan9 share to a utility VM. Each Plan9 share is ref-counted and
-// only added if it isn't already.
+// only added if the host path isn't already shared at uvmPath. A share at the
+// same host path and uvmPath must be requested with the same read-only flag.
 func (uvm *UtilityVM) AddPlan9(hostPath string, uvmPath string, flags int32) error {
 	if uvm.operatingSystem != "linux" {
 		return errNotSupported
@@ -17,89 +56,103 @@ func (uvm *UtilityVM) AddPlan9(hostPath string, uvmPath string, flags int32) err
 	if uvmPath == "" {
 		return fmt.Errorf("uvmPath must be passed to AddPlan9")
 	}
+	readOnly := (flags & schema2.VPlan9FlagReadOnly) == schema2.VPlan9FlagReadOnly
 
 	logrus.Debugf("uvm::AddPlan9 %s %s %d id:%s", hostPath, uvmPath, flags, uvm.id)
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 	if uvm.plan9Shares == nil {
-		uvm.plan9Shares = make(map[string]*plan9Info)
+		uvm.plan9Shares = make(map[plan9Key]*plan9Info)
 	}
-	if _, ok := uvm.plan9Shares[hostPath]; !ok {
-		uvm.plan9Counter++
-
-		modification := &schema2.ModifySettingsRequestV2{
-			ResourceType: schema2.ResourceTypePlan9Share,
-			RequestType:  schema2.RequestTypeAdd,
-			Settings: schema2.VirtualMachinesResourcesStoragePlan9ShareV2{
-				Name: fmt.Sprintf("%d", uvm.plan9Counter),
-				Path: hostPath,
-				Port: int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
-			},
-			ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%d", uvm.plan9Counter),
-			HostedSettings: lcowhostedsettings.MappedDirectory{
-				MountPath: uvmPath,
-				Port:      int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
-				ReadOnly:  (flags & schema2.VPlan9FlagReadOnly) == schema2.VPlan9FlagReadOnly,
-			},
+	key := plan9Key{hostPath: hostPath, uvmPath: uvmPath}
+	if existing, ok := uvm.plan9Shares[key]; ok {
+		if existing.readOnly != readOnly {
+			return fmt.Errorf("%s is already shared into %s at %s with read-only=%t", hostPath, uvm.id, uvmPath, existing.readOnly)
 		}
+		existing.refCount++
+		logrus.Debugf("hcsshim::AddPlan9 Success %s: refcount=%d %+v", hostPath, existing.refCount, existing)
+		return nil
+	}
 
-		if err := uvm.Modify(modification); err != nil {
-			return err
-		}
-		uvm.plan9Shares[hostPath] = &plan9Info{
-			refCount:  1,
-			uvmPath:   uvmPath,
-			idCounter: uvm.plan9Counter,
-			port:      int32(uvm.plan9Counter), // TODO: Temporary. Will all use a single port (9999)
-		}
-	} else {
-		uvm.plan9Shares[hostPath].refCount++
+	uvm.plan9Counter++
+	share, hosted := plan9ShareSettings(uvm.plan9Counter, hostPath, uvmPath, readOnly, uvm.plan9PerPort)
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType:   schema2.ResourceTypePlan9Share,
+		RequestType:    schema2.RequestTypeAdd,
+		Settings:       share,
+		ResourceUri:    fmt.Sprintf("virtualmachine/devices/plan9shares/%d", uvm.plan9Counter),
+		HostedSettings: hosted,
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return err
+	}
+	uvm.plan9Shares[key] = &plan9Info{
+		refCount:  1,
+		uvmPath:   uvmPath,
+		idCounter: uvm.plan9Counter,
+		name:      share.Name,
+		port:      share.Port,
+		readOnly:  readOnly,
 	}
-	logrus.Debugf("hcsshim::AddPlan9 Success %s: refcount=%d %+v", hostPath, uvm.plan9Shares[hostPath].refCount, uvm.plan9Shares[hostPath])
+	logrus.Debugf("hcsshim::AddPlan9 Success %s: refcount=1 %+v", hostPath, uvm.plan9Shares[key])
 	return nil
 }
 
-// RemovePlan9 removes a Plan9 share from a utility VM. Each Plan9 share is ref-counted
-// and only actually removed when the ref-count drops to zero.
-func (uvm *UtilityVM) RemovePlan9(hostPath string) error {
+// RemovePlan9 removes a Plan9 share of hostPath at uvmPath from a utility VM.
+// Each Plan9 share is ref-counted and only actually removed when the ref-count
+// drops to zero.
+func (uvm *UtilityVM) RemovePlan9(hostPath, uvmPath string) error {
 	if uvm.operatingSystem != "linux" {
 		return errNotSupported
 	}
-	logrus.Debugf("uvm::RemovePlan9 %s id:%s", hostPath, uvm.id)
+	logrus.Debugf("uvm::RemovePlan9 %s %s id:%s", hostPath, uvmPath, uvm.id)
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
-	if _, ok := uvm.plan9Shares[hostPath]; !ok {
-		return fmt.Errorf("%s is not present as a Plan9 share in %s, cannot remove", hostPath, uvm.id)
+	key := plan9Key{hostPath: hostPath, uvmPath: uvmPath}
+	if _, ok := uvm.plan9Shares[key]; !ok {
+		return fmt.Errorf("%s is not present as a Plan9 share at %s in %s, cannot remove", hostPath, uvmPath, uvm.id)
 	}
-	return uvm.removePlan9(hostPath, uvm.plan9Shares[hostPath].uvmPath)
+	return uvm.removePlan9(key)
 }
 
 // removePlan9 is the internally callable "unsafe" version of RemovePlan9. The mutex
 // MUST be held when calling this function.
-func (uvm *UtilityVM) removePlan9(hostPath, uvmPath string) error {
-	uvm.plan9Shares[hostPath].refCount--
-	if uvm.plan9Shares[hostPath].refCount > 0 {
-		logrus.Debugf("uvm::RemovePlan9 Success %s id:%s Ref-count now %d. It is still present in the utility VM", hostPath, uvm.id, uvm.plan9Shares[hostPath].refCount)
+func (uvm *UtilityVM) removePlan9(key plan9Key) error {
+	hostPath := key.hostPath
+	info := uvm.plan9Shares[key]
+	info.refCount--
+	if info.refCount > 0 {
+		logrus.Debugf("uvm::RemovePlan9 Success %s id:%s Ref-count now %d. It is still present in the utility VM", hostPath, uvm.id, info.refCount)
 		return nil
 	}
 	logrus.Debugf("uvm::RemovePlan9 Zero ref-count, removing. %s id:%s", hostPath, uvm.id)
+	share, hosted := plan9ShareSettings(info.idCounter, "", info.uvmPath, info.readOnly, uvm.plan9PerPort)
 	modification := &schema2.ModifySettingsRequestV2{
-		ResourceType: schema2.ResourceTypePlan9Share,
-		RequestType:  schema2.RequestTypeRemove,
-		Settings: schema2.VirtualMachinesResourcesStoragePlan9ShareV2{
-			Name: fmt.Sprintf("%d", uvm.plan9Shares[hostPath].idCounter),
-			Port: uvm.plan9Shares[hostPath].port,
-		},
-		ResourceUri: fmt.Sprintf("virtualmachine/devices/plan9shares/%d", uvm.plan9Shares[hostPath].idCounter),
-		HostedSettings: lcowhostedsettings.MappedDirectory{
-			MountPath: uvm.plan9Shares[hostPath].uvmPath,
-			Port:      uvm.plan9Shares[hostPath].port,
-		},
+		ResourceType:   schema2.ResourceTypePlan9Share,
+		RequestType:    schema2.RequestTypeRemove,
+		Settings:       share,
+		ResourceUri:    fmt.Sprintf("virtualmachine/devices/plan9shares/%d", info.idCounter),
+		HostedSettings: hosted,
 	}
 	if err := uvm.Modify(modification); err != nil {
 		return fmt.Errorf("failed to remove plan9 share %s from %s: %+v: %s", hostPath, uvm.id, modification, err)
 	}
-	delete(uvm.plan9Shares, hostPath)
+	delete(uvm.plan9Shares, key)
 	logrus.Debugf("uvm::RemovePlan9 Success %s id:%s successfully removed from utility VM", hostPath, uvm.id)
 	return nil
 }
+
+// GetPlan9UvmPath returns the path in the utility VM at which a host path is
+// shared with the read-only flag, so that further requests for the same host
+// path can share it. If the host path is shared more than once with the flag,
+// the path of one of its shares is returned.
+func (uvm *UtilityVM) GetPlan9UvmPath(hostPath string, readOnly bool) (string, error) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	for key, info := range uvm.plan9Shares {
+		if key.hostPath == hostPath && info.readOnly == readOnly {
+			return key.uvmPath, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found as Plan9 share with read-only=%t in %s", hostPath, readOnly, uvm.id)
+}
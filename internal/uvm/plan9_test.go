@@ -0,0 +1,53 @@
+package uvm
+
+import (
+	"testing"
+)
+
+// Unit tests for rendering Plan9 share settings
+
+func TestPlan9ShareSettingsANames(t *testing.T) {
+	share, hosted := plan9ShareSettings(3, `c:\share`, "/tmp/share", true, false)
+	if share.Name != "3" || share.AccessName != "3" || share.Port != plan9Port || share.Path != `c:\share` {
+		t.Fatalf("unexpected share settings %+v", share)
+	}
+	if hosted.ShareName != "3" || hosted.Port != plan9Port || hosted.MountPath != "/tmp/share" || !hosted.ReadOnly {
+		t.Fatalf("unexpected hosted settings %+v", hosted)
+	}
+
+	// All shares use the same port
+	share2, hosted2 := plan9ShareSettings(4, `c:\other`, "/tmp/other", false, false)
+	if share2.Port != share.Port || hosted2.Port != hosted.Port || share2.AccessName == share.AccessName {
+		t.Fatalf("unexpected settings for second share %+v %+v", share2, hosted2)
+	}
+}
+
+func TestPlan9ShareSettingsPerPort(t *testing.T) {
+	share, hosted := plan9ShareSettings(3, `c:\share`, "/tmp/share", false, true)
+	if share.Name != "3" || share.AccessName != "" || share.Port != 3 {
+		t.Fatalf("unexpected share settings %+v", share)
+	}
+	if hosted.ShareName != "" || hosted.Port != 3 || hosted.ReadOnly {
+		t.Fatalf("unexpected hosted settings %+v", hosted)
+	}
+}
+
+func TestGetPlan9UvmPath(t *testing.T) {
+	uvm := &UtilityVM{
+		id: "uvm",
+		plan9Shares: map[plan9Key]*plan9Info{
+			{hostPath: `c:\share`, uvmPath: "/run/gcs/c/1/m0"}: {refCount: 1, uvmPath: "/run/gcs/c/1/m0", readOnly: true},
+			{hostPath: `c:\other`, uvmPath: "/run/gcs/c/1/m1"}: {refCount: 1, uvmPath: "/run/gcs/c/1/m1"},
+		},
+	}
+	if p, err := uvm.GetPlan9UvmPath(`c:\share`, true); err != nil || p != "/run/gcs/c/1/m0" {
+		t.Fatalf("unexpected path for read-only share: %q %v", p, err)
+	}
+	// A share with a different read-only flag is not reused.
+	if p, err := uvm.GetPlan9UvmPath(`c:\share`, false); err == nil {
+		t.Fatalf("found a writable share of a read-only share at %q", p)
+	}
+	if _, err := uvm.GetPlan9UvmPath(`c:\missing`, false); err == nil {
+		t.Fatal("found a share of a host path which is not shared")
+	}
+}
@@ -0,0 +1,127 @@
+package uvm
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxProcessorLimit is the largest processor limit HCS accepts. The limit is
+	// expressed as a percentage of the host's processors multiplied by 1000.
+	MaxProcessorLimit = 100000
+
+	// MaxProcessorWeight is the largest relative scheduling weight HCS accepts.
+	MaxProcessorWeight = 10000
+)
+
+// processorSettings computes the processor and NUMA topology for a utility VM
+// from the options supplied to Create(). The dedicated processor fields in
+// UVMOptions take precedence over the OCI resources, which in turn take
+// precedence over the defaults.
+func processorSettings(opts *UVMOptions) (*schema2.VirtualMachinesResourcesComputeProcessorV2, *schema2.VirtualMachinesResourcesComputeNumaV2, error) {
+	hostProcessors := int32(runtime.NumCPU())
+
+	processor := &schema2.VirtualMachinesResourcesComputeProcessorV2{
+		Count:                          2,
+		ExposeVirtualizationExtensions: opts.ExposeVirtualizationExtensions,
+	}
+	if hostProcessors == 1 {
+		processor.Count = 1
+	}
+
+	if opts.Resources != nil && opts.Resources.CPU != nil {
+		if opts.Resources.CPU.Count != nil {
+			processor.Count = int32(*opts.Resources.CPU.Count)
+		}
+		if opts.Resources.CPU.Maximum != nil {
+			// OCI is percentage * 100. HCS is percentage * 1000.
+			processor.Limit = int32(*opts.Resources.CPU.Maximum) * 10
+		}
+		if opts.Resources.CPU.Shares != nil {
+			processor.Weight = int32(*opts.Resources.CPU.Shares)
+		}
+	}
+
+	if opts.ProcessorCount != nil {
+		processor.Count = *opts.ProcessorCount
+	}
+	if opts.ProcessorLimit != nil {
+		processor.Limit = *opts.ProcessorLimit
+	}
+	if opts.ProcessorWeight != nil {
+		processor.Weight = *opts.ProcessorWeight
+	}
+
+	if processor.Count < 1 || processor.Count > hostProcessors {
+		return nil, nil, fmt.Errorf("processor count must be between 1 and %d", hostProcessors)
+	}
+	if err := validateProcessorLimits(processor.Limit, processor.Weight); err != nil {
+		return nil, nil, err
+	}
+
+	var numa *schema2.VirtualMachinesResourcesComputeNumaV2
+	if opts.NumaNodeCount != nil {
+		if *opts.NumaNodeCount < 1 || *opts.NumaNodeCount > processor.Count {
+			return nil, nil, fmt.Errorf("NUMA node count must be between 1 and the processor count (%d)", processor.Count)
+		}
+		numa = &schema2.VirtualMachinesResourcesComputeNumaV2{VirtualNodeCount: *opts.NumaNodeCount}
+	}
+
+	return processor, numa, nil
+}
+
+// validateProcessorLimits checks a processor limit and weight are within the
+// ranges HCS accepts. Zero means not set for both.
+func validateProcessorLimits(limit, weight int32) error {
+	if limit < 0 || limit > MaxProcessorLimit {
+		return fmt.Errorf("processor limit must be between 0 and %d", MaxProcessorLimit)
+	}
+	if weight < 0 || weight > MaxProcessorWeight {
+		return fmt.Errorf("processor weight must be between 0 and %d", MaxProcessorWeight)
+	}
+	return nil
+}
+
+// ProcessorCount returns the number of virtual processors assigned to the utility VM.
+func (uvm *UtilityVM) ProcessorCount() int32 {
+	return uvm.processorCount
+}
+
+// UpdateProcessorLimits updates the processor limit and/or weight of a running
+// utility VM. A nil value leaves the current setting unchanged.
+func (uvm *UtilityVM) UpdateProcessorLimits(limit, weight *int32) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	newLimit := uvm.processorLimit
+	if limit != nil {
+		newLimit = *limit
+	}
+	newWeight := uvm.processorWeight
+	if weight != nil {
+		newWeight = *weight
+	}
+	if err := validateProcessorLimits(newLimit, newWeight); err != nil {
+		return err
+	}
+
+	logrus.Debugf("uvm::UpdateProcessorLimits id:%s limit:%d weight:%d", uvm.id, newLimit, newWeight)
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeProcessor,
+		RequestType:  schema2.RequestTypeUpdate,
+		Settings: schema2.VirtualMachinesResourcesComputeProcessorLimitsV2{
+			Limit:  newLimit,
+			Weight: newWeight,
+		},
+		ResourceUri: "VirtualMachine/ComputeTopology/Processor/Limits",
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to update processor limits of %s: %s", uvm.id, err)
+	}
+	uvm.processorLimit = newLimit
+	uvm.processorWeight = newWeight
+	return nil
+}
@@ -0,0 +1,93 @@
+package uvm
+
+import (
+	"runtime"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Unit tests for processor topology calculation in uvm.Create()
+
+func int32p(i int32) *int32 {
+	return &i
+}
+
+func TestProcessorSettingsDefault(t *testing.T) {
+	p, numa, err := processorSettings(&UVMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := int32(2)
+	if runtime.NumCPU() == 1 {
+		expected = 1
+	}
+	if p.Count != expected || p.Limit != 0 || p.Weight != 0 || numa != nil {
+		t.Fatalf("unexpected defaults %+v %+v", p, numa)
+	}
+}
+
+func TestProcessorSettingsFromResources(t *testing.T) {
+	count := uint64(1)
+	maximum := uint16(5000)
+	shares := uint16(200)
+	opts := &UVMOptions{
+		Resources: &specs.WindowsResources{
+			CPU: &specs.WindowsCPUResources{Count: &count, Maximum: &maximum, Shares: &shares},
+		},
+	}
+	p, _, err := processorSettings(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Count != 1 || p.Limit != 50000 || p.Weight != 200 {
+		t.Fatalf("unexpected settings %+v", p)
+	}
+
+	// Explicit options override the OCI resources
+	opts.ProcessorLimit = int32p(1000)
+	opts.ProcessorWeight = int32p(10)
+	p, _, err = processorSettings(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Limit != 1000 || p.Weight != 10 {
+		t.Fatalf("unexpected settings %+v", p)
+	}
+}
+
+func TestProcessorSettingsBadCount(t *testing.T) {
+	_, _, err := processorSettings(&UVMOptions{ProcessorCount: int32p(int32(runtime.NumCPU()) + 1)})
+	if err == nil {
+		t.Fatal("expected failure for processor count exceeding host")
+	}
+	_, _, err = processorSettings(&UVMOptions{ProcessorCount: int32p(0)})
+	if err == nil {
+		t.Fatal("expected failure for zero processor count")
+	}
+}
+
+func TestProcessorSettingsBadLimits(t *testing.T) {
+	_, _, err := processorSettings(&UVMOptions{ProcessorLimit: int32p(MaxProcessorLimit + 1)})
+	if err == nil {
+		t.Fatal("expected failure for processor limit")
+	}
+	_, _, err = processorSettings(&UVMOptions{ProcessorWeight: int32p(-1)})
+	if err == nil {
+		t.Fatal("expected failure for processor weight")
+	}
+}
+
+func TestProcessorSettingsNuma(t *testing.T) {
+	_, numa, err := processorSettings(&UVMOptions{ProcessorCount: int32p(1), NumaNodeCount: int32p(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numa == nil || numa.VirtualNodeCount != 1 {
+		t.Fatalf("unexpected NUMA settings %+v", numa)
+	}
+	_, _, err = processorSettings(&UVMOptions{ProcessorCount: int32p(1), NumaNodeCount: int32p(2)})
+	if err == nil {
+		t.Fatal("expected failure for more NUMA nodes than processors")
+	}
+}
@@ -0,0 +1,75 @@
+package uvm
+
+import (
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm/lcowhostedsettings"
+	"github.com/Microsoft/hcsshim/internal/wclayer"
+	"github.com/sirupsen/logrus"
+)
+
+// AttachScratch attaches an ext4 formatted scratch disk, such as one created by
+// lcow.CreateScratch, to a running Linux utility VM and mounts it at
+// LCOWScratchPath. File system utilities run in the utility VM use it rather
+// than the tmpfs backed by the VM's memory. A utility VM has at most one
+// scratch disk.
+func (uvm *UtilityVM) AttachScratch(hostPath string) error {
+	if uvm.operatingSystem != "linux" {
+		return errNotSupported
+	}
+	logrus.Debugf("uvm::AttachScratch %s id:%s", hostPath, uvm.id)
+	if existing := uvm.scratchHostPath(); existing != "" {
+		return fmt.Errorf("utility VM %s already has scratch disk %s attached", uvm.id, existing)
+	}
+	if err := wclayer.GrantVmAccess(uvm.id, hostPath); err != nil {
+		return err
+	}
+	if _, _, err := uvm.AddSCSI(hostPath, LCOWScratchPath); err != nil {
+		return fmt.Errorf("failed to attach scratch disk %s to %s: %s", hostPath, uvm.id, err)
+	}
+	return nil
+}
+
+// mountBootScratch mounts the scratch disk attached to SCSI 0:0 when the
+// utility VM was created at LCOWScratchPath in the guest. The disk is already
+// attached, so the request is for the guest only.
+func (uvm *UtilityVM) mountBootScratch() error {
+	logrus.Debugf("uvm::mountBootScratch %s id:%s", uvm.scratchFile, uvm.id)
+	request := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeMappedVirtualDisk,
+		RequestType:  schema2.RequestTypeAdd,
+		HostedSettings: lcowhostedsettings.MappedVirtualDisk{
+			MountPath:  LCOWScratchPath,
+			Lun:        0,
+			Controller: 0,
+		},
+	}
+	if err := uvm.Modify(request); err != nil {
+		return fmt.Errorf("failed to mount scratch disk %s in %s: %s", uvm.scratchFile, uvm.id, err)
+	}
+	return nil
+}
+
+// ScratchPath returns the path in a Linux utility VM at which its scratch disk
+// is mounted, or "" if it has none.
+func (uvm *UtilityVM) ScratchPath() string {
+	if uvm.scratchHostPath() == "" {
+		return ""
+	}
+	return LCOWScratchPath
+}
+
+// scratchHostPath returns the host path of the attached scratch disk, if any.
+func (uvm *UtilityVM) scratchHostPath() string {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	for _, luns := range uvm.scsiLocations {
+		for _, si := range luns {
+			if si.hostPath != "" && si.uvmPath == LCOWScratchPath {
+				return si.hostPath
+			}
+		}
+	}
+	return ""
+}
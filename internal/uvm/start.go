@@ -1,6 +1,17 @@
 package uvm
 
-// Start synchronously starts the utility VM.
+// Start synchronously starts the utility VM. If a scratch disk was supplied for
+// a Linux utility VM, the guest mounts it as part of starting, so that it is
+// in place before Start returns and anything is run in the VM.
 func (uvm *UtilityVM) Start() error {
-	return uvm.hcsSystem.Start()
+	if err := uvm.hcsSystem.Start(); err != nil {
+		return err
+	}
+	if uvm.scratchFile != "" {
+		if err := uvm.mountBootScratch(); err != nil {
+			uvm.hcsSystem.Terminate()
+			return err
+		}
+	}
+	return nil
 }
@@ -12,7 +12,7 @@ import (
 
 //                    | WCOW | LCOW
 // Container scratch  | SCSI | SCSI
-// Scratch space      | ---- | SCSI   // For file system utilities. /tmp/scratch
+// Scratch space      | ---- | SCSI   // For file system utilities. /tmp/scratch. See AttachScratch
 // Read-Only Layer    | VSMB | VPMEM
 // Mapped Directory   | VSMB | PLAN9
 
@@ -20,6 +20,9 @@ import (
 type vsmbShare struct {
 	refCount       uint32
 	name           string
+	hostPath       string
+	file           string // Set if a single file in the shared directory is exposed
+	options        VSMBOptions
 	hostedSettings interface{}
 }
 
@@ -36,6 +39,20 @@ type vpmemInfo struct {
 	hostPath string
 	uvmPath  string
 	refCount uint32
+
+	// Set for a device onto which several read-only layers are packed. hostPath,
+	// uvmPath and refCount are unused for these; each mapping is ref-counted.
+	sizeBytes uint64
+	mappings  []*vpmemMapping // Ordered by offset
+}
+
+// vpmemMapping is a read-only layer packed into a VPMem device at an offset.
+type vpmemMapping struct {
+	hostPath  string
+	uvmPath   string
+	offset    uint64
+	sizeBytes uint64
+	refCount  uint32
 }
 
 // plan9Info is an internal structure used for ref-counting Plan9 shares mapped to a Linux utility VM.
@@ -43,7 +60,9 @@ type plan9Info struct {
 	refCount  uint32
 	idCounter uint64
 	uvmPath   string
-	port      int32 // Temporary. TODO Remove
+	name      string // Share name, also used as the aname when multiplexed
+	port      int32
+	readOnly  bool
 }
 type nicInfo struct {
 	ID       guid.GUID
@@ -64,7 +83,7 @@ type UtilityVM struct {
 	m               sync.Mutex  // Lock for adding/removing devices
 
 	// VSMB shares that are mapped into a Windows UVM. These are used for read-only
-	// layers and mapped directories
+	// layers and mapped directories and files. Keyed by host path and options.
 	vsmbShares  map[string]*vsmbShare
 	vsmbCounter uint64 // Counter to generate a unique share name for each VSMB share.
 
@@ -72,13 +91,42 @@ type UtilityVM struct {
 	vpmemDevices [MaxVPMEM]vpmemInfo // Limited by ACPI size.
 	vpmemMax     int32               // Actual number of VPMem devices
 
+	// If set, read-only layers are packed onto VPMem devices of vpmemDeviceSizeBytes.
+	vpmemMultiMapping    bool
+	vpmemDeviceSizeBytes uint64
+
 	// SCSI devices that are mapped into a Windows or Linux utility VM
 	scsiLocations       [4][64]scsiInfo // Hyper-V supports 4 controllers, 64 slots per controller. Limited to 1 controller for now though.
 	scsiControllerCount int             // Number of SCSI controllers in the utility VM
 
 	// Plan9 are directories mapped into a Linux utility VM
-	plan9Shares  map[string]*plan9Info
+	plan9Shares  map[plan9Key]*plan9Info
 	plan9Counter uint64 // Each newly-added plan9 share has a counter used as its ID in the ResourceURI and for the name
+	plan9PerPort bool   // Compatibility mode where each share uses its own port rather than an aname on plan9Port
 
 	namespaces map[string]*namespaceInfo
+
+	// scratchFile is the scratch disk attached when a Linux utility VM is started.
+	scratchFile string
+
+	// kernelCommandLine is the final command line used to boot a Linux utility VM.
+	kernelCommandLine string
+	kernelDirect      bool // Linux utility VM booted directly rather than through UEFI
+
+	// Processor topology. The limit and weight can be updated while running.
+	processorCount  int32
+	processorLimit  int32
+	processorWeight int32
+
+	// Memory and processors committed to containers, keyed by container ID, and
+	// the ratio to the VM's by which they may be overcommitted. See Commit.
+	memoryMB        int32
+	overcommitRatio float64
+	commitments     map[string]Commitment
+
+	// console captures the serial console of a Linux utility VM if a log file was requested.
+	console *ConsoleLogger
+
+	// health is the monitor started by StartHealthMonitor, if any.
+	health *HealthMonitor
 }
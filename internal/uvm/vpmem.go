@@ -13,7 +13,7 @@ import (
 // when calling this function.
 func (uvm *UtilityVM) allocateVPMEM(hostPath string) (uint32, error) {
 	for index, vi := range uvm.vpmemDevices {
-		if vi.hostPath == "" {
+		if vi.hostPath == "" && vi.sizeBytes == 0 {
 			vi.hostPath = hostPath
 			logrus.Debugf("uvm::allocateVPMEM %d %q", index, hostPath)
 			return uint32(index), nil
@@ -44,6 +44,10 @@ func (uvm *UtilityVM) findVPMEMDevice(findThisHostPath string) (uint32, string,
 //
 // Returns the location(0..MaxVPMEM-1) where the device is attached, and if exposed,
 // the utility VM path which will be /tmp/p<location>//
+//
+// If the utility VM was created with VPMemMultiMapping, hostPath is instead packed
+// alongside other layers onto a shared device, and the utility VM path will be
+// /tmp/p<location>-<offset>. Each layer is ref-counted individually.
 func (uvm *UtilityVM) AddVPMEM(hostPath string, expose bool) (uint32, string, error) {
 	if uvm.operatingSystem != "linux" {
 		return 0, "", errNotSupported
@@ -54,6 +58,10 @@ func (uvm *UtilityVM) AddVPMEM(hostPath string, expose bool) (uint32, string, er
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
+	if uvm.vpmemMultiMapping {
+		return uvm.addVPMEMMapped(hostPath, expose)
+	}
+
 	var deviceNumber uint32
 	var err error
 	uvmPath := ""
@@ -119,6 +127,13 @@ func (uvm *UtilityVM) RemoveVPMEM(hostPath string) error {
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
+	if deviceNumber, m := uvm.findVPMEMMapping(hostPath); m != nil {
+		if err := uvm.removeVPMEMMapped(deviceNumber, m); err != nil {
+			return fmt.Errorf("failed to remove VPMEM %s from utility VM %s: %s", hostPath, uvm.id, err)
+		}
+		return nil
+	}
+
 	// Make sure is actually attached
 	deviceNumber, uvmPath, err := uvm.findVPMEMDevice(hostPath)
 	if err != nil {
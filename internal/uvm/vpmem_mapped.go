@@ -0,0 +1,225 @@
+package uvm
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/uvm/lcowhostedsettings"
+	"github.com/sirupsen/logrus"
+)
+
+// findVPMEMMappingOffset returns the lowest aligned offset at which size bytes
+// fit between the existing mappings of a device, which must be ordered by
+// offset.
+func findVPMEMMappingOffset(mappings []*vpmemMapping, size, deviceSize uint64) (uint64, bool) {
+	var offset uint64
+	for _, m := range mappings {
+		if m.offset >= offset+size {
+			break
+		}
+		offset = alignVPMEM(m.offset + m.sizeBytes)
+	}
+	if offset+size > deviceSize {
+		return 0, false
+	}
+	return offset, true
+}
+
+// alignVPMEM rounds size up to vpmemMappingAlignment.
+func alignVPMEM(size uint64) uint64 {
+	return (size + vpmemMappingAlignment - 1) / vpmemMappingAlignment * vpmemMappingAlignment
+}
+
+// findVPMEMMapping finds a layer packed into a VPMem device. The lock MUST be
+// held when calling this function.
+func (uvm *UtilityVM) findVPMEMMapping(hostPath string) (uint32, *vpmemMapping) {
+	for deviceNumber, vi := range uvm.vpmemDevices {
+		for _, m := range vi.mappings {
+			if m.hostPath == hostPath {
+				return uint32(deviceNumber), m
+			}
+		}
+	}
+	return 0, nil
+}
+
+// addVPMEMMapped packs a read-only layer onto a VPMem device, hot-adding a new
+// device if none has space. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) addVPMEMMapped(hostPath string, expose bool) (uint32, string, error) {
+	if deviceNumber, m := uvm.findVPMEMMapping(hostPath); m != nil {
+		m.refCount++
+		logrus.Debugf("hcsshim::AddVPMEM id:%s Success device:%d %+v", uvm.id, deviceNumber, m)
+		return deviceNumber, m.uvmPath, nil
+	}
+
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return 0, "", err
+	}
+	size := alignVPMEM(uint64(fi.Size()))
+	if size > uvm.vpmemDeviceSizeBytes {
+		return 0, "", fmt.Errorf("%s is too large to pack onto a VPMem device of %d bytes", hostPath, uvm.vpmemDeviceSizeBytes)
+	}
+
+	// Find space on an existing device, otherwise hot-add an empty device.
+	var (
+		deviceNumber uint32
+		offset       uint64
+		found        bool
+	)
+	for i := range uvm.vpmemDevices {
+		if uvm.vpmemDevices[i].sizeBytes == 0 {
+			continue
+		}
+		if offset, found = findVPMEMMappingOffset(uvm.vpmemDevices[i].mappings, size, uvm.vpmemDevices[i].sizeBytes); found {
+			deviceNumber = uint32(i)
+			break
+		}
+	}
+	if !found {
+		if deviceNumber, err = uvm.addVPMEMDevice(); err != nil {
+			return 0, "", err
+		}
+		offset = 0
+	}
+
+	m := &vpmemMapping{
+		hostPath:  hostPath,
+		offset:    offset,
+		sizeBytes: size,
+		refCount:  1,
+	}
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeAdd,
+		Settings: schema2.VirtualMachinesResourcesStorageVpmemMappingV2{
+			HostPath:    hostPath,
+			ImageFormat: "VHD1",
+		},
+		ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d/mappings/%d", deviceNumber, offset),
+	}
+	if expose {
+		m.uvmPath = fmt.Sprintf("/tmp/p%d-%d", deviceNumber, offset)
+		modification.HostedSettings = lcowhostedsettings.MappedVPMemDevice{
+			DeviceNumber: deviceNumber,
+			MountPath:    m.uvmPath,
+			MappingInfo: &lcowhostedsettings.VPMemMappingInfo{
+				DeviceOffsetInBytes: offset,
+				DeviceSizeInBytes:   size,
+			},
+		}
+	}
+	if err := uvm.Modify(modification); err != nil {
+		if len(uvm.vpmemDevices[deviceNumber].mappings) == 0 {
+			uvm.removeVPMEMDevice(deviceNumber)
+		}
+		return 0, "", fmt.Errorf("uvm::AddVPMEM: failed to map %s into VPMem device %d: %s", hostPath, deviceNumber, err)
+	}
+
+	vi := &uvm.vpmemDevices[deviceNumber]
+	i := 0
+	for i < len(vi.mappings) && vi.mappings[i].offset < offset {
+		i++
+	}
+	vi.mappings = append(vi.mappings, nil)
+	copy(vi.mappings[i+1:], vi.mappings[i:])
+	vi.mappings[i] = m
+	logrus.Debugf("hcsshim::AddVPMEM id:%s Success device:%d %+v", uvm.id, deviceNumber, m)
+	return deviceNumber, m.uvmPath, nil
+}
+
+// addVPMEMDevice hot-adds an empty VPMem device onto which layers can be
+// packed. The lock MUST be held when calling this function.
+func (uvm *UtilityVM) addVPMEMDevice() (uint32, error) {
+	deviceNumber := -1
+	for i := 0; i < int(uvm.vpmemMax); i++ {
+		if uvm.vpmemDevices[i].hostPath == "" && uvm.vpmemDevices[i].sizeBytes == 0 {
+			deviceNumber = i
+			break
+		}
+	}
+	if deviceNumber == -1 {
+		return 0, fmt.Errorf("no free VPMEM locations")
+	}
+
+	controller := schema2.VirtualMachinesResourcesStorageVpmemControllerV2{}
+	controller.Devices = make(map[string]schema2.VirtualMachinesResourcesStorageVpmemDeviceV2)
+	controller.Devices[strconv.Itoa(deviceNumber)] = schema2.VirtualMachinesResourcesStorageVpmemDeviceV2{
+		ReadOnly:    true,
+		ImageFormat: "VHD1",
+		SizeBytes:   uvm.vpmemDeviceSizeBytes,
+	}
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeAdd,
+		Settings:     controller,
+		ResourceUri:  fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d", deviceNumber),
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return 0, fmt.Errorf("uvm::AddVPMEM: failed to add VPMem device %d: %s", deviceNumber, err)
+	}
+	uvm.vpmemDevices[deviceNumber] = vpmemInfo{sizeBytes: uvm.vpmemDeviceSizeBytes}
+	logrus.Debugf("uvm::addVPMEMDevice id:%s device:%d size:%d", uvm.id, deviceNumber, uvm.vpmemDeviceSizeBytes)
+	return uint32(deviceNumber), nil
+}
+
+// removeVPMEMDevice hot-removes an empty VPMem device. The lock MUST be held
+// when calling this function.
+func (uvm *UtilityVM) removeVPMEMDevice(deviceNumber uint32) error {
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeRemove,
+		ResourceUri:  fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d", deviceNumber),
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return fmt.Errorf("failed to remove VPMem device %d from %s: %s", deviceNumber, uvm.id, err)
+	}
+	uvm.vpmemDevices[deviceNumber] = vpmemInfo{}
+	return nil
+}
+
+// removeVPMEMMapped drops a reference to a layer packed into a VPMem device,
+// unmapping it when unused and removing the device once it is empty. The lock
+// MUST be held when calling this function.
+func (uvm *UtilityVM) removeVPMEMMapped(deviceNumber uint32, m *vpmemMapping) error {
+	logrus.Debugf("uvm::RemoveVPMEM id:%s hostPath:%s device:%d offset:%d", uvm.id, m.hostPath, deviceNumber, m.offset)
+	if m.refCount > 1 {
+		m.refCount--
+		logrus.Debugf("uvm::RemoveVPMEM: Success id:%s hostPath:%s device:%d refCount:%d", uvm.id, m.hostPath, deviceNumber, m.refCount)
+		return nil
+	}
+
+	modification := &schema2.ModifySettingsRequestV2{
+		ResourceType: schema2.ResourceTypeVPMemDevice,
+		RequestType:  schema2.RequestTypeRemove,
+		ResourceUri:  fmt.Sprintf("virtualmachine/devices/virtualpmemdevices/%d/mappings/%d", deviceNumber, m.offset),
+	}
+	if m.uvmPath != "" {
+		modification.HostedSettings = lcowhostedsettings.MappedVPMemDevice{
+			DeviceNumber: deviceNumber,
+			MountPath:    m.uvmPath,
+			MappingInfo: &lcowhostedsettings.VPMemMappingInfo{
+				DeviceOffsetInBytes: m.offset,
+				DeviceSizeInBytes:   m.sizeBytes,
+			},
+		}
+	}
+	if err := uvm.Modify(modification); err != nil {
+		return err
+	}
+
+	vi := &uvm.vpmemDevices[deviceNumber]
+	for i := range vi.mappings {
+		if vi.mappings[i] == m {
+			vi.mappings = append(vi.mappings[:i], vi.mappings[i+1:]...)
+			break
+		}
+	}
+	logrus.Debugf("uvm::RemoveVPMEM: Success id:%s hostPath:%s device:%d unmapped", uvm.id, m.hostPath, deviceNumber)
+	if len(vi.mappings) == 0 {
+		return uvm.removeVPMEMDevice(deviceNumber)
+	}
+	return nil
+}
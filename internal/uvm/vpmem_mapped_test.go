@@ -0,0 +1,49 @@
+package uvm
+
+import (
+	"testing"
+)
+
+// Unit tests for packing read-only layers onto a VPMem device
+
+func TestAlignVPMEM(t *testing.T) {
+	for size, expected := range map[uint64]uint64{
+		0:                         0,
+		1:                         vpmemMappingAlignment,
+		vpmemMappingAlignment:     vpmemMappingAlignment,
+		vpmemMappingAlignment + 1: 2 * vpmemMappingAlignment,
+	} {
+		if aligned := alignVPMEM(size); aligned != expected {
+			t.Fatalf("alignVPMEM(%d): expected %d got %d", size, expected, aligned)
+		}
+	}
+}
+
+func TestFindVPMEMMappingOffset(t *testing.T) {
+	const a = vpmemMappingAlignment
+	mappings := []*vpmemMapping{
+		{offset: 0, sizeBytes: 2 * a},
+		{offset: 3 * a, sizeBytes: a},
+		{offset: 6 * a, sizeBytes: 2 * a},
+	}
+	for _, test := range []struct {
+		size   uint64
+		offset uint64
+		found  bool
+	}{
+		{a, 2 * a, true},     // First gap
+		{2 * a, 4 * a, true}, // Second gap
+		{3 * a, 8 * a, true}, // After the last mapping
+		{4 * a, 0, false},    // Does not fit on the device
+		{10 * a, 0, false},   // Larger than the device
+	} {
+		offset, found := findVPMEMMappingOffset(mappings, test.size, 11*a)
+		if offset != test.offset || found != test.found {
+			t.Fatalf("size %d: expected %d/%t got %d/%t", test.size, test.offset, test.found, offset, found)
+		}
+	}
+
+	if offset, found := findVPMEMMappingOffset(nil, a, a); !found || offset != 0 {
+		t.Fatalf("empty device: got %d/%t", offset, found)
+	}
+}
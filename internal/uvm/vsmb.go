@@ -2,31 +2,153 @@ package uvm
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/Microsoft/hcsshim/internal/schema2"
 	"github.com/sirupsen/logrus"
 )
 
+// VSMBOptions are the options for a VSMB share. Two requests for the same host
+// path with different options are separate shares.
+type VSMBOptions struct {
+	ReadOnly            bool     // The guest cannot write to the share
+	CacheIO             bool     // All opens use cached I/O
+	ShareRead           bool     // Convert exclusive access to shared read access
+	PseudoOplocks       bool     // Enable pseudo-oplocks
+	NoOplocks           bool     // Disable oplocks
+	ForceLevelIIOplocks bool     // Disable all oplocks except level II
+	TakeBackupPrivilege bool     // Acquire the backup privilege when opening files
+	NoDirectMap         bool     // Disable direct mapping of files into guest memory
+	RestrictFileAccess  bool     // Only allow access to AllowedFiles
+	AllowedFiles        []string // Files which may be accessed if RestrictFileAccess is set
+}
+
+// DefaultVSMBOptions returns the options used for sharing a directory mounted
+// into a container.
+func DefaultVSMBOptions(readOnly bool) *VSMBOptions {
+	if !readOnly {
+		return &VSMBOptions{}
+	}
+	return &VSMBOptions{
+		ReadOnly:            true,
+		CacheIO:             true,
+		ShareRead:           true,
+		ForceLevelIIOplocks: true,
+	}
+}
+
+// LayerVSMBOptions returns the options used for sharing a read-only container
+// image layer.
+func LayerVSMBOptions() *VSMBOptions {
+	return &VSMBOptions{
+		ReadOnly:            true,
+		CacheIO:             true,
+		ShareRead:           true,
+		PseudoOplocks:       true,
+		TakeBackupPrivilege: true,
+	}
+}
+
+// flags returns the HCS flags for the options.
+func (o *VSMBOptions) flags() int32 {
+	var flags int32 = schema2.VsmbFlagNone
+	for _, f := range []struct {
+		set  bool
+		flag int32
+	}{
+		{o.ReadOnly, schema2.VsmbFlagReadOnly},
+		{o.CacheIO, schema2.VsmbFlagCacheIO},
+		{o.ShareRead, schema2.VsmbFlagShareRead},
+		{o.PseudoOplocks, schema2.VsmbFlagPseudoOplocks},
+		{o.NoOplocks, schema2.VsmbFlagNoOplocks},
+		{o.ForceLevelIIOplocks, schema2.VsmbFlagForceLevelIIOplocks},
+		{o.TakeBackupPrivilege, schema2.VsmbFlagTakeBackupPrivilege},
+		{o.NoDirectMap, schema2.VsmbFlagNoDirectmap},
+		{o.RestrictFileAccess, schema2.VsmbFlagRestrictFileAccess},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// vsmbShareKey identifies a share by its host path and options.
+func vsmbShareKey(hostPath string, options *VSMBOptions) string {
+	key := strings.ToLower(hostPath) + "|" + strconv.FormatInt(int64(options.flags()), 16)
+	if options.RestrictFileAccess {
+		key += "|" + strings.ToLower(strings.Join(options.AllowedFiles, "|"))
+	}
+	return key
+}
+
+// vsmbShareSettings returns the path to share and the options to share it with
+// for hostPath. A file is shared by sharing its parent directory, restricted to
+// that file only.
+func vsmbShareSettings(hostPath string, isFile bool, options *VSMBOptions) (string, *VSMBOptions, string, error) {
+	if options == nil {
+		options = &VSMBOptions{}
+	}
+	if !isFile {
+		if options.RestrictFileAccess && len(options.AllowedFiles) == 0 {
+			return "", nil, "", fmt.Errorf("no allowed files supplied for VSMB share %s restricting file access", hostPath)
+		}
+		return hostPath, options, "", nil
+	}
+	dir, file := filepath.Split(hostPath)
+	fileOptions := *options
+	fileOptions.RestrictFileAccess = true
+	fileOptions.AllowedFiles = []string{file}
+	return filepath.Clean(dir), &fileOptions, file, nil
+}
+
 func (share *vsmbShare) GuestPath() string {
-	return `\\?\VMSMB\VSMB-{dcc079ae-60ba-4d07-847c-3493609c0870}\` + share.name
+	path := `\\?\VMSMB\VSMB-{dcc079ae-60ba-4d07-847c-3493609c0870}\` + share.name
+	if share.file != "" {
+		path += `\` + share.file
+	}
+	return path
+}
+
+// resolveVSMBShare returns the key of the share for hostPath and options, and
+// the directory and options actually shared.
+func resolveVSMBShare(hostPath string, options *VSMBOptions) (string, string, *VSMBOptions, string, error) {
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return "", "", nil, "", err
+	}
+	sharePath, shareOptions, file, err := vsmbShareSettings(hostPath, !fi.IsDir(), options)
+	if err != nil {
+		return "", "", nil, "", err
+	}
+	return vsmbShareKey(hostPath, shareOptions), sharePath, shareOptions, file, nil
 }
 
 // AddVSMB adds a VSMB share to a Windows utility VM. Each VSMB share is ref-counted and
-// only added if it isn't already. This is used for read-only layers, mapped directories
-// to a container, and for mapped pipes.
-func (uvm *UtilityVM) AddVSMB(hostPath string, hostedSettings interface{}, flags int32) error {
+// only added if it isn't already with the same options. This is used for read-only
+// layers, mapped directories and files to a container, and for mapped pipes.
+//
+// If hostPath is a file, only that file is accessible through the share.
+func (uvm *UtilityVM) AddVSMB(hostPath string, hostedSettings interface{}, options *VSMBOptions) error {
 	if uvm.operatingSystem != "windows" {
 		return errNotSupported
 	}
 
-	logrus.Debugf("uvm::AddVSMB %s %+v %d id:%s", hostPath, hostedSettings, flags, uvm.id)
+	logrus.Debugf("uvm::AddVSMB %s %+v %+v id:%s", hostPath, hostedSettings, options, uvm.id)
+	key, sharePath, shareOptions, file, err := resolveVSMBShare(hostPath, options)
+	if err != nil {
+		return err
+	}
+
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 	if uvm.vsmbShares == nil {
 		uvm.vsmbShares = make(map[string]*vsmbShare)
 	}
-	share := uvm.vsmbShares[hostPath]
+	share := uvm.vsmbShares[key]
 	if share == nil {
 		uvm.vsmbCounter++
 		shareName := "s" + strconv.FormatUint(uvm.vsmbCounter, 16)
@@ -35,9 +157,10 @@ func (uvm *UtilityVM) AddVSMB(hostPath string, hostedSettings interface{}, flags
 			ResourceType: schema2.ResourceTypeVSmbShare,
 			RequestType:  schema2.RequestTypeAdd,
 			Settings: schema2.VirtualMachinesResourcesStorageVSmbShareV2{
-				Name:  shareName,
-				Flags: flags,
-				Path:  hostPath,
+				Name:         shareName,
+				Flags:        shareOptions.flags(),
+				Path:         sharePath,
+				AllowedFiles: shareOptions.AllowedFiles,
 			},
 			ResourceUri: fmt.Sprintf("virtualmachine/devices/virtualsmbshares/" + shareName),
 		}
@@ -47,9 +170,12 @@ func (uvm *UtilityVM) AddVSMB(hostPath string, hostedSettings interface{}, flags
 		}
 		share = &vsmbShare{
 			name:           shareName,
+			hostPath:       hostPath,
+			file:           file,
+			options:        *shareOptions,
 			hostedSettings: hostedSettings,
 		}
-		uvm.vsmbShares[hostPath] = share
+		uvm.vsmbShares[key] = share
 	}
 	share.refCount++
 	logrus.Debugf("hcsshim::AddVSMB Success %s: refcount=%d %+v", hostPath, share.refCount, share)
@@ -57,15 +183,16 @@ func (uvm *UtilityVM) AddVSMB(hostPath string, hostedSettings interface{}, flags
 }
 
 // RemoveVSMB removes a VSMB share from a utility VM. Each VSMB share is ref-counted
-// and only actually removed when the ref-count drops to zero.
-func (uvm *UtilityVM) RemoveVSMB(hostPath string) error {
+// and only actually removed when the ref-count drops to zero. options must match
+// those passed to AddVSMB.
+func (uvm *UtilityVM) RemoveVSMB(hostPath string, options *VSMBOptions) error {
 	if uvm.operatingSystem != "windows" {
 		return errNotSupported
 	}
 	logrus.Debugf("uvm::RemoveVSMB %s id:%s", hostPath, uvm.id)
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
-	share := uvm.vsmbShares[hostPath]
+	key, share := uvm.findVSMBShare(hostPath, options)
 	if share == nil {
 		return fmt.Errorf("%s is not present as a VSMB share in %s, cannot remove", hostPath, uvm.id)
 	}
@@ -86,18 +213,37 @@ func (uvm *UtilityVM) RemoveVSMB(hostPath string) error {
 		return fmt.Errorf("failed to remove vsmb share %s from %s: %s: %s", hostPath, uvm.id, modification, err)
 	}
 	logrus.Debugf("uvm::RemoveVSMB Success %s id:%s successfully removed from utility VM", hostPath, uvm.id)
-	delete(uvm.vsmbShares, hostPath)
+	delete(uvm.vsmbShares, key)
 	return nil
 }
 
-// GetVSMBUvmPath returns the guest path of a VSMB mount.
-func (uvm *UtilityVM) GetVSMBUvmPath(hostPath string) (string, error) {
+// findVSMBShare finds the share added for hostPath with options. The host
+// path may no longer exist, so shares are matched on the key they were added
+// with for either a file or a directory. The lock MUST be held when calling
+// this function.
+func (uvm *UtilityVM) findVSMBShare(hostPath string, options *VSMBOptions) (string, *vsmbShare) {
+	for _, isFile := range []bool{false, true} {
+		_, shareOptions, _, err := vsmbShareSettings(hostPath, isFile, options)
+		if err != nil {
+			continue
+		}
+		key := vsmbShareKey(hostPath, shareOptions)
+		if share := uvm.vsmbShares[key]; share != nil {
+			return key, share
+		}
+	}
+	return "", nil
+}
+
+// GetVSMBUvmPath returns the guest path of a VSMB mount. For a file, this is
+// the path of the file within the share.
+func (uvm *UtilityVM) GetVSMBUvmPath(hostPath string, options *VSMBOptions) (string, error) {
 	if hostPath == "" {
 		return "", fmt.Errorf("no hostPath passed to GetVSMBUvmPath")
 	}
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
-	share := uvm.vsmbShares[hostPath]
+	_, share := uvm.findVSMBShare(hostPath, options)
 	if share == nil {
 		return "", fmt.Errorf("%s not found as VSMB share in %s", hostPath, uvm.id)
 	}
@@ -0,0 +1,51 @@
+package uvm
+
+import (
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+// Unit tests for VSMB share options
+
+func TestVSMBOptionsFlags(t *testing.T) {
+	expected := int32(schema2.VsmbFlagReadOnly | schema2.VsmbFlagPseudoOplocks | schema2.VsmbFlagTakeBackupPrivilege | schema2.VsmbFlagCacheIO | schema2.VsmbFlagShareRead)
+	if flags := LayerVSMBOptions().flags(); flags != expected {
+		t.Fatalf("expected layer flags %x got %x", expected, flags)
+	}
+	expected = int32(schema2.VsmbFlagReadOnly | schema2.VsmbFlagCacheIO | schema2.VsmbFlagShareRead | schema2.VsmbFlagForceLevelIIOplocks)
+	if flags := DefaultVSMBOptions(true).flags(); flags != expected {
+		t.Fatalf("expected read-only mount flags %x got %x", expected, flags)
+	}
+	if flags := DefaultVSMBOptions(false).flags(); flags != schema2.VsmbFlagNone {
+		t.Fatalf("expected no flags got %x", flags)
+	}
+}
+
+func TestVSMBShareKey(t *testing.T) {
+	ro := vsmbShareKey(`C:\Share`, DefaultVSMBOptions(true))
+	rw := vsmbShareKey(`c:\share`, DefaultVSMBOptions(false))
+	if ro == rw {
+		t.Fatal("expected different keys for different options")
+	}
+	if ro != vsmbShareKey(`c:\share`, DefaultVSMBOptions(true)) {
+		t.Fatal("expected host path to be case-insensitive")
+	}
+}
+
+func TestVSMBShareSettingsFile(t *testing.T) {
+	sharePath, options, file, err := vsmbShareSettings(`c:\dir\config.txt`, true, DefaultVSMBOptions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sharePath != `c:\dir` || file != "config.txt" {
+		t.Fatalf("unexpected share %s %s", sharePath, file)
+	}
+	if !options.ReadOnly || !options.RestrictFileAccess || len(options.AllowedFiles) != 1 || options.AllowedFiles[0] != "config.txt" {
+		t.Fatalf("unexpected options %+v", options)
+	}
+
+	if _, _, _, err := vsmbShareSettings(`c:\dir`, false, &VSMBOptions{RestrictFileAccess: true}); err == nil {
+		t.Fatal("expected failure restricting file access without allowed files")
+	}
+}
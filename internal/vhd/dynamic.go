@@ -0,0 +1,201 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+// Constants of the dynamic disk header of a VHD.
+const (
+	dynamicHeaderCookie  = "cxsparse"
+	dynamicHeaderOffset  = footerSize
+	dynamicHeaderSize    = 1024
+	dynamicHeaderVersion = 0x00010000
+	batOffset            = dynamicHeaderOffset + dynamicHeaderSize
+	unusedBATEntry       = 0xffffffff
+
+	// DefaultVhdBlockSize is the block size of a dynamic VHD when none is
+	// given.
+	DefaultVhdBlockSize = 2 * 1024 * 1024
+	minVhdBlockSize     = 512 * 1024
+	maxVhdBlockSize     = DefaultVhdBlockSize
+
+	// Platform codes of the parent locators of a differencing VHD.
+	platformCodeW2ku = 0x57326b75 // An absolute Windows path, in UTF-16LE
+	platformCodeW2ru = 0x57327275 // A relative Windows path, in UTF-16LE
+)
+
+type parentLocatorEntry struct {
+	PlatformCode       uint32
+	PlatformDataSpace  uint32
+	PlatformDataLength uint32
+	Reserved           uint32
+	PlatformDataOffset uint64
+}
+
+// dynamicHeader follows the copy of the footer at the start of a dynamic or
+// differencing VHD, and is stored big-endian.
+type dynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    guid.GUID
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8]parentLocatorEntry
+	Reserved2         [256]byte
+}
+
+func (h *dynamicHeader) checksum() uint32 {
+	c := *h
+	c.Checksum = 0
+	return checksum(&c)
+}
+
+// CreateDynamicVhd creates a dynamic VHD at path with a virtual size of size
+// bytes and no blocks allocated. blockSize is a power of two between 512KB
+// and 2MB, or 0 for DefaultVhdBlockSize.
+func CreateDynamicVhd(path string, size int64, blockSize uint32) error {
+	if blockSize == 0 {
+		blockSize = DefaultVhdBlockSize
+	}
+	if err := validateSize(size); err != nil {
+		return err
+	}
+	if size > maxVhdSize {
+		return fmt.Errorf("invalid disk size %d: the maximum size of a VHD is %d", size, int64(maxVhdSize))
+	}
+	if err := validateBlockSize(blockSize, minVhdBlockSize, maxVhdBlockSize); err != nil {
+		return err
+	}
+
+	entries := (size + int64(blockSize) - 1) / int64(blockSize)
+	batSize := (entries*4 + sectorSize - 1) / sectorSize * sectorSize
+	header := dynamicHeader{
+		DataOffset:      fixedDataOffset,
+		TableOffset:     batOffset,
+		HeaderVersion:   dynamicHeaderVersion,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       blockSize,
+	}
+	copy(header.Cookie[:], dynamicHeaderCookie)
+	header.Checksum = header.checksum()
+
+	footer := newFooter(DiskTypeDynamic, size, dynamicHeaderOffset).bytes()
+	var buf bytes.Buffer
+	buf.Write(footer)
+	binary.Write(&buf, binary.BigEndian, &header)
+	buf.Write(bytes.Repeat([]byte{0xff}, int(batSize)))
+	buf.Write(footer)
+	return createFile(path, func(f *os.File) error {
+		_, err := buf.WriteTo(f)
+		return err
+	})
+}
+
+// inspectVhd returns the description of a fixed, dynamic or differencing VHD.
+func inspectVhd(f *os.File) (*Info, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < footerSize {
+		return nil, errors.New("not a VHD or VHDX file")
+	}
+	footer, err := readFooter(f, fi.Size()-footerSize)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{
+		Format:             FormatVHD,
+		Type:               DiskType(footer.DiskType),
+		VirtualSize:        footer.CurrentSize,
+		DiskID:             footer.UniqueID,
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+	}
+	switch info.Type {
+	case DiskTypeFixed:
+		return info, nil
+	case DiskTypeDynamic, DiskTypeDifferencing:
+	default:
+		return nil, fmt.Errorf("unsupported VHD disk type %d", footer.DiskType)
+	}
+
+	b := make([]byte, dynamicHeaderSize)
+	if _, err := f.ReadAt(b, int64(footer.DataOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read the dynamic disk header: %s", err)
+	}
+	var header dynamicHeader
+	binary.Read(bytes.NewReader(b), binary.BigEndian, &header)
+	if string(header.Cookie[:]) != dynamicHeaderCookie || header.Checksum != header.checksum() {
+		return nil, errors.New("the dynamic disk header is invalid")
+	}
+	info.BlockSize = header.BlockSize
+	if info.Type != DiskTypeDifferencing {
+		return info, nil
+	}
+
+	info.ParentLocator = map[string]string{
+		"parent_linkage": "{" + header.ParentUniqueID.String() + "}",
+	}
+	for _, l := range header.ParentLocators {
+		var key string
+		switch l.PlatformCode {
+		case platformCodeW2ku:
+			key = "absolute_win32_path"
+		case platformCodeW2ru:
+			key = "relative_path"
+		default:
+			continue
+		}
+		b := make([]byte, l.PlatformDataLength)
+		if _, err := f.ReadAt(b, int64(l.PlatformDataOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read the parent locator: %s", err)
+		}
+		info.ParentLocator[key] = decodeUTF16(b, binary.LittleEndian)
+	}
+	info.ParentPath = info.ParentLocator["absolute_win32_path"]
+	if info.ParentPath == "" {
+		info.ParentPath = info.ParentLocator["relative_path"]
+	}
+	if info.ParentPath == "" {
+		info.ParentPath = decodeUTF16(header.ParentUnicodeName[:], binary.BigEndian)
+	}
+	return info, nil
+}
+
+// decodeUTF16 decodes a UTF-16 string, which may be terminated by a NUL.
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[i*2:])
+	}
+	s := string(utf16.Decode(u))
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// encodeUTF16 encodes a string as UTF-16, without a terminating NUL.
+func encodeUTF16(s string, order binary.ByteOrder) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		order.PutUint16(b[i*2:], c)
+	}
+	return b
+}
@@ -0,0 +1,234 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+// Constants of the VHD footer. See the Virtual Hard Disk Image Format
+// Specification.
+const (
+	sectorSize        = 512
+	footerSize        = 512
+	footerCookie      = "conectix"
+	footerFeatures    = 2 // Reserved, always set
+	footerVersion     = 0x00010000
+	fixedDataOffset   = 0xffffffffffffffff
+	footerCreatorHost = 0x5769326b // Wi2k
+	footerCreatorVer  = 0x000a0000
+	maxCHSSectors     = 65535 * 16 * 255
+	maxVhdSize        = 2040 * 1024 * 1024 * 1024
+	footerCreatorApp  = "hcs "
+)
+
+// vhdEpoch is the time from which VHD timestamps are counted.
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// footer is the 512-byte footer of a VHD, stored big-endian. A copy starts a
+// dynamic VHD.
+type footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       int64
+	CurrentSize        int64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           guid.GUID
+	SavedState         uint8
+	Reserved           [427]uint8
+}
+
+// calculateCHS returns the cylinder, head and sectors per track geometry of a
+// disk of the given number of sectors, as described in the specification.
+func calculateCHS(sectors int64) (uint16, uint8, uint8) {
+	if sectors > maxCHSSectors {
+		sectors = maxCHSSectors
+	}
+	var sectorsPerTrack, heads, cylinderTimesHeads int64
+	if sectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = sectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = sectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = sectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = sectors / sectorsPerTrack
+		}
+	}
+	return uint16(cylinderTimesHeads / heads), uint8(heads), uint8(sectorsPerTrack)
+}
+
+// newFooter returns the footer of a new disk of the given type and size.
+func newFooter(diskType DiskType, size int64, dataOffset uint64) *footer {
+	cylinders, heads, sectorsPerTrack := calculateCHS(size / sectorSize)
+	f := &footer{
+		Features:          footerFeatures,
+		FileFormatVersion: footerVersion,
+		DataOffset:        dataOffset,
+		TimeStamp:         uint32(time.Since(vhdEpoch) / time.Second),
+		CreatorVersion:    footerCreatorVer,
+		CreatorHostOS:     footerCreatorHost,
+		OriginalSize:      size,
+		CurrentSize:       size,
+		DiskGeometry:      uint32(cylinders)<<16 | uint32(heads)<<8 | uint32(sectorsPerTrack),
+		DiskType:          uint32(diskType),
+		UniqueID:          guid.New(),
+	}
+	copy(f.Cookie[:], footerCookie)
+	copy(f.CreatorApplication[:], footerCreatorApp)
+	f.Checksum = f.checksum()
+	return f
+}
+
+// checksum is the ones' complement of the sum of the bytes of the footer,
+// excluding the checksum itself.
+func (f *footer) checksum() uint32 {
+	c := *f
+	c.Checksum = 0
+	return checksum(&c)
+}
+
+// checksum returns the ones' complement of the sum of the bytes of a big-endian
+// structure, as used by the VHD footer and dynamic disk header.
+func checksum(v interface{}) uint32 {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	var sum uint32
+	for _, b := range buf.Bytes() {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+func (f *footer) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, f)
+	return buf.Bytes()
+}
+
+// readFooter reads and validates a VHD footer at offset.
+func readFooter(r io.ReaderAt, offset int64) (*footer, error) {
+	b := make([]byte, footerSize)
+	if _, err := r.ReadAt(b, offset); err != nil {
+		return nil, fmt.Errorf("failed to read the VHD footer: %s", err)
+	}
+	var f footer
+	binary.Read(bytes.NewReader(b), binary.BigEndian, &f)
+	if string(f.Cookie[:]) != footerCookie {
+		return nil, errors.New("not a VHD or VHDX file")
+	}
+	if f.Checksum != f.checksum() {
+		return nil, errors.New("the VHD footer checksum is invalid")
+	}
+	return &f, nil
+}
+
+// WriteFixedFooter writes the footer of a fixed VHD whose data is size bytes,
+// making a raw disk image a fixed VHD. size must be a multiple of 512.
+func WriteFixedFooter(w io.Writer, size int64) error {
+	if err := validateSize(size); err != nil {
+		return err
+	}
+	_, err := w.Write(newFooter(DiskTypeFixed, size, fixedDataOffset).bytes())
+	return err
+}
+
+// CreateFixedVhd creates a fixed VHD at path, whose data is size bytes of zeros.
+// The data is written sparsely where the file system allows.
+func CreateFixedVhd(path string, size int64) error {
+	if err := validateSize(size); err != nil {
+		return err
+	}
+	if size > maxVhdSize {
+		return fmt.Errorf("invalid disk size %d: the maximum size of a VHD is %d", size, int64(maxVhdSize))
+	}
+	return createFile(path, func(f *os.File) error {
+		if _, err := f.Seek(size, io.SeekStart); err != nil {
+			return err
+		}
+		return WriteFixedFooter(f, size)
+	})
+}
+
+// FixedVhdToRaw removes the footer of the fixed VHD at path, leaving a raw disk
+// image.
+func FixedVhdToRaw(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size() - footerSize
+	if size < 0 {
+		return fmt.Errorf("%s is not a fixed VHD", path)
+	}
+	footer, err := readFooter(f, size)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if DiskType(footer.DiskType) != DiskTypeFixed || footer.CurrentSize != size {
+		return fmt.Errorf("%s is not a fixed VHD", path)
+	}
+	return f.Truncate(size)
+}
+
+// RawToFixedVhd appends a VHD footer to the raw disk image at path, making it a
+// fixed VHD. The image is first padded with zeros to a multiple of 512 bytes.
+func RawToFixedVhd(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size >= footerSize {
+		if footer, err := readFooter(f, size-footerSize); err == nil && DiskType(footer.DiskType) == DiskTypeFixed {
+			return fmt.Errorf("%s is already a fixed VHD", path)
+		}
+	}
+	size = (size + sectorSize - 1) / sectorSize * sectorSize
+	if size > maxVhdSize {
+		return fmt.Errorf("%s is too large for a VHD", path)
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := WriteFixedFooter(f, size); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,143 @@
+// Package vhd creates and inspects VHD and VHDX virtual disk files. Unlike the
+// virtdisk APIs used by go-winio, it works on plain files, so disks can be
+// created on any platform.
+//
+// Fixed and dynamic VHDs and dynamic VHDX files can be created. Any VHD or VHDX
+// can be inspected, including differencing disks.
+package vhd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+// Format is the file format of a virtual disk.
+type Format int
+
+const (
+	FormatVHD Format = iota + 1
+	FormatVHDX
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatVHD:
+		return "vhd"
+	case FormatVHDX:
+		return "vhdx"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// DiskType is the type of a virtual disk, which determines how its data is
+// stored.
+type DiskType int
+
+const (
+	// DiskTypeFixed is a disk whose data is stored in full, followed by a
+	// footer.
+	DiskTypeFixed DiskType = 2
+	// DiskTypeDynamic is a disk whose blocks are allocated as they are
+	// written.
+	DiskTypeDynamic DiskType = 3
+	// DiskTypeDifferencing is a dynamic disk holding the changes to a parent
+	// disk.
+	DiskTypeDifferencing DiskType = 4
+)
+
+func (t DiskType) String() string {
+	switch t {
+	case DiskTypeFixed:
+		return "fixed"
+	case DiskTypeDynamic:
+		return "dynamic"
+	case DiskTypeDifferencing:
+		return "differencing"
+	}
+	return fmt.Sprintf("DiskType(%d)", int(t))
+}
+
+// Info describes a virtual disk.
+type Info struct {
+	Format      Format
+	Type        DiskType
+	VirtualSize int64     // The size of the disk presented to a VM
+	BlockSize   uint32    // The allocation unit of a dynamic or differencing disk
+	DiskID      guid.GUID // The unique ID of the disk
+
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+
+	// ParentPath is the path of the parent of a differencing disk, as
+	// recorded in its parent locator. The absolute path is preferred over
+	// the relative one.
+	ParentPath string
+	// ParentLocator holds all of the entries of the parent locator of a
+	// differencing disk, keyed by the VHDX key names: absolute_win32_path,
+	// relative_path, volume_path and parent_linkage.
+	ParentLocator map[string]string
+}
+
+// Inspect returns the description of the VHD or VHDX file at path.
+func Inspect(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var signature [8]byte
+	if _, err := io.ReadFull(f, signature[:]); err != nil {
+		return nil, fmt.Errorf("%s is not a virtual disk: %s", path, err)
+	}
+	var info *Info
+	if bytes.Equal(signature[:], []byte(vhdxSignature)) {
+		info, err = inspectVhdx(f)
+	} else {
+		info, err = inspectVhd(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return info, nil
+}
+
+// validateSize checks the size of a new disk, which must be a positive multiple
+// of the sector size.
+func validateSize(size int64) error {
+	if size <= 0 || size%sectorSize != 0 {
+		return fmt.Errorf("invalid disk size %d: the size must be a positive multiple of %d", size, sectorSize)
+	}
+	return nil
+}
+
+// validateBlockSize checks the block size of a new dynamic disk, which must be
+// a power of two between min and max.
+func validateBlockSize(blockSize, min, max uint32) error {
+	if blockSize < min || blockSize > max || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d: the size must be a power of two between %d and %d", blockSize, min, max)
+	}
+	return nil
+}
+
+// createFile creates a new disk file, which must not already exist, and calls
+// write to fill it in. The file is removed if write fails.
+func createFile(path string, write func(f *os.File) error) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	return write(f)
+}
@@ -0,0 +1,350 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestCalculateCHS(t *testing.T) {
+	for _, c := range []struct {
+		sectors                int64
+		cylinders              uint16
+		heads, sectorsPerTrack uint8
+	}{
+		{sectors: 20 * 1024 * 2, cylinders: 602, heads: 4, sectorsPerTrack: 17},
+		{sectors: 65535 * 16 * 255 * 2, cylinders: 65535, heads: 16, sectorsPerTrack: 255},
+	} {
+		cylinders, heads, sectorsPerTrack := calculateCHS(c.sectors)
+		if cylinders != c.cylinders || heads != c.heads || sectorsPerTrack != c.sectorsPerTrack {
+			t.Errorf("%d sectors: got %d/%d/%d, expected %d/%d/%d", c.sectors, cylinders, heads, sectorsPerTrack, c.cylinders, c.heads, c.sectorsPerTrack)
+		}
+	}
+}
+
+func TestFixedVhd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fixed.vhd")
+	const size = 20 * 1024 * 1024
+	if err := CreateFixedVhd(path, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateFixedVhd(path, size); err == nil {
+		t.Error("creating over an existing file succeeded")
+	}
+	if s := fileSize(t, path); s != size+footerSize {
+		t.Errorf("fixed VHD is %d bytes", s)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatVHD || info.Type != DiskTypeFixed || info.VirtualSize != size || info.BlockSize != 0 {
+		t.Errorf("unexpected %+v", info)
+	}
+
+	if err := FixedVhdToRaw(path); err != nil {
+		t.Fatal(err)
+	}
+	if s := fileSize(t, path); s != size {
+		t.Errorf("raw image is %d bytes", s)
+	}
+	if _, err := Inspect(path); err == nil {
+		t.Error("inspecting a raw image succeeded")
+	}
+	if err := FixedVhdToRaw(path); err == nil {
+		t.Error("converting a raw image to raw succeeded")
+	}
+	if err := RawToFixedVhd(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := RawToFixedVhd(path); err == nil {
+		t.Error("converting a fixed VHD to a fixed VHD succeeded")
+	}
+	if info, err := Inspect(path); err != nil || info.VirtualSize != size {
+		t.Errorf("unexpected %+v, %v", info, err)
+	}
+}
+
+func TestRawToFixedVhdPads(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raw.img")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RawToFixedVhd(path); err != nil {
+		t.Fatal(err)
+	}
+	if s := fileSize(t, path); s != sectorSize+footerSize {
+		t.Errorf("fixed VHD is %d bytes", s)
+	}
+	if info, err := Inspect(path); err != nil || info.VirtualSize != sectorSize {
+		t.Errorf("unexpected %+v, %v", info, err)
+	}
+}
+
+func TestDynamicVhd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dynamic.vhd")
+	const size = 1024 * 1024 * 1024
+	if err := CreateDynamicVhd(path, size, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The BAT has 512 entries of 4 bytes.
+	if s := fileSize(t, path); s != footerSize+dynamicHeaderSize+2048+footerSize {
+		t.Errorf("dynamic VHD is %d bytes", s)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatVHD || info.Type != DiskTypeDynamic || info.VirtualSize != size || info.BlockSize != DefaultVhdBlockSize {
+		t.Errorf("unexpected %+v", info)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:footerSize], b[len(b)-footerSize:]) {
+		t.Error("the footer and its copy differ")
+	}
+	if !bytes.Equal(b[batOffset:batOffset+2048], bytes.Repeat([]byte{0xff}, 2048)) {
+		t.Error("the BAT has allocated blocks")
+	}
+
+	if err := CreateDynamicVhd(filepath.Join(dir, "bad.vhd"), size, 3*1024*1024); err == nil {
+		t.Error("creating a VHD with an invalid block size succeeded")
+	}
+	if err := CreateDynamicVhd(filepath.Join(dir, "bad.vhd"), size+1, 0); err == nil {
+		t.Error("creating a VHD with an invalid size succeeded")
+	}
+}
+
+func TestDifferencingVhd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "child.vhd")
+	const size = 1024 * 1024 * 1024
+	if err := CreateDynamicVhd(path, size, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the disk a differencing disk, with an absolute path locator
+	// after the BAT and before the footer.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := `C:\layers\parent.vhd`
+	locator := make([]byte, sectorSize)
+	copy(locator, encodeUTF16(parent, binary.LittleEndian))
+	locatorOffset := len(b) - footerSize
+
+	f, _ := readFooter(bytes.NewReader(b), 0)
+	f.DiskType = uint32(DiskTypeDifferencing)
+	f.Checksum = f.checksum()
+	var h dynamicHeader
+	binary.Read(bytes.NewReader(b[dynamicHeaderOffset:]), binary.BigEndian, &h)
+	h.ParentLocators[0] = parentLocatorEntry{
+		PlatformCode:       platformCodeW2ku,
+		PlatformDataSpace:  sectorSize,
+		PlatformDataLength: uint32(len(parent) * 2),
+		PlatformDataOffset: uint64(locatorOffset),
+	}
+	h.Checksum = h.checksum()
+
+	var buf bytes.Buffer
+	buf.Write(f.bytes())
+	binary.Write(&buf, binary.BigEndian, &h)
+	buf.Write(b[batOffset:locatorOffset])
+	buf.Write(locator)
+	buf.Write(f.bytes())
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != DiskTypeDifferencing || info.ParentPath != parent || info.ParentLocator["absolute_win32_path"] != parent {
+		t.Errorf("unexpected %+v", info)
+	}
+}
+
+func TestDynamicVhdx(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dynamic.vhdx")
+	const size = 20 * 1024 * 1024 * 1024
+	if err := CreateDynamicVhdx(path, size, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	// 20480 data blocks and 4 sector bitmap blocks fit in 1MB of BAT.
+	if s := fileSize(t, path); s != 4*mb {
+		t.Errorf("dynamic VHDX is %d bytes", s)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatVHDX || info.Type != DiskTypeDynamic || info.VirtualSize != size || info.BlockSize != 1024*1024 ||
+		info.LogicalSectorSize != 512 || info.PhysicalSectorSize != 4096 {
+		t.Errorf("unexpected %+v", info)
+	}
+	other := filepath.Join(dir, "other.vhdx")
+	if err := CreateDynamicVhdx(other, size, 0); err != nil {
+		t.Fatal(err)
+	}
+	otherInfo, err := Inspect(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherInfo.DiskID == info.DiskID || otherInfo.BlockSize != DefaultVhdxBlockSize {
+		t.Errorf("unexpected %+v", otherInfo)
+	}
+
+	// Either header and either region table can be corrupted.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, offset := range []int64{vhdxHeader2Offset + 100, vhdxRegionTable1Offset + 100} {
+		if _, err := f.WriteAt([]byte{0xff}, offset); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := Inspect(path); err != nil || info.VirtualSize != size {
+			t.Errorf("after corrupting offset %d: unexpected %+v, %v", offset, info, err)
+		}
+	}
+	if _, err := f.WriteAt([]byte{0xff}, vhdxHeader1Offset+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Inspect(path); err == nil {
+		t.Error("inspecting a VHDX with no valid header succeeded")
+	}
+
+	if err := CreateDynamicVhdx(filepath.Join(dir, "bad.vhdx"), size, 512*1024); err == nil {
+		t.Error("creating a VHDX with an invalid block size succeeded")
+	}
+}
+
+func TestVhdxMetadataOutOfRange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.vhdx")
+	if err := CreateDynamicVhdx(path, 1024*1024*1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The metadata table has no checksum, so its entries can be rewritten
+	// without invalidating it. The first entry is at offset 32.
+	entry := int64(vhdxMetadataOffset + binary.Size(metadataTableHeader{}))
+	original := make([]byte, binary.Size(metadataTableEntry{}))
+	if _, err := f.ReadAt(original, entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name           string
+		offset, length uint32
+	}{
+		{"huge", vhdxMetadataTableSize, 0xffffffff},
+		{"past the region", vhdxMetadataLength - 8, 16},
+		{"overflowing", 0xfffffff8, 16},
+		{"in the table", 0, 8},
+	} {
+		b := append([]byte(nil), original...)
+		binary.LittleEndian.PutUint32(b[16:], tc.offset)
+		binary.LittleEndian.PutUint32(b[20:], tc.length)
+		if _, err := f.WriteAt(b, entry); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Inspect(path); err == nil {
+			t.Errorf("%s: inspecting a VHDX with a metadata item out of range succeeded", tc.name)
+		}
+	}
+	if _, err := f.WriteAt(original, entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Inspect(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeParentLocator returns a VHDX parent locator metadata item.
+func encodeParentLocator(entries [][2]string) []byte {
+	var header, data bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, &parentLocatorHeader{
+		LocatorType:   parentLocatorTypeVhdx,
+		KeyValueCount: uint16(len(entries)),
+	})
+	offset := header.Len() + len(entries)*binary.Size(parentLocatorKeyValue{})
+	for _, e := range entries {
+		key, value := encodeUTF16(e[0], binary.LittleEndian), encodeUTF16(e[1], binary.LittleEndian)
+		binary.Write(&header, binary.LittleEndian, &parentLocatorKeyValue{
+			KeyOffset:   uint32(offset + data.Len()),
+			ValueOffset: uint32(offset + data.Len() + len(key)),
+			KeyLength:   uint16(len(key)),
+			ValueLength: uint16(len(value)),
+		})
+		data.Write(key)
+		data.Write(value)
+	}
+	return append(header.Bytes(), data.Bytes()...)
+}
+
+func TestDifferencingVhdx(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "child.vhdx")
+	const size = 1024 * 1024 * 1024
+
+	items := newVhdxMetadata(size, DefaultVhdxBlockSize)
+	items[0].data = encode(&fileParameters{BlockSize: DefaultVhdxBlockSize, Flags: fileParametersHasParent})
+	items = append(items, metadataItem{metadataParentLocator, metadataIsRequired, encodeParentLocator([][2]string{
+		{"parent_linkage", "{83ff2e8c-d5b1-4f1c-a1a4-3e32c6f7a0e1}"},
+		{"relative_path", `..\parent.vhdx`},
+		{"absolute_win32_path", `\\?\C:\layers\parent.vhdx`},
+	})})
+	if err := createFile(path, func(f *os.File) error {
+		return writeVhdx(f, size, DefaultVhdxBlockSize, items)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != DiskTypeDifferencing || info.ParentPath != `\\?\C:\layers\parent.vhdx` || info.ParentLocator["relative_path"] != `..\parent.vhdx` {
+		t.Errorf("unexpected %+v", info)
+	}
+}
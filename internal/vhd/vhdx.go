@@ -0,0 +1,461 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+// Layout and constants of a VHDX file. See the VHDX Format Specification. The
+// structures are stored little-endian.
+const (
+	vhdxSignature       = "vhdxfile"
+	vhdxHeaderSignature = 0x64616568 // head
+	vhdxRegionSignature = 0x69676572 // regi
+	vhdxMetadataSig     = "metadata"
+	vhdxVersion         = 1
+
+	mb                     = 1024 * 1024
+	vhdxHeaderSize         = 4096
+	vhdxHeader1Offset      = 64 * 1024
+	vhdxHeader2Offset      = 128 * 1024
+	vhdxRegionTableSize    = 64 * 1024
+	vhdxRegionTable1Offset = 192 * 1024
+	vhdxRegionTable2Offset = 256 * 1024
+	vhdxLogOffset          = 1 * mb
+	vhdxLogLength          = 1 * mb
+	vhdxMetadataOffset     = 2 * mb
+	vhdxMetadataLength     = 1 * mb
+	vhdxMetadataTableSize  = 64 * 1024
+	vhdxMaxMetadataItem    = 1 * mb // The largest metadata item allowed by the specification
+	vhdxBATOffset          = 3 * mb
+	vhdxMaxSize            = 64 * 1024 * 1024 * mb
+
+	// DefaultVhdxBlockSize is the block size of a dynamic VHDX when none is
+	// given.
+	DefaultVhdxBlockSize = 32 * mb
+	minVhdxBlockSize     = 1 * mb
+	maxVhdxBlockSize     = 256 * mb
+
+	vhdxLogicalSectorSize  = 512
+	vhdxPhysicalSectorSize = 4096
+
+	// Flags of metadata table entries.
+	metadataIsUser        = 0x1
+	metadataIsVirtualDisk = 0x2
+	metadataIsRequired    = 0x4
+
+	// Flags of the file parameters metadata item.
+	fileParametersLeaveBlocksAllocated = 0x1
+	fileParametersHasParent            = 0x2
+)
+
+var (
+	regionBAT      = mustGUID("2dc27766-f623-4200-9d64-115e9bfd4a08")
+	regionMetadata = mustGUID("8b7ca206-4790-4b9a-b8fe-575f050f886e")
+
+	metadataFileParameters     = mustGUID("caa16737-fa36-4d43-b3b6-33f0aa44e76b")
+	metadataVirtualDiskSize    = mustGUID("2fa54224-cd1b-4876-b211-5dbed83bf4b8")
+	metadataVirtualDiskID      = mustGUID("beca12ab-b2e6-4523-93ef-c309e000c746")
+	metadataLogicalSectorSize  = mustGUID("8141bf1d-a96f-4709-ba47-f233a8faab5f")
+	metadataPhysicalSectorSize = mustGUID("cda348c7-445d-4471-9cc9-e9885251c556")
+	metadataParentLocator      = mustGUID("a8d35f2d-b30b-454d-abf7-d3d84834ab0c")
+
+	parentLocatorTypeVhdx = mustGUID("b04aefb7-d19e-4a81-b789-25b8e9445913")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func mustGUID(s string) guid.GUID {
+	g, err := guid.FromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+type vhdxHeader struct {
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  guid.GUID
+	DataWriteGUID  guid.GUID
+	LogGUID        guid.GUID
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+type regionTableHeader struct {
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type regionTableEntry struct {
+	GUID       guid.GUID
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type metadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type metadataTableEntry struct {
+	ItemID   guid.GUID
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+type fileParameters struct {
+	BlockSize uint32
+	Flags     uint32
+}
+
+type parentLocatorHeader struct {
+	LocatorType   guid.GUID
+	Reserved      uint16
+	KeyValueCount uint16
+}
+
+type parentLocatorKeyValue struct {
+	KeyOffset   uint32
+	ValueOffset uint32
+	KeyLength   uint16
+	ValueLength uint16
+}
+
+// metadataItem is an item of the metadata region of a VHDX.
+type metadataItem struct {
+	id    guid.GUID
+	flags uint32
+	data  []byte
+}
+
+// encode returns the little-endian encoding of v.
+func encode(v interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v)
+	return buf.Bytes()
+}
+
+// withChecksum returns b with the CRC-32C of b, computed with the checksum
+// zeroed, stored at offset 4 as the VHDX headers and region tables require.
+func withChecksum(b []byte) []byte {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+	return b
+}
+
+// validChecksum returns whether the CRC-32C stored at offset 4 of b is valid.
+func validChecksum(b []byte) bool {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return bytes.Equal(withChecksum(c)[4:8], b[4:8])
+}
+
+// vhdxChunkRatio returns the number of data blocks covered by one sector
+// bitmap block.
+func vhdxChunkRatio(blockSize uint32) int64 {
+	return (1 << 23) * vhdxLogicalSectorSize / int64(blockSize)
+}
+
+// vhdxBATEntries returns the number of entries in the block allocation table of
+// a dynamic VHDX, which interleaves the entries of the data blocks with those
+// of the sector bitmap blocks.
+func vhdxBATEntries(size int64, blockSize uint32) int64 {
+	dataBlocks := (size + int64(blockSize) - 1) / int64(blockSize)
+	return dataBlocks + (dataBlocks-1)/vhdxChunkRatio(blockSize)
+}
+
+// newVhdxMetadata returns the metadata items of a dynamic VHDX.
+func newVhdxMetadata(size int64, blockSize uint32) []metadataItem {
+	return []metadataItem{
+		{metadataFileParameters, metadataIsRequired, encode(&fileParameters{BlockSize: blockSize})},
+		{metadataVirtualDiskSize, metadataIsVirtualDisk | metadataIsRequired, encode(uint64(size))},
+		{metadataVirtualDiskID, metadataIsVirtualDisk | metadataIsRequired, encode(guid.New())},
+		{metadataLogicalSectorSize, metadataIsVirtualDisk | metadataIsRequired, encode(uint32(vhdxLogicalSectorSize))},
+		{metadataPhysicalSectorSize, metadataIsVirtualDisk | metadataIsRequired, encode(uint32(vhdxPhysicalSectorSize))},
+	}
+}
+
+// CreateDynamicVhdx creates a dynamic VHDX at path with a virtual size of size
+// bytes and no blocks allocated. blockSize is a power of two between 1MB and
+// 256MB, or 0 for DefaultVhdxBlockSize.
+func CreateDynamicVhdx(path string, size int64, blockSize uint32) error {
+	if blockSize == 0 {
+		blockSize = DefaultVhdxBlockSize
+	}
+	if err := validateSize(size); err != nil {
+		return err
+	}
+	if size > vhdxMaxSize {
+		return fmt.Errorf("invalid disk size %d: the maximum size of a VHDX is %d", size, int64(vhdxMaxSize))
+	}
+	if err := validateBlockSize(blockSize, minVhdxBlockSize, maxVhdxBlockSize); err != nil {
+		return err
+	}
+	return createFile(path, func(f *os.File) error {
+		return writeVhdx(f, size, blockSize, newVhdxMetadata(size, blockSize))
+	})
+}
+
+// writeVhdx writes a dynamic VHDX with the given metadata items and an empty
+// block allocation table to f.
+func writeVhdx(f *os.File, size int64, blockSize uint32, items []metadataItem) error {
+	batLength := (vhdxBATEntries(size, blockSize)*8 + mb - 1) / mb * mb
+
+	creator := make([]byte, 512)
+	copy(creator, encodeUTF16("hcsshim", binary.LittleEndian))
+	type write struct {
+		offset int64
+		data   []byte
+	}
+	writes := []write{{0, append([]byte(vhdxSignature), creator...)}}
+
+	header := vhdxHeader{
+		Signature:     vhdxHeaderSignature,
+		FileWriteGUID: guid.New(),
+		DataWriteGUID: guid.New(),
+		Version:       vhdxVersion,
+		LogLength:     vhdxLogLength,
+		LogOffset:     vhdxLogOffset,
+	}
+	for i, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header.SequenceNumber = uint64(i)
+		writes = append(writes, write{offset, withChecksum(encode(&header))})
+	}
+
+	regions := new(bytes.Buffer)
+	binary.Write(regions, binary.LittleEndian, &regionTableHeader{Signature: vhdxRegionSignature, EntryCount: 2})
+	binary.Write(regions, binary.LittleEndian, &regionTableEntry{GUID: regionBAT, FileOffset: vhdxBATOffset, Length: uint32(batLength), Required: 1})
+	binary.Write(regions, binary.LittleEndian, &regionTableEntry{GUID: regionMetadata, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataLength, Required: 1})
+	regionTable := make([]byte, vhdxRegionTableSize)
+	copy(regionTable, regions.Bytes())
+	withChecksum(regionTable)
+	for _, offset := range []int64{vhdxRegionTable1Offset, vhdxRegionTable2Offset} {
+		writes = append(writes, write{offset, regionTable})
+	}
+
+	metadata := new(bytes.Buffer)
+	table := metadataTableHeader{EntryCount: uint16(len(items))}
+	copy(table.Signature[:], vhdxMetadataSig)
+	binary.Write(metadata, binary.LittleEndian, &table)
+	var data []byte
+	for _, item := range items {
+		binary.Write(metadata, binary.LittleEndian, &metadataTableEntry{
+			ItemID: item.id,
+			Offset: uint32(vhdxMetadataTableSize + len(data)),
+			Length: uint32(len(item.data)),
+			Flags:  item.flags,
+		})
+		data = append(data, item.data...)
+	}
+	if metadata.Len() > vhdxMetadataTableSize || vhdxMetadataTableSize+len(data) > vhdxMetadataLength {
+		return errors.New("the VHDX metadata is too large")
+	}
+	metadataRegion := make([]byte, vhdxMetadataTableSize+len(data))
+	copy(metadataRegion, metadata.Bytes())
+	copy(metadataRegion[vhdxMetadataTableSize:], data)
+	writes = append(writes, write{vhdxMetadataOffset, metadataRegion})
+
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, w.offset); err != nil {
+			return err
+		}
+	}
+	// The log and block allocation table are all zeros: the log is empty and
+	// no block is present.
+	return f.Truncate(vhdxBATOffset + batLength)
+}
+
+// readVhdxHeader returns the current header of a VHDX, which is the valid one
+// with the higher sequence number.
+func readVhdxHeader(f *os.File) (*vhdxHeader, error) {
+	var header *vhdxHeader
+	for _, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		b := make([]byte, vhdxHeaderSize)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			continue
+		}
+		var h vhdxHeader
+		binary.Read(bytes.NewReader(b), binary.LittleEndian, &h)
+		if h.Signature != vhdxHeaderSignature || !validChecksum(b) {
+			continue
+		}
+		if header == nil || h.SequenceNumber > header.SequenceNumber {
+			header = &h
+		}
+	}
+	if header == nil {
+		return nil, errors.New("the VHDX has no valid header")
+	}
+	if header.Version != vhdxVersion {
+		return nil, fmt.Errorf("unsupported VHDX version %d", header.Version)
+	}
+	return header, nil
+}
+
+// readVhdxRegions returns the entries of the first valid region table of a
+// VHDX.
+func readVhdxRegions(f *os.File) ([]regionTableEntry, error) {
+	for _, offset := range []int64{vhdxRegionTable1Offset, vhdxRegionTable2Offset} {
+		b := make([]byte, vhdxRegionTableSize)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			continue
+		}
+		r := bytes.NewReader(b)
+		var h regionTableHeader
+		binary.Read(r, binary.LittleEndian, &h)
+		if h.Signature != vhdxRegionSignature || !validChecksum(b) || h.EntryCount > 2047 {
+			continue
+		}
+		entries := make([]regionTableEntry, h.EntryCount)
+		binary.Read(r, binary.LittleEndian, entries)
+		return entries, nil
+	}
+	return nil, errors.New("the VHDX has no valid region table")
+}
+
+func findRegion(entries []regionTableEntry, id guid.GUID) *regionTableEntry {
+	for i := range entries {
+		if entries[i].GUID == id {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// readVhdxMetadata returns the metadata items of a VHDX, keyed by item ID,
+// given its metadata region. Items must lie within the region and are at most
+// vhdxMaxMetadataItem bytes, so a corrupt table cannot cause reads of
+// arbitrary size.
+func readVhdxMetadata(f *os.File, region *regionTableEntry) (map[guid.GUID][]byte, error) {
+	if region.Length < vhdxMetadataTableSize {
+		return nil, errors.New("the VHDX metadata region is too small")
+	}
+	b := make([]byte, vhdxMetadataTableSize)
+	if _, err := f.ReadAt(b, int64(region.FileOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read the VHDX metadata table: %s", err)
+	}
+	r := bytes.NewReader(b)
+	var table metadataTableHeader
+	binary.Read(r, binary.LittleEndian, &table)
+	if string(table.Signature[:]) != vhdxMetadataSig || table.EntryCount > 2047 {
+		return nil, errors.New("the VHDX metadata table is invalid")
+	}
+	items := make(map[guid.GUID][]byte)
+	for i := uint16(0); i < table.EntryCount; i++ {
+		var e metadataTableEntry
+		binary.Read(r, binary.LittleEndian, &e)
+		if e.Length > vhdxMaxMetadataItem ||
+			e.Length != 0 && (e.Offset < vhdxMetadataTableSize || uint64(e.Offset)+uint64(e.Length) > uint64(region.Length)) {
+			return nil, fmt.Errorf("the VHDX metadata item %s is out of range", e.ItemID)
+		}
+		data := make([]byte, e.Length)
+		if _, err := f.ReadAt(data, int64(region.FileOffset)+int64(e.Offset)); err != nil {
+			return nil, fmt.Errorf("failed to read VHDX metadata item %s: %s", e.ItemID, err)
+		}
+		items[e.ItemID] = data
+	}
+	return items, nil
+}
+
+// inspectVhdx returns the description of a VHDX.
+func inspectVhdx(f *os.File) (*Info, error) {
+	if _, err := readVhdxHeader(f); err != nil {
+		return nil, err
+	}
+	regions, err := readVhdxRegions(f)
+	if err != nil {
+		return nil, err
+	}
+	metadataRegion := findRegion(regions, regionMetadata)
+	if metadataRegion == nil {
+		return nil, errors.New("the VHDX has no metadata region")
+	}
+	items, err := readVhdxMetadata(f, metadataRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Format: FormatVHDX}
+	for _, m := range []struct {
+		id guid.GUID
+		v  interface{}
+	}{
+		{metadataVirtualDiskSize, &info.VirtualSize},
+		{metadataVirtualDiskID, &info.DiskID},
+		{metadataLogicalSectorSize, &info.LogicalSectorSize},
+		{metadataPhysicalSectorSize, &info.PhysicalSectorSize},
+	} {
+		data, ok := items[m.id]
+		if !ok || binary.Read(bytes.NewReader(data), binary.LittleEndian, m.v) != nil {
+			return nil, fmt.Errorf("the VHDX metadata item %s is missing or invalid", m.id)
+		}
+	}
+	var params fileParameters
+	if data, ok := items[metadataFileParameters]; !ok || binary.Read(bytes.NewReader(data), binary.LittleEndian, &params) != nil {
+		return nil, errors.New("the VHDX file parameters are missing or invalid")
+	}
+	info.BlockSize = params.BlockSize
+	switch {
+	case params.Flags&fileParametersHasParent != 0:
+		info.Type = DiskTypeDifferencing
+	case params.Flags&fileParametersLeaveBlocksAllocated != 0:
+		info.Type = DiskTypeFixed
+	default:
+		info.Type = DiskTypeDynamic
+	}
+
+	if info.Type == DiskTypeDifferencing {
+		locator, err := decodeParentLocator(items[metadataParentLocator])
+		if err != nil {
+			return nil, err
+		}
+		info.ParentLocator = locator
+		info.ParentPath = locator["absolute_win32_path"]
+		if info.ParentPath == "" {
+			info.ParentPath = locator["relative_path"]
+		}
+	}
+	return info, nil
+}
+
+// decodeParentLocator returns the key-value pairs of a VHDX parent locator.
+func decodeParentLocator(b []byte) (map[string]string, error) {
+	r := bytes.NewReader(b)
+	var h parentLocatorHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil || h.LocatorType != parentLocatorTypeVhdx {
+		return nil, errors.New("the VHDX parent locator is missing or invalid")
+	}
+	locator := make(map[string]string)
+	for i := uint16(0); i < h.KeyValueCount; i++ {
+		var e parentLocatorKeyValue
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return nil, errors.New("the VHDX parent locator is truncated")
+		}
+		if int(e.KeyOffset)+int(e.KeyLength) > len(b) || int(e.ValueOffset)+int(e.ValueLength) > len(b) {
+			return nil, errors.New("the VHDX parent locator has an entry out of range")
+		}
+		key := decodeUTF16(b[e.KeyOffset:e.KeyOffset+uint32(e.KeyLength)], binary.LittleEndian)
+		locator[strings.ToLower(key)] = decodeUTF16(b[e.ValueOffset:e.ValueOffset+uint32(e.ValueLength)], binary.LittleEndian)
+	}
+	return locator, nil
+}